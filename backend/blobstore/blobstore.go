@@ -0,0 +1,222 @@
+// Package blobstore is a content-addressed store of immutable blobs, each
+// named by the SHA-256 digest of its content. Storing the same content twice
+// stores it once.
+//
+// Blobs are files under the store's directory, sharded by the first two
+// characters of their digest. A store without a directory keeps its blobs in
+// memory.
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for a digest with no blob.
+var ErrNotFound = errors.New("blobstore: blob not found")
+
+// ErrInvalidDigest is returned for a string that is not a digest.
+var ErrInvalidDigest = errors.New("blobstore: invalid digest")
+
+// Store is a content-addressed blob store. It is safe for concurrent use.
+type Store struct {
+	dir string
+
+	mu  sync.Mutex
+	mem map[string]memBlob
+}
+
+// memBlob is a blob of an in-memory store.
+type memBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Open opens the store in dir, creating the directory when the first blob
+// is stored. An empty dir opens an in-memory store.
+func Open(dir string) *Store {
+	s := &Store{dir: dir}
+	if dir == "" {
+		s.mem = make(map[string]memBlob)
+	}
+	return s
+}
+
+// Digest returns the digest naming data.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidDigest reports whether d is a well-formed digest.
+func ValidDigest(d string) bool {
+	if len(d) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range []byte(d) {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// path returns the file of the blob named d.
+func (s *Store) path(d string) string {
+	return filepath.Join(s.dir, d[:2], d)
+}
+
+// Put stores data and returns its digest. Storing content that is already
+// stored refreshes its modification time.
+func (s *Store) Put(data []byte) (string, error) {
+	d := Digest(data)
+	if s.mem != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.mem[d] = memBlob{data: bytes.Clone(data), modTime: time.Now()}
+		return d, nil
+	}
+
+	path := s.path(d)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return d, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("blobstore: %w", err)
+	}
+	// Write to a temporary file and rename it, so that a blob is never
+	// seen partially written.
+	tmp, err := os.CreateTemp(filepath.Dir(path), d+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("blobstore: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("blobstore: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("blobstore: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("blobstore: %w", err)
+	}
+	return d, nil
+}
+
+// Blob is an open blob.
+type Blob interface {
+	io.ReadSeekCloser
+	// Size returns the blob's size in bytes.
+	Size() int64
+}
+
+// memReader is an open blob of an in-memory store.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+// fileBlob is an open blob of a store on disk.
+type fileBlob struct {
+	*os.File
+	size int64
+}
+
+func (b fileBlob) Size() int64 { return b.size }
+
+// Open opens the blob named d for reading.
+func (s *Store) Open(d string) (Blob, error) {
+	if !ValidDigest(d) {
+		return nil, ErrInvalidDigest
+	}
+	if s.mem != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		b, ok := s.mem[d]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		return memReader{bytes.NewReader(b.data)}, nil
+	}
+
+	f, err := os.Open(s.path(d))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("blobstore: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("blobstore: %w", err)
+	}
+	return fileBlob{File: f, size: info.Size()}, nil
+}
+
+// Delete removes the blob named d, if it is stored.
+func (s *Store) Delete(d string) error {
+	if !ValidDigest(d) {
+		return ErrInvalidDigest
+	}
+	if s.mem != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.mem, d)
+		return nil
+	}
+	if err := os.Remove(s.path(d)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("blobstore: %w", err)
+	}
+	return nil
+}
+
+// Walk calls fn with the digest and modification time of each stored blob,
+// in no particular order, stopping at the first error fn returns.
+func (s *Store) Walk(fn func(d string, modTime time.Time) error) error {
+	if s.mem != nil {
+		s.mu.Lock()
+		blobs := make(map[string]time.Time, len(s.mem))
+		for d, b := range s.mem {
+			blobs[d] = b.modTime
+		}
+		s.mu.Unlock()
+		for d, modTime := range blobs {
+			if err := fn(d, modTime); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !ValidDigest(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(entry.Name(), info.ModTime())
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
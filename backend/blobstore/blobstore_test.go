@@ -0,0 +1,80 @@
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	for name, s := range map[string]*Store{"disk": Open(dir), "memory": Open("")} {
+		t.Run(name, func(t *testing.T) {
+			d, err := s.Put([]byte("chunk one"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d != Digest([]byte("chunk one")) || !ValidDigest(d) {
+				t.Errorf("Unexpected digest %s", d)
+			}
+			if again, _ := s.Put([]byte("chunk one")); again != d {
+				t.Errorf("Expected the same content to have the same digest, got %s", again)
+			}
+			other, _ := s.Put([]byte("chunk two"))
+
+			b, err := s.Open(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Seek(6, io.SeekStart)
+			if data, _ := io.ReadAll(b); string(data) != "one" || b.Size() != 9 {
+				t.Errorf("Unexpected content %q of size %d", data, b.Size())
+			}
+			b.Close()
+
+			var walked []string
+			s.Walk(func(d string, modTime time.Time) error {
+				if time.Since(modTime) > time.Minute {
+					t.Errorf("Unexpected modification time %v", modTime)
+				}
+				walked = append(walked, d)
+				return nil
+			})
+			if len(walked) != 2 {
+				t.Errorf("Expected both blobs, got %v", walked)
+			}
+
+			if err := s.Delete(other); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Open(other); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected the blob to be deleted, got %v", err)
+			}
+			if err := s.Delete(other); err != nil {
+				t.Errorf("Expected deleting a missing blob to succeed, got %v", err)
+			}
+			if _, err := s.Open("../../etc/passwd"); !errors.Is(err, ErrInvalidDigest) {
+				t.Errorf("Expected an invalid digest to be refused, got %v", err)
+			}
+		})
+	}
+
+	// Blobs are sharded files, without temporary files left behind.
+	d := Digest([]byte("chunk one"))
+	if _, err := os.Stat(filepath.Join(dir, d[:2], d)); err != nil {
+		t.Error(err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, d[:2]))
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("Unexpected temporary file %s", e.Name())
+		}
+	}
+	if err := Open(filepath.Join(dir, "missing")).Walk(func(string, time.Time) error { return nil }); err != nil {
+		t.Errorf("Expected an empty store to walk, got %v", err)
+	}
+}
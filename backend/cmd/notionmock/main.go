@@ -0,0 +1,48 @@
+// Command notionmock runs a mock Notion API server, so that the app can be
+// developed without a Notion workspace.
+//
+// Point the backend at it with NOTION_API_URL, for example:
+//
+//	go run ./cmd/notionmock -addr :8081
+//	NOTION_API_URL=http://localhost:8081 go run .
+//
+// The backend's Notion login then completes against the mock without a
+// consent screen. The mock starts with a small demo workspace.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmock"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8081", "address to listen on")
+	tokens := flag.String("tokens", "", "comma-separated bearer tokens to accept, e.g. for NOTION_INTEGRATION_TOKEN")
+	clientID := flag.String("client-id", "", "OAuth client ID to require (any client if empty)")
+	clientSecret := flag.String("client-secret", "", "OAuth client secret to require with -client-id")
+	rate := flag.Float64("rate", 3, "requests per second allowed per token (0 disables rate limiting)")
+	burst := flag.Int("burst", 10, "requests allowed at once per token")
+	empty := flag.Bool("empty", false, "start with an empty workspace")
+	flag.Parse()
+
+	opts := notionmock.Options{
+		ClientID:     *clientID,
+		ClientSecret: *clientSecret,
+		RateLimit:    *rate,
+		Burst:        *burst,
+	}
+	if *tokens != "" {
+		opts.Tokens = strings.Split(*tokens, ",")
+	}
+	srv := notionmock.New(opts)
+	if !*empty {
+		srv.SeedDemo()
+	}
+
+	log.Printf("Mock Notion API listening on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, srv))
+}
@@ -3,11 +3,13 @@ module github.com/mnehpets/mtranscribe/backend
 go 1.25.5
 
 require (
+	github.com/coder/websocket v1.8.14
 	github.com/knadh/koanf/parsers/dotenv v1.1.1
 	github.com/knadh/koanf/providers/env v1.1.0
 	github.com/knadh/koanf/providers/file v1.2.1
 	github.com/knadh/koanf/v2 v2.3.0
 	github.com/mnehpets/oneserve v0.0.0-20260205082201-f6b1b4627fc2
+	github.com/yuin/goldmark v1.8.2
 	golang.org/x/oauth2 v0.34.0
 )
 
@@ -0,0 +1,85 @@
+package notionmd
+
+// Block is a Notion block. Data holds the type-specific payload (e.g.
+// {"rich_text": [...]}) and Children any nested blocks. ID is only set on
+// blocks read from Notion.
+type Block struct {
+	ID       string
+	Type     string
+	Data     map[string]any
+	Children []*Block
+}
+
+// TextBlocks creates blocks of the given type holding rich text. Text that
+// needs more rich text items than a single block allows is continued in
+// further blocks of the same type.
+func TextBlocks(typ string, items ...Text) []*Block {
+	return textBlocks(typ, nil, items)
+}
+
+// textBlocks is TextBlocks with extra payload fields copied into each block.
+func textBlocks(typ string, extra map[string]any, items []Text) []*Block {
+	rt := RichText(items...)
+	var blocks []*Block
+	for len(rt) > 0 || len(blocks) == 0 {
+		n := min(len(rt), MaxRichText)
+		data := map[string]any{"rich_text": rt[:n]}
+		for k, v := range extra {
+			data[k] = v
+		}
+		blocks = append(blocks, &Block{Type: typ, Data: data})
+		rt = rt[n:]
+	}
+	return blocks
+}
+
+// Encode returns the blocks as JSON as they end up on a page, with all of
+// their children. Appending them takes the requests made of EncodeBlock and
+// Deferred, so the result is not itself a valid request when it nests deeper
+// than MaxNestingDepth.
+func Encode(blocks []*Block) []map[string]any {
+	out := make([]map[string]any, 0, len(blocks))
+	for _, b := range blocks {
+		obj := EncodeBlock(b)
+		if deferred := Deferred(b); len(deferred) > 0 {
+			data := obj[b.Type].(map[string]any)
+			inline, _ := data["children"].([]map[string]any)
+			data["children"] = append(inline, Encode(deferred)...)
+		}
+		out = append(out, obj)
+	}
+	return out
+}
+
+// EncodeBlock returns a block as JSON for an append request. Its children
+// are appended in separate requests, under the created block, so that
+// nesting never exceeds the request limit, except for a table's rows, which
+// must be sent with the table itself.
+func EncodeBlock(b *Block) map[string]any {
+	data := make(map[string]any, len(b.Data)+1)
+	for k, v := range b.Data {
+		data[k] = v
+	}
+	if inline := inlineChildren(b); len(inline) > 0 {
+		children := make([]map[string]any, len(inline))
+		for i, child := range inline {
+			children[i] = EncodeBlock(child)
+		}
+		data["children"] = children
+	}
+	return map[string]any{"object": "block", "type": b.Type, b.Type: data}
+}
+
+// Deferred returns the children of a block that EncodeBlock leaves out, to
+// be appended under the block once it is created.
+func Deferred(b *Block) []*Block {
+	return b.Children[len(inlineChildren(b)):]
+}
+
+// inlineChildren returns the children sent in the same request as a block.
+func inlineChildren(b *Block) []*Block {
+	if b.Type != "table" {
+		return nil
+	}
+	return b.Children[:min(len(b.Children), MaxChildren)]
+}
@@ -0,0 +1,404 @@
+package notionmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdown parses CommonMark with the GitHub extensions for tables,
+// strikethrough, task lists and bare links.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// Convert parses CommonMark and returns the equivalent Notion blocks.
+//
+// Headings, paragraphs, bulleted, numbered and task lists, quotes, code
+// blocks, thematic breaks, tables and images with absolute URLs are converted
+// to the matching block types. Inline bold, italic, strikethrough, code and
+// links become rich text annotations. Anything else, such as raw HTML, is kept
+// as plain text. Soft line breaks are kept as newlines, as people typing notes
+// expect.
+func Convert(source []byte) []*Block {
+	doc := markdown.Parser().Parse(text.NewReader(source))
+	c := converter{source: source}
+	return c.blocks(doc)
+}
+
+type converter struct {
+	source []byte
+}
+
+// blocks converts the block-level children of n.
+func (c converter) blocks(n ast.Node) []*Block {
+	var out []*Block
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		out = append(out, c.block(child)...)
+	}
+	return out
+}
+
+// block converts a single block-level node.
+func (c converter) block(n ast.Node) []*Block {
+	switch n := n.(type) {
+	case *ast.Heading:
+		// Notion has three heading levels.
+		typ := fmt.Sprintf("heading_%d", min(n.Level, 3))
+		return textBlocks(typ, nil, c.inline(n))
+
+	case *ast.Paragraph, *ast.TextBlock:
+		if img := c.image(n); img != nil {
+			return []*Block{img}
+		}
+		return textBlocks("paragraph", nil, c.inline(n))
+
+	case *ast.List:
+		typ := "bulleted_list_item"
+		if n.IsOrdered() {
+			typ = "numbered_list_item"
+		}
+		var out []*Block
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			out = append(out, c.listItem(typ, item)...)
+		}
+		return out
+
+	case *ast.Blockquote:
+		return c.container("quote", nil, n)
+
+	case *ast.FencedCodeBlock:
+		return textBlocks("code", map[string]any{"language": codeLanguage(string(n.Language(c.source)))},
+			[]Text{{Content: c.lines(n)}})
+
+	case *ast.CodeBlock:
+		return textBlocks("code", map[string]any{"language": "plain text"}, []Text{{Content: c.lines(n)}})
+
+	case *ast.ThematicBreak:
+		return []*Block{{Type: "divider", Data: map[string]any{}}}
+
+	case *ast.HTMLBlock:
+		content := c.lines(n)
+		if n.HasClosure() {
+			content += string(n.ClosureLine.Value(c.source))
+		}
+		content = strings.TrimRight(content, "\n")
+		if content == "" {
+			return nil
+		}
+		return textBlocks("paragraph", nil, []Text{{Content: content}})
+
+	case *extast.Table:
+		return c.table(n)
+	}
+
+	// Unknown block types keep their children's content.
+	return c.blocks(n)
+}
+
+// listItem converts a list item. Task list items become to_do blocks.
+func (c converter) listItem(typ string, item ast.Node) []*Block {
+	var extra map[string]any
+	if first := item.FirstChild(); first != nil {
+		if box, ok := first.FirstChild().(*extast.TaskCheckBox); ok {
+			typ = "to_do"
+			extra = map[string]any{"checked": box.IsChecked}
+		}
+	}
+	return c.container(typ, extra, item)
+}
+
+// container converts a node whose first paragraph becomes the block's text
+// and whose remaining children are nested under it.
+func (c converter) container(typ string, extra map[string]any, n ast.Node) []*Block {
+	var items []Text
+	rest := n.FirstChild()
+	switch first := rest.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		items = c.inline(first)
+		rest = first.NextSibling()
+	}
+
+	blocks := textBlocks(typ, extra, items)
+	last := blocks[len(blocks)-1]
+	for ; rest != nil; rest = rest.NextSibling() {
+		last.Children = append(last.Children, c.block(rest)...)
+	}
+	return blocks
+}
+
+// table converts a table. Tables with more rows than fit in one request are
+// continued in further tables that repeat the header row.
+func (c converter) table(n *extast.Table) []*Block {
+	width := len(n.Alignments)
+	var header *Block
+	var rows []*Block
+	for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+		var cells []any
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			rt := RichText(c.inline(cell)...)
+			cells = append(cells, rt[:min(len(rt), MaxRichText)])
+		}
+		width = max(width, len(cells))
+		block := &Block{Type: "table_row", Data: map[string]any{"cells": cells}}
+		if _, ok := row.(*extast.TableHeader); ok {
+			header = block
+		} else {
+			rows = append(rows, block)
+		}
+	}
+
+	// Every row must have exactly table_width cells.
+	all := rows
+	if header != nil {
+		all = append([]*Block{header}, rows...)
+	}
+	for _, row := range all {
+		cells := row.Data["cells"].([]any)
+		for len(cells) < width {
+			cells = append(cells, []map[string]any{})
+		}
+		row.Data["cells"] = cells
+	}
+
+	perTable := MaxChildren
+	if header != nil {
+		perTable--
+	}
+	var tables []*Block
+	for len(rows) > 0 || len(tables) == 0 {
+		chunk := rows[:min(len(rows), perTable)]
+		rows = rows[len(chunk):]
+		table := &Block{
+			Type: "table",
+			Data: map[string]any{
+				"table_width":       width,
+				"has_column_header": header != nil,
+				"has_row_header":    false,
+			},
+		}
+		if header != nil {
+			table.Children = append(table.Children, header)
+		}
+		table.Children = append(table.Children, chunk...)
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+// image returns an image block if the paragraph holds only an image with an
+// absolute URL, which Notion can embed.
+func (c converter) image(n ast.Node) *Block {
+	img, ok := n.FirstChild().(*ast.Image)
+	if !ok || img.NextSibling() != nil || linkURL(string(img.Destination)) == "" {
+		return nil
+	}
+	data := map[string]any{
+		"type":     "external",
+		"external": map[string]any{"url": string(img.Destination)},
+	}
+	if caption := c.inline(img); len(caption) > 0 {
+		rt := RichText(caption...)
+		data["caption"] = rt[:min(len(rt), MaxRichText)]
+	}
+	return &Block{Type: "image", Data: data}
+}
+
+// lines returns the raw lines of a code or HTML block.
+func (c converter) lines(n ast.Node) string {
+	var b strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		seg := lines.At(i)
+		b.Write(seg.Value(c.source))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// inline converts the inline children of n to rich text items, merging
+// neighbours with the same formatting.
+func (c converter) inline(n ast.Node) []Text {
+	var out []Text
+	c.walkInline(n, Text{}, &out)
+	return out
+}
+
+// walkInline appends the text of n's inline children, formatted as style.
+func (c converter) walkInline(n ast.Node, style Text, out *[]Text) {
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		switch child := child.(type) {
+		case *ast.Text:
+			value := child.Value(c.source)
+			if !child.IsRaw() {
+				value = unescape(value)
+			}
+			content := string(value)
+			if child.SoftLineBreak() || child.HardLineBreak() {
+				content += "\n"
+			}
+			appendText(out, style, content)
+
+		case *ast.String:
+			value := child.Value
+			if !child.IsRaw() && !child.IsCode() {
+				value = unescape(value)
+			}
+			appendText(out, style, string(value))
+
+		case *ast.CodeSpan:
+			s := style
+			s.Code = true
+			c.walkInline(child, s, out)
+
+		case *ast.Emphasis:
+			s := style
+			if child.Level >= 2 {
+				s.Bold = true
+			} else {
+				s.Italic = true
+			}
+			c.walkInline(child, s, out)
+
+		case *extast.Strikethrough:
+			s := style
+			s.Strikethrough = true
+			c.walkInline(child, s, out)
+
+		case *ast.Link:
+			s := style
+			s.Link = linkURL(string(child.Destination))
+			c.walkInline(child, s, out)
+
+		case *ast.Image:
+			// Images inside text are shown as their alt text, linked to the image.
+			s := style
+			s.Link = linkURL(string(child.Destination))
+			c.walkInline(child, s, out)
+
+		case *ast.AutoLink:
+			s := style
+			u := string(child.URL(c.source))
+			s.Link = linkURL(u)
+			appendText(out, s, string(child.Label(c.source)))
+
+		case *ast.RawHTML:
+			var b strings.Builder
+			for i := 0; i < child.Segments.Len(); i++ {
+				seg := child.Segments.At(i)
+				b.Write(seg.Value(c.source))
+			}
+			appendText(out, style, b.String())
+
+		case *extast.TaskCheckBox:
+			// Represented by the to_do block's checked state.
+
+		default:
+			c.walkInline(child, style, out)
+		}
+	}
+}
+
+// appendText adds content to out, extending the last item if it has the same
+// formatting.
+func appendText(out *[]Text, style Text, content string) {
+	if content == "" {
+		return
+	}
+	if n := len(*out); n > 0 && (*out)[n-1].Link == style.Link && (*out)[n-1].Annotations == style.Annotations {
+		(*out)[n-1].Content += content
+		return
+	}
+	style.Content = content
+	*out = append(*out, style)
+}
+
+// unescape resolves backslash escapes and character references.
+func unescape(b []byte) []byte {
+	return util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(b)))
+}
+
+// linkURL returns u if Notion accepts it as a link, or "" otherwise. Notion
+// rejects relative URLs, so links to them are kept as plain text.
+func linkURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		if parsed.Host == "" {
+			return ""
+		}
+		return u
+	case "mailto":
+		return u
+	}
+	return ""
+}
+
+// codeLanguages maps fenced code info strings to Notion code languages.
+// Languages Notion knows by the same name need no entry.
+var codeLanguages = map[string]string{
+	"":           "plain text",
+	"text":       "plain text",
+	"txt":        "plain text",
+	"plaintext":  "plain text",
+	"sh":         "shell",
+	"zsh":        "shell",
+	"console":    "shell",
+	"js":         "javascript",
+	"jsx":        "javascript",
+	"ts":         "typescript",
+	"tsx":        "typescript",
+	"py":         "python",
+	"rb":         "ruby",
+	"rs":         "rust",
+	"golang":     "go",
+	"yml":        "yaml",
+	"md":         "markdown",
+	"cpp":        "c++",
+	"cs":         "c#",
+	"csharp":     "c#",
+	"fsharp":     "f#",
+	"kt":         "kotlin",
+	"objc":       "objective-c",
+	"ps1":        "powershell",
+	"dockerfile": "docker",
+	"proto":      "protobuf",
+	"tf":         "hcl",
+}
+
+// notionLanguages are the code languages Notion accepts.
+var notionLanguages = map[string]bool{
+	"abap": true, "arduino": true, "bash": true, "basic": true, "c": true, "clojure": true,
+	"coffeescript": true, "c++": true, "c#": true, "css": true, "dart": true, "diff": true,
+	"docker": true, "elixir": true, "elm": true, "erlang": true, "flow": true, "fortran": true,
+	"f#": true, "gherkin": true, "glsl": true, "go": true, "graphql": true, "groovy": true,
+	"haskell": true, "hcl": true, "html": true, "java": true, "javascript": true, "json": true,
+	"julia": true, "kotlin": true, "latex": true, "less": true, "lisp": true, "livescript": true,
+	"lua": true, "makefile": true, "markdown": true, "markup": true, "matlab": true,
+	"mermaid": true, "nix": true, "objective-c": true, "ocaml": true, "pascal": true, "perl": true,
+	"php": true, "plain text": true, "powershell": true, "prolog": true, "protobuf": true,
+	"python": true, "r": true, "reason": true, "ruby": true, "rust": true, "sass": true,
+	"scala": true, "scheme": true, "scss": true, "shell": true, "solidity": true, "sql": true,
+	"swift": true, "toml": true, "typescript": true, "vb.net": true, "verilog": true,
+	"vhdl": true, "visual basic": true, "webassembly": true, "xml": true, "yaml": true,
+}
+
+// codeLanguage returns the Notion code language for a fenced code block's
+// language, falling back to plain text.
+func codeLanguage(lang string) string {
+	lang = strings.ToLower(lang)
+	if mapped, ok := codeLanguages[lang]; ok {
+		return mapped
+	}
+	if notionLanguages[lang] {
+		return lang
+	}
+	return "plain text"
+}
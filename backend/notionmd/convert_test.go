@@ -0,0 +1,392 @@
+package notionmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// describe renders blocks as one line per block, indented by depth, with rich
+// text shown in a Markdown-like notation so expectations stay readable.
+func describe(blocks []*Block) string {
+	var b strings.Builder
+	var walk func(blocks []*Block, depth int)
+	walk = func(blocks []*Block, depth int) {
+		for _, block := range blocks {
+			b.WriteString(strings.Repeat("  ", depth))
+			b.WriteString(block.Type)
+			switch block.Type {
+			case "to_do":
+				fmt.Fprintf(&b, "[%v]", block.Data["checked"])
+			case "code":
+				fmt.Fprintf(&b, "(%s)", block.Data["language"])
+			case "table":
+				fmt.Fprintf(&b, "(%v, header=%v)", block.Data["table_width"], block.Data["has_column_header"])
+			case "image":
+				fmt.Fprintf(&b, "(%s)", block.Data["external"].(map[string]any)["url"])
+			}
+			if rt, ok := block.Data["rich_text"]; ok {
+				fmt.Fprintf(&b, " %q", describeRichText(rt.([]map[string]any)))
+			}
+			if cells, ok := block.Data["cells"]; ok {
+				var texts []string
+				for _, cell := range cells.([]any) {
+					texts = append(texts, describeRichText(cell.([]map[string]any)))
+				}
+				fmt.Fprintf(&b, " %s", strings.TrimSpace(strings.Join(texts, " | ")))
+			}
+			b.WriteString("\n")
+			walk(block.Children, depth+1)
+		}
+	}
+	walk(blocks, 0)
+	return b.String()
+}
+
+func describeRichText(rt []map[string]any) string {
+	var b strings.Builder
+	for _, item := range rt {
+		text := item["text"].(map[string]any)
+		s := text["content"].(string)
+		if a, ok := item["annotations"].(Annotations); ok {
+			if a.Code {
+				s = "`" + s + "`"
+			}
+			if a.Italic {
+				s = "_" + s + "_"
+			}
+			if a.Bold {
+				s = "**" + s + "**"
+			}
+			if a.Strikethrough {
+				s = "~~" + s + "~~"
+			}
+		}
+		if link, ok := text["link"].(map[string]any); ok {
+			s = "[" + s + "](" + link["url"].(string) + ")"
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{
+			name:     "Empty",
+			markdown: "",
+			want:     "",
+		},
+		{
+			name:     "Headings",
+			markdown: "# One\n## Two\n### Three\n#### Four",
+			want: `heading_1 "One"
+heading_2 "Two"
+heading_3 "Three"
+heading_3 "Four"
+`,
+		},
+		{
+			name:     "Paragraphs keep line breaks",
+			markdown: "First line\nsecond line\n\nNext paragraph",
+			want: `paragraph "First line\nsecond line"
+paragraph "Next paragraph"
+`,
+		},
+		{
+			name:     "Inline formatting",
+			markdown: "Plain **bold** _italic_ ***both*** `code` ~~gone~~",
+			want: `paragraph "Plain **bold** _italic_ **_both_** ` + "`code`" + ` ~~gone~~"
+`,
+		},
+		{
+			name:     "Links",
+			markdown: "[site](https://example.com) <https://example.org> [relative](/docs) www.example.net",
+			want: `paragraph "[site](https://example.com) [https://example.org](https://example.org) relative [www.example.net](http://www.example.net)"
+`,
+		},
+		{
+			name:     "Escapes and entities",
+			markdown: `\*not bold\* &amp; &#169;`,
+			want: `paragraph "*not bold* & ©"
+`,
+		},
+		{
+			name:     "Bulleted list with nesting",
+			markdown: "- One\n  - One A\n    - One A i\n- Two",
+			want: `bulleted_list_item "One"
+  bulleted_list_item "One A"
+    bulleted_list_item "One A i"
+bulleted_list_item "Two"
+`,
+		},
+		{
+			name:     "Numbered list with paragraphs",
+			markdown: "1. First\n\n   More about first\n2. Second",
+			want: `numbered_list_item "First"
+  paragraph "More about first"
+numbered_list_item "Second"
+`,
+		},
+		{
+			name:     "Task list",
+			markdown: "- [ ] Open\n- [x] Done",
+			want: `to_do[false] "Open"
+to_do[true] "Done"
+`,
+		},
+		{
+			name:     "Quote",
+			markdown: "> Quoted **text**\n>\n> - point",
+			want: `quote "Quoted **text**"
+  bulleted_list_item "point"
+`,
+		},
+		{
+			name:     "Code blocks",
+			markdown: "```go\nfunc main() {}\n```\n\n```ts\nlet x\n```\n\n```brainfuck\n+\n```\n\n    indented",
+			want: `code(go) "func main() {}"
+code(typescript) "let x"
+code(plain text) "+"
+code(plain text) "indented"
+`,
+		},
+		{
+			name:     "Divider",
+			markdown: "Above\n\n---\n\nBelow",
+			want: `paragraph "Above"
+divider
+paragraph "Below"
+`,
+		},
+		{
+			name:     "Table",
+			markdown: "| Name | Role |\n| --- | --- |\n| Ann | **Chair** |\n| Bob |",
+			want: `table(2, header=true)
+  table_row Name | Role
+  table_row Ann | **Chair**
+  table_row Bob |
+`,
+		},
+		{
+			name:     "Images",
+			markdown: "![Diagram](https://example.com/d.png)\n\nSee ![icon](https://example.com/i.png) here\n\n![local](img.png)",
+			want: `image(https://example.com/d.png)
+paragraph "See [icon](https://example.com/i.png) here"
+paragraph "local"
+`,
+		},
+		{
+			name:     "HTML is kept as text",
+			markdown: "<div>\nhello\n</div>\n\nInline <b>tag</b>",
+			want: `paragraph "<div>\nhello\n</div>"
+paragraph "Inline <b>tag</b>"
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describe(Convert([]byte(tt.markdown))); got != tt.want {
+				t.Errorf("Convert(%q):\ngot:\n%s\nwant:\n%s", tt.markdown, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvert_Limits(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		check    func(t *testing.T, blocks []*Block)
+	}{
+		{
+			name:     "Long text is split into rich text items",
+			markdown: strings.Repeat("a", MaxTextLength-1) + "😀" + strings.Repeat("b", 3000),
+			check: func(t *testing.T, blocks []*Block) {
+				rt := blocks[0].Data["rich_text"].([]map[string]any)
+				if len(rt) != 3 {
+					t.Fatalf("Expected 3 rich text items, got %d", len(rt))
+				}
+				for _, item := range rt {
+					content := item["text"].(map[string]any)["content"].(string)
+					if n := len(utf16.Encode([]rune(content))); n > MaxTextLength {
+						t.Errorf("Rich text item of %d units exceeds limit", n)
+					}
+				}
+			},
+		},
+		{
+			name:     "Too many rich text items continue in another block",
+			markdown: "- " + strings.Repeat("**b** i ", 60) + "\n  - child",
+			check: func(t *testing.T, blocks []*Block) {
+				if len(blocks) != 2 {
+					t.Fatalf("Expected 2 blocks, got %d", len(blocks))
+				}
+				for _, b := range blocks {
+					if n := len(b.Data["rich_text"].([]map[string]any)); n > MaxRichText {
+						t.Errorf("Block has %d rich text items", n)
+					}
+				}
+				if len(blocks[0].Children) != 0 || len(blocks[1].Children) != 1 {
+					t.Errorf("Expected children on the last block")
+				}
+			},
+		},
+		{
+			name:     "Large tables are split",
+			markdown: "| n |\n| - |\n" + strings.Repeat("| x |\n", 150),
+			check: func(t *testing.T, blocks []*Block) {
+				if len(blocks) != 2 {
+					t.Fatalf("Expected 2 tables, got %d", len(blocks))
+				}
+				if n := len(blocks[0].Children); n != MaxChildren {
+					t.Errorf("Expected first table to have %d rows, got %d", MaxChildren, n)
+				}
+				if n := len(blocks[1].Children); n != 150-(MaxChildren-1)+1 {
+					t.Errorf("Unexpected second table row count %d", n)
+				}
+				if describeRichText(blocks[1].Children[0].Data["cells"].([]any)[0].([]map[string]any)) != "n" {
+					t.Errorf("Expected second table to repeat the header")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.check(t, Convert([]byte(tt.markdown)))
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		want     string
+	}{
+		{
+			name:     "Nesting within the limit is kept",
+			markdown: "- a\n  - b\n    - c",
+			want: `bulleted_list_item "a"
+  bulleted_list_item "b"
+    bulleted_list_item "c"
+`,
+		},
+		{
+			name:     "Deeper nesting is kept",
+			markdown: "- a\n  - b\n    - c\n      - d\n    - e",
+			want: `bulleted_list_item "a"
+  bulleted_list_item "b"
+    bulleted_list_item "c"
+      bulleted_list_item "d"
+    bulleted_list_item "e"
+`,
+		},
+		{
+			name:     "Nested tables keep their rows",
+			markdown: "- a\n  - b\n\n    | h |\n    | - |\n    | r |",
+			want: `bulleted_list_item "a"
+  bulleted_list_item "b"
+    table(1, header=true)
+      table_row h
+      table_row r
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := Convert([]byte(tt.markdown))
+			if got := describe(decodeBlocks(t, Encode(blocks))); got != tt.want {
+				t.Errorf("Encode(%q):\ngot:\n%s\nwant:\n%s", tt.markdown, got, tt.want)
+			}
+			// Each block is appended on its own, so requests stay within
+			// the nesting limit however deep the page nests.
+			var check func(blocks []*Block)
+			check = func(blocks []*Block) {
+				for _, b := range blocks {
+					if depth := maxDepth([]map[string]any{EncodeBlock(b)}); depth >= MaxNestingDepth {
+						t.Errorf("Encoded %s block nests %d levels deep", b.Type, depth)
+					}
+					check(Deferred(b))
+				}
+			}
+			check(blocks)
+		})
+	}
+}
+
+func TestEncodeBlock_TableRows(t *testing.T) {
+	table := &Block{Type: "table", Data: map[string]any{"table_width": 1}}
+	for range 150 {
+		table.Children = append(table.Children, &Block{Type: "table_row", Data: map[string]any{"cells": []any{}}})
+	}
+	toggle := &Block{Type: "toggle", Children: []*Block{{Type: "paragraph"}}}
+
+	if got := len(EncodeBlock(table)["table"].(map[string]any)["children"].([]map[string]any)); got != MaxChildren {
+		t.Errorf("Expected %d inline table rows, got %d", MaxChildren, got)
+	}
+	if got := len(Deferred(table)); got != 50 {
+		t.Errorf("Expected 50 deferred table rows, got %d", got)
+	}
+	if _, ok := EncodeBlock(toggle)["toggle"].(map[string]any)["children"]; ok {
+		t.Error("Expected toggle children to be deferred")
+	}
+	if got := len(Deferred(toggle)); got != 1 {
+		t.Errorf("Expected 1 deferred toggle child, got %d", got)
+	}
+	if got := len(Encode([]*Block{table})[0]["table"].(map[string]any)["children"].([]map[string]any)); got != 150 {
+		t.Errorf("Expected all 150 rows on the page, got %d", got)
+	}
+}
+
+// decodeBlocks turns encoded block JSON back into Blocks for describe.
+func decodeBlocks(t *testing.T, encoded []map[string]any) []*Block {
+	t.Helper()
+	var blocks []*Block
+	for _, obj := range encoded {
+		typ := obj["type"].(string)
+		data := obj[typ].(map[string]any)
+		b := &Block{Type: typ, Data: map[string]any{}}
+		for k, v := range data {
+			if k == "children" {
+				b.Children = decodeBlocks(t, v.([]map[string]any))
+			} else {
+				b.Data[k] = v
+			}
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// maxDepth returns the number of levels of children below the top level.
+func maxDepth(encoded []map[string]any) int {
+	depth := 0
+	for _, obj := range encoded {
+		data := obj[obj["type"].(string)].(map[string]any)
+		if children, ok := data["children"].([]map[string]any); ok {
+			depth = max(depth, 1+maxDepth(children))
+		}
+	}
+	return depth
+}
+
+func TestEncode_JSON(t *testing.T) {
+	encoded, err := json.Marshal(Encode(Convert([]byte("**Hi** [there](https://example.com)"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"object":"block","paragraph":{"rich_text":[{"annotations":{"bold":true},"text":{"content":"Hi"},"type":"text"},{"text":{"content":" "},"type":"text"},{"text":{"content":"there","link":{"url":"https://example.com"}},"type":"text"}]},"type":"paragraph"}]`
+	if string(encoded) != want {
+		t.Errorf("Unexpected JSON:\n%s", encoded)
+	}
+}
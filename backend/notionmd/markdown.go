@@ -0,0 +1,423 @@
+package notionmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DecodeBlock decodes a block object returned by the Notion API. Children
+// are not included; Notion lists them separately when HasChildren is set.
+func DecodeBlock(raw json.RawMessage) (block *Block, hasChildren bool, err error) {
+	var header struct {
+		ID          string `json:"id"`
+		Type        string `json:"type"`
+		HasChildren bool   `json:"has_children"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, false, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, false, err
+	}
+	data := map[string]any{}
+	if payload, ok := fields[header.Type]; ok {
+		// Some payloads, such as unsupported blocks, are not objects.
+		json.Unmarshal(payload, &data)
+	}
+	return &Block{ID: header.ID, Type: header.Type, Data: data}, header.HasChildren, nil
+}
+
+// Markdown renders blocks as CommonMark, the reverse of Convert. Formatting
+// Markdown cannot express, such as colours, is dropped. Blocks with no
+// Markdown equivalent keep their text, or become an HTML comment naming
+// their type.
+func Markdown(blocks []*Block) string {
+	lines := renderBlocks(blocks)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// isListItem reports whether consecutive blocks of this type form a list.
+func isListItem(typ string) bool {
+	switch typ {
+	case "bulleted_list_item", "numbered_list_item", "to_do", "toggle":
+		return true
+	}
+	return false
+}
+
+// renderBlocks renders sibling blocks, separated by blank lines except
+// between items of the same list.
+func renderBlocks(blocks []*Block) []string {
+	var lines []string
+	number := 0
+	prev := ""
+	for _, b := range blocks {
+		if b.Type == "numbered_list_item" {
+			number++
+		} else {
+			number = 0
+		}
+		rendered := renderBlock(b, number)
+		if len(rendered) == 0 {
+			continue
+		}
+		if len(lines) > 0 && !(isListItem(b.Type) && b.Type == prev) {
+			lines = append(lines, "")
+		}
+		lines = append(lines, rendered...)
+		prev = b.Type
+	}
+	return lines
+}
+
+// renderBlock renders a block and its children. number is the position of a
+// numbered list item within its list.
+func renderBlock(b *Block, number int) []string {
+	text := inlineMarkdown(richTextItems(b.Data["rich_text"]))
+	children := renderBlocks(b.Children)
+
+	switch b.Type {
+	case "paragraph":
+		return join(splitLines(text), children)
+
+	case "heading_1", "heading_2", "heading_3":
+		level := int(b.Type[len(b.Type)-1] - '0')
+		heading := strings.Repeat("#", level) + " " + strings.ReplaceAll(text, "\n", " ")
+		return join([]string{heading}, children)
+
+	case "bulleted_list_item", "toggle":
+		return listItem("- ", text, b, children)
+
+	case "numbered_list_item":
+		return listItem(fmt.Sprintf("%d. ", number), text, b, children)
+
+	case "to_do":
+		box := "[ ] "
+		if checked, _ := b.Data["checked"].(bool); checked {
+			box = "[x] "
+		}
+		return listItem("- ", box+text, b, children)
+
+	case "quote":
+		return prefixLines("> ", join(splitLines(text), children))
+
+	case "callout":
+		if icon, ok := b.Data["icon"].(map[string]any); ok {
+			if emoji, ok := icon["emoji"].(string); ok {
+				text = emoji + " " + text
+			}
+		}
+		return prefixLines("> ", join(splitLines(text), children))
+
+	case "code":
+		code := plainText(richTextItems(b.Data["rich_text"]))
+		lang, _ := b.Data["language"].(string)
+		if lang == "plain text" {
+			lang = ""
+		}
+		fence := "```"
+		for strings.Contains(code, fence) {
+			fence += "`"
+		}
+		return append(append([]string{fence + lang}, strings.Split(code, "\n")...), fence)
+
+	case "equation":
+		expr, _ := b.Data["expression"].(string)
+		return []string{"$$", expr, "$$"}
+
+	case "divider":
+		return []string{"---"}
+
+	case "table":
+		return renderTable(b)
+
+	case "image":
+		caption := plainText(richTextItems(b.Data["caption"]))
+		return []string{"![" + escapeMarkdown(caption) + "](" + fileURL(b.Data) + ")"}
+
+	case "video", "audio", "file", "pdf", "bookmark", "embed", "link_preview":
+		u := fileURL(b.Data)
+		if u == "" {
+			u, _ = b.Data["url"].(string)
+		}
+		if u == "" {
+			break
+		}
+		label := plainText(richTextItems(b.Data["caption"]))
+		if label == "" {
+			label, _ = b.Data["name"].(string)
+		}
+		if label == "" {
+			return []string{"<" + u + ">"}
+		}
+		return []string{"[" + escapeMarkdown(label) + "](" + u + ")"}
+
+	case "child_page", "child_database":
+		title, _ := b.Data["title"].(string)
+		if title == "" {
+			title = "Untitled"
+		}
+		return []string{"[" + escapeMarkdown(title) + "](https://www.notion.so/" + strings.ReplaceAll(b.ID, "-", "") + ")"}
+
+	case "column_list", "column", "synced_block", "template":
+		return children
+
+	case "table_of_contents", "breadcrumb":
+		// Navigation aids with no content of their own.
+		return nil
+	}
+
+	if text != "" {
+		return join(splitLines(text), children)
+	}
+	return join([]string{"<!-- unsupported block: " + b.Type + " -->"}, children)
+}
+
+// join returns lines followed by a blank line and more, if more is not empty.
+func join(lines, more []string) []string {
+	if len(more) == 0 {
+		return lines
+	}
+	return append(append(lines, ""), more...)
+}
+
+// blockStart matches text at the start of a line that Markdown would read as
+// the start of a heading, list, quote or thematic break.
+var blockStart = regexp.MustCompile(`^(\s*)(#{1,6}(\s|$)|[-+*](\s|$)|\d{1,9}[.)](\s|$)|>|={3,}|-{3,})`)
+
+// splitLines splits text into lines. Line breaks within a block become soft
+// line breaks, which Convert turns back into newlines. Lines that would start
+// another block are escaped.
+func splitLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if m := blockStart.FindStringSubmatchIndex(line); m != nil {
+			// Escape the first character of the marker; for an ordered
+			// list that is the delimiter after the number.
+			at := m[4]
+			for at < len(line) && line[at] >= '0' && line[at] <= '9' {
+				at++
+			}
+			lines[i] = line[:at] + `\` + line[at:]
+		}
+	}
+	return lines
+}
+
+// listItem renders a list item with continuation lines and children indented
+// under the marker. Children other than a nested list are separated by a
+// blank line so they are not read as a continuation of the item's text.
+func listItem(marker, text string, b *Block, children []string) []string {
+	if len(b.Children) > 0 && !isListItem(b.Children[0].Type) {
+		children = append([]string{""}, children...)
+	}
+	indent := strings.Repeat(" ", len(marker))
+	lines := splitLines(text)
+	out := []string{marker + lines[0]}
+	for _, line := range append(lines[1:], children...) {
+		if line == "" {
+			out = append(out, "")
+		} else {
+			out = append(out, indent+line)
+		}
+	}
+	return out
+}
+
+// prefixLines prefixes every line, as for block quotes.
+func prefixLines(prefix string, lines []string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = strings.TrimRight(prefix+line, " ")
+	}
+	return out
+}
+
+// renderTable renders a table block whose children are its rows. Markdown
+// tables always have a header row, so the first row is used as one.
+func renderTable(b *Block) []string {
+	var rows [][]string
+	for _, row := range b.Children {
+		cells, _ := row.Data["cells"].([]any)
+		var texts []string
+		for _, cell := range cells {
+			text := inlineMarkdown(richTextItems(cell))
+			text = strings.ReplaceAll(strings.ReplaceAll(text, "|", `\|`), "\n", " ")
+			texts = append(texts, text)
+		}
+		rows = append(rows, texts)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	width := 1
+	for _, row := range rows {
+		width = max(width, len(row))
+	}
+	line := func(cells []string) string {
+		for len(cells) < width {
+			cells = append(cells, "")
+		}
+		return "| " + strings.Join(cells, " | ") + " |"
+	}
+	lines := []string{line(rows[0]), line(slices.Repeat([]string{"---"}, width))}
+	for _, row := range rows[1:] {
+		lines = append(lines, line(row))
+	}
+	return lines
+}
+
+// fileURL returns the URL of a file-like block, hosted by Notion or external.
+func fileURL(data map[string]any) string {
+	for _, key := range []string{"external", "file"} {
+		if f, ok := data[key].(map[string]any); ok {
+			if u, ok := f["url"].(string); ok {
+				return u
+			}
+		}
+	}
+	return ""
+}
+
+// richTextItem is a rich text item as returned by the Notion API, or as built
+// by RichText.
+type richTextItem struct {
+	Type      string `json:"type"`
+	PlainText string `json:"plain_text"`
+	Href      string `json:"href"`
+	Text      *struct {
+		Content string `json:"content"`
+		Link    *struct {
+			URL string `json:"url"`
+		} `json:"link"`
+	} `json:"text"`
+	Equation *struct {
+		Expression string `json:"expression"`
+	} `json:"equation"`
+	Annotations Annotations `json:"annotations"`
+}
+
+// content returns the item's text.
+func (i richTextItem) content() string {
+	if i.PlainText == "" && i.Text != nil {
+		return i.Text.Content
+	}
+	return i.PlainText
+}
+
+// link returns the URL the item links to, if any.
+func (i richTextItem) link() string {
+	if i.Href != "" {
+		return i.Href
+	}
+	if i.Text != nil && i.Text.Link != nil {
+		return i.Text.Link.URL
+	}
+	return ""
+}
+
+// richTextItems decodes a rich text array from block data.
+func richTextItems(v any) []richTextItem {
+	if v == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var items []richTextItem
+	json.Unmarshal(raw, &items)
+	return items
+}
+
+// plainText concatenates the text of rich text items.
+func plainText(items []richTextItem) string {
+	var b strings.Builder
+	for _, item := range items {
+		b.WriteString(item.content())
+	}
+	return b.String()
+}
+
+// inlineMarkdown renders rich text as inline Markdown. Neighbouring items
+// with the same formatting are merged first so their markers do not touch.
+func inlineMarkdown(items []richTextItem) string {
+	var b strings.Builder
+	for i := 0; i < len(items); {
+		item := items[i]
+		content := item.content()
+		j := i + 1
+		for ; j < len(items) && items[j].Type == item.Type && items[j].Annotations == item.Annotations && items[j].link() == item.link(); j++ {
+			content += items[j].content()
+		}
+		b.WriteString(inlineItem(item, content))
+		i = j
+	}
+	return b.String()
+}
+
+// inlineItem renders one run of rich text with its formatting.
+func inlineItem(item richTextItem, content string) string {
+	if content == "" {
+		return ""
+	}
+	a := item.Annotations
+
+	// Markers must touch the text, so surrounding spaces go outside them.
+	trimmed := strings.TrimLeft(content, " ")
+	lead := content[:len(content)-len(trimmed)]
+	core := strings.TrimRight(trimmed, " ")
+	trail := trimmed[len(core):]
+	if core == "" {
+		return content
+	}
+
+	var s string
+	switch {
+	case item.Type == "equation":
+		s = "$" + core + "$"
+	case a.Code:
+		fence := "`"
+		for strings.Contains(core, fence) {
+			fence += "`"
+		}
+		if strings.HasPrefix(core, "`") || strings.HasSuffix(core, "`") {
+			s = fence + " " + core + " " + fence
+		} else {
+			s = fence + core + fence
+		}
+	default:
+		s = escapeMarkdown(core)
+	}
+	if a.Italic {
+		s = "_" + s + "_"
+	}
+	if a.Bold {
+		s = "**" + s + "**"
+	}
+	if a.Strikethrough {
+		s = "~~" + s + "~~"
+	}
+	if link := item.link(); link != "" && item.Type != "equation" {
+		s = "[" + s + "](" + strings.ReplaceAll(link, ")", "%29") + ")"
+	}
+	return lead + s + trail
+}
+
+// markdownEscaper escapes characters that would otherwise start inline
+// Markdown formatting.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "~", `\~`, "<", `\<`,
+)
+
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
@@ -0,0 +1,186 @@
+package notionmd
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// decodeFixture decodes Notion API block objects, with children given inline
+// under "children" for brevity.
+func decodeFixture(t *testing.T, fixture string) []*Block {
+	t.Helper()
+	var raws []json.RawMessage
+	if err := json.Unmarshal([]byte(fixture), &raws); err != nil {
+		t.Fatal(err)
+	}
+	var blocks []*Block
+	for _, raw := range raws {
+		block, _, err := DecodeBlock(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var nested struct {
+			Children json.RawMessage `json:"children"`
+		}
+		json.Unmarshal(raw, &nested)
+		if nested.Children != nil {
+			block.Children = decodeFixture(t, string(nested.Children))
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestMarkdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		want    string
+	}{
+		{
+			name: "Annotations and links",
+			fixture: `[{"type": "paragraph", "paragraph": {"rich_text": [
+				{"type": "text", "plain_text": "Plain ", "annotations": {}},
+				{"type": "text", "plain_text": "bold ", "annotations": {"bold": true}},
+				{"type": "text", "plain_text": "italic", "annotations": {"italic": true}},
+				{"type": "text", "plain_text": " and ", "annotations": {}},
+				{"type": "text", "plain_text": "code", "annotations": {"code": true}},
+				{"type": "text", "plain_text": " ", "annotations": {}},
+				{"type": "text", "plain_text": "site", "href": "https://example.com", "annotations": {"strikethrough": true}},
+				{"type": "mention", "plain_text": "@Ann", "annotations": {"color": "blue"}},
+				{"type": "equation", "plain_text": "x^2", "annotations": {}}
+			]}}]`,
+			want: "Plain **bold** _italic_ and `code` [~~site~~](https://example.com)@Ann$x^2$\n",
+		},
+		{
+			name: "Special characters are escaped",
+			fixture: `[{"type": "paragraph", "paragraph": {"rich_text": [
+				{"type": "text", "plain_text": "# not a heading\n- not a list\n2. not numbered\nsnake_case *stars* [brackets]"}
+			]}}]`,
+			want: "\\# not a heading\n\\- not a list\n2\\. not numbered\nsnake\\_case \\*stars\\* \\[brackets\\]\n",
+		},
+		{
+			name: "Lists with nesting",
+			fixture: `[
+				{"type": "bulleted_list_item", "bulleted_list_item": {"rich_text": [{"plain_text": "One"}]}, "children": [
+					{"type": "numbered_list_item", "numbered_list_item": {"rich_text": [{"plain_text": "One A"}]}},
+					{"type": "numbered_list_item", "numbered_list_item": {"rich_text": [{"plain_text": "One B"}]}}
+				]},
+				{"type": "bulleted_list_item", "bulleted_list_item": {"rich_text": [{"plain_text": "Two"}]}},
+				{"type": "to_do", "to_do": {"rich_text": [{"plain_text": "Task"}], "checked": true}},
+				{"type": "toggle", "toggle": {"rich_text": [{"plain_text": "Details"}]}, "children": [
+					{"type": "paragraph", "paragraph": {"rich_text": [{"plain_text": "Hidden"}]}}
+				]}
+			]`,
+			want: `- One
+  1. One A
+  2. One B
+- Two
+
+- [x] Task
+
+- Details
+
+  Hidden
+`,
+		},
+		{
+			name: "Headings, quotes and callouts",
+			fixture: `[
+				{"type": "heading_1", "heading_1": {"rich_text": [{"plain_text": "Agenda"}]}},
+				{"type": "quote", "quote": {"rich_text": [{"plain_text": "Line one\nLine two"}]}},
+				{"type": "callout", "callout": {"rich_text": [{"plain_text": "Note"}], "icon": {"type": "emoji", "emoji": "💡"}}}
+			]`,
+			want: `# Agenda
+
+> Line one
+> Line two
+
+> 💡 Note
+`,
+		},
+		{
+			name: "Code, equations and dividers",
+			fixture: `[
+				{"type": "code", "code": {"rich_text": [{"plain_text": "fmt.Println(\"*\")\n` + "```" + `"}], "language": "go"}},
+				{"type": "equation", "equation": {"expression": "e=mc^2"}},
+				{"type": "divider", "divider": {}}
+			]`,
+			want: "````go\nfmt.Println(\"*\")\n```\n````\n\n$$\ne=mc^2\n$$\n\n---\n",
+		},
+		{
+			name: "Tables",
+			fixture: `[{"type": "table", "table": {"table_width": 2, "has_column_header": true}, "children": [
+				{"type": "table_row", "table_row": {"cells": [[{"plain_text": "Name"}], [{"plain_text": "Role"}]]}},
+				{"type": "table_row", "table_row": {"cells": [[{"plain_text": "Ann"}], [{"plain_text": "a|b", "annotations": {"bold": true}}]]}}
+			]}]`,
+			want: `| Name | Role |
+| --- | --- |
+| Ann | **a\|b** |
+`,
+		},
+		{
+			name: "Media and links to pages",
+			fixture: `[
+				{"type": "image", "image": {"type": "external", "external": {"url": "https://example.com/a.png"}, "caption": [{"plain_text": "Diagram"}]}},
+				{"type": "file", "file": {"type": "file", "file": {"url": "https://files.example/f.pdf"}, "name": "minutes.pdf"}},
+				{"type": "bookmark", "bookmark": {"url": "https://example.org"}},
+				{"type": "child_page", "id": "1234-abcd", "child_page": {"title": "Notes"}}
+			]`,
+			want: `![Diagram](https://example.com/a.png)
+
+[minutes.pdf](https://files.example/f.pdf)
+
+<https://example.org>
+
+[Notes](https://www.notion.so/1234abcd)
+`,
+		},
+		{
+			name: "Unsupported blocks degrade",
+			fixture: `[
+				{"type": "table_of_contents", "table_of_contents": {}},
+				{"type": "unsupported", "unsupported": {}},
+				{"type": "future_block", "future_block": {"rich_text": [{"plain_text": "Kept text"}]}},
+				{"type": "column_list", "column_list": {}, "children": [
+					{"type": "column", "column": {}, "children": [
+						{"type": "paragraph", "paragraph": {"rich_text": [{"plain_text": "Left"}]}}
+					]},
+					{"type": "column", "column": {}, "children": [
+						{"type": "paragraph", "paragraph": {"rich_text": [{"plain_text": "Right"}]}}
+					]}
+				]}
+			]`,
+			want: `<!-- unsupported block: unsupported -->
+
+Kept text
+
+Left
+
+Right
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Markdown(decodeFixture(t, tt.fixture)); got != tt.want {
+				t.Errorf("Markdown:\ngot:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkdown_RoundTrip(t *testing.T) {
+	tests := []string{
+		"# Agenda\n\n1. **Budget** for _Q3_\n   - Review `costs`\n2. Hiring\n\n- [ ] Send [minutes](https://example.com)\n",
+		"> Quoted\n> text\n\n```python\nprint(1)\n```\n\n---\n\n| a | b |\n| --- | --- |\n| 1 | 2 |\n",
+		"Escaped \\*stars\\* and snake\\_case\n",
+		"1. Item\n\n   With a paragraph\n2. Next\n",
+	}
+	for _, markdown := range tests {
+		if got := Markdown(Convert([]byte(markdown))); got != markdown {
+			t.Errorf("Round trip of %q gave %q", markdown, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package notionmd converts between CommonMark and Notion block objects.
+//
+// Convert parses Markdown into a tree of Blocks, and Encode turns blocks into
+// the JSON accepted by Notion's append block children endpoint. Text is split
+// to respect Notion's rich text limits, and Encode rearranges nesting that a
+// single request cannot carry. In the other direction, DecodeBlock reads
+// blocks returned by Notion and Markdown renders them.
+package notionmd
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+// Notion API request limits.
+const (
+	// MaxTextLength is the maximum length of a single rich text item, in
+	// UTF-16 code units.
+	MaxTextLength = 2000
+	// MaxRichText is the maximum number of rich text items in a block.
+	MaxRichText = 100
+	// MaxChildren is the maximum number of blocks in a children array.
+	MaxChildren = 100
+	// MaxNestingDepth is the number of levels of children a single append
+	// request may carry below its top-level blocks.
+	MaxNestingDepth = 2
+)
+
+// Annotations are the formatting options of a rich text item.
+type Annotations struct {
+	Bold          bool   `json:"bold,omitempty"`
+	Italic        bool   `json:"italic,omitempty"`
+	Strikethrough bool   `json:"strikethrough,omitempty"`
+	Underline     bool   `json:"underline,omitempty"`
+	Code          bool   `json:"code,omitempty"`
+	Color         string `json:"color,omitempty"`
+}
+
+// Text is a rich text item of type "text".
+type Text struct {
+	Content string
+	Link    string
+	Annotations
+}
+
+// JSON encodes the item as a Notion rich text object.
+func (t Text) JSON() map[string]any {
+	text := map[string]any{"content": t.Content}
+	if t.Link != "" {
+		text["link"] = map[string]any{"url": t.Link}
+	}
+	item := map[string]any{"type": "text", "text": text}
+	if t.Annotations != (Annotations{}) {
+		item["annotations"] = t.Annotations
+	}
+	return item
+}
+
+// SplitText splits s into chunks that fit in a rich text item. Lengths are
+// measured in UTF-16 code units, as Notion does, and runes are never split.
+func SplitText(s string) []string {
+	var chunks []string
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		size := utf16.RuneLen(r)
+		if size < 0 {
+			size = 1
+		}
+		if n+size > MaxTextLength {
+			chunks = append(chunks, b.String())
+			b.Reset()
+			n = 0
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	if b.Len() > 0 {
+		chunks = append(chunks, b.String())
+	}
+	return chunks
+}
+
+// RichText encodes items as a Notion rich text array, splitting any item
+// longer than the per-item limit.
+func RichText(items ...Text) []map[string]any {
+	out := []map[string]any{}
+	for _, item := range items {
+		for _, chunk := range SplitText(item.Content) {
+			part := item
+			part.Content = chunk
+			out = append(out, part.JSON())
+		}
+	}
+	return out
+}
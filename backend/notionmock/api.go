@@ -0,0 +1,709 @@
+package notionmock
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// blockTypes are the block types that can be created.
+var blockTypes = map[string]bool{
+	"paragraph": true, "heading_1": true, "heading_2": true, "heading_3": true,
+	"bulleted_list_item": true, "numbered_list_item": true, "to_do": true,
+	"toggle": true, "quote": true, "callout": true, "code": true,
+	"divider": true, "table": true, "table_row": true, "image": true,
+	"bookmark": true, "embed": true, "equation": true, "table_of_contents": true,
+	"breadcrumb": true, "column_list": true, "column": true,
+}
+
+// listJSON returns a paginated list response.
+func listJSON(results []any, next string, typ string) map[string]any {
+	var cursor any
+	if next != "" {
+		cursor = next
+	}
+	return map[string]any{
+		"object":      "list",
+		"results":     results,
+		"next_cursor": cursor,
+		"has_more":    next != "",
+		"type":        typ,
+		typ:           map[string]any{},
+	}
+}
+
+// pageParams reads page_size and start_cursor from the query string of a GET
+// request or the body of a POST request.
+func pageParams(r *http.Request, body map[string]any) (size int, cursor string, err *apiError) {
+	size = MaxPageSize
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		if v := q.Get("page_size"); v != "" {
+			n, convErr := strconv.Atoi(v)
+			if convErr != nil {
+				return 0, "", validationError("page_size should be a number, instead was `%q`.", v)
+			}
+			size = n
+		}
+		cursor = q.Get("start_cursor")
+	} else {
+		if v, ok := body["page_size"]; ok {
+			n, ok := v.(float64)
+			if !ok || n != float64(int(n)) {
+				return 0, "", validationError("body.page_size should be an integer, instead was `%v`.", v)
+			}
+			size = int(n)
+		}
+		if v, ok := body["start_cursor"]; ok {
+			cursor, _ = v.(string)
+		}
+	}
+	if size < 1 || size > MaxPageSize {
+		return 0, "", validationError("page_size should be ≤ `%d` and ≥ `1`, instead was `%d`.", MaxPageSize, size)
+	}
+	return size, cursor, nil
+}
+
+// paginate returns the page of ids starting at cursor, which is the ID of the
+// first item to return, and the cursor of the next page.
+func paginate(ids []string, size int, cursor string) ([]string, string, *apiError) {
+	start := 0
+	if cursor != "" {
+		start = slices.Index(ids, cursor)
+		if start < 0 {
+			return nil, "", validationError("start_cursor provided is invalid: %s", cursor)
+		}
+	}
+	end := min(len(ids), start+size)
+	next := ""
+	if end < len(ids) {
+		next = ids[end]
+	}
+	return ids[start:end], next, nil
+}
+
+func (s *Server) search(r *http.Request, body map[string]any) (any, *apiError) {
+	query, _ := body["query"].(string)
+	query = strings.ToLower(strings.TrimSpace(query))
+	kind := ""
+	if filter, ok := body["filter"].(map[string]any); ok {
+		kind, _ = filter["value"].(string)
+		if filter["property"] != "object" || (kind != "page" && kind != "data_source") {
+			return nil, validationError("body.filter.value should be `\"page\"` or `\"data_source\"`, instead was `%q`.", kind)
+		}
+	}
+	ascending := false
+	if sort, ok := body["sort"].(map[string]any); ok {
+		ascending = sort["direction"] == "ascending"
+	}
+	size, cursor, err := pageParams(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	type hit struct {
+		id     string
+		edited int64
+		json   func() map[string]any
+	}
+	var hits []hit
+	if kind != "data_source" {
+		for _, p := range s.pages {
+			if !p.inTrash && strings.Contains(strings.ToLower(p.title()), query) {
+				hits = append(hits, hit{p.id, p.edited.UnixNano(), func() map[string]any { return s.pageJSON(p) }})
+			}
+		}
+	}
+	if kind != "page" {
+		for _, ds := range s.sources {
+			if !s.dbs[ds.databaseID].inTrash && strings.Contains(strings.ToLower(plainText(ds.title)), query) {
+				hits = append(hits, hit{ds.id, ds.edited.UnixNano(), func() map[string]any { return s.dataSourceJSON(ds) }})
+			}
+		}
+	}
+	slices.SortFunc(hits, func(a, b hit) int {
+		c := cmp.Compare(b.edited, a.edited)
+		if ascending {
+			c = -c
+		}
+		return cmp.Or(c, strings.Compare(a.id, b.id))
+	})
+
+	ids := make([]string, len(hits))
+	byID := make(map[string]hit, len(hits))
+	for i, h := range hits {
+		ids[i] = h.id
+		byID[h.id] = h
+	}
+	ids, next, err := paginate(ids, size, cursor)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]any, len(ids))
+	for i, id := range ids {
+		results[i] = byID[id].json()
+	}
+	return listJSON(results, next, "page_or_data_source"), nil
+}
+
+func (s *Server) me(r *http.Request, body map[string]any) (any, *apiError) {
+	return botJSON(), nil
+}
+
+func (s *Server) listUsers(r *http.Request, body map[string]any) (any, *apiError) {
+	size, cursor, err := pageParams(r, body)
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]map[string]any{personUserID: personJSON(), botUserID: botJSON()}
+	ids, next, err := paginate(slices.Sorted(maps.Keys(users)), size, cursor)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]any, len(ids))
+	for i, id := range ids {
+		results[i] = users[id]
+	}
+	return listJSON(results, next, "user"), nil
+}
+
+func (s *Server) getUser(r *http.Request, body map[string]any) (any, *apiError) {
+	switch id := normalizeID(r.PathValue("id")); id {
+	case personUserID:
+		return personJSON(), nil
+	case botUserID:
+		return botJSON(), nil
+	default:
+		return nil, notFound("user", id)
+	}
+}
+
+// pageProperties validates property values for a page under parent, and
+// returns them merged into current.
+func (s *Server) pageProperties(parent parentRef, values map[string]any, current map[string]any) (map[string]any, *apiError) {
+	out := maps.Clone(current)
+	if out == nil {
+		out = make(map[string]any)
+	}
+
+	if parent.Type != "data_source_id" {
+		for name, v := range values {
+			if name != "title" {
+				return nil, validationError("Invalid property identifier: %s. A page whose parent is a page can only have a title property.", name)
+			}
+			rt, err := titleValue(v, "body.properties.title")
+			if err != nil {
+				return nil, err
+			}
+			out["title"] = map[string]any{"id": "title", "type": "title", "title": rt}
+		}
+		if _, ok := out["title"]; !ok {
+			out["title"] = map[string]any{"id": "title", "type": "title", "title": []any{}}
+		}
+		return out, nil
+	}
+
+	ds := s.sources[parent.ID]
+	byID := make(map[string]string, len(ds.properties))
+	for name, v := range ds.properties {
+		byID[v.(map[string]any)["id"].(string)] = name
+	}
+	for key, v := range values {
+		name := key
+		if _, ok := ds.properties[name]; !ok {
+			if name, ok = byID[key]; !ok {
+				return nil, validationError("%s is not a property that exists.", key)
+			}
+		}
+		prop := ds.properties[name].(map[string]any)
+		typ := prop["type"].(string)
+		value, ok := v.(map[string]any)
+		if !ok {
+			return nil, validationError("body.properties.%s should be an object.", name)
+		}
+		content, ok := value[typ]
+		if !ok {
+			return nil, validationError("body.properties.%s.%s should be defined, instead was `undefined`.", name, typ)
+		}
+		if typ == "title" || typ == "rich_text" {
+			rt, err := normalizeRichText(content, fmt.Sprintf("body.properties.%s.%s", name, typ))
+			if err != nil {
+				return nil, err
+			}
+			content = rt
+		}
+		out[name] = map[string]any{"id": prop["id"], "type": typ, typ: content}
+	}
+	for name, v := range ds.properties {
+		if _, ok := out[name]; ok {
+			continue
+		}
+		prop := v.(map[string]any)
+		typ := prop["type"].(string)
+		var empty any
+		switch typ {
+		case "title", "rich_text", "multi_select", "people", "relation", "files":
+			empty = []any{}
+		}
+		out[name] = map[string]any{"id": prop["id"], "type": typ, typ: empty}
+	}
+	return out, nil
+}
+
+// titleValue reads a title property value, which may be given as a rich text
+// array or as {"title": [...]}.
+func titleValue(v any, path string) ([]any, *apiError) {
+	if m, ok := v.(map[string]any); ok {
+		return normalizeRichText(m["title"], path+".title")
+	}
+	return normalizeRichText(v, path)
+}
+
+// resolveParent reads the parent of a page to be created.
+func (s *Server) resolveParent(v any) (parentRef, *apiError) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return parentRef{}, validationError("body.parent should be an object, instead was `%v`.", v)
+	}
+	if id, ok := m["page_id"].(string); ok {
+		id = normalizeID(id)
+		p, ok := s.pages[id]
+		if !ok {
+			return parentRef{}, notFound("page", id)
+		}
+		if p.inTrash {
+			return parentRef{}, validationError("Can't edit block that is archived. You must unarchive the block before editing.")
+		}
+		return parentRef{Type: "page_id", ID: id}, nil
+	}
+	if id, ok := m["data_source_id"].(string); ok {
+		id = normalizeID(id)
+		ds, ok := s.sources[id]
+		if !ok {
+			return parentRef{}, notFound("data_source", id)
+		}
+		return parentRef{Type: "data_source_id", ID: id, DatabaseID: ds.databaseID}, nil
+	}
+	if id, ok := m["database_id"].(string); ok {
+		id = normalizeID(id)
+		db, ok := s.dbs[id]
+		if !ok {
+			return parentRef{}, notFound("database", id)
+		}
+		if len(db.sources) != 1 {
+			return parentRef{}, validationError("Databases with multiple data sources are not supported in this API version.")
+		}
+		return parentRef{Type: "data_source_id", ID: db.sources[0], DatabaseID: id}, nil
+	}
+	if m["workspace"] == true {
+		return parentRef{Type: "workspace"}, nil
+	}
+	return parentRef{}, validationError("body.parent.page_id should be defined, instead was `undefined`.")
+}
+
+func (s *Server) createPage(r *http.Request, body map[string]any) (any, *apiError) {
+	parent, err := s.resolveParent(body["parent"])
+	if err != nil {
+		return nil, err
+	}
+	values, _ := body["properties"].(map[string]any)
+	properties, err := s.pageProperties(parent, values, nil)
+	if err != nil {
+		return nil, err
+	}
+	var children []*newBlock
+	if v, ok := body["children"]; ok {
+		if children, err = parseBlocks(v, "body.children", 0, new(int)); err != nil {
+			return nil, err
+		}
+	}
+
+	now := s.now()
+	p := &page{id: s.newID(), parent: parent, properties: properties, created: now, edited: now}
+	s.pages[p.id] = p
+	if parent.Type == "page_id" {
+		s.children[parent.ID] = append(s.children[parent.ID], p.id)
+	}
+	s.insertBlocks(parentRef{Type: "page_id", ID: p.id}, children, -1)
+	return s.pageJSON(p), nil
+}
+
+func (s *Server) getPage(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	p, ok := s.pages[id]
+	if !ok {
+		return nil, notFound("page", id)
+	}
+	return s.pageJSON(p), nil
+}
+
+// trashFlag reads the in_trash or archived field of an update request.
+func trashFlag(body map[string]any) (trash bool, ok bool) {
+	if v, ok := body["in_trash"].(bool); ok {
+		return v, true
+	}
+	v, ok := body["archived"].(bool)
+	return v, ok
+}
+
+func (s *Server) updatePage(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	p, ok := s.pages[id]
+	if !ok {
+		return nil, notFound("page", id)
+	}
+	trash, hasTrash := trashFlag(body)
+	if p.inTrash && (!hasTrash || trash) {
+		return nil, validationError("Can't edit page that is archived. You must unarchive the page before editing.")
+	}
+	if values, ok := body["properties"].(map[string]any); ok {
+		properties, err := s.pageProperties(p.parent, values, p.properties)
+		if err != nil {
+			return nil, err
+		}
+		p.properties = properties
+	}
+	if hasTrash {
+		p.inTrash = trash
+	}
+	p.edited = s.now()
+	return s.pageJSON(p), nil
+}
+
+func (s *Server) getBlock(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	if b, ok := s.blocks[id]; ok {
+		return s.blockJSON(b), nil
+	}
+	if p, ok := s.pages[id]; ok {
+		return s.pageBlockJSON(p), nil
+	}
+	return nil, notFound("block", id)
+}
+
+func (s *Server) updateBlock(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	if p, ok := s.pages[id]; ok {
+		trash, hasTrash := trashFlag(body)
+		if p.inTrash && (!hasTrash || trash) {
+			return nil, validationError("Can't edit block that is archived. You must unarchive the block before editing.")
+		}
+		if hasTrash {
+			p.inTrash = trash
+			p.edited = s.now()
+		}
+		return s.pageBlockJSON(p), nil
+	}
+	b, ok := s.blocks[id]
+	if !ok {
+		return nil, notFound("block", id)
+	}
+	trash, hasTrash := trashFlag(body)
+	if b.inTrash && (!hasTrash || trash) {
+		return nil, validationError("Can't edit block that is archived. You must unarchive the block before editing.")
+	}
+	for key, v := range body {
+		switch key {
+		case "in_trash", "archived", "object", "type":
+		case b.typ:
+			data, ok := v.(map[string]any)
+			if !ok {
+				return nil, validationError("body.%s should be an object.", key)
+			}
+			updated := maps.Clone(b.data)
+			for k, v := range data {
+				updated[k] = v
+			}
+			if err := normalizeBlockData(b.typ, updated, "body."+key); err != nil {
+				return nil, err
+			}
+			b.data = updated
+		default:
+			return nil, validationError("body.%s should be not present, instead was `%v`.", key, v)
+		}
+	}
+	if hasTrash {
+		b.inTrash = trash
+	}
+	now := s.now()
+	b.edited = now
+	s.touch(b.parent.ID, now)
+	return s.blockJSON(b), nil
+}
+
+func (s *Server) deleteBlock(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	now := s.now()
+	if p, ok := s.pages[id]; ok {
+		if p.inTrash {
+			return nil, validationError("Can't edit block that is archived. You must unarchive the block before editing.")
+		}
+		p.inTrash, p.edited = true, now
+		return s.pageBlockJSON(p), nil
+	}
+	b, ok := s.blocks[id]
+	if !ok {
+		return nil, notFound("block", id)
+	}
+	if b.inTrash {
+		return nil, validationError("Can't edit block that is archived. You must unarchive the block before editing.")
+	}
+	b.inTrash, b.edited = true, now
+	s.touch(b.parent.ID, now)
+	return s.blockJSON(b), nil
+}
+
+// childJSON returns the block or child page id.
+func (s *Server) childJSON(id string) any {
+	if b, ok := s.blocks[id]; ok {
+		return s.blockJSON(b)
+	}
+	return s.pageBlockJSON(s.pages[id])
+}
+
+func (s *Server) listChildren(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	if !s.isBlockParent(id) {
+		return nil, notFound("block", id)
+	}
+	size, cursor, err := pageParams(r, body)
+	if err != nil {
+		return nil, err
+	}
+	ids, next, err := paginate(s.liveChildren(id), size, cursor)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]any, len(ids))
+	for i, child := range ids {
+		results[i] = s.childJSON(child)
+	}
+	return listJSON(results, next, "block"), nil
+}
+
+func (s *Server) appendChildren(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	parent := parentRef{Type: "block_id", ID: id}
+	if p, ok := s.pages[id]; ok {
+		if p.inTrash {
+			return nil, validationError("Can't edit block that is archived. You must unarchive the block before editing.")
+		}
+		parent.Type = "page_id"
+	} else if b, ok := s.blocks[id]; ok {
+		if b.inTrash {
+			return nil, validationError("Can't edit block that is archived. You must unarchive the block before editing.")
+		}
+	} else {
+		return nil, notFound("block", id)
+	}
+
+	v, ok := body["children"]
+	if !ok {
+		return nil, validationError("body.children should be defined, instead was `undefined`.")
+	}
+	blocks, err := parseBlocks(v, "body.children", 0, new(int))
+	if err != nil {
+		return nil, err
+	}
+	at := -1
+	if after, ok := body["after"].(string); ok {
+		after = normalizeID(after)
+		at = slices.Index(s.children[id], after)
+		if at < 0 || !slices.Contains(s.liveChildren(id), after) {
+			return nil, validationError("body.after should be the ID of a child of the block, instead was `%s`.", after)
+		}
+		at++
+	}
+
+	created := s.insertBlocks(parent, blocks, at)
+	s.touch(id, s.now())
+	results := make([]any, len(created))
+	for i, b := range created {
+		results[i] = s.blockJSON(b)
+	}
+	return listJSON(results, "", "block"), nil
+}
+
+func (s *Server) getDatabase(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	db, ok := s.dbs[id]
+	if !ok {
+		return nil, notFound("database", id)
+	}
+	return s.databaseJSON(db), nil
+}
+
+func (s *Server) getDataSource(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	ds, ok := s.sources[id]
+	if !ok {
+		return nil, notFound("data_source", id)
+	}
+	return s.dataSourceJSON(ds), nil
+}
+
+// queryDataSource lists the pages of a data source, most recently edited
+// first. Filters and sorts are not supported.
+func (s *Server) queryDataSource(r *http.Request, body map[string]any) (any, *apiError) {
+	id := normalizeID(r.PathValue("id"))
+	if _, ok := s.sources[id]; !ok {
+		return nil, notFound("data_source", id)
+	}
+	size, cursor, err := pageParams(r, body)
+	if err != nil {
+		return nil, err
+	}
+	var pages []*page
+	for _, p := range s.pages {
+		if p.parent.Type == "data_source_id" && p.parent.ID == id && !p.inTrash {
+			pages = append(pages, p)
+		}
+	}
+	slices.SortFunc(pages, func(a, b *page) int {
+		return cmp.Or(b.edited.Compare(a.edited), strings.Compare(a.id, b.id))
+	})
+	ids := make([]string, len(pages))
+	for i, p := range pages {
+		ids[i] = p.id
+	}
+	ids, next, err := paginate(ids, size, cursor)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]any, len(ids))
+	for i, id := range ids {
+		results[i] = s.pageJSON(s.pages[id])
+	}
+	return listJSON(results, next, "page_or_data_source"), nil
+}
+
+// newBlock is a validated block from a request.
+type newBlock struct {
+	typ      string
+	data     map[string]any
+	children []*newBlock
+}
+
+// parseBlocks validates a children array from a request. depth is the
+// nesting level of the array, with 0 for the top level, and count the number
+// of blocks seen so far in the request.
+func parseBlocks(v any, path string, depth int, count *int) ([]*newBlock, *apiError) {
+	items, ok := v.([]any)
+	if !ok {
+		return nil, validationError("%s should be an array, instead was `%v`.", path, v)
+	}
+	if len(items) > MaxChildren {
+		return nil, validationError("%s.length should be ≤ `%d`, instead was `%d`.", path, MaxChildren, len(items))
+	}
+	blocks := make([]*newBlock, len(items))
+	for i, item := range items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		*count++
+		if *count > MaxBlocksPerRequest {
+			return nil, validationError("Request body may contain at most %d blocks.", MaxBlocksPerRequest)
+		}
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, validationError("%s should be an object.", itemPath)
+		}
+		typ, _ := m["type"].(string)
+		if typ == "" {
+			for key := range m {
+				if key != "object" {
+					typ = key
+				}
+			}
+		}
+		if !blockTypes[typ] {
+			return nil, validationError("%s.%s should be not present, instead was `%v`.", itemPath, typ, m[typ])
+		}
+		data, ok := m[typ].(map[string]any)
+		if !ok {
+			return nil, validationError("%s.%s should be defined, instead was `undefined`.", itemPath, typ)
+		}
+		data = maps.Clone(data)
+		if err := normalizeBlockData(typ, data, itemPath+"."+typ); err != nil {
+			return nil, err
+		}
+		b := &newBlock{typ: typ, data: data}
+		if children, ok := data["children"]; ok {
+			delete(data, "children")
+			if depth >= MaxNestingDepth {
+				return nil, validationError("%s.%s.children should be not present, instead was `%v`. Blocks may be nested at most %d levels deep in a single request.", itemPath, typ, children, MaxNestingDepth)
+			}
+			var err *apiError
+			if b.children, err = parseBlocks(children, itemPath+"."+typ+".children", depth+1, count); err != nil {
+				return nil, err
+			}
+		}
+		if typ == "table" {
+			width, _ := data["table_width"].(float64)
+			if len(b.children) == 0 {
+				return nil, validationError("%s.table.children should be defined, instead was `undefined`.", itemPath)
+			}
+			for j, row := range b.children {
+				cells, _ := row.data["cells"].([]any)
+				if row.typ != "table_row" || len(cells) != int(width) {
+					return nil, validationError("%s.table.children[%d] should be a table_row with %d cells.", itemPath, j, int(width))
+				}
+			}
+		}
+		blocks[i] = b
+	}
+	return blocks, nil
+}
+
+// normalizeBlockData validates and normalizes the rich text in a block's
+// type-specific data.
+func normalizeBlockData(typ string, data map[string]any, path string) *apiError {
+	for _, key := range []string{"rich_text", "caption"} {
+		if v, ok := data[key]; ok {
+			rt, err := normalizeRichText(v, path+"."+key)
+			if err != nil {
+				return err
+			}
+			data[key] = rt
+		}
+	}
+	if typ == "table_row" {
+		cells, ok := data["cells"].([]any)
+		if !ok {
+			return validationError("%s.cells should be an array.", path)
+		}
+		cells = slices.Clone(cells)
+		for i, cell := range cells {
+			rt, err := normalizeRichText(cell, fmt.Sprintf("%s.cells[%d]", path, i))
+			if err != nil {
+				return err
+			}
+			cells[i] = rt
+		}
+		data["cells"] = cells
+	}
+	return nil
+}
+
+// insertBlocks creates blocks under parent, at position at among its
+// children or at the end if at is negative, and returns the top-level blocks.
+// s.mu must be held.
+func (s *Server) insertBlocks(parent parentRef, blocks []*newBlock, at int) []*block {
+	now := s.now()
+	created := make([]*block, len(blocks))
+	ids := make([]string, len(blocks))
+	for i, nb := range blocks {
+		b := &block{id: s.newID(), parent: parent, typ: nb.typ, data: nb.data, created: now, edited: now}
+		s.blocks[b.id] = b
+		created[i], ids[i] = b, b.id
+		s.insertBlocks(parentRef{Type: "block_id", ID: b.id}, nb.children, -1)
+	}
+	siblings := s.children[parent.ID]
+	if at < 0 || at > len(siblings) {
+		at = len(siblings)
+	}
+	s.children[parent.ID] = slices.Insert(siblings, at, ids...)
+	return created
+}
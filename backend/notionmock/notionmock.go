@@ -0,0 +1,263 @@
+// Package notionmock is an in-memory stand-in for the Notion API, for tests
+// and for running the app without a Notion workspace.
+//
+// A Server keeps a workspace of pages, databases, data sources and blocks,
+// and serves the parts of the API the app uses: search, retrieving pages,
+// databases and data sources, querying data sources, and reading, appending,
+// updating and deleting blocks. Requests are checked against Notion's
+// documented limits, results are paginated as Notion paginates them, and
+// each token is rate limited with 429 responses. The OAuth authorize and
+// token endpoints complete immediately, without a consent screen.
+package notionmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notion API limits enforced by the mock.
+const (
+	// MaxPageSize is the largest page_size accepted by paginated endpoints.
+	MaxPageSize = 100
+	// MaxChildren is the maximum number of blocks in a children array.
+	MaxChildren = 100
+	// MaxNestingDepth is the number of levels of children a single request
+	// may carry below its top-level blocks.
+	MaxNestingDepth = 2
+	// MaxBlocksPerRequest is the maximum number of blocks in one request.
+	MaxBlocksPerRequest = 1000
+	// MaxTextLength is the maximum length of a rich text item's content, in
+	// UTF-16 code units.
+	MaxTextLength = 2000
+	// MaxRichText is the maximum number of items in a rich text array.
+	MaxRichText = 100
+	// MaxBodyBytes is the maximum size of a request body.
+	MaxBodyBytes = 500 * 1000
+)
+
+// RequestIDHeader is the response header carrying the ID of an API request.
+// Error bodies also carry it, as request_id.
+const RequestIDHeader = "X-Notion-Request-Id"
+
+// Options configure a Server.
+type Options struct {
+	// Tokens are accepted as bearer tokens, in addition to the tokens issued
+	// through OAuth.
+	Tokens []string
+	// ClientID and ClientSecret are the OAuth client credentials. If
+	// ClientID is empty, any client is accepted.
+	ClientID     string
+	ClientSecret string
+	// RateLimit is the average number of requests per second allowed for
+	// each token, and Burst the number allowed at once. A zero RateLimit
+	// disables rate limiting.
+	RateLimit float64
+	Burst     int
+}
+
+// Server is a mock Notion API server. It implements http.Handler.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+	now  func() time.Time
+
+	mu      sync.Mutex
+	nextID  int
+	pages   map[string]*page
+	dbs     map[string]*database
+	sources map[string]*dataSource
+	blocks  map[string]*block
+	// children lists the child block IDs of each page and block, in order.
+	children map[string][]string
+
+	tokens    map[string]bool
+	codes     map[string]*authCode
+	refresh   map[string]bool
+	buckets   map[string]*bucket
+	forced429 int
+	requests  int
+}
+
+// New creates a server with an empty workspace.
+func New(opts Options) *Server {
+	s := &Server{
+		opts:     opts,
+		mux:      http.NewServeMux(),
+		now:      time.Now,
+		pages:    make(map[string]*page),
+		dbs:      make(map[string]*database),
+		sources:  make(map[string]*dataSource),
+		blocks:   make(map[string]*block),
+		children: make(map[string][]string),
+		tokens:   make(map[string]bool),
+		codes:    make(map[string]*authCode),
+		refresh:  make(map[string]bool),
+		buckets:  make(map[string]*bucket),
+	}
+	for _, token := range opts.Tokens {
+		s.tokens[token] = true
+	}
+
+	s.mux.HandleFunc("GET /v1/oauth/authorize", s.authorize)
+	s.mux.HandleFunc("POST /v1/oauth/token", s.token)
+
+	s.handle("POST /v1/search", s.search)
+	s.handle("GET /v1/users/me", s.me)
+	s.handle("GET /v1/users", s.listUsers)
+	s.handle("GET /v1/users/{id}", s.getUser)
+	s.handle("POST /v1/pages", s.createPage)
+	s.handle("GET /v1/pages/{id}", s.getPage)
+	s.handle("PATCH /v1/pages/{id}", s.updatePage)
+	s.handle("GET /v1/blocks/{id}", s.getBlock)
+	s.handle("PATCH /v1/blocks/{id}", s.updateBlock)
+	s.handle("DELETE /v1/blocks/{id}", s.deleteBlock)
+	s.handle("GET /v1/blocks/{id}/children", s.listChildren)
+	s.handle("PATCH /v1/blocks/{id}/children", s.appendChildren)
+	s.handle("GET /v1/databases/{id}", s.getDatabase)
+	s.handle("GET /v1/data_sources/{id}", s.getDataSource)
+	s.handle("POST /v1/data_sources/{id}/query", s.queryDataSource)
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, &apiError{http.StatusBadRequest, "invalid_request_url", "Invalid request URL."})
+	})
+	return s
+}
+
+// ServeHTTP serves a Notion API request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// RateLimitNext makes the next n API requests fail with 429, regardless of
+// the rate limit.
+func (s *Server) RateLimitNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forced429 = n
+}
+
+// apiError is an error response in Notion's format.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+func notFound(kind, id string) *apiError {
+	return &apiError{http.StatusNotFound, "object_not_found", fmt.Sprintf("Could not find %s with ID: %s. Make sure the relevant pages and databases are shared with your integration.", kind, id)}
+}
+
+func validationError(format string, args ...any) *apiError {
+	return &apiError{http.StatusBadRequest, "validation_error", fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response, including the request ID if one
+// has been assigned.
+func writeError(w http.ResponseWriter, err *apiError) {
+	body := map[string]any{
+		"object":  "error",
+		"status":  err.Status,
+		"code":    err.Code,
+		"message": err.Message,
+	}
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	writeJSON(w, err.Status, body)
+}
+
+// apiHandler serves an API request with the workspace locked. body is the
+// decoded JSON request body, or nil if there was none.
+type apiHandler func(r *http.Request, body map[string]any) (any, *apiError)
+
+// handle registers an API endpoint. Requests must carry a known bearer token
+// and a Notion-Version header, and are subject to the rate limit.
+func (s *Server) handle(pattern string, h apiHandler) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.requests++
+		w.Header().Set(RequestIDHeader, fmt.Sprintf("%08x-0000-4000-8000-%012x", 0xfeed, s.requests))
+
+		if !ok || !s.tokens[token] {
+			writeError(w, &apiError{http.StatusUnauthorized, "unauthorized", "API token is invalid."})
+			return
+		}
+		if r.Header.Get("Notion-Version") == "" {
+			writeError(w, &apiError{http.StatusBadRequest, "missing_version", "Notion-Version header failed validation: Notion-Version header should be defined."})
+			return
+		}
+		if wait := s.limit(token); wait > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+			writeError(w, &apiError{http.StatusTooManyRequests, "rate_limited", "You have been rate limited. Please try again in a few minutes."})
+			return
+		}
+
+		var body map[string]any
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+		if err != nil {
+			writeError(w, &apiError{http.StatusRequestEntityTooLarge, "validation_error", "Request body too large."})
+			return
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &body); err != nil {
+				writeError(w, &apiError{http.StatusBadRequest, "invalid_json", "Error parsing JSON body."})
+				return
+			}
+		}
+
+		result, apiErr := h(r, body)
+		if apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+}
+
+// bucket is a token's rate limit state.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limit takes a request from token's bucket, returning how long to wait
+// before retrying if the bucket is empty. s.mu must be held.
+func (s *Server) limit(token string) time.Duration {
+	if s.forced429 > 0 {
+		s.forced429--
+		return time.Second
+	}
+	if s.opts.RateLimit <= 0 {
+		return 0
+	}
+	burst := float64(max(1, s.opts.Burst))
+	now := s.now()
+	b, ok := s.buckets[token]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		s.buckets[token] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*s.opts.RateLimit)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / s.opts.RateLimit * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
@@ -0,0 +1,350 @@
+package notionmock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// call sends an API request to s and decodes the JSON response.
+func call(t *testing.T, s *Server, method, path, token string, body any) (int, map[string]any) {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Notion-Version", "2025-09-03")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	var out map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s %s: invalid JSON response %q", method, path, rec.Body.String())
+	}
+	return rec.Code, out
+}
+
+func paragraph(s string) map[string]any {
+	return map[string]any{"type": "paragraph", "paragraph": map[string]any{
+		"rich_text": []any{map[string]any{"type": "text", "text": map[string]any{"content": s}}},
+	}}
+}
+
+func toggle(children ...any) map[string]any {
+	return withChildren(map[string]any{"type": "toggle", "toggle": map[string]any{"rich_text": []any{}}}, children...)
+}
+
+// withChildren adds children to a block.
+func withChildren(block map[string]any, children ...any) map[string]any {
+	if len(children) > 0 {
+		block[block["type"].(string)].(map[string]any)["children"] = children
+	}
+	return block
+}
+
+func TestAuthentication(t *testing.T) {
+	s := New(Options{Tokens: []string{"tok"}})
+
+	if status, body := call(t, s, "GET", "/v1/users/me", "wrong", nil); status != http.StatusUnauthorized || body["code"] != "unauthorized" {
+		t.Errorf("Expected 401 unauthorized, got %d %v", status, body)
+	}
+
+	req := httptest.NewRequest("GET", "/v1/users/me", nil)
+	req.Header.Set("Authorization", "Bearer tok")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing_version") {
+		t.Errorf("Expected missing_version, got %d %s", rec.Code, rec.Body)
+	}
+
+	if status, body := call(t, s, "GET", "/v1/users/me", "tok", nil); status != http.StatusOK || body["type"] != "bot" {
+		t.Errorf("Expected the bot user, got %d %v", status, body)
+	}
+	if status, body := call(t, s, "GET", "/v1/comments", "tok", nil); status != http.StatusBadRequest || body["code"] != "invalid_request_url" {
+		t.Errorf("Expected invalid_request_url, got %d %v", status, body)
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	s := New(Options{Tokens: []string{"tok"}})
+	for range 5 {
+		s.AddPage("", "Standup")
+	}
+	s.AddPage("", "Retro")
+	s.AddDatabase(s.AddPage("", "Team"), "Standup notes", nil)
+
+	var ids []string
+	body := map[string]any{"query": "standup", "page_size": 2, "filter": map[string]any{"property": "object", "value": "page"}}
+	for {
+		status, resp := call(t, s, "POST", "/v1/search", "tok", body)
+		if status != http.StatusOK {
+			t.Fatalf("Search failed: %d %v", status, resp)
+		}
+		for _, r := range resp["results"].([]any) {
+			ids = append(ids, r.(map[string]any)["id"].(string))
+		}
+		if resp["has_more"] != true {
+			break
+		}
+		body["start_cursor"] = resp["next_cursor"]
+	}
+	if len(ids) != 5 {
+		t.Errorf("Expected the 5 matching pages, got %v", ids)
+	}
+
+	status, resp := call(t, s, "POST", "/v1/search", "tok", map[string]any{"query": "standup", "filter": map[string]any{"property": "object", "value": "data_source"}})
+	if results := resp["results"].([]any); status != http.StatusOK || len(results) != 1 || results[0].(map[string]any)["object"] != "data_source" {
+		t.Errorf("Expected the data source, got %d %v", status, resp)
+	}
+
+	if status, resp := call(t, s, "POST", "/v1/search", "tok", map[string]any{"page_size": 101}); status != http.StatusBadRequest || resp["code"] != "validation_error" {
+		t.Errorf("Expected page_size to be limited, got %d %v", status, resp)
+	}
+	if status, _ := call(t, s, "POST", "/v1/search", "tok", map[string]any{"start_cursor": "bogus"}); status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid cursor to fail, got %d", status)
+	}
+}
+
+func TestBlockChildren(t *testing.T) {
+	s := New(Options{Tokens: []string{"tok"}})
+	pageID := s.AddPage("", "Notes")
+	path := "/v1/blocks/" + strings.ReplaceAll(pageID, "-", "") + "/children"
+
+	// Limits are enforced before anything is created.
+	tooMany := make([]any, MaxChildren+1)
+	for i := range tooMany {
+		tooMany[i] = paragraph("x")
+	}
+	for name, children := range map[string][]any{
+		"too many children":  tooMany,
+		"too deep":           {toggle(toggle(toggle(paragraph("x"))))},
+		"long text":          {paragraph(strings.Repeat("a", MaxTextLength+1))},
+		"unknown type":       {map[string]any{"type": "widget", "widget": map[string]any{}}},
+		"table without rows": {map[string]any{"type": "table", "table": map[string]any{"table_width": 2}}},
+	} {
+		if status, resp := call(t, s, "PATCH", path, "tok", map[string]any{"children": children}); status != http.StatusBadRequest || resp["code"] != "validation_error" {
+			t.Errorf("%s: expected validation_error, got %d %v", name, status, resp)
+		}
+	}
+	if got := s.Children(pageID); len(got) != 0 {
+		t.Fatalf("Expected no blocks after failed requests, got %d", len(got))
+	}
+
+	// Two levels of nesting are allowed.
+	nested := withChildren(paragraph("1"), toggle(toggle()))
+	status, resp := call(t, s, "PATCH", path, "tok", map[string]any{"children": []any{nested, paragraph("3")}})
+	if status != http.StatusOK {
+		t.Fatalf("Append failed: %d %v", status, resp)
+	}
+	results := resp["results"].([]any)
+	first := results[0].(map[string]any)
+	if len(results) != 2 || first["has_children"] != true {
+		t.Fatalf("Expected the two top-level blocks, got %v", results)
+	}
+	rt := first["paragraph"].(map[string]any)["rich_text"].([]any)[0].(map[string]any)
+	if rt["plain_text"] != "1" || rt["annotations"].(map[string]any)["color"] != "default" {
+		t.Errorf("Expected rich text to be filled in, got %v", rt)
+	}
+
+	// Insert after the first block.
+	status, _ = call(t, s, "PATCH", path, "tok", map[string]any{"children": []any{paragraph("2")}, "after": first["id"]})
+	if status != http.StatusOK {
+		t.Fatalf("Append after failed: %d", status)
+	}
+	if status, _ := call(t, s, "PATCH", path, "tok", map[string]any{"children": []any{paragraph("x")}, "after": pageID}); status != http.StatusBadRequest {
+		t.Errorf("Expected after to require a child block, got %d", status)
+	}
+
+	// Pagination uses block IDs as cursors, and trashed blocks are skipped.
+	var texts []string
+	next := ""
+	for {
+		u := path + "?page_size=1"
+		if next != "" {
+			u += "&start_cursor=" + next
+		}
+		status, resp := call(t, s, "GET", u, "tok", nil)
+		if status != http.StatusOK {
+			t.Fatalf("List failed: %d %v", status, resp)
+		}
+		for _, r := range resp["results"].([]any) {
+			block := r.(map[string]any)
+			texts = append(texts, block["paragraph"].(map[string]any)["rich_text"].([]any)[0].(map[string]any)["plain_text"].(string))
+		}
+		if resp["has_more"] != true {
+			break
+		}
+		next = resp["next_cursor"].(string)
+	}
+	if got := strings.Join(texts, ","); got != "1,2,3" {
+		t.Errorf("Expected blocks in order, got %s", got)
+	}
+
+	if status, _ := call(t, s, "DELETE", "/v1/blocks/"+first["id"].(string), "tok", nil); status != http.StatusOK {
+		t.Errorf("Delete failed: %d", status)
+	}
+	if status, resp := call(t, s, "DELETE", "/v1/blocks/"+first["id"].(string), "tok", nil); status != http.StatusBadRequest {
+		t.Errorf("Expected deleting a trashed block to fail, got %d %v", status, resp)
+	}
+	if _, resp := call(t, s, "GET", path, "tok", nil); len(resp["results"].([]any)) != 2 {
+		t.Errorf("Expected the trashed block to be hidden, got %v", resp["results"])
+	}
+	if status, _ := call(t, s, "GET", "/v1/blocks/00000000-0000-4000-8000-0000000000ff/children", "tok", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown block, got %d", status)
+	}
+}
+
+func TestPagesAndDataSources(t *testing.T) {
+	s := New(Options{Tokens: []string{"tok"}})
+	team := s.AddPage("", "Team")
+	dbID, dsID := s.AddDatabase(team, "Meetings", map[string]any{"Date": map[string]any{"date": map[string]any{}}})
+
+	status, db := call(t, s, "GET", "/v1/databases/"+dbID, "tok", nil)
+	if sources := db["data_sources"].([]any); status != http.StatusOK || len(sources) != 1 || sources[0].(map[string]any)["id"] != dsID {
+		t.Fatalf("Unexpected database %d %v", status, db)
+	}
+
+	title := map[string]any{"title": []any{map[string]any{"text": map[string]any{"content": "Standup"}}}}
+	status, page := call(t, s, "POST", "/v1/pages", "tok", map[string]any{
+		"parent":     map[string]any{"database_id": dbID},
+		"properties": map[string]any{"Name": title, "Date": map[string]any{"date": map[string]any{"start": "2026-01-02"}}},
+		"children":   []any{paragraph("hello")},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Create failed: %d %v", status, page)
+	}
+	if parent := page["parent"].(map[string]any); parent["data_source_id"] != dsID {
+		t.Errorf("Expected the page in the data source, got %v", parent)
+	}
+	if got := s.Children(page["id"].(string)); len(got) != 1 {
+		t.Errorf("Expected the page's content, got %v", got)
+	}
+
+	if status, resp := call(t, s, "POST", "/v1/pages", "tok", map[string]any{
+		"parent":     map[string]any{"data_source_id": dsID},
+		"properties": map[string]any{"Status": map[string]any{"select": map[string]any{"name": "Done"}}},
+	}); status != http.StatusBadRequest || !strings.Contains(resp["message"].(string), "Status is not a property") {
+		t.Errorf("Expected an unknown property to fail, got %d %v", status, resp)
+	}
+	if status, _ := call(t, s, "POST", "/v1/pages", "tok", map[string]any{
+		"parent":     map[string]any{"page_id": team},
+		"properties": map[string]any{"Date": map[string]any{"date": nil}},
+	}); status != http.StatusBadRequest {
+		t.Errorf("Expected pages under pages to only have a title, got %d", status)
+	}
+
+	status, resp := call(t, s, "POST", "/v1/data_sources/"+dsID+"/query", "tok", map[string]any{})
+	if results := resp["results"].([]any); status != http.StatusOK || len(results) != 1 || results[0].(map[string]any)["id"] != page["id"] {
+		t.Errorf("Expected the query to find the page, got %d %v", status, resp)
+	}
+
+	if status, _ := call(t, s, "PATCH", "/v1/pages/"+page["id"].(string), "tok", map[string]any{"in_trash": true}); status != http.StatusOK {
+		t.Errorf("Trash failed: %d", status)
+	}
+	if status, _ := call(t, s, "PATCH", "/v1/pages/"+page["id"].(string), "tok", map[string]any{"properties": map[string]any{"Name": title}}); status != http.StatusBadRequest {
+		t.Errorf("Expected editing a trashed page to fail, got %d", status)
+	}
+	if got := s.Page(page["id"].(string)); got["in_trash"] != true {
+		t.Errorf("Expected the page in the trash, got %v", got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := New(Options{Tokens: []string{"a", "b"}, RateLimit: 1, Burst: 2})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	for i := range 2 {
+		if status, _ := call(t, s, "GET", "/v1/users/me", "a", nil); status != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i, status)
+		}
+	}
+	req := httptest.NewRequest("GET", "/v1/users/me", nil)
+	req.Header.Set("Authorization", "Bearer a")
+	req.Header.Set("Notion-Version", "2025-09-03")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Tokens are limited separately, and buckets refill.
+	if status, _ := call(t, s, "GET", "/v1/users/me", "b", nil); status != http.StatusOK {
+		t.Errorf("Expected another token to be allowed, got %d", status)
+	}
+	now = now.Add(time.Second)
+	if status, _ := call(t, s, "GET", "/v1/users/me", "a", nil); status != http.StatusOK {
+		t.Errorf("Expected the bucket to refill, got %d", status)
+	}
+
+	s.RateLimitNext(1)
+	if status, resp := call(t, s, "GET", "/v1/users/me", "b", nil); status != http.StatusTooManyRequests || resp["code"] != "rate_limited" {
+		t.Errorf("Expected a forced 429, got %d %v", status, resp)
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	s := New(Options{ClientID: "client", ClientSecret: "secret"})
+	verifier := "verifier-0123456789-0123456789-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+
+	q := url.Values{
+		"client_id":             {"client"},
+		"redirect_uri":          {"http://app.test/auth/callback/notion"},
+		"response_type":         {"code"},
+		"owner":                 {"user"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/oauth/authorize?"+q.Encode(), nil))
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil || loc.Host != "app.test" || loc.Query().Get("state") != "xyz" {
+		t.Fatalf("Expected a redirect to the app, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	code := loc.Query().Get("code")
+
+	exchange := func(form url.Values, user, pass string) (int, map[string]any) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/v1/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(user, pass)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var out map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &out)
+		return rec.Code, out
+	}
+
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": q["redirect_uri"], "code_verifier": {verifier}}
+	if status, resp := exchange(form, "client", "wrong"); status != http.StatusUnauthorized || resp["error"] != "invalid_client" {
+		t.Errorf("Expected invalid_client, got %d %v", status, resp)
+	}
+	status, token := exchange(form, "client", "secret")
+	if status != http.StatusOK {
+		t.Fatalf("Token exchange failed: %d %v", status, token)
+	}
+	if status, _ := exchange(form, "client", "secret"); status != http.StatusBadRequest {
+		t.Errorf("Expected a code to be single use, got %d", status)
+	}
+	if status, _ := call(t, s, "GET", "/v1/users/me", token["access_token"].(string), nil); status != http.StatusOK {
+		t.Errorf("Expected the issued token to be accepted, got %d", status)
+	}
+
+	status, refreshed := exchange(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {token["refresh_token"].(string)}}, "client", "secret")
+	if status != http.StatusOK || refreshed["access_token"] == token["access_token"] {
+		t.Errorf("Expected a new access token, got %d %v", status, refreshed)
+	}
+}
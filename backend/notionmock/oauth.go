@@ -0,0 +1,135 @@
+package notionmock
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// authCode is an authorization code issued by the authorize endpoint.
+type authCode struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+}
+
+// randomToken returns a random token with the given prefix.
+func randomToken(prefix string) string {
+	return prefix + rand.Text()
+}
+
+// authorize approves an authorization request immediately, redirecting to
+// redirect_uri with a code and the request's state.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	clientID := q.Get("client_id")
+	if s.opts.ClientID != "" && clientID != s.opts.ClientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+
+	params := redirect.Query()
+	if q.Get("response_type") != "code" {
+		params.Set("error", "unsupported_response_type")
+	} else {
+		code := randomToken("code_")
+		s.mu.Lock()
+		s.codes[code] = &authCode{clientID: clientID, redirectURI: q.Get("redirect_uri"), codeChallenge: q.Get("code_challenge")}
+		s.mu.Unlock()
+		params.Set("code", code)
+	}
+	if state := q.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]any{"error": code, "error_description": description})
+}
+
+// token exchanges an authorization code or refresh token for an access token.
+// Parameters may be sent as JSON, as Notion documents, or form encoded, and
+// client credentials in a Basic Authorization header or the parameters.
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]string)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid JSON body.")
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid form body.")
+			return
+		}
+		for key := range r.PostForm {
+			params[key] = r.PostForm.Get(key)
+		}
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = params["client_id"], params["client_secret"]
+	}
+	if s.opts.ClientID != "" && (clientID != s.opts.ClientID || clientSecret != s.opts.ClientSecret) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch params["grant_type"] {
+	case "authorization_code":
+		code, ok := s.codes[params["code"]]
+		delete(s.codes, params["code"])
+		if !ok || code.clientID != clientID {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code.")
+			return
+		}
+		if params["redirect_uri"] != "" && params["redirect_uri"] != code.redirectURI {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid redirect_uri.")
+			return
+		}
+		if code.codeChallenge != "" {
+			sum := sha256.Sum256([]byte(params["code_verifier"]))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != code.codeChallenge {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier.")
+				return
+			}
+		}
+	case "refresh_token":
+		if !s.refresh[params["refresh_token"]] {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token.")
+			return
+		}
+		delete(s.refresh, params["refresh_token"])
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type.")
+		return
+	}
+
+	access, refresh := randomToken("ntn_mock_"), randomToken("nrt_mock_")
+	s.tokens[access] = true
+	s.refresh[refresh] = true
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token":           access,
+		"token_type":             "bearer",
+		"refresh_token":          refresh,
+		"bot_id":                 botUserID,
+		"workspace_id":           workspaceID,
+		"workspace_name":         "Mock workspace",
+		"workspace_icon":         nil,
+		"owner":                  map[string]any{"type": "user", "user": personJSON()},
+		"duplicated_template_id": nil,
+	})
+}
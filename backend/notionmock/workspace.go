@@ -0,0 +1,480 @@
+package notionmock
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// timeFormat is the format of Notion's timestamps.
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// botUserID and personUserID are the users of the mock workspace.
+const (
+	botUserID    = "b0000000-0000-4000-8000-000000000001"
+	personUserID = "a0000000-0000-4000-8000-000000000001"
+	workspaceID  = "c0000000-0000-4000-8000-000000000001"
+)
+
+// parentRef is the parent of a page, database or block.
+type parentRef struct {
+	// Type is "workspace", "page_id", "block_id" or "data_source_id".
+	Type string
+	ID   string
+	// DatabaseID is the database of a data_source_id parent.
+	DatabaseID string
+}
+
+func (p parentRef) json() map[string]any {
+	switch p.Type {
+	case "workspace":
+		return map[string]any{"type": "workspace", "workspace": true}
+	case "data_source_id":
+		return map[string]any{"type": "data_source_id", "data_source_id": p.ID, "database_id": p.DatabaseID}
+	}
+	return map[string]any{"type": p.Type, p.Type: p.ID}
+}
+
+type page struct {
+	id         string
+	parent     parentRef
+	properties map[string]any
+	created    time.Time
+	edited     time.Time
+	inTrash    bool
+}
+
+type database struct {
+	id      string
+	parent  parentRef
+	title   []any
+	sources []string
+	created time.Time
+	edited  time.Time
+	inTrash bool
+}
+
+type dataSource struct {
+	id         string
+	databaseID string
+	title      []any
+	properties map[string]any
+	created    time.Time
+	edited     time.Time
+}
+
+type block struct {
+	id      string
+	parent  parentRef
+	typ     string
+	data    map[string]any
+	created time.Time
+	edited  time.Time
+	inTrash bool
+}
+
+// newID returns a new object ID. IDs are sequential so that tests are
+// deterministic. s.mu must be held.
+func (s *Server) newID() string {
+	s.nextID++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012x", s.nextID)
+}
+
+// normalizeID returns id in the dashed form used by the workspace. Notion
+// accepts IDs with or without dashes.
+func normalizeID(id string) string {
+	compact := strings.ToLower(strings.ReplaceAll(id, "-", ""))
+	if len(compact) != 32 {
+		return id
+	}
+	return compact[:8] + "-" + compact[8:12] + "-" + compact[12:16] + "-" + compact[16:20] + "-" + compact[20:]
+}
+
+func userJSON(id string) map[string]any {
+	return map[string]any{"object": "user", "id": id}
+}
+
+func botJSON() map[string]any {
+	return map[string]any{
+		"object": "user",
+		"id":     botUserID,
+		"type":   "bot",
+		"name":   "mtranscribe (mock)",
+		"bot": map[string]any{
+			"owner":          map[string]any{"type": "workspace", "workspace": true},
+			"workspace_name": "Mock workspace",
+		},
+	}
+}
+
+func personJSON() map[string]any {
+	return map[string]any{
+		"object":     "user",
+		"id":         personUserID,
+		"type":       "person",
+		"name":       "Mock User",
+		"avatar_url": nil,
+		"person":     map[string]any{"email": "user@example.com"},
+	}
+}
+
+// plainText concatenates the plain text of normalized rich text.
+func plainText(rt []any) string {
+	var b strings.Builder
+	for _, item := range rt {
+		if m, ok := item.(map[string]any); ok {
+			s, _ := m["plain_text"].(string)
+			b.WriteString(s)
+		}
+	}
+	return b.String()
+}
+
+// text returns rich text holding s.
+func text(s string) []any {
+	rt, _ := normalizeRichText([]any{map[string]any{"text": map[string]any{"content": s}}}, "text")
+	return rt
+}
+
+// normalizeRichText validates a rich text array from a request and fills in
+// the fields Notion adds to responses.
+func normalizeRichText(v any, path string) ([]any, *apiError) {
+	items, ok := v.([]any)
+	if !ok {
+		return nil, validationError("%s should be an array, instead was `%v`.", path, v)
+	}
+	if len(items) > MaxRichText {
+		return nil, validationError("%s.length should be ≤ `%d`, instead was `%d`.", path, MaxRichText, len(items))
+	}
+	out := make([]any, len(items))
+	for i, v := range items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		item, ok := v.(map[string]any)
+		if !ok {
+			return nil, validationError("%s should be an object.", itemPath)
+		}
+		item = maps.Clone(item)
+		typ, _ := item["type"].(string)
+		if typ == "" {
+			typ = "text"
+		}
+		item["type"] = typ
+
+		annotations := map[string]any{"bold": false, "italic": false, "strikethrough": false, "underline": false, "code": false, "color": "default"}
+		if a, ok := item["annotations"].(map[string]any); ok {
+			maps.Copy(annotations, a)
+		}
+		item["annotations"] = annotations
+
+		if typ == "text" {
+			t, ok := item["text"].(map[string]any)
+			if !ok {
+				return nil, validationError("%s.text should be defined, instead was `undefined`.", itemPath)
+			}
+			content, ok := t["content"].(string)
+			if !ok {
+				return nil, validationError("%s.text.content should be a string.", itemPath)
+			}
+			if n := len(utf16.Encode([]rune(content))); n > MaxTextLength {
+				return nil, validationError("%s.text.content.length should be ≤ `%d`, instead was `%d`.", itemPath, MaxTextLength, n)
+			}
+			t = maps.Clone(t)
+			var href any
+			if link, ok := t["link"].(map[string]any); ok {
+				href = link["url"]
+			} else {
+				t["link"] = nil
+			}
+			item["text"] = t
+			item["plain_text"] = content
+			item["href"] = href
+		} else if _, ok := item["plain_text"].(string); !ok {
+			item["plain_text"] = ""
+		}
+		out[i] = item
+	}
+	return out, nil
+}
+
+// title returns the page's title.
+func (p *page) title() string {
+	for _, v := range p.properties {
+		if prop, ok := v.(map[string]any); ok && prop["type"] == "title" {
+			rt, _ := prop["title"].([]any)
+			return plainText(rt)
+		}
+	}
+	return ""
+}
+
+func (s *Server) pageJSON(p *page) map[string]any {
+	slug := strings.Join(strings.Fields(p.title()), "-")
+	url := "https://www.notion.so/" + strings.ReplaceAll(p.id, "-", "")
+	if slug != "" {
+		url = "https://www.notion.so/" + slug + "-" + strings.ReplaceAll(p.id, "-", "")
+	}
+	return map[string]any{
+		"object":           "page",
+		"id":               p.id,
+		"created_time":     p.created.UTC().Format(timeFormat),
+		"last_edited_time": p.edited.UTC().Format(timeFormat),
+		"created_by":       userJSON(botUserID),
+		"last_edited_by":   userJSON(botUserID),
+		"cover":            nil,
+		"icon":             nil,
+		"parent":           p.parent.json(),
+		"archived":         p.inTrash,
+		"in_trash":         p.inTrash,
+		"properties":       p.properties,
+		"url":              url,
+		"public_url":       nil,
+	}
+}
+
+func (s *Server) databaseJSON(db *database) map[string]any {
+	sources := make([]any, 0, len(db.sources))
+	for _, id := range db.sources {
+		sources = append(sources, map[string]any{"id": id, "name": plainText(s.sources[id].title)})
+	}
+	return map[string]any{
+		"object":           "database",
+		"id":               db.id,
+		"created_time":     db.created.UTC().Format(timeFormat),
+		"last_edited_time": db.edited.UTC().Format(timeFormat),
+		"title":            db.title,
+		"description":      []any{},
+		"parent":           db.parent.json(),
+		"is_inline":        false,
+		"in_trash":         db.inTrash,
+		"is_locked":        false,
+		"data_sources":     sources,
+		"icon":             nil,
+		"cover":            nil,
+		"url":              "https://www.notion.so/" + strings.ReplaceAll(db.id, "-", ""),
+	}
+}
+
+func (s *Server) dataSourceJSON(ds *dataSource) map[string]any {
+	db := s.dbs[ds.databaseID]
+	return map[string]any{
+		"object":           "data_source",
+		"id":               ds.id,
+		"created_time":     ds.created.UTC().Format(timeFormat),
+		"last_edited_time": ds.edited.UTC().Format(timeFormat),
+		"title":            ds.title,
+		"description":      []any{},
+		"parent":           map[string]any{"type": "database_id", "database_id": ds.databaseID},
+		"database_parent":  db.parent.json(),
+		"properties":       ds.properties,
+		"archived":         db.inTrash,
+		"in_trash":         db.inTrash,
+	}
+}
+
+func (s *Server) blockJSON(b *block) map[string]any {
+	return map[string]any{
+		"object":           "block",
+		"id":               b.id,
+		"parent":           b.parent.json(),
+		"created_time":     b.created.UTC().Format(timeFormat),
+		"last_edited_time": b.edited.UTC().Format(timeFormat),
+		"created_by":       userJSON(botUserID),
+		"last_edited_by":   userJSON(botUserID),
+		"has_children":     len(s.liveChildren(b.id)) > 0,
+		"archived":         b.inTrash,
+		"in_trash":         b.inTrash,
+		"type":             b.typ,
+		b.typ:              b.data,
+	}
+}
+
+// pageBlockJSON returns a page as a child_page block, as Notion returns it
+// from the block endpoints.
+func (s *Server) pageBlockJSON(p *page) map[string]any {
+	return map[string]any{
+		"object":           "block",
+		"id":               p.id,
+		"parent":           p.parent.json(),
+		"created_time":     p.created.UTC().Format(timeFormat),
+		"last_edited_time": p.edited.UTC().Format(timeFormat),
+		"has_children":     len(s.liveChildren(p.id)) > 0,
+		"archived":         p.inTrash,
+		"in_trash":         p.inTrash,
+		"type":             "child_page",
+		"child_page":       map[string]any{"title": p.title()},
+	}
+}
+
+// liveChildren returns the IDs of the blocks under id that are not in the
+// trash. s.mu must be held.
+func (s *Server) liveChildren(id string) []string {
+	var ids []string
+	for _, child := range s.children[id] {
+		if b, ok := s.blocks[child]; ok && !b.inTrash {
+			ids = append(ids, child)
+		} else if p, ok := s.pages[child]; ok && !p.inTrash {
+			ids = append(ids, child)
+		}
+	}
+	return ids
+}
+
+// touch updates the last edited time of the page containing the block or
+// page id. s.mu must be held.
+func (s *Server) touch(id string, now time.Time) {
+	for range 64 {
+		if b, ok := s.blocks[id]; ok {
+			b.edited = now
+			id = b.parent.ID
+			continue
+		}
+		if p, ok := s.pages[id]; ok {
+			p.edited = now
+		}
+		return
+	}
+}
+
+// isBlockParent reports whether id is a page or block that can have children.
+// s.mu must be held.
+func (s *Server) isBlockParent(id string) bool {
+	if _, ok := s.pages[id]; ok {
+		return true
+	}
+	_, ok := s.blocks[id]
+	return ok
+}
+
+// AddPage adds a page with the given title and returns its ID. parentID is a
+// page or data source ID, or empty for a top-level page.
+func (s *Server) AddPage(parentID, title string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	p := &page{
+		id:      s.newID(),
+		parent:  parentRef{Type: "workspace"},
+		created: now,
+		edited:  now,
+	}
+	titleProp := "title"
+	if parentID != "" {
+		parentID = normalizeID(parentID)
+		if ds, ok := s.sources[parentID]; ok {
+			p.parent = parentRef{Type: "data_source_id", ID: ds.id, DatabaseID: ds.databaseID}
+			for name, v := range ds.properties {
+				if prop, ok := v.(map[string]any); ok && prop["type"] == "title" {
+					titleProp = name
+				}
+			}
+		} else {
+			p.parent = parentRef{Type: "page_id", ID: parentID}
+			s.children[parentID] = append(s.children[parentID], p.id)
+		}
+	}
+	p.properties = map[string]any{titleProp: map[string]any{"id": "title", "type": "title", "title": text(title)}}
+	s.pages[p.id] = p
+	return p.id
+}
+
+// AddDatabase adds a database with a single data source under the page
+// parentID, and returns their IDs. properties is the data source's schema in
+// Notion's format, for example {"Date": {"date": {}}}; a "Name" title
+// property is added if there is no title property.
+func (s *Server) AddDatabase(parentID, title string, properties map[string]any) (databaseID, dataSourceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	parentID = normalizeID(parentID)
+	db := &database{
+		id:      s.newID(),
+		parent:  parentRef{Type: "page_id", ID: parentID},
+		title:   text(title),
+		created: now,
+		edited:  now,
+	}
+	ds := &dataSource{
+		id:         s.newID(),
+		databaseID: db.id,
+		title:      text(title),
+		properties: schema(properties),
+		created:    now,
+		edited:     now,
+	}
+	db.sources = []string{ds.id}
+	s.dbs[db.id] = db
+	s.sources[ds.id] = ds
+	return db.id, ds.id
+}
+
+// schema fills in the id, name and type of each property in a data source
+// schema, adding a title property if there is none.
+func schema(properties map[string]any) map[string]any {
+	out := make(map[string]any, len(properties)+1)
+	hasTitle := false
+	for _, name := range slices.Sorted(maps.Keys(properties)) {
+		config, _ := properties[name].(map[string]any)
+		prop := map[string]any{"name": name}
+		for typ, v := range config {
+			prop["type"] = typ
+			prop[typ] = v
+			prop["id"] = typ
+			if typ == "title" {
+				hasTitle = true
+			} else {
+				prop["id"] = fmt.Sprintf("p%d", len(out))
+			}
+		}
+		out[name] = prop
+	}
+	if !hasTitle {
+		out["Name"] = map[string]any{"id": "title", "name": "Name", "type": "title", "title": map[string]any{}}
+	}
+	return out
+}
+
+// Children returns the blocks under the page or block id, in Notion's format,
+// including blocks in the trash.
+func (s *Server) Children(id string) []map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []map[string]any
+	for _, child := range s.children[normalizeID(id)] {
+		if b, ok := s.blocks[child]; ok {
+			out = append(out, s.blockJSON(b))
+		} else if p, ok := s.pages[child]; ok {
+			out = append(out, s.pageBlockJSON(p))
+		}
+	}
+	return out
+}
+
+// Page returns the page id in Notion's format, or nil if there is none.
+func (s *Server) Page(id string) map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pages[normalizeID(id)]
+	if !ok {
+		return nil
+	}
+	return s.pageJSON(p)
+}
+
+// SeedDemo adds a small demo workspace: a Meetings page holding a meeting
+// notes database with a few entries, and a Personal page.
+func (s *Server) SeedDemo() {
+	meetings := s.AddPage("", "Meetings")
+	s.AddPage(meetings, "Weekly Standup")
+	_, notes := s.AddDatabase(meetings, "Meeting notes", map[string]any{
+		"Date":      map[string]any{"date": map[string]any{}},
+		"Attendees": map[string]any{"multi_select": map[string]any{"options": []any{}}},
+		"Tags":      map[string]any{"multi_select": map[string]any{"options": []any{}}},
+	})
+	s.AddPage(notes, "Planning 2026-01-05")
+	s.AddPage(notes, "Retro 2026-01-09")
+	personal := s.AddPage("", "Personal")
+	s.AddPage(personal, "Ideas")
+}
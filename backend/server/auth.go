@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/mnehpets/oneserve/auth"
 	"github.com/mnehpets/oneserve/endpoint"
@@ -13,20 +16,13 @@ import (
 	"golang.org/x/oauth2"
 )
 
-var notionURLBase = "https://api.notion.com/v1/oauth/"
+// notionOAuthPath is the path of Notion's OAuth endpoints below the API's
+// base URL.
+const notionOAuthPath = "/v1/oauth/"
 
 const notionAuthSuffix = "authorize"
 const notionTokenSuffix = "token"
 
-// setNotionURLBase sets the Notion API base URL for testing purposes.
-// This is primarily used in integration tests to point to a mock OAuth server.
-// Returns the original URL for restoration purposes.
-func setNotionURLBase(url string) string {
-	original := notionURLBase
-	notionURLBase = url
-	return original
-}
-
 // NotionToken stores the Notion OAuth tokens in the session.
 type NotionToken struct {
 	AccessToken  string `cbor:"1,keyasint"`
@@ -34,14 +30,15 @@ type NotionToken struct {
 	Expiry       int64  `cbor:"3,keyasint,omitempty"` // Unix timestamp
 }
 
-// setupNotionAuth configures the Notion OAuth provider and auth handler.
-func setupNotionAuth(cfg *Config, sessionKey []byte, secureCookies bool, processors []endpoint.Processor) (http.Handler, error) {
+// setupNotionAuth configures the Notion OAuth provider and auth handler,
+// with the OAuth endpoints of the Notion API at apiURL.
+func setupNotionAuth(cfg *Config, apiURL string, sessionKey []byte, secureCookies bool, processors []endpoint.Processor) (http.Handler, error) {
 	registry := auth.NewRegistry()
 
 	// Notion OAuth2 endpoint
 	notionEndpoint := oauth2.Endpoint{
-		AuthURL:  notionURLBase + notionAuthSuffix,
-		TokenURL: notionURLBase + notionTokenSuffix,
+		AuthURL:  apiURL + notionOAuthPath + notionAuthSuffix,
+		TokenURL: apiURL + notionOAuthPath + notionTokenSuffix,
 	}
 
 	// Notion OAuth2 config
@@ -141,6 +138,7 @@ func authResultEndpoint(w http.ResponseWriter, r *http.Request, result *auth.Aut
 	if u, err := url.Parse(nextURL); err == nil {
 		q := u.Query()
 		if result.Error != nil {
+			log.Printf("Notion login failed: %v", result.Error)
 			q.Set("success", "false")
 			var providerErr *auth.ProviderError
 			if errors.As(result.Error, &providerErr) {
@@ -194,13 +192,33 @@ func logoutEndpoint(w http.ResponseWriter, r *http.Request, params struct {
 	return &endpoint.RedirectRenderer{URL: nextURL, Status: http.StatusFound}, nil
 }
 
-// meEndpoint returns the current session status.
-func meEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+// notionLoginDisabledEndpoint replaces the Notion OAuth routes when the
+// server uses an internal integration token.
+func notionLoginDisabledEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	return nil, endpoint.Error(http.StatusNotFound, "Notion login is disabled: this server uses an internal integration token", nil)
+}
+
+// notionLoginUnavailableEndpoint replaces the Notion OAuth routes when Notion
+// is not configured.
+func notionLoginUnavailableEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	return nil, endpoint.Error(http.StatusNotFound, "Notion login is not available: Notion is not configured on this server", nil)
+}
+
+// meEndpoint returns the current session status. "integrations" lists the
+// integrations configured on the server and "services" those connected for
+// the session. With an internal integration token, Notion is connected for
+// every logged-in session. "transcription_available" reports whether the
+// session can use the transcription provider, such as whether it has a
+// Deepgram key to use, its own or the server's.
+func (s *Server) meEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
 	session, ok := middleware.SessionFromContext(r.Context())
 
 	response := map[string]interface{}{
-		"logged_in": false,
-		"services":  []string{},
+		"logged_in":    false,
+		"services":     []string{},
+		"integrations": s.cfg.Integrations(),
+		// Whether the session can use transcription
+		"transcription_available": false,
 	}
 
 	if ok {
@@ -210,11 +228,20 @@ func meEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Re
 			response["session_id"] = session.ID()
 
 			services := []string{}
-			// Check if Notion token exists
+			// Check if Notion token exists, or an integration token is used
 			var notionToken NotionToken
-			if err := session.Get("notion_token", &notionToken); err == nil && notionToken.AccessToken != "" {
+			if s.cfg.NotionIntegrationToken != "" {
 				services = append(services, "notion")
+			} else if err := session.Get("notion_token", &notionToken); err == nil && notionToken.AccessToken != "" {
+				services = append(services, "notion")
+			}
+			// Deepgram is connected if the user has a key or may use the
+			// server's
+			userKey, _ := sessionUserKey(r)
+			if s.deepgramSettings(userKey).Available {
+				services = append(services, "deepgram")
 			}
+			response["transcription_available"] = s.transcriptionAvailable(userKey)
 			response["services"] = services
 
 			// Include username if present (don't check for empty string)
@@ -226,3 +253,38 @@ func meEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Re
 
 	return &endpoint.JSONRenderer{Value: response}, nil
 }
+
+// sessionUserKey returns a stable key identifying the user of a logged-in
+// session, for scoping server-side records. Named users are keyed by username;
+// anonymous users by session ID.
+func sessionUserKey(r *http.Request) (string, error) {
+	session, ok := middleware.SessionFromContext(r.Context())
+	if !ok {
+		return "", endpoint.Error(http.StatusUnauthorized, "Unauthorized", nil)
+	}
+
+	username, loggedIn := session.Username()
+	if !loggedIn {
+		return "", endpoint.Error(http.StatusUnauthorized, "Unauthorized", nil)
+	}
+	if username != "" {
+		return "user:" + username, nil
+	}
+	return "session:" + session.ID(), nil
+}
+
+// quotaKey returns the key the request's rate, concurrency and storage
+// limits are counted under: the user key of a named user, and the client's address for
+// an anonymous session, since a client can start a new anonymous session
+// whenever it likes. Behind a reverse proxy, anonymous sessions share the
+// proxy's address and so its limits.
+func quotaKey(r *http.Request, userKey string) string {
+	if !strings.HasPrefix(userKey, "session:") {
+		return userKey
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
@@ -2,11 +2,13 @@ package server
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/knadh/koanf/parsers/dotenv"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/v2"
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
 )
 
 // Config holds the application configuration.
@@ -17,17 +19,108 @@ type Config struct {
 	// SessionKey is the secret key used for session encryption (32 bytes base64url-encoded for ChaCha20-Poly1305).
 	SessionKey string `koanf:"SESSION_KEY"`
 
-	// NotionClientID is the Notion OAuth client ID.
+	// NotionClientID is the Notion OAuth client ID. The Notion integration is
+	// disabled unless either the OAuth client or NotionIntegrationToken is
+	// configured.
 	NotionClientID string `koanf:"NOTION_CLIENT_ID"`
 
 	// NotionClientSecret is the Notion OAuth client secret.
 	NotionClientSecret string `koanf:"NOTION_CLIENT_SECRET"`
 
+	// NotionIntegrationToken is the secret of a Notion internal integration.
+	// If set, it is used for every logged-in session, anonymous ones
+	// included, and Notion OAuth is disabled.
+	NotionIntegrationToken string `koanf:"NOTION_INTEGRATION_TOKEN"`
+
+	// NotionWebhookSecret is the verification token of the Notion webhook
+	// subscription, used to check the signature of webhook events. If empty,
+	// webhook events are rejected.
+	NotionWebhookSecret string `koanf:"NOTION_WEBHOOK_SECRET"`
+
+	// NotionAPIURL is the base URL of the Notion API, including its OAuth
+	// endpoints. It defaults to https://api.notion.com and can point at a
+	// mock server such as cmd/notionmock for offline development.
+	NotionAPIURL string `koanf:"NOTION_API_URL"`
+
+	// NotionProxyLog writes every Notion API call made for a session to the
+	// server log as a JSON line, with bodies redacted and truncated.
+	NotionProxyLog bool `koanf:"NOTION_PROXY_LOG"`
+
+	// NotionLogRedact is a comma-separated list of JSON fields to redact from
+	// logged Notion bodies, in addition to tokens and secrets.
+	NotionLogRedact string `koanf:"NOTION_LOG_REDACT"`
+
+	// DeepgramAPIKey is the server's Deepgram API key, used for transcription
+	// by users who have not stored a key of their own. It is never sent to
+	// the browser.
+	DeepgramAPIKey string `koanf:"DEEPGRAM_API_KEY"`
+
+	// DeepgramAPIURL overrides the base URL of the Deepgram API, such as
+	// for a local stand-in. Defaults to https://api.deepgram.com.
+	DeepgramAPIURL string `koanf:"DEEPGRAM_API_URL"`
+
+	// TranscribeProvider names the provider used for server-side
+	// transcription: "deepgram" (the default), "openai" for the OpenAI
+	// transcription API or a compatible server, "assemblyai", or "fake", a
+	// deterministic stand-in for tests and offline development. Users may
+	// choose another configured provider.
+	TranscribeProvider string `koanf:"TRANSCRIBE_PROVIDER"`
+
+	// TranscribeAllowAnonymous lets anonymous sessions transcribe with the
+	// server's providers, such as DeepgramAPIKey. Every session the app
+	// starts is anonymous, so it is on by default and anonymous use is
+	// limited per client address instead; turn it off to make anonymous
+	// sessions bring a Deepgram key of their own.
+	TranscribeAllowAnonymous bool `koanf:"TRANSCRIBE_ALLOW_ANONYMOUS"`
+
+	// OpenAIAPIKey is the API key for the "openai" transcription provider.
+	// Self-hosted servers may not need one.
+	OpenAIAPIKey string `koanf:"OPENAI_API_KEY"`
+
+	// OpenAIAPIURL overrides the base URL of the OpenAI API, such as for a
+	// self-hosted Whisper server. Defaults to https://api.openai.com.
+	OpenAIAPIURL string `koanf:"OPENAI_API_URL"`
+
+	// OpenAITranscribeModel is the model used by the "openai" provider.
+	// Defaults to whisper-1.
+	OpenAITranscribeModel string `koanf:"OPENAI_TRANSCRIBE_MODEL"`
+
+	// AssemblyAIAPIKey is the server's AssemblyAI API key. If set, the
+	// "assemblyai" provider can be used.
+	AssemblyAIAPIKey string `koanf:"ASSEMBLYAI_API_KEY"`
+
+	// AssemblyAIAPIURL overrides the base URL of the AssemblyAI API, such as
+	// for a local stand-in. Defaults to https://api.assemblyai.com.
+	AssemblyAIAPIURL string `koanf:"ASSEMBLYAI_API_URL"`
+
+	// AssemblyAIWebhook asks AssemblyAI to call the server's webhook under
+	// PublicURL when a transcript completes, instead of polling for it
+	// every few seconds. PublicURL must be reachable from AssemblyAI.
+	AssemblyAIWebhook bool `koanf:"ASSEMBLYAI_WEBHOOK"`
+
+	// RecordingRetentionDays is how many days the audio of a recording is
+	// kept after it was last added to. Zero keeps recordings until they are
+	// deleted.
+	RecordingRetentionDays int `koanf:"RECORDING_RETENTION_DAYS"`
+
+	// RecordingQuotaMB bounds the audio recorded by each user, or by each
+	// client address for anonymous sessions, in megabytes. Zero means no
+	// limit.
+	RecordingQuotaMB int `koanf:"RECORDING_QUOTA_MB"`
+
+	// RecordingStorageMB bounds the audio recorded by everyone, in
+	// megabytes. Zero means no limit.
+	RecordingStorageMB int `koanf:"RECORDING_STORAGE_MB"`
+
 	// PublicURL is the public base URL of the application (e.g., "http://localhost:8080").
 	PublicURL string `koanf:"PUBLIC_URL"`
 
 	// FrontendDir is the directory containing the frontend build artifacts.
 	FrontendDir string `koanf:"FRONTEND_DIR"`
+
+	// DataDir is the directory where server-side state (such as Notion export
+	// records) is persisted. If empty, state is kept in memory only.
+	DataDir string `koanf:"DATA_DIR"`
 }
 
 // LoadConfig loads configuration from a .env file (if present) and environment variables.
@@ -53,6 +146,13 @@ func LoadConfig(envFile string) (*Config, error) {
 		Port:        "8080",
 		PublicURL:   "http://localhost:8080",
 		FrontendDir: "../frontend/dist",
+		DataDir:     "./data",
+
+		TranscribeProvider:       transcribe.ProviderDeepgram,
+		TranscribeAllowAnonymous: true,
+		RecordingRetentionDays:   30,
+		RecordingQuotaMB:         4096,
+		RecordingStorageMB:       51200,
 	}
 
 	if err := k.Unmarshal("", cfg); err != nil {
@@ -63,12 +163,41 @@ func LoadConfig(envFile string) (*Config, error) {
 	if cfg.SessionKey == "" {
 		return nil, fmt.Errorf("SESSION_KEY is required")
 	}
-	if cfg.NotionClientID == "" {
-		return nil, fmt.Errorf("NOTION_CLIENT_ID is required")
+	// Notion is optional, but OAuth needs both the client ID and secret
+	if (cfg.NotionClientID == "") != (cfg.NotionClientSecret == "") {
+		return nil, fmt.Errorf("NOTION_CLIENT_ID and NOTION_CLIENT_SECRET must be set together")
+	}
+	if cfg.RecordingRetentionDays < 0 {
+		return nil, fmt.Errorf("RECORDING_RETENTION_DAYS must not be negative")
+	}
+	if cfg.RecordingQuotaMB < 0 || cfg.RecordingStorageMB < 0 {
+		return nil, fmt.Errorf("RECORDING_QUOTA_MB and RECORDING_STORAGE_MB must not be negative")
 	}
-	if cfg.NotionClientSecret == "" {
-		return nil, fmt.Errorf("NOTION_CLIENT_SECRET is required")
+	if !transcribe.Known(cfg.TranscribeProvider) {
+		return nil, fmt.Errorf("TRANSCRIBE_PROVIDER must be one of %s", strings.Join(transcribe.Providers(), ", "))
 	}
 
 	return cfg, nil
 }
+
+// NotionEnabled reports whether the Notion integration is configured, either
+// with an OAuth client or an internal integration token.
+func (c *Config) NotionEnabled() bool {
+	return c.NotionIntegrationToken != "" || (c.NotionClientID != "" && c.NotionClientSecret != "")
+}
+
+// Integrations returns the names of the optional integrations that are
+// configured.
+func (c *Config) Integrations() []string {
+	integrations := []string{}
+	if c.NotionEnabled() {
+		integrations = append(integrations, "notion")
+	}
+	if c.DeepgramAPIKey != "" {
+		integrations = append(integrations, "deepgram")
+	}
+	if c.AssemblyAIAPIKey != "" {
+		integrations = append(integrations, "assemblyai")
+	}
+	return integrations
+}
@@ -107,3 +107,192 @@ func TestLoadConfig_MissingRequiredVars(t *testing.T) {
 		t.Errorf("LoadConfig should fail when required environment variables are missing")
 	}
 }
+
+func TestLoadConfig_IntegrationToken(t *testing.T) {
+	tmpDir := t.TempDir()
+	envFile := filepath.Join(tmpDir, ".env")
+	envContent := `SESSION_KEY=MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=
+NOTION_INTEGRATION_TOKEN=ntn_test
+`
+	if err := os.WriteFile(envFile, []byte(envContent), 0644); err != nil {
+		t.Fatalf("Failed to create test .env file: %v", err)
+	}
+
+	// OAuth credentials are not required with an integration token
+	cfg, err := LoadConfig(envFile)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.NotionIntegrationToken != "ntn_test" {
+		t.Errorf("Expected NotionIntegrationToken=ntn_test, got %s", cfg.NotionIntegrationToken)
+	}
+}
+
+func TestLoadConfig_OptionalNotion(t *testing.T) {
+	tmpDir := t.TempDir()
+	load := func(content string) (*Config, error) {
+		envFile := filepath.Join(tmpDir, ".env")
+		if err := os.WriteFile(envFile, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test .env file: %v", err)
+		}
+		return LoadConfig(envFile)
+	}
+	const sessionKey = "SESSION_KEY=MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=\n"
+
+	cfg, err := load(sessionKey)
+	if err != nil {
+		t.Fatalf("LoadConfig should not require Notion, got error: %v", err)
+	}
+	if cfg.NotionEnabled() || len(cfg.Integrations()) != 0 {
+		t.Errorf("Expected Notion to be disabled, got integrations %v", cfg.Integrations())
+	}
+
+	if _, err := load(sessionKey + "NOTION_CLIENT_ID=test_id\n"); err == nil {
+		t.Error("LoadConfig should fail when only NOTION_CLIENT_ID is set")
+	}
+
+	cfg, err = load(sessionKey + "NOTION_CLIENT_ID=test_id\nNOTION_CLIENT_SECRET=test_secret\n")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !cfg.NotionEnabled() {
+		t.Error("Expected Notion to be enabled with OAuth credentials")
+	}
+}
+
+func TestLoadConfig_NotionProxyLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	envFile := filepath.Join(tmpDir, ".env")
+	envContent := `SESSION_KEY=MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=
+NOTION_PROXY_LOG=true
+NOTION_LOG_REDACT=plain_text,content
+`
+	if err := os.WriteFile(envFile, []byte(envContent), 0644); err != nil {
+		t.Fatalf("Failed to create test .env file: %v", err)
+	}
+
+	cfg, err := LoadConfig(envFile)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !cfg.NotionProxyLog || cfg.NotionLogRedact != "plain_text,content" {
+		t.Errorf("Unexpected logging config %v %q", cfg.NotionProxyLog, cfg.NotionLogRedact)
+	}
+}
+
+func TestLoadConfig_Deepgram(t *testing.T) {
+	tmpDir := t.TempDir()
+	envFile := filepath.Join(tmpDir, ".env")
+	envContent := `SESSION_KEY=MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=
+DEEPGRAM_API_KEY=dg_server_key
+`
+	if err := os.WriteFile(envFile, []byte(envContent), 0644); err != nil {
+		t.Fatalf("Failed to create test .env file: %v", err)
+	}
+
+	cfg, err := LoadConfig(envFile)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.DeepgramAPIKey != "dg_server_key" {
+		t.Errorf("Expected DeepgramAPIKey=dg_server_key, got %q", cfg.DeepgramAPIKey)
+	}
+	if got := cfg.Integrations(); len(got) != 1 || got[0] != "deepgram" {
+		t.Errorf("Expected the deepgram integration, got %v", got)
+	}
+}
+
+func TestLoadConfig_TranscribeProvider(t *testing.T) {
+	tmpDir := t.TempDir()
+	envFile := filepath.Join(tmpDir, ".env")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(envFile, []byte("SESSION_KEY=MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=\n"+content), 0644); err != nil {
+			t.Fatalf("Failed to create test .env file: %v", err)
+		}
+	}
+
+	write("")
+	cfg, err := LoadConfig(envFile)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.TranscribeProvider != "deepgram" {
+		t.Errorf("Expected Deepgram by default, got %q", cfg.TranscribeProvider)
+	}
+	if !cfg.TranscribeAllowAnonymous {
+		t.Error("Expected anonymous sessions to use the server's providers by default")
+	}
+
+	write("TRANSCRIBE_ALLOW_ANONYMOUS=false\n")
+	if cfg, err := LoadConfig(envFile); err != nil || cfg.TranscribeAllowAnonymous {
+		t.Errorf("Expected anonymous sessions to be turned off, got %v", err)
+	}
+
+	write("TRANSCRIBE_PROVIDER=fake\n")
+	if cfg, err := LoadConfig(envFile); err != nil || cfg.TranscribeProvider != "fake" {
+		t.Errorf("Expected the fake provider, got %v", err)
+	}
+
+	write("TRANSCRIBE_PROVIDER=openai\nOPENAI_API_URL=http://localhost:8000/v1\nOPENAI_TRANSCRIBE_MODEL=large-v3\n")
+	if cfg, err := LoadConfig(envFile); err != nil || cfg.TranscribeProvider != "openai" || cfg.OpenAIAPIURL != "http://localhost:8000/v1" || cfg.OpenAITranscribeModel != "large-v3" {
+		t.Errorf("Expected the OpenAI provider, got %+v, %v", cfg, err)
+	}
+
+	write("TRANSCRIBE_PROVIDER=whisper\n")
+	if _, err := LoadConfig(envFile); err == nil {
+		t.Error("Expected an unknown provider to be rejected")
+	}
+}
+
+func TestLoadConfig_RecordingRetention(t *testing.T) {
+	tmpDir := t.TempDir()
+	envFile := filepath.Join(tmpDir, ".env")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(envFile, []byte("SESSION_KEY=MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=\n"+content), 0644); err != nil {
+			t.Fatalf("Failed to create test .env file: %v", err)
+		}
+	}
+
+	write("")
+	if cfg, err := LoadConfig(envFile); err != nil || cfg.RecordingRetentionDays != 30 {
+		t.Errorf("Expected 30 days by default, got %v", err)
+	}
+
+	write("RECORDING_RETENTION_DAYS=0\n")
+	if cfg, err := LoadConfig(envFile); err != nil || cfg.RecordingRetentionDays != 0 {
+		t.Errorf("Expected recordings to be kept forever, got %v", err)
+	}
+
+	write("RECORDING_RETENTION_DAYS=-1\n")
+	if _, err := LoadConfig(envFile); err == nil {
+		t.Error("Expected a negative retention to be rejected")
+	}
+}
+
+func TestLoadConfig_RecordingQuota(t *testing.T) {
+	tmpDir := t.TempDir()
+	envFile := filepath.Join(tmpDir, ".env")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(envFile, []byte("SESSION_KEY=MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=\n"+content), 0644); err != nil {
+			t.Fatalf("Failed to create test .env file: %v", err)
+		}
+	}
+
+	write("")
+	if cfg, err := LoadConfig(envFile); err != nil || cfg.RecordingQuotaMB != 4096 || cfg.RecordingStorageMB != 51200 {
+		t.Errorf("Expected 4 GB per user and 50 GB in all by default, got %v", err)
+	}
+
+	write("RECORDING_QUOTA_MB=0\nRECORDING_STORAGE_MB=100\n")
+	if cfg, err := LoadConfig(envFile); err != nil || cfg.RecordingQuotaMB != 0 || cfg.RecordingStorageMB != 100 {
+		t.Errorf("Expected the configured limits, got %v", err)
+	}
+
+	write("RECORDING_STORAGE_MB=-1\n")
+	if _, err := LoadConfig(envFile); err == nil {
+		t.Error("Expected a negative limit to be rejected")
+	}
+}
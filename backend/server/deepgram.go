@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// defaultDeepgramAPIURL is the base URL of the Deepgram API, unless
+// DEEPGRAM_API_URL points the server at another.
+const defaultDeepgramAPIURL = "https://api.deepgram.com"
+
+// deepgramMaxKeyLength bounds the length of a user's Deepgram API key.
+const deepgramMaxKeyLength = 256
+
+// deepgramKeyRecord is a user's Deepgram API key, encrypted with the
+// server's secrets key. Hint is the end of the key, to tell keys apart.
+type deepgramKeyRecord struct {
+	Ciphertext []byte    `json:"ciphertext"`
+	Hint       string    `json:"hint"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// newSecretsAEAD returns the cipher used for secrets stored server-side. Its
+// key is derived from the session key, so changing SESSION_KEY makes stored
+// secrets unreadable.
+func newSecretsAEAD(sessionKey []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte("mtranscribe stored secrets v1"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret encrypts plaintext, binding it to ad (such as the owner's user
+// key) so that it cannot be moved to another record.
+func sealSecret(aead cipher.AEAD, plaintext, ad string) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, []byte(plaintext), []byte(ad))
+}
+
+// openSecret decrypts a secret sealed with the same ad.
+func openSecret(aead cipher.AEAD, ciphertext []byte, ad string) (string, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return "", errors.New("secret too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(ad))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// deepgramKey returns the Deepgram API key to use for the request's session:
+// the user's own key if they have stored one, and otherwise the server's.
+// source is "user" or "server". It fails with 401 if the session is not
+// logged in or may not use the server's key, and 501 if there is no key.
+func (s *Server) deepgramKey(r *http.Request) (key, source string, err error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return "", "", err
+	}
+	if rec, ok := s.deepgramKeys.Get(userKey); ok {
+		key, err := openSecret(s.secrets, rec.Ciphertext, userKey)
+		if err != nil {
+			return "", "", endpoint.Error(http.StatusInternalServerError, "stored Deepgram API key cannot be decrypted; store it again", err)
+		}
+		return key, "user", nil
+	}
+	if s.cfg.DeepgramAPIKey != "" {
+		if !s.serverProvidersAllowed(userKey) {
+			return "", "", endpoint.Error(http.StatusUnauthorized, "Transcription requires a named login or a Deepgram API key of your own", nil)
+		}
+		return s.cfg.DeepgramAPIKey, "server", nil
+	}
+	return "", "", endpoint.Error(http.StatusNotImplemented, "Transcription is not available: no Deepgram API key is configured", nil)
+}
+
+// deepgramSettings describes the Deepgram key of a user without revealing
+// it.
+type deepgramSettings struct {
+	// UserKey is true if the user has stored their own key, and Hint and
+	// UpdatedAt describe it.
+	UserKey   bool       `json:"user_key"`
+	Hint      string     `json:"hint,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// ServerKey is true if the server has a key of its own that the user
+	// may use.
+	ServerKey bool `json:"server_key"`
+	// Available is true if transcription can be used.
+	Available bool `json:"available"`
+}
+
+func (s *Server) deepgramSettings(userKey string) deepgramSettings {
+	settings := deepgramSettings{ServerKey: s.cfg.DeepgramAPIKey != "" && s.serverProvidersAllowed(userKey)}
+	if rec, ok := s.deepgramKeys.Get(userKey); ok {
+		settings.UserKey = true
+		settings.Hint = rec.Hint
+		settings.UpdatedAt = &rec.UpdatedAt
+	}
+	settings.Available = settings.UserKey || settings.ServerKey
+	return settings
+}
+
+// getDeepgramSettingsEndpoint reports which Deepgram key the user's
+// transcription uses. The key itself is never returned.
+func (s *Server) getDeepgramSettingsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: s.deepgramSettings(userKey)}, nil
+}
+
+// putDeepgramSettingsEndpoint stores the user's own Deepgram API key,
+// encrypted, in place of the server's key.
+func (s *Server) putDeepgramSettingsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	key := strings.TrimSpace(req.APIKey)
+	if key == "" {
+		return nil, endpoint.Error(http.StatusBadRequest, "api_key is required", nil)
+	}
+	if len(key) > deepgramMaxKeyLength || strings.ContainsFunc(key, unicode.IsSpace) {
+		return nil, endpoint.Error(http.StatusBadRequest, "invalid api_key", nil)
+	}
+
+	rec := deepgramKeyRecord{
+		Ciphertext: sealSecret(s.secrets, key, userKey),
+		Hint:       "…" + key[max(0, len(key)-4):],
+		UpdatedAt:  time.Now().UTC(),
+	}
+	if len(key) < 12 {
+		rec.Hint = ""
+	}
+	if err := s.deepgramKeys.Put(userKey, rec); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to store Deepgram API key", err)
+	}
+	return &endpoint.JSONRenderer{Value: s.deepgramSettings(userKey)}, nil
+}
+
+// deleteDeepgramSettingsEndpoint removes the user's own Deepgram API key, so
+// that the server's key is used, if there is one.
+func (s *Server) deleteDeepgramSettingsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.deepgramKeys.Delete(userKey); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to remove Deepgram API key", err)
+	}
+	return &endpoint.JSONRenderer{Value: s.deepgramSettings(userKey)}, nil
+}
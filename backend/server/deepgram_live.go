@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// Live relay timing. These are variables so tests can shorten them.
+var (
+	// liveRelayPingInterval is how often the relay pings the browser.
+	liveRelayPingInterval = 20 * time.Second
+	// liveRelayIdleTimeout closes relays whose browser has not answered a
+	// ping for this long.
+	liveRelayIdleTimeout = time.Minute
+	// liveRelayDialTimeout bounds opening the connection to Deepgram.
+	liveRelayDialTimeout = 10 * time.Second
+)
+
+// maxLiveRelaysPerUser limits the number of concurrent relays per user.
+const maxLiveRelaysPerUser = 2
+
+// liveRelayMessageLimit bounds the size of messages relayed either way.
+const liveRelayMessageLimit = 1 << 20
+
+// liveRelayControlTypes are the control messages the browser may send to
+// Deepgram as text. Everything else it sends must be audio.
+var liveRelayControlTypes = []string{"KeepAlive", "Finalize", "CloseStream"}
+
+var (
+	liveModelPattern    = regexp.MustCompile(`^[a-z0-9][a-z0-9._:-]{0,63}$`)
+	liveLanguagePattern = regexp.MustCompile(`^([A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*|multi)$`)
+)
+
+// liveRelayQuery validates the Deepgram options of a relay request and
+// returns them as the upstream query. Only the options below may be set, so
+// that the relay is the one place where the streaming policy is decided.
+func liveRelayQuery(q url.Values) (url.Values, error) {
+	upstream := url.Values{}
+	for name, values := range q {
+		if len(values) != 1 {
+			return nil, endpoint.Error(http.StatusBadRequest, fmt.Sprintf("%s must be given once", name), nil)
+		}
+		value := values[0]
+		switch name {
+		case "model":
+			if !liveModelPattern.MatchString(value) {
+				return nil, endpoint.Error(http.StatusBadRequest, "invalid model", nil)
+			}
+		case "language":
+			if !liveLanguagePattern.MatchString(value) {
+				return nil, endpoint.Error(http.StatusBadRequest, "invalid language", nil)
+			}
+		case "diarize", "interim_results", "mip_opt_out":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, endpoint.Error(http.StatusBadRequest, fmt.Sprintf("%s must be true or false", name), nil)
+			}
+			value = strconv.FormatBool(b)
+		case "utterance_end_ms":
+			// Deepgram needs at least a second to detect the end of an
+			// utterance.
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms < 1000 || ms > 5000 {
+				return nil, endpoint.Error(http.StatusBadRequest, "utterance_end_ms must be between 1000 and 5000", nil)
+			}
+		default:
+			return nil, endpoint.Error(http.StatusBadRequest, fmt.Sprintf("unsupported option %q", name), nil)
+		}
+		upstream.Set(name, value)
+	}
+	if upstream.Has("utterance_end_ms") && upstream.Get("interim_results") != "true" {
+		return nil, endpoint.Error(http.StatusBadRequest, "utterance_end_ms requires interim_results=true", nil)
+	}
+	return upstream, nil
+}
+
+// liveRelays counts the running relays of each user, by quotaKey.
+type liveRelays struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newLiveRelays() *liveRelays {
+	return &liveRelays{active: make(map[string]int)}
+}
+
+// acquire takes a relay slot for quota.
+func (m *liveRelays) acquire(quota string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active[quota] >= maxLiveRelaysPerUser {
+		return endpoint.Error(http.StatusTooManyRequests, "too many live transcriptions", nil)
+	}
+	m.active[quota]++
+	return nil
+}
+
+// release returns a slot taken by acquire.
+func (m *liveRelays) release(quota string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active[quota]--; m.active[quota] <= 0 {
+		delete(m.active, quota)
+	}
+}
+
+// liveTranscribeEndpoint relays a live transcription between the browser and
+// Deepgram over WebSockets, so that the browser only ever connects to the
+// backend. The browser sends audio as binary messages and Deepgram control
+// messages as text, and receives Deepgram's results as they are. The audio
+// is also stored as the recording of a transcript if the request asks.
+func (s *Server) liveTranscribeEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	key, _, err := s.deepgramKey(r)
+	if err != nil {
+		return nil, err
+	}
+	owner, _ := sessionUserKey(r)
+	q := r.URL.Query()
+	quota := quotaKey(r, owner)
+	sink, err := s.liveRecordingSink(owner, quota, q)
+	if err != nil {
+		return nil, err
+	}
+	query, err := liveRelayQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.liveRelays.acquire(quota); err != nil {
+		return nil, err
+	}
+	return &liveRelay{
+		relays:   s.liveRelays,
+		quota:    quota,
+		key:      key,
+		upstream: s.deepgramStreamURL() + "?" + query.Encode(),
+		public:   s.cfg.PublicURL,
+		sink:     sink,
+	}, nil
+}
+
+// liveRelay is the renderer that takes over the connection and runs a relay.
+type liveRelay struct {
+	relays   *liveRelays
+	quota    string
+	key      string
+	upstream string
+	public   string
+	// sink stores the relayed audio, if it is recorded.
+	sink *recordingSink
+}
+
+func (l *liveRelay) Render(w http.ResponseWriter, r *http.Request) error {
+	defer l.relays.release(l.quota)
+
+	var opts websocket.AcceptOptions
+	if u, err := url.Parse(l.public); err == nil && u.Host != "" {
+		opts.OriginPatterns = []string{u.Host}
+	}
+	browser, err := websocket.Accept(w, r, &opts)
+	if err != nil {
+		// Accept has responded.
+		return nil
+	}
+	defer browser.CloseNow()
+	browser.SetReadLimit(liveRelayMessageLimit)
+
+	// The request's context lasts until the relay returns.
+	ctx := r.Context()
+	dialCtx, cancel := context.WithTimeout(ctx, liveRelayDialTimeout)
+	upstream, resp, err := websocket.Dial(dialCtx, l.upstream, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Token " + l.key}},
+	})
+	cancel()
+	if err != nil {
+		code, reason := liveRelayDialError(resp, err)
+		log.Printf("Live transcription: failed to connect to Deepgram: %v", err)
+		// Close waits for the browser to answer.
+		browser.Close(code, reason)
+		return nil
+	}
+	defer upstream.CloseNow()
+	upstream.SetReadLimit(liveRelayMessageLimit)
+
+	// Relay Deepgram's messages to the browser, and its close status once
+	// it is done.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			typ, data, err := upstream.Read(ctx)
+			if err != nil {
+				var ce websocket.CloseError
+				if errors.As(err, &ce) && ce.Code != websocket.StatusNoStatusRcvd {
+					browser.Close(ce.Code, ce.Reason)
+				} else {
+					browser.Close(websocket.StatusInternalError, "lost connection to Deepgram")
+				}
+				return
+			}
+			if err := browser.Write(ctx, typ, data); err != nil {
+				upstream.Close(websocket.StatusGoingAway, "")
+			}
+		}
+	}()
+
+	// Ping the browser so that a browser that went away is noticed, rather
+	// than holding the Deepgram connection open.
+	interval, timeout := liveRelayPingInterval, liveRelayIdleTimeout
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				pingCtx, cancel := context.WithTimeout(ctx, timeout)
+				err := browser.Ping(pingCtx)
+				cancel()
+				if err != nil {
+					browser.CloseNow()
+					return
+				}
+			}
+		}
+	}()
+
+	// Relay the browser's audio and control messages to Deepgram, and its
+	// close status once it is done and the recording is stored.
+	closeCode := websocket.StatusGoingAway
+	for {
+		typ, data, err := browser.Read(ctx)
+		if err != nil {
+			if code := websocket.CloseStatus(err); code != -1 && code != websocket.StatusNoStatusRcvd {
+				closeCode = code
+			}
+			break
+		}
+		if typ == websocket.MessageText && !liveRelayControlMessage(data) {
+			// Close returns once the browser has answered, and the next
+			// read then fails.
+			browser.Close(websocket.StatusPolicyViolation, "unsupported control message")
+			continue
+		}
+		if typ == websocket.MessageBinary && l.sink != nil {
+			l.sink.Write(data)
+		}
+		// A failed write shows up as Deepgram's connection closing.
+		upstream.Write(ctx, typ, data)
+	}
+	if l.sink != nil {
+		l.sink.Flush()
+	}
+	upstream.Close(closeCode, "")
+	<-done
+	return nil
+}
+
+// liveRelayControlMessage reports whether data is a Deepgram control message
+// the browser may send.
+func liveRelayControlMessage(data []byte) bool {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return false
+	}
+	return slices.Contains(liveRelayControlTypes, msg.Type)
+}
+
+// liveRelayDialError returns the close status to send the browser when the
+// connection to Deepgram cannot be opened.
+func liveRelayDialError(resp *http.Response, err error) (websocket.StatusCode, string) {
+	if resp == nil || resp.Body == nil {
+		return websocket.StatusInternalError, "failed to connect to Deepgram"
+	}
+	message := resp.Header.Get("Dg-Error")
+	if message == "" {
+		var body struct {
+			ErrMsg string `json:"err_msg"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &body) == nil {
+			message = body.ErrMsg
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return websocket.StatusInternalError, "Deepgram rejected the API key"
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return websocket.StatusTryAgainLater, "Deepgram is busy; try again later"
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return websocket.StatusPolicyViolation, "Deepgram rejected the options: " + message
+	}
+	return websocket.StatusInternalError, fmt.Sprintf("Deepgram returned %d", resp.StatusCode)
+}
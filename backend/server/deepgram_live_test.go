@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestLiveRelayQuery(t *testing.T) {
+	q, err := liveRelayQuery(url.Values{
+		"model": {"nova-3"}, "language": {"en-US"}, "diarize": {"1"},
+		"interim_results": {"true"}, "utterance_end_ms": {"1000"}, "mip_opt_out": {"false"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := q.Encode(); got != "diarize=true&interim_results=true&language=en-US&mip_opt_out=false&model=nova-3&utterance_end_ms=1000" {
+		t.Errorf("Unexpected upstream query %s", got)
+	}
+
+	for _, bad := range []string{
+		"model=nova%203",
+		"language=english",
+		"diarize=maybe",
+		"utterance_end_ms=500&interim_results=true",
+		"utterance_end_ms=1000",
+		"keywords=secret",
+		"model=nova-3&model=nova-2",
+	} {
+		q, _ := url.ParseQuery(bad)
+		if _, err := liveRelayQuery(q); err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+}
+
+// fakeDeepgramStream is a stand-in for Deepgram's streaming endpoint. It
+// answers each audio message with a result counting its bytes, answers
+// CloseStream with metadata before closing, and closes with an error on
+// "fail" audio.
+type fakeDeepgramStream struct {
+	t       *testing.T
+	queries chan url.Values
+	control chan string
+	closed  chan websocket.StatusCode
+}
+
+func newFakeDeepgramStream(t *testing.T) *fakeDeepgramStream {
+	return &fakeDeepgramStream{
+		t:       t,
+		queries: make(chan url.Values, 10),
+		control: make(chan string, 10),
+		closed:  make(chan websocket.StatusCode, 10),
+	}
+}
+
+func (f *fakeDeepgramStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/listen" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Token dg_server_key" {
+		w.Header().Set("Dg-Error", "Invalid credentials.")
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Query().Get("model") == "missing" {
+		w.Header().Set("Dg-Error", "No such model/language/tier combination found.")
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	f.queries <- r.URL.Query()
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(-1)
+	ctx := r.Context()
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			var ce websocket.CloseError
+			if errors.As(err, &ce) {
+				f.closed <- ce.Code
+			} else {
+				f.closed <- -1
+			}
+			return
+		}
+		if typ == websocket.MessageBinary {
+			if string(data) == "fail" {
+				conn.Close(websocket.StatusInternalError, "Deepgram did not receive audio data or a text message within the timeout window.")
+				continue
+			}
+			conn.Write(ctx, websocket.MessageText, []byte(`{"type":"Results","bytes":`+strconv.Itoa(len(data))+`}`))
+			continue
+		}
+		var msg struct{ Type string }
+		json.Unmarshal(data, &msg)
+		f.control <- msg.Type
+		if msg.Type == "CloseStream" {
+			conn.Write(ctx, websocket.MessageText, []byte(`{"type":"Metadata"}`))
+			conn.Close(websocket.StatusNormalClosure, "")
+		}
+	}
+}
+
+func TestLiveTranscribe(t *testing.T) {
+	fake := newFakeDeepgramStream(t)
+	s := setupTestServer(t)
+	useMockDeepgram(t, s, fake)
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	ctx := context.Background()
+	dial := func(query string, cookies []*http.Cookie) (*websocket.Conn, *http.Response, error) {
+		t.Helper()
+		header := http.Header{}
+		for _, c := range cookies {
+			header.Add("Cookie", c.String())
+		}
+		return websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/api/transcribe/live?"+query, &websocket.DialOptions{HTTPHeader: header})
+	}
+	read := func(conn *websocket.Conn) string {
+		t.Helper()
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected a message, got %v", err)
+		}
+		return string(data)
+	}
+	expectClose := func(conn *websocket.Conn, code websocket.StatusCode, reason string) {
+		t.Helper()
+		for {
+			_, data, err := conn.Read(ctx)
+			if err == nil {
+				t.Logf("Skipping %s", data)
+				continue
+			}
+			var ce websocket.CloseError
+			if !errors.As(err, &ce) || ce.Code != code || !strings.Contains(ce.Reason, reason) {
+				t.Errorf("Expected close %d %q, got %v", code, reason, err)
+			}
+			return
+		}
+	}
+
+	if _, resp, err := dial("", nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a session, got %v", err)
+	}
+	cookies := loginWithNotionToken(t, s, ts, "")
+	if _, resp, _ := dial("", cookies); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a key, got %d", resp.StatusCode)
+	}
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	if _, resp, _ := dial("search=secret", cookies); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unsupported option, got %d", resp.StatusCode)
+	}
+
+	// Audio and control messages are relayed, and Deepgram's close reaches
+	// the browser once it has sent its final messages.
+	conn, _, err := dial("model=nova-3&language=en&diarize=true&interim_results=true&utterance_end_ms=1000&mip_opt_out=true", cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := <-fake.queries; q.Get("model") != "nova-3" || q.Get("diarize") != "true" || q.Get("utterance_end_ms") != "1000" || q.Get("mip_opt_out") != "true" {
+		t.Errorf("Expected the options to reach Deepgram, got %v", q)
+	}
+	conn.Write(ctx, websocket.MessageBinary, make([]byte, 3200))
+	if got := read(conn); got != `{"type":"Results","bytes":3200}` {
+		t.Errorf("Unexpected result %s", got)
+	}
+	conn.Write(ctx, websocket.MessageText, []byte(`{"type":"KeepAlive"}`))
+	if got := <-fake.control; got != "KeepAlive" {
+		t.Errorf("Expected the keepalive to be relayed, got %s", got)
+	}
+	conn.Write(ctx, websocket.MessageText, []byte(`{"type":"CloseStream"}`))
+	if got := read(conn); got != `{"type":"Metadata"}` {
+		t.Errorf("Expected the final metadata, got %s", got)
+	}
+	expectClose(conn, websocket.StatusNormalClosure, "")
+	<-fake.control
+	<-fake.closed
+
+	// Deepgram's errors reach the browser with their status and reason.
+	conn, _, err = dial("", cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fake.queries
+	conn.Write(ctx, websocket.MessageBinary, []byte("fail"))
+	expectClose(conn, websocket.StatusInternalError, "timeout window")
+	<-fake.closed
+
+	// The browser's close reaches Deepgram.
+	conn, _, err = dial("", cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fake.queries
+	if err := conn.Close(websocket.StatusGoingAway, "tab closed"); err != nil {
+		t.Errorf("Expected the relay to answer the close, got %v", err)
+	}
+	if code := <-fake.closed; code != websocket.StatusGoingAway {
+		t.Errorf("Expected Deepgram to see the browser's close status, got %d", code)
+	}
+
+	// Messages other than audio and Deepgram's control messages are refused.
+	conn, _, err = dial("", cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fake.queries
+	conn.Write(ctx, websocket.MessageText, []byte(`{"type":"Configure","keyterms":["x"]}`))
+	expectClose(conn, websocket.StatusPolicyViolation, "unsupported")
+	<-fake.closed
+
+	// A refused connection to Deepgram closes the browser's with the reason.
+	conn, _, err = dial("model=missing", cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClose(conn, websocket.StatusPolicyViolation, "No such model")
+	s.cfg.DeepgramAPIKey = "dg_revoked_key"
+	conn, _, err = dial("", cookies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClose(conn, websocket.StatusInternalError, "API key")
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+
+	// Each user may run a limited number of relays.
+	var open []*websocket.Conn
+	for range maxLiveRelaysPerUser {
+		conn, _, err := dial("", cookies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-fake.queries
+		open = append(open, conn)
+	}
+	if _, resp, _ := dial("", cookies); resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 beyond the limit, got %v", resp)
+	}
+
+	// Anonymous sessions may only use the server's key if configured to,
+	// and share the limit of their address however many sessions they
+	// start.
+	if _, resp, _ := dial("", loginAnonymous(t, ts)); resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an anonymous session, got %v", resp)
+	}
+	s.cfg.TranscribeAllowAnonymous = true
+	for range maxLiveRelaysPerUser {
+		conn, _, err := dial("", loginAnonymous(t, ts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-fake.queries
+		open = append(open, conn)
+	}
+	if _, resp, _ := dial("", loginAnonymous(t, ts)); resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a new anonymous session beyond the limit, got %v", resp)
+	}
+	for _, conn := range open {
+		conn.Close(websocket.StatusNormalClosure, "")
+		<-fake.closed
+	}
+	conn, _, err = dial("", cookies)
+	if err != nil {
+		t.Fatalf("Expected the slots to be released, got %v", err)
+	}
+	<-fake.queries
+	conn.CloseNow()
+	<-fake.closed
+}
+
+func TestLiveTranscribe_IdleBrowser(t *testing.T) {
+	fake := newFakeDeepgramStream(t)
+	s := setupTestServer(t)
+	useMockDeepgram(t, s, fake)
+	oldPing, oldIdle := liveRelayPingInterval, liveRelayIdleTimeout
+	liveRelayPingInterval, liveRelayIdleTimeout = 20*time.Millisecond, 100*time.Millisecond
+	defer func() { liveRelayPingInterval, liveRelayIdleTimeout = oldPing, oldIdle }()
+
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "")
+	header := http.Header{}
+	for _, c := range cookies {
+		header.Add("Cookie", c.String())
+	}
+
+	// A browser that stops answering pings is dropped, and so is the
+	// Deepgram connection.
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/api/transcribe/live", &websocket.DialOptions{HTTPHeader: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+	<-fake.queries
+	select {
+	case code := <-fake.closed:
+		if code != websocket.StatusGoingAway {
+			t.Errorf("Expected Deepgram to see the browser go away, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle relay to be closed")
+	}
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSealSecret(t *testing.T) {
+	aead, err := newSecretsAEAD([]byte("01234567890123456789012345678901"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := sealSecret(aead, "dg_secret", "user:alice")
+	if strings.Contains(string(sealed), "dg_secret") {
+		t.Fatal("Expected the secret to be encrypted")
+	}
+	if got, err := openSecret(aead, sealed, "user:alice"); err != nil || got != "dg_secret" {
+		t.Errorf("Expected the secret back, got %q, %v", got, err)
+	}
+	if _, err := openSecret(aead, sealed, "user:bob"); err == nil {
+		t.Error("Expected a secret sealed for another user to fail")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := openSecret(aead, sealed, "user:alice"); err == nil {
+		t.Error("Expected a tampered secret to fail")
+	}
+}
+
+// deepgramRequest sends a request with a JSON body to the Deepgram settings
+// endpoint and decodes the response.
+func deepgramRequest(t *testing.T, ts *httptest.Server, method, body string, cookies []*http.Cookie) (int, deepgramSettings) {
+	t.Helper()
+	req, _ := http.NewRequest(method, ts.URL+"/api/settings/deepgram", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var settings deepgramSettings
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, settings
+}
+
+func TestDeepgramSettings(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.DataDir = t.TempDir()
+	var err error
+	if s.deepgramKeys, err = openJSONStore[deepgramKeyRecord](dataPath(s.cfg, "deepgram_keys.json")); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	if status, _ := deepgramRequest(t, ts, "GET", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", status)
+	}
+
+	cookies := loginWithNotionToken(t, s, ts, "")
+	me := func() map[string]any {
+		t.Helper()
+		resp := getWithCookies(t, ts, "/auth/me", cookies)
+		defer resp.Body.Close()
+		var result map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if got := me(); got["transcription_available"] != false {
+		t.Errorf("Expected transcription to be unavailable without a key, got %v", got)
+	}
+	if _, _, err := s.deepgramKey(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Error("Expected deepgramKey to fail without a session")
+	}
+
+	for _, body := range []string{`{}`, `{"api_key":"  "}`, `{"api_key":"two words"}`, `{"api_key":"` + strings.Repeat("k", deepgramMaxKeyLength+1) + `"}`} {
+		if status, _ := deepgramRequest(t, ts, "PUT", body, cookies); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %.40s, got %d", body, status)
+		}
+	}
+
+	const userKey = "dg_user_key_0123456789abcd"
+	status, settings := deepgramRequest(t, ts, "PUT", `{"api_key":" `+userKey+` "}`, cookies)
+	if status != http.StatusOK || !settings.UserKey || !settings.Available || settings.Hint != "…abcd" || settings.UpdatedAt == nil {
+		t.Fatalf("Unexpected settings after storing a key: %d %+v", status, settings)
+	}
+	resp := getWithCookies(t, ts, "/api/settings/deepgram", cookies)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), userKey) {
+		t.Errorf("Expected the key not to be returned, got %s", body)
+	}
+	stored, err := os.ReadFile(filepath.Join(s.cfg.DataDir, "deepgram_keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(stored), userKey) || strings.Contains(string(stored), "0123456789") {
+		t.Errorf("Expected the key to be encrypted at rest, got %s", stored)
+	}
+	if got := me(); got["transcription_available"] != true || !slices.Contains(toStrings(got["services"]), "deepgram") {
+		t.Errorf("Expected transcription to be available with a user key, got %v", got)
+	}
+
+	// The user's key takes precedence over the server's.
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	// keyFor returns the key deepgramKey picks for the test session.
+	keyFor := func() (string, string) {
+		t.Helper()
+		var key, source string
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		s.sessionProcessor.Process(rec, req, func(w http.ResponseWriter, r *http.Request) error {
+			var err error
+			key, source, err = s.deepgramKey(r)
+			return err
+		})
+		return key, source
+	}
+	if key, source := keyFor(); key != userKey || source != "user" {
+		t.Errorf("Expected the user's key, got %q from %q", key, source)
+	}
+
+	status, settings = deepgramRequest(t, ts, "DELETE", "", cookies)
+	if status != http.StatusOK || settings.UserKey || !settings.ServerKey || !settings.Available || settings.Hint != "" {
+		t.Errorf("Unexpected settings after removing the key: %d %+v", status, settings)
+	}
+	if key, source := keyFor(); key != "dg_server_key" || source != "server" {
+		t.Errorf("Expected the server's key, got %q from %q", key, source)
+	}
+
+	s.cfg.DeepgramAPIKey = ""
+	if got := me(); got["transcription_available"] != false {
+		t.Errorf("Expected transcription to be unavailable after removing the key, got %v", got)
+	}
+}
+
+func toStrings(v any) []string {
+	var out []string
+	list, _ := v.([]any)
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// useMockDeepgram points s at handler as its Deepgram API for the duration
+// of the test, and lifts the token rate limit.
+func useMockDeepgram(t *testing.T, s *Server, handler http.Handler) *httptest.Server {
+	t.Helper()
+	mock := httptest.NewServer(handler)
+	s.deepgramAPIURL = mock.URL
+	oldLimit := deepgramTokenRateLimit
+	deepgramTokenRateLimit = newRateLimiter(1e6, 1e6)
+	t.Cleanup(func() {
+		mock.Close()
+		deepgramTokenRateLimit = oldLimit
+	})
+	return mock
+}
+
+// fakeDeepgramGrant is a stand-in for Deepgram's token endpoint that accepts
+// the given API key.
+func fakeDeepgramGrant(t *testing.T, apiKey string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/auth/grant", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token "+apiKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"err_code":"INVALID_AUTH","err_msg":"Invalid credentials."}`))
+			return
+		}
+		var body struct {
+			TTLSeconds int `json:"ttl_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.TTLSeconds < 1 || body.TTLSeconds > 3600 {
+			t.Errorf("Unexpected grant request %+v, %v", body, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "temp-token-for-" + apiKey[:3], "expires_in": body.TTLSeconds})
+	})
+	return mux
+}
+
+func TestDeepgramToken(t *testing.T) {
+	s := setupTestServer(t)
+	useMockDeepgram(t, s, fakeDeepgramGrant(t, "dg_server_key"))
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	mint := func(cookies []*http.Cookie) (*http.Response, deepgramToken) {
+		t.Helper()
+		resp := postJSON(t, ts, "/api/deepgram/token", map[string]any{}, cookies)
+		defer resp.Body.Close()
+		var token deepgramToken
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, token
+	}
+
+	if resp, _ := mint(nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+	cookies := loginWithNotionToken(t, s, ts, "")
+	if resp, _ := mint(cookies); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected 501 without a key, got %d", resp.StatusCode)
+	}
+
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	resp, token := mint(cookies)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if token.AccessToken != "temp-token-for-dg_" || token.ExpiresIn != 30 || time.Until(token.ExpiresAt) > 31*time.Second {
+		t.Errorf("Unexpected token %+v", token)
+	}
+	if !strings.HasPrefix(token.URL, "ws://") || !strings.HasSuffix(token.URL, "/v1/listen") {
+		t.Errorf("Expected the streaming URL of the stand-in, got %s", token.URL)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected the token not to be cached")
+	}
+
+	s.cfg.DeepgramAPIKey = "dg_revoked_key"
+	if resp, _ := mint(cookies); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a rejected key, got %d", resp.StatusCode)
+	}
+
+	// Each user gets a small burst of tokens.
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	deepgramTokenRateLimit = newRateLimiter(0.1, 2)
+	for i := range 2 {
+		if resp, _ := mint(cookies); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected token %d to be minted, got %d", i, resp.StatusCode)
+		}
+	}
+	resp, _ = mint(cookies)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d", resp.StatusCode)
+	}
+
+	// Anonymous sessions may only use the server's key if configured to,
+	// and share the limit of their address however many sessions they
+	// start.
+	if resp, _ := mint(loginAnonymous(t, ts)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an anonymous session, got %d", resp.StatusCode)
+	}
+	s.cfg.TranscribeAllowAnonymous = true
+	for i := range 2 {
+		if resp, _ := mint(loginAnonymous(t, ts)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected anonymous token %d to be minted, got %d", i, resp.StatusCode)
+		}
+	}
+	if resp, _ := mint(loginAnonymous(t, ts)); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a new anonymous session, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// deepgramTokenTTL is the lifetime of the tokens handed to the browser. It
+// only needs to cover opening the streaming connection, which stays open
+// once established.
+const deepgramTokenTTL = 30 * time.Second
+
+// deepgramTokenRateLimit bounds how often each user may mint tokens: a
+// handful at once, for reconnects, and then one every ten seconds.
+var deepgramTokenRateLimit = newRateLimiter(0.1, 5)
+
+// deepgramToken is a short-lived Deepgram credential for the browser.
+type deepgramToken struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// URL is the streaming endpoint the token is meant for.
+	URL string `json:"url"`
+}
+
+// deepgramTokenEndpoint exchanges the session's Deepgram API key for a
+// temporary token, so that the browser can open the streaming connection
+// without ever holding the key. Deepgram's temporary tokens can only be
+// used for transcription, not to manage the project or its keys.
+func (s *Server) deepgramTokenEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	key, _, err := s.deepgramKey(r)
+	if err != nil {
+		return nil, err
+	}
+	userKey, _ := sessionUserKey(r)
+	quota := quotaKey(r, userKey)
+	if delay := deepgramTokenRateLimit.reserve(quota); delay > 0 {
+		deepgramTokenRateLimit.cancel(quota)
+		w.Header().Set("Retry-After", strconv.Itoa(int(delay.Seconds()+1)))
+		return nil, endpoint.Error(http.StatusTooManyRequests, "too many token requests", nil)
+	}
+
+	payload, _ := json.Marshal(map[string]any{"ttl_seconds": int(deepgramTokenTTL.Seconds())})
+	req, err := http.NewRequestWithContext(r.Context(), "POST", s.deepgramAPIURL+"/v1/auth/grant", bytes.NewReader(payload))
+	if err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to create token request", err)
+	}
+	req.Header.Set("Authorization", "Token "+key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, endpoint.Error(http.StatusBadGateway, "failed to reach Deepgram", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, endpoint.Error(http.StatusBadGateway, "failed to read Deepgram response", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, endpoint.Error(http.StatusBadGateway, "Deepgram rejected the API key", fmt.Errorf("deepgram: %d %s", resp.StatusCode, data))
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, endpoint.Error(http.StatusBadGateway, "Deepgram token request failed", fmt.Errorf("deepgram: %d %s", resp.StatusCode, data))
+	}
+
+	var grant struct {
+		AccessToken string   `json:"access_token"`
+		ExpiresIn   *float64 `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &grant); err != nil || grant.AccessToken == "" {
+		return nil, endpoint.Error(http.StatusBadGateway, "invalid Deepgram token response", err)
+	}
+	ttl := deepgramTokenTTL
+	if grant.ExpiresIn != nil {
+		ttl = time.Duration(*grant.ExpiresIn * float64(time.Second))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return &endpoint.JSONRenderer{Value: deepgramToken{
+		AccessToken: grant.AccessToken,
+		ExpiresIn:   int(ttl.Seconds()),
+		ExpiresAt:   time.Now().Add(ttl).UTC(),
+		URL:         s.deepgramStreamURL(),
+	}}, nil
+}
+
+// deepgramStreamURL returns the WebSocket URL of Deepgram's streaming
+// transcription endpoint.
+func (s *Server) deepgramStreamURL() string {
+	u := s.deepgramAPIURL
+	if rest, ok := strings.CutPrefix(u, "https://"); ok {
+		u = "wss://" + rest
+	} else if rest, ok := strings.CutPrefix(u, "http://"); ok {
+		u = "ws://" + rest
+	}
+	return u + "/v1/listen"
+}
@@ -9,6 +9,8 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmock"
 )
 
 func setupTestServer(t *testing.T) *Server {
@@ -287,41 +289,18 @@ func TestSessionManagement_Me(t *testing.T) {
 }
 
 func TestNotionAuthFlow(t *testing.T) {
-	// 1. Setup Mock OAuth Server
-	mockOAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/token" {
-			if r.Method != "POST" {
-				t.Errorf("Expected POST to /token, got %s", r.Method)
-				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(`{
-				"access_token": "mock_access_token",
-				"token_type": "bearer",
-				"expires_in": 3600,
-				"workspace_id": "mock_workspace_id",
-				"bot_id": "mock_bot_id"
-			}`))
-			return
-		}
-		// Allow any other path for authorize redirect if needed
-		http.Error(w, "not found", http.StatusNotFound)
-	}))
-	defer mockOAuthServer.Close()
-
-	// 2. Set the Notion URL base to point to the mock server
-	originalNotionURLBase := setNotionURLBase(mockOAuthServer.URL + "/")
-	defer func() {
-		setNotionURLBase(originalNotionURLBase)
-	}()
-
-	// 3. Setup Server with Mock URLs
+	// 1. Setup the mock Notion API, whose OAuth endpoints approve at once
+	mock := notionmock.New(notionmock.Options{ClientID: "test_client_id", ClientSecret: "test_client_secret"})
+	mockNotion := httptest.NewServer(mock)
+	defer mockNotion.Close()
+
+	// 2. Setup Server, with NOTION_API_URL pointing OAuth at the mock
 	cfg := &Config{
 		Port:               "8080",
 		SessionKey:         "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=",
 		NotionClientID:     "test_client_id",
 		NotionClientSecret: "test_client_secret",
+		NotionAPIURL:       mockNotion.URL,
 		PublicURL:          "http://localhost:8080",
 		FrontendDir:        "../../frontend/dist",
 	}
@@ -372,18 +351,30 @@ func TestNotionAuthFlow(t *testing.T) {
 	}
 
 	// Verify redirect to mock auth URL
-	if !strings.HasPrefix(loc.String(), mockOAuthServer.URL+"/authorize") {
-		t.Errorf("Expected redirect to %s..., got %s", mockOAuthServer.URL+"/authorize", loc.String())
+	if !strings.HasPrefix(loc.String(), mockNotion.URL+"/v1/oauth/authorize") {
+		t.Errorf("Expected redirect to %s..., got %s", mockNotion.URL+"/v1/oauth/authorize", loc.String())
 	}
 
-	state := loc.Query().Get("state")
-	if state == "" {
+	if loc.Query().Get("state") == "" {
 		t.Error("State parameter missing in redirect URL")
 	}
 
-	// 5. Callback
-	// Simulate the user being redirected back with code and state
-	callbackURL := ts.URL + "/auth/callback/notion?code=mock_code&state=" + state
+	// 5. Authorize
+	// The mock approves at once, redirecting back to the public URL with a
+	// code and the state
+	resp, err = client.Get(loc.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	approved, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || approved.Query().Get("code") == "" {
+		t.Fatalf("Expected the mock to approve, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// 6. Callback
+	// Follow the redirect to the test server rather than the public URL
+	callbackURL := ts.URL + approved.Path + "?" + approved.RawQuery
 	callbackReq, _ := http.NewRequest("GET", callbackURL, nil)
 
 	resp, err = client.Do(callbackReq)
@@ -397,7 +388,7 @@ func TestNotionAuthFlow(t *testing.T) {
 		t.Fatalf("Expected 302 Found at callback, got %d. Body: %s", resp.StatusCode, string(body))
 	}
 
-	// 6. Verify Token in Session
+	// 7. Verify Token in Session
 	meReq, _ := http.NewRequest("GET", ts.URL+"/auth/me", nil)
 	resp, err = client.Do(meReq)
 	if err != nil {
@@ -434,4 +425,14 @@ func TestNotionAuthFlow(t *testing.T) {
 	if !hasNotion {
 		t.Errorf("Expected 'notion' in services list, got %v", services)
 	}
+
+	// 8. Verify the issued token is accepted through the proxy
+	resp, err = client.Get(ts.URL + "/api/notion/v1/users/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 OK from the proxy, got %d", resp.StatusCode)
+	}
 }
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionMaxBatch bounds the number of sub-requests in a batch. At Notion's
+// rate limit a full batch takes around 15 seconds.
+const notionMaxBatch = 50
+
+// notionAllowedRequests lists the Notion API requests that sessions may make
+// through the batch endpoint, as "METHOD /path". A "*" segment
+// matches any single path segment, such as an object ID.
+var notionAllowedRequests = []string{
+	"POST /v1/search",
+	"GET /v1/users",
+	"GET /v1/users/*",
+	"POST /v1/pages",
+	"GET /v1/pages/*",
+	"PATCH /v1/pages/*",
+	"GET /v1/pages/*/properties/*",
+	"GET /v1/blocks/*",
+	"PATCH /v1/blocks/*",
+	"DELETE /v1/blocks/*",
+	"GET /v1/blocks/*/children",
+	"PATCH /v1/blocks/*/children",
+	"GET /v1/databases/*",
+	"GET /v1/data_sources/*",
+	"POST /v1/data_sources/*/query",
+}
+
+// notionRequestAllowed reports whether a request with the given method and
+// Notion API path matches the allowlist. Paths with empty, "." or ".."
+// segments never match.
+func notionRequestAllowed(method, path string) bool {
+	segments := strings.Split(path, "/")
+	for _, seg := range segments[1:] {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	for _, allowed := range notionAllowedRequests {
+		allowedMethod, allowedPath, _ := strings.Cut(allowed, " ")
+		if method == allowedMethod && matchSegments(strings.Split(allowedPath, "/"), segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments reports whether path segments match a pattern's segments.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) != len(segments) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// notionBatchItem is a Notion API request in a batch. Path is a Notion API
+// path such as "/v1/blocks/<id>/children?page_size=100".
+type notionBatchItem struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// notionBatchResult is the response to one sub-request. Body is Notion's
+// JSON response, or an error object in Notion's format for sub-requests that
+// were rejected or could not be sent.
+type notionBatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// notionErrorBody returns an error response body in Notion's format.
+func notionErrorBody(status int, code, message string) json.RawMessage {
+	body, _ := json.Marshal(map[string]any{"object": "error", "status": status, "code": code, "message": message})
+	return body
+}
+
+// notionBatchEndpoint sends a sequence of Notion API requests in one
+// round-trip. Sub-requests run in order, are limited to notionAllowedRequests,
+// and share the token's rate limit with the proxy. A failed sub-request does not
+// stop the batch; each result carries its own status.
+func (s *Server) notionBatchEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req struct {
+		Requests []notionBatchItem `json:"requests"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Requests) == 0 {
+		return nil, endpoint.Error(http.StatusBadRequest, "requests is required", nil)
+	}
+	if len(req.Requests) > notionMaxBatch {
+		return nil, endpoint.Error(http.StatusBadRequest, "too many requests in batch", nil)
+	}
+
+	ctx := r.Context()
+	client := s.newNotionClient(token)
+	results := make([]notionBatchResult, len(req.Requests))
+	for i, item := range req.Requests {
+		u, err := url.Parse(item.Path)
+		if err != nil || u.Scheme != "" || u.Host != "" || !notionRequestAllowed(item.Method, u.Path) {
+			results[i] = notionBatchResult{
+				Status: http.StatusForbidden,
+				Body:   notionErrorBody(http.StatusForbidden, "restricted_resource", "Notion API request not allowed: "+item.Method+" "+item.Path),
+			}
+			continue
+		}
+
+		var payload []byte
+		if len(item.Body) > 0 && string(item.Body) != "null" {
+			payload = item.Body
+		}
+		status, data, err := client.send(ctx, item.Method, u.RequestURI(), payload)
+		if ctx.Err() != nil {
+			return nil, endpoint.Error(http.StatusServiceUnavailable, "request cancelled", ctx.Err())
+		}
+		if err != nil {
+			results[i] = notionBatchResult{
+				Status: http.StatusBadGateway,
+				Body:   notionErrorBody(http.StatusBadGateway, "bad_gateway", err.Error()),
+			}
+			continue
+		}
+		if !json.Valid(data) {
+			data, _ = json.Marshal(string(data))
+		}
+		results[i] = notionBatchResult{Status: status, Body: data}
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{"results": results}}, nil
+}
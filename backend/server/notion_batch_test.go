@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotionBatch(t *testing.T) {
+	var seen []string
+	s := setupTestServer(t)
+	useMockNotion(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen = append(seen, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/pages/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"object":"error","status":404,"code":"object_not_found","message":"Not found"}`))
+		default:
+			w.Write([]byte(`{"object":"page","path":"` + r.URL.Path + `"}`))
+		}
+	}))
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	resp := postJSON(t, ts, "/api/notion/batch", map[string]any{"requests": []map[string]any{
+		{"method": "GET", "path": "/v1/pages/p1"},
+		{"method": "POST", "path": "/v1/search", "body": map[string]any{"query": "Standup"}},
+		{"method": "GET", "path": "/v1/blocks/b1/children?page_size=100"},
+		{"method": "GET", "path": "/v1/pages/missing"},
+		{"method": "POST", "path": "/v1/oauth/token"},
+		{"method": "GET", "path": "/v1/pages/../users"},
+		{"method": "GET", "path": "https://evil.example/v1/pages/p1"},
+	}}, cookies)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var result struct {
+		Results []struct {
+			Status int            `json:"status"`
+			Body   map[string]any `json:"body"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	wantStatus := []int{200, 200, 200, 404, 403, 403, 403}
+	if len(result.Results) != len(wantStatus) {
+		t.Fatalf("Expected %d results, got %d", len(wantStatus), len(result.Results))
+	}
+	for i, want := range wantStatus {
+		if got := result.Results[i].Status; got != want {
+			t.Errorf("Result %d: expected status %d, got %d", i, want, got)
+		}
+	}
+	if got := result.Results[0].Body["path"]; got != "/v1/pages/p1" {
+		t.Errorf("Unexpected body for first result: %v", result.Results[0].Body)
+	}
+	if got := result.Results[3].Body["code"]; got != "object_not_found" {
+		t.Errorf("Expected Notion's error body, got %v", result.Results[3].Body)
+	}
+	if got := result.Results[4].Body["code"]; got != "restricted_resource" {
+		t.Errorf("Expected restricted_resource error, got %v", result.Results[4].Body)
+	}
+
+	want := []string{
+		"GET /v1/pages/p1 ",
+		`POST /v1/search {"query":"Standup"}`,
+		"GET /v1/blocks/b1/children?page_size=100 ",
+		"GET /v1/pages/missing ",
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("Expected %d requests to Notion, got %v", len(want), seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("Request %d: expected %q, got %q", i, want[i], seen[i])
+		}
+	}
+
+	// The allowlist is the batch endpoint's; the proxy forwards any request.
+	resp = getWithCookies(t, ts, "/api/notion/v1/comments?block_id=b1", cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || seen[len(seen)-1] != "GET /v1/comments?block_id=b1 " {
+		t.Errorf("Expected proxy to forward the request, got %d", resp.StatusCode)
+	}
+
+	for name, body := range map[string]any{
+		"Empty":     map[string]any{"requests": []any{}},
+		"Too large": map[string]any{"requests": make([]map[string]any, notionMaxBatch+1)},
+	} {
+		resp := postJSON(t, ts, "/api/notion/batch", body, cookies)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, resp.StatusCode)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	// The burst is available at once, after which slots are spaced by
+	// 1/rate in the order they were reserved.
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, l.reserve("a"))
+	}
+	want := []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("Reservation %d: expected delay %v, got %v", i, want[i], delays[i])
+		}
+	}
+
+	// Other keys have their own buckets.
+	if d := l.reserve("b"); d != 0 {
+		t.Errorf("Expected no delay for another key, got %v", d)
+	}
+
+	// A cancelled reservation gives its slot back.
+	l.cancel("a")
+	if d := l.reserve("a"); d != time.Second {
+		t.Errorf("Expected cancelled slot to be reused, got %v", d)
+	}
+
+	// Once refilled, a bucket allows a full burst again.
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		if d := l.reserve("a"); d != 0 {
+			t.Errorf("Expected no delay after refilling, got %v", d)
+		}
+	}
+
+	// Idle buckets are dropped, but only once per sweep interval.
+	if len(l.buckets) != 2 {
+		t.Errorf("Expected buckets to be kept until the next sweep, have %d", len(l.buckets))
+	}
+	now = now.Add(rateLimiterSweepInterval)
+	l.reserve("a")
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be dropped, have %d", len(l.buckets))
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmd"
+)
+
+// Notion API request limits.
+const (
+	notionMaxTextLength  = notionmd.MaxTextLength
+	notionMaxRichText    = notionmd.MaxRichText
+	notionMaxChildren    = notionmd.MaxChildren
+	notionMaxMultiSelect = 100
+)
+
+// notionBlock is a Notion block to be created. Blocks are encoded for
+// append requests by notionmd.EncodeBlock, and their notionmd.Deferred
+// children appended under them afterwards.
+type notionBlock = notionmd.Block
+
+// textBlocks creates blocks of the given type holding rich text, continuing
+// in further blocks when the text needs more rich text items than one allows.
+func textBlocks(typ string, items ...notionmd.Text) []*notionBlock {
+	return notionmd.TextBlocks(typ, items...)
+}
+
+// markdownBlocks converts Markdown text into blocks.
+func markdownBlocks(text string) []*notionBlock {
+	return notionmd.Convert([]byte(text))
+}
+
+// blockFingerprint summarises a block's type and text for change detection.
+// It accepts both blocks being written, whose rich text carries text.content,
+// and blocks returned by Notion, which also carry plain_text.
+func blockFingerprint(block json.RawMessage) string {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(block, &typed) != nil || json.Unmarshal(block, &fields) != nil {
+		return ""
+	}
+	var data struct {
+		RichText []struct {
+			PlainText string `json:"plain_text"`
+			Text      *struct {
+				Content string `json:"content"`
+			} `json:"text"`
+		} `json:"rich_text"`
+	}
+	json.Unmarshal(fields[typed.Type], &data)
+
+	h := sha256.New()
+	h.Write([]byte(typed.Type))
+	h.Write([]byte{0})
+	for _, rt := range data.RichText {
+		if rt.PlainText == "" && rt.Text != nil {
+			h.Write([]byte(rt.Text.Content))
+		} else {
+			h.Write([]byte(rt.PlainText))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+// writtenFingerprint returns the blockFingerprint of a block being written.
+func writtenFingerprint(b *notionBlock) string {
+	raw, _ := json.Marshal(notionmd.EncodeBlock(b))
+	return blockFingerprint(raw)
+}
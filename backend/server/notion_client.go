@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionVersion is the Notion-Version header sent on server-side Notion API
+// calls. It matches the API version used by the frontend SDK.
+const notionVersion = "2025-09-03"
+
+// notionMaxRetries bounds how many times a rate-limited (429) request is retried.
+const notionMaxRetries = 3
+
+// notionClient is a minimal JSON client for the Notion API used by backend
+// endpoints that talk to Notion directly rather than through the proxy.
+type notionClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// newNotionClient creates a client that authenticates with the given token
+// against the Notion API at baseURL.
+func newNotionClient(baseURL, token string) *notionClient {
+	return &notionClient{
+		baseURL:    baseURL,
+		token:      token,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// newNotionClient creates a client for the server's Notion API that
+// authenticates with the given token.
+func (s *Server) newNotionClient(token string) *notionClient {
+	return newNotionClient(s.notionAPIURL, token)
+}
+
+// notionAPIError is returned for non-2xx responses from the Notion API.
+type notionAPIError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *notionAPIError) Error() string {
+	return fmt.Sprintf("notion: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// do sends a request to the Notion API and decodes the JSON response into out
+// (if non-nil).
+func (c *notionClient) do(ctx context.Context, method, path string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("notion: encode request: %w", err)
+		}
+	}
+
+	status, data, err := c.send(ctx, method, path, payload)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		apiErr := &notionAPIError{Status: status}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Code = http.StatusText(status)
+			apiErr.Message = string(data)
+		}
+		// The Notion error body carries its own status; prefer the real one.
+		apiErr.Status = status
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("notion: decode response: %w", err)
+	}
+	return nil
+}
+
+// send sends a request with a JSON payload (if non-nil) to the Notion API
+// and returns the response status and body. Requests are paced by the
+// token's rate limit, and rate-limited requests are retried after the
+// Retry-After delay.
+func (c *notionClient) send(ctx context.Context, method, path string, payload []byte) (int, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		if err := notionRateLimit.wait(ctx, c.token); err != nil {
+			return 0, nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.baseURL, "/")+path, bytes.NewReader(payload))
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Notion-Version", notionVersion)
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		trace := notionTraceFrom(ctx)
+		entry := notionLogEntry{Time: time.Now().UTC(), Method: method, Path: path}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			entry.LatencyMS, entry.Error = time.Since(entry.Time).Milliseconds(), err.Error()
+			trace.record(entry, c.token, fullBody(payload), notionBody{})
+			return 0, nil, fmt.Errorf("notion: %s %s: %w", method, path, err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		entry.LatencyMS, entry.Status = time.Since(entry.Time).Milliseconds(), resp.StatusCode
+		entry.RequestID = notionRequestID(resp.Header, data)
+		if err != nil {
+			entry.Error = err.Error()
+			trace.record(entry, c.token, fullBody(payload), fullBody(data))
+			return 0, nil, fmt.Errorf("notion: read response: %w", err)
+		}
+		trace.record(entry, c.token, fullBody(payload), fullBody(data))
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < notionMaxRetries {
+			if err := sleepContext(ctx, retryAfter(resp.Header.Get("Retry-After"))); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		return resp.StatusCode, data, nil
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds, defaulting to one
+// second when absent or malformed.
+func retryAfter(header string) time.Duration {
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return time.Second
+}
+
+// sleepContext waits for d or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// notionEndpointError converts an error from notionClient into an endpoint
+// error. Client errors reported by Notion keep their status; everything else
+// is reported as a bad gateway.
+func notionEndpointError(err error) error {
+	var apiErr *notionAPIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Status {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusTooManyRequests:
+			return endpoint.Error(apiErr.Status, apiErr.Message, err)
+		}
+	}
+	return endpoint.Error(http.StatusBadGateway, "Notion request failed", err)
+}
+
+// sameNotionID reports whether two Notion IDs refer to the same object. Notion
+// accepts IDs with or without dashes.
+func sameNotionID(a, b string) bool {
+	return strings.EqualFold(strings.ReplaceAll(a, "-", ""), strings.ReplaceAll(b, "-", ""))
+}
+
+// compactNotionID returns id in a canonical form, without dashes and in
+// lower case, for use as a map key.
+func compactNotionID(id string) string {
+	return strings.ToLower(strings.ReplaceAll(id, "-", ""))
+}
+
+// listBlockChildren pages through the children of a block or page.
+func (c *notionClient) listBlockChildren(ctx context.Context, id string) ([]json.RawMessage, error) {
+	var children []json.RawMessage
+	cursor := ""
+	for {
+		path := "/v1/blocks/" + url.PathEscape(id) + "/children?page_size=100"
+		if cursor != "" {
+			path += "&start_cursor=" + url.QueryEscape(cursor)
+		}
+		var resp struct {
+			Results    []json.RawMessage `json:"results"`
+			HasMore    bool              `json:"has_more"`
+			NextCursor string            `json:"next_cursor"`
+		}
+		if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		children = append(children, resp.Results...)
+		if !resp.HasMore || resp.NextCursor == "" {
+			return children, nil
+		}
+		cursor = resp.NextCursor
+	}
+}
+
+// isNotFound reports whether err is a Notion 404 error.
+func isNotFound(err error) bool {
+	var apiErr *notionAPIError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
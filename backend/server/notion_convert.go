@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmd"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionConvertEndpoint converts Markdown into the Notion blocks an export
+// would create, nested as they end up on the page, so that clients can
+// preview them.
+func (s *Server) notionConvertEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	if _, err := sessionUserKey(r); err != nil {
+		return nil, err
+	}
+
+	var req struct {
+		Markdown string `json:"markdown"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	blocks := notionmd.Encode(notionmd.Convert([]byte(req.Markdown)))
+	return &endpoint.JSONRenderer{Value: map[string]any{"blocks": blocks}}, nil
+}
@@ -0,0 +1,491 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmd"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionExportParent identifies where an exported page is created. Exactly
+// one of the IDs must be set.
+type notionExportParent struct {
+	PageID       string `json:"page_id,omitempty"`
+	DatabaseID   string `json:"database_id,omitempty"`
+	DataSourceID string `json:"data_source_id,omitempty"`
+}
+
+// validate checks that exactly one parent ID is set.
+func (p notionExportParent) validate() error {
+	set := 0
+	for _, id := range []string{p.PageID, p.DatabaseID, p.DataSourceID} {
+		if id != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("parent must have exactly one of page_id, database_id or data_source_id")
+	}
+	return nil
+}
+
+// notionExportRequest is the body of POST /api/export/notion.
+type notionExportRequest struct {
+	Parent     notionExportParent `json:"parent"`
+	Transcript Transcript         `json:"transcript"`
+	// TimeZone is the IANA time zone used to format turn timestamps.
+	// Defaults to UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+	// Force overwrites blocks that were edited or deleted in Notion since the
+	// last export instead of failing with a conflict.
+	Force bool `json:"force,omitempty"`
+}
+
+// notionExportResponse is returned after a successful export. The section
+// counts describe how an existing page was updated on re-export.
+type notionExportResponse struct {
+	PageID    string `json:"page_id"`
+	URL       string `json:"url"`
+	Created   bool   `json:"created"`
+	Added     int    `json:"sections_added"`
+	Replaced  int    `json:"sections_replaced"`
+	Removed   int    `json:"sections_removed"`
+	Unchanged int    `json:"sections_unchanged"`
+	// DryRun is set when nothing was written; Requests then lists the
+	// requests the export would make.
+	DryRun   bool              `json:"dry_run,omitempty"`
+	Requests []*plannedRequest `json:"requests,omitempty"`
+}
+
+// notionExportRecord remembers the page a transcript was exported to and the
+// blocks written for each section, so that re-exports can update the page.
+type notionExportRecord struct {
+	Parent     notionExportParent `json:"parent"`
+	PageID     string             `json:"page_id"`
+	URL        string             `json:"url"`
+	Sections   []exportedSection  `json:"sections"`
+	ExportedAt time.Time          `json:"exported_at"`
+
+	// Deleted, LastEditedAt and MovedAt are kept current by Notion webhook
+	// events for the page. LastEventAt is the time of the latest event
+	// applied.
+	Deleted      bool      `json:"deleted,omitempty"`
+	LastEditedAt time.Time `json:"last_edited_at,omitzero"`
+	MovedAt      time.Time `json:"moved_at,omitzero"`
+	LastEventAt  time.Time `json:"last_event_at,omitzero"`
+}
+
+// exportedSection records the top-level blocks written for a section and the
+// fingerprint of each block at the time of writing.
+type exportedSection struct {
+	Key          string   `json:"key"`
+	BlockIDs     []string `json:"block_ids"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// exportSection is a contiguous run of blocks generated from one part of a
+// transcript. Sections are the unit of change on re-export.
+type exportSection struct {
+	Key    string
+	Blocks []*notionBlock
+}
+
+// fingerprints returns the fingerprints of the section's blocks.
+func (sec exportSection) fingerprints() []string {
+	fps := make([]string, len(sec.Blocks))
+	for i, b := range sec.Blocks {
+		fps[i] = writtenFingerprint(b)
+	}
+	return fps
+}
+
+// exportConflict describes a block written by a previous export that has
+// since been changed in Notion.
+type exportConflict struct {
+	BlockID string `json:"block_id"`
+	Section string `json:"section"`
+	// Kind is "edited" or "deleted".
+	Kind string `json:"kind"`
+}
+
+// exportConflictError is returned when a re-export would overwrite changes
+// made in Notion.
+type exportConflictError struct {
+	Conflicts []exportConflict
+}
+
+func (e *exportConflictError) Error() string {
+	edited, deleted := 0, 0
+	for _, c := range e.Conflicts {
+		if c.Kind == "deleted" {
+			deleted++
+		} else {
+			edited++
+		}
+	}
+	return fmt.Sprintf("page was changed in Notion since the last export (%d blocks edited, %d deleted); export with force to overwrite", edited, deleted)
+}
+
+// notionPage is the subset of a Notion page object returned on creation.
+type notionPage struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// transcriptSections lays out the transcript body: summary and notes sections
+// followed by one paragraph per turn, headed by the speaker and time.
+// Headings are sections of their own so that they stay in place when the
+// text beneath them changes.
+func transcriptSections(t Transcript, loc *time.Location) []exportSection {
+	var sections []exportSection
+
+	if t.Summary != "" {
+		sections = append(sections,
+			exportSection{Key: "summary:heading", Blocks: textBlocks("heading_2", notionmd.Text{Content: "Summary"})},
+			exportSection{Key: "summary", Blocks: markdownBlocks(t.Summary)},
+		)
+	}
+
+	if t.Notes != "" {
+		sections = append(sections,
+			exportSection{Key: "notes:heading", Blocks: textBlocks("heading_2", notionmd.Text{Content: "Notes"})},
+			exportSection{Key: "notes", Blocks: markdownBlocks(t.Notes)},
+		)
+	}
+
+	if len(t.Turns) > 0 {
+		sections = append(sections, exportSection{Key: "transcript:heading", Blocks: textBlocks("heading_2", notionmd.Text{Content: "Transcript"})})
+		seen := make(map[string]int, len(t.Turns))
+		for _, turn := range t.Turns {
+			// Turns are keyed by when and by whom they were said rather than
+			// by position, so that adding or removing a turn leaves the
+			// sections of the others alone.
+			key := "turn:" + turn.Timestamp.UTC().Format(time.RFC3339Nano) + ":" + turn.Speaker
+			if seen[key]++; seen[key] > 1 {
+				key += "#" + strconv.Itoa(seen[key])
+			}
+			sections = append(sections, exportSection{Key: key, Blocks: turnBlocks(turn, loc)})
+		}
+	}
+
+	// Whitespace-only text produces no blocks; drop such sections.
+	nonEmpty := sections[:0]
+	for _, sec := range sections {
+		if len(sec.Blocks) > 0 {
+			nonEmpty = append(nonEmpty, sec)
+		}
+	}
+	return nonEmpty
+}
+
+// turnBlocks renders a turn as "**Speaker** (15:04:05)" followed by its text.
+func turnBlocks(turn Turn, loc *time.Location) []*notionBlock {
+	items := []notionmd.Text{
+		{Content: turn.Speaker, Annotations: notionmd.Annotations{Bold: true}},
+		{Content: " (" + turn.Timestamp.In(loc).Format(time.TimeOnly) + ")", Annotations: notionmd.Annotations{Color: "gray"}},
+	}
+	if text := turn.content(); text != "" {
+		items = append(items, notionmd.Text{Content: "\n" + text})
+	}
+	return textBlocks("paragraph", items...)
+}
+
+// exportTarget describes where an exported page is created.
+type exportTarget struct {
+	// Parent is the parent object for the new page.
+	Parent map[string]any
+	// TitleProperty is the name of the page's title property.
+	TitleProperty string
+	// DatabaseID is the database the page is created in, if any.
+	DatabaseID string
+	// Schema maps property names to property types for database pages.
+	Schema map[string]string
+}
+
+// resolveExportParent resolves where a page is created. Database parents are
+// resolved to their first data source, as pages are created in data sources.
+func (c *notionClient) resolveExportParent(ctx context.Context, p notionExportParent) (*exportTarget, error) {
+	if p.PageID != "" {
+		return &exportTarget{
+			Parent:        map[string]any{"type": "page_id", "page_id": p.PageID},
+			TitleProperty: "title",
+		}, nil
+	}
+
+	dataSourceID := p.DataSourceID
+	if p.DatabaseID != "" {
+		var err error
+		if dataSourceID, err = c.firstDataSource(ctx, p.DatabaseID); err != nil {
+			return nil, err
+		}
+	}
+
+	var ds struct {
+		Parent     notionParent `json:"parent"`
+		Properties map[string]struct {
+			Type string `json:"type"`
+		} `json:"properties"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/data_sources/"+dataSourceID, nil, &ds); err != nil {
+		return nil, err
+	}
+	target := &exportTarget{
+		Parent:     map[string]any{"type": "data_source_id", "data_source_id": dataSourceID},
+		DatabaseID: p.DatabaseID,
+		Schema:     make(map[string]string, len(ds.Properties)),
+	}
+	if target.DatabaseID == "" {
+		target.DatabaseID = ds.Parent.DatabaseID
+	}
+	for name, prop := range ds.Properties {
+		target.Schema[name] = prop.Type
+		if prop.Type == "title" {
+			target.TitleProperty = name
+		}
+	}
+	if target.TitleProperty == "" {
+		return nil, &notionAPIError{Status: http.StatusBadRequest, Code: "validation_error", Message: "data source has no title property"}
+	}
+	return target, nil
+}
+
+// firstDataSource returns the ID of a database's first data source.
+func (c *notionClient) firstDataSource(ctx context.Context, databaseID string) (string, error) {
+	var db struct {
+		DataSources []struct {
+			ID string `json:"id"`
+		} `json:"data_sources"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/databases/"+databaseID, nil, &db); err != nil {
+		return "", err
+	}
+	if len(db.DataSources) == 0 {
+		return "", &notionAPIError{Status: http.StatusBadRequest, Code: "validation_error", Message: "database has no data sources"}
+	}
+	return db.DataSources[0].ID, nil
+}
+
+// exportedPageExists reports whether a previously exported page still exists
+// and has not been moved to the trash.
+func (c *notionClient) exportedPageExists(ctx context.Context, pageID string) (bool, error) {
+	var page struct {
+		Archived bool `json:"archived"`
+		InTrash  bool `json:"in_trash"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/pages/"+pageID, nil, &page); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !page.Archived && !page.InTrash, nil
+}
+
+// exportConflicts compares the blocks recorded for an export with the page's
+// current top-level blocks and reports blocks edited or deleted in Notion.
+// Blocks added in Notion are not conflicts; they are left in place.
+func (c *notionClient) exportConflicts(ctx context.Context, rec *notionExportRecord) ([]exportConflict, error) {
+	children, err := c.listBlockChildren(ctx, rec.PageID)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]string, len(children))
+	for _, raw := range children {
+		var block struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &block) == nil {
+			current[block.ID] = blockFingerprint(raw)
+		}
+	}
+
+	var conflicts []exportConflict
+	for _, sec := range rec.Sections {
+		for i, id := range sec.BlockIDs {
+			fp, ok := current[id]
+			switch {
+			case !ok:
+				conflicts = append(conflicts, exportConflict{BlockID: id, Section: sec.Key, Kind: "deleted"})
+			case fp != sec.Fingerprints[i]:
+				conflicts = append(conflicts, exportConflict{BlockID: id, Section: sec.Key, Kind: "edited"})
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// notionExportEndpoint exports a transcript to Notion.
+//
+// Transcripts with an ID are exported idempotently: the first export creates a
+// page and later exports to the same parent update that page, failing with 409
+// Conflict if blocks were changed in Notion in the meantime (unless forced).
+// Transcripts without an ID always create a new page.
+//
+// With dry_run=true, the planned requests are returned instead of being made.
+// Only the reads needed to plan, such as resolving a database parent or
+// checking a previous export for conflicts, are sent to Notion.
+func (s *Server) notionExportEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
+	}
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return nil, endpoint.Error(http.StatusBadRequest, "invalid dry_run", err)
+		}
+	}
+
+	var req notionExportRequest
+	if err := decodeTranscriptBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	if err := req.Parent.validate(); err != nil {
+		return nil, endpoint.Error(http.StatusBadRequest, err.Error(), err)
+	}
+	loc := time.UTC
+	if req.TimeZone != "" {
+		if loc, err = time.LoadLocation(req.TimeZone); err != nil {
+			return nil, endpoint.Error(http.StatusBadRequest, "invalid time_zone", err)
+		}
+	}
+
+	ctx := r.Context()
+	client := s.newNotionClient(token)
+	recordKey := userKey + "/" + req.Transcript.ID
+
+	// Database pages get the transcript's metadata in the properties chosen
+	// by the user's saved mapping for that database.
+	target, err := client.resolveExportParent(ctx, req.Parent)
+	if err != nil {
+		return nil, notionEndpointError(err)
+	}
+	var properties map[string]any
+	if mapping, ok := s.notionMappings.Get(mappingKey(userKey, target.DatabaseID)); ok && target.DatabaseID != "" {
+		if properties, err = mapping.propertyValues(req.Transcript, target.Schema, loc); err != nil {
+			return nil, endpoint.Error(http.StatusUnprocessableEntity, err.Error(), err)
+		}
+	}
+
+	var rec *notionExportRecord
+	if req.Transcript.ID != "" {
+		// A page known to be deleted is not looked up again; the transcript
+		// is exported to a new page.
+		if prev, ok := s.notionExports.Get(recordKey); ok && prev.Parent == req.Parent && !prev.Deleted {
+			exists, err := client.exportedPageExists(ctx, prev.PageID)
+			if err != nil {
+				return nil, notionEndpointError(err)
+			}
+			if exists {
+				rec = &prev
+			}
+		}
+	}
+
+	resp := notionExportResponse{}
+	sections := transcriptSections(req.Transcript, loc)
+	var plan *exportPlan
+	if rec != nil {
+		conflicts, err := client.exportConflicts(ctx, rec)
+		if err != nil {
+			return nil, notionEndpointError(err)
+		}
+		plan, err = planUpdate(rec, sections, conflicts, req.Force, &resp)
+		var conflictErr *exportConflictError
+		if errors.As(err, &conflictErr) {
+			return nil, endpoint.Error(http.StatusConflict, conflictErr.Error(), err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		plan.updatePageProperties(rec.PageID, target, req.Transcript.Title, properties)
+		resp.PageID, resp.URL = rec.PageID, rec.URL
+	} else {
+		plan = planCreate(target, req.Transcript.Title, sections, properties)
+		resp.Created = true
+		resp.Added = len(plan.Sections)
+	}
+
+	if dryRun {
+		resp.DryRun = true
+		resp.Requests = plan.Requests
+		return &endpoint.JSONRenderer{Value: resp}, nil
+	}
+
+	result, err := client.execute(ctx, plan)
+	if err != nil {
+		// Record the blocks written before the failure, so that the next
+		// export updates them rather than leaving them behind.
+		if pageID, ok := result.IDs["{page}"]; req.Transcript.ID != "" && (rec != nil || ok) {
+			if rec == nil {
+				rec = &notionExportRecord{Parent: req.Parent, PageID: pageID, URL: result.URLs["{page}"]}
+			}
+			rec.Sections = result.written(plan, rec.Sections)
+			rec.ExportedAt = time.Now().UTC()
+			if err := s.notionExports.Put(recordKey, *rec); err != nil {
+				log.Printf("Notion export: failed to save partial export record: %v", err)
+			}
+		}
+		return nil, notionEndpointError(err)
+	}
+	if rec == nil {
+		rec = &notionExportRecord{Parent: req.Parent, PageID: result.IDs["{page}"], URL: result.URLs["{page}"]}
+		resp.PageID, resp.URL = rec.PageID, rec.URL
+	}
+	if rec.Sections, err = result.sections(plan.Sections); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to record export", err)
+	}
+
+	if req.Transcript.ID != "" {
+		rec.ExportedAt = time.Now().UTC()
+		if err := s.notionExports.Put(recordKey, *rec); err != nil {
+			return nil, endpoint.Error(http.StatusInternalServerError, "failed to save export record", err)
+		}
+	}
+	if err := s.recordRecentDestination(userKey, req.Parent); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to save recent destination", err)
+	}
+	return &endpoint.JSONRenderer{Value: resp}, nil
+}
+
+// notionExportStatusEndpoint returns what is known about the page a
+// transcript was exported to, including changes reported by Notion webhook
+// events since the export.
+func (s *Server) notionExportStatusEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := s.notionExports.Get(userKey + "/" + r.PathValue("transcript_id"))
+	if !ok {
+		return nil, endpoint.Error(http.StatusNotFound, "transcript has not been exported", nil)
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{
+		"page_id":        rec.PageID,
+		"url":            rec.URL,
+		"exported_at":    rec.ExportedAt,
+		"deleted":        rec.Deleted,
+		"last_edited_at": nullTime(rec.LastEditedAt),
+		"moved_at":       nullTime(rec.MovedAt),
+		"edited":         rec.LastEditedAt.After(rec.ExportedAt),
+	}}, nil
+}
+
+// nullTime returns t, or nil for the zero time so that it encodes as null.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
@@ -0,0 +1,1030 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmock"
+)
+
+// fakeNotionPages is a minimal stand-in for the Notion pages and blocks APIs.
+// It records created pages and appended blocks, and checks request limits.
+type fakeNotionPages struct {
+	t  *testing.T
+	mu sync.Mutex
+
+	nextID   int
+	pages    map[string]map[string]any // page ID -> create request body
+	trashed  map[string]bool           // page ID -> in trash
+	children map[string][]string       // parent ID -> child block IDs
+	parents  map[string]string         // block ID -> parent ID
+	blocks   map[string]map[string]any // block ID -> block JSON
+	appends  int
+	deletes  int
+
+	dataSources map[string]map[string]any // data source ID -> object
+	databases   map[string]map[string]any // database ID -> object
+}
+
+func newFakeNotionPages(t *testing.T) *fakeNotionPages {
+	return &fakeNotionPages{
+		t:           t,
+		pages:       map[string]map[string]any{},
+		trashed:     map[string]bool{},
+		children:    map[string][]string{},
+		parents:     map[string]string{},
+		blocks:      map[string]map[string]any{},
+		dataSources: map[string]map[string]any{},
+		databases:   map[string]map[string]any{},
+	}
+}
+
+func (f *fakeNotionPages) newID(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%d", prefix, f.nextID)
+}
+
+func (f *fakeNotionPages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v1/pages":
+		if _, ok := body["children"]; ok {
+			f.t.Errorf("Expected page to be created without children")
+		}
+		id := f.newID("page")
+		f.pages[id] = body
+		json.NewEncoder(w).Encode(map[string]any{"object": "page", "id": id, "url": "https://www.notion.so/" + id})
+
+	case r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/v1/blocks/") && strings.HasSuffix(r.URL.Path, "/children"):
+		parentID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/blocks/"), "/children")
+		children, _ := body["children"].([]any)
+		if len(children) > notionMaxChildren {
+			f.t.Errorf("Append of %d children exceeds limit", len(children))
+		}
+		f.appends++
+		after, _ := body["after"].(string)
+		var results []any
+		for _, child := range children {
+			id := f.addBlock(parentID, child.(map[string]any), 1)
+			if after != "" {
+				f.moveAfter(parentID, id, after)
+				after = id
+			}
+			results = append(results, map[string]any{"object": "block", "id": id})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "results": results})
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/blocks/") && strings.HasSuffix(r.URL.Path, "/children"):
+		parentID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/blocks/"), "/children")
+		start, _ := strconv.Atoi(r.URL.Query().Get("start_cursor"))
+		ids := f.children[parentID]
+		end := min(start+100, len(ids))
+		var results []any
+		for _, id := range ids[start:end] {
+			results = append(results, f.blockObject(id))
+		}
+		next := ""
+		if end < len(ids) {
+			next = strconv.Itoa(end)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "results": results, "has_more": next != "", "next_cursor": next})
+
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/v1/blocks/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/blocks/")
+		parentID, ok := f.parents[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"object":"error","status":404,"code":"object_not_found","message":"Could not find block"}`))
+			return
+		}
+		f.deletes++
+		f.removeBlock(parentID, id)
+		json.NewEncoder(w).Encode(map[string]any{"object": "block", "id": id, "in_trash": true})
+
+	case r.Method == "PATCH" && strings.HasPrefix(r.URL.Path, "/v1/pages/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/pages/")
+		page, ok := f.pages[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"object":"error","status":404,"code":"object_not_found","message":"Could not find page"}`))
+			return
+		}
+		props := page["properties"].(map[string]any)
+		for name, value := range body["properties"].(map[string]any) {
+			props[name] = value
+		}
+		json.NewEncoder(w).Encode(map[string]any{"object": "page", "id": id})
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/pages/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/pages/")
+		if _, ok := f.pages[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"object":"error","status":404,"code":"object_not_found","message":"Could not find page"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"object": "page", "id": id, "in_trash": f.trashed[id]})
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/databases/"):
+		db, ok := f.databases[strings.TrimPrefix(r.URL.Path, "/v1/databases/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"object":"error","status":404,"code":"object_not_found","message":"Could not find database"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(db)
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/data_sources/"):
+		ds, ok := f.dataSources[strings.TrimPrefix(r.URL.Path, "/v1/data_sources/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"object":"error","status":404,"code":"object_not_found","message":"Could not find data source"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(ds)
+
+	default:
+		f.t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// addBlock stores a block (and any inline children) and checks its limits.
+func (f *fakeNotionPages) addBlock(parentID string, block map[string]any, depth int) string {
+	if depth > 2 {
+		f.t.Errorf("Block nesting depth %d exceeds limit", depth)
+	}
+	id := f.newID("block")
+	f.blocks[id] = block
+	f.children[parentID] = append(f.children[parentID], id)
+	f.parents[id] = parentID
+
+	typ, _ := block["type"].(string)
+	data, _ := block[typ].(map[string]any)
+	rt, _ := data["rich_text"].([]any)
+	if len(rt) > notionMaxRichText {
+		f.t.Errorf("Block has %d rich text items, exceeds limit", len(rt))
+	}
+	for _, item := range rt {
+		content := item.(map[string]any)["text"].(map[string]any)["content"].(string)
+		if n := len(utf16.Encode([]rune(content))); n > notionMaxTextLength {
+			f.t.Errorf("Rich text item of length %d exceeds limit", n)
+		}
+	}
+	if children, ok := data["children"].([]any); ok {
+		if len(children) > notionMaxChildren {
+			f.t.Errorf("Inline children of %d exceeds limit", len(children))
+		}
+		for _, child := range children {
+			f.addBlock(id, child.(map[string]any), depth+1)
+		}
+	}
+	return id
+}
+
+// moveAfter moves the child id of parentID to directly after the child after.
+func (f *fakeNotionPages) moveAfter(parentID, id, after string) {
+	ids := slices.DeleteFunc(f.children[parentID], func(c string) bool { return c == id })
+	i := slices.Index(ids, after)
+	if i < 0 {
+		f.t.Errorf("Block %s to insert after is not a child of %s", after, parentID)
+		ids = append(ids, id)
+	} else {
+		ids = slices.Insert(ids, i+1, id)
+	}
+	f.children[parentID] = ids
+}
+
+// removeBlock removes a block from its parent.
+func (f *fakeNotionPages) removeBlock(parentID, id string) {
+	f.children[parentID] = slices.DeleteFunc(f.children[parentID], func(c string) bool { return c == id })
+	delete(f.parents, id)
+}
+
+// blockObject returns a stored block as Notion returns it, with plain_text
+// filled in for rich text.
+func (f *fakeNotionPages) blockObject(id string) map[string]any {
+	block := f.blocks[id]
+	typ := block["type"].(string)
+	data := map[string]any{}
+	for k, v := range block[typ].(map[string]any) {
+		data[k] = v
+	}
+	if rt, ok := data["rich_text"].([]any); ok {
+		var items []any
+		for _, item := range rt {
+			copied := map[string]any{}
+			for k, v := range item.(map[string]any) {
+				copied[k] = v
+			}
+			copied["plain_text"] = copied["text"].(map[string]any)["content"]
+			items = append(items, copied)
+		}
+		data["rich_text"] = items
+	}
+	delete(data, "children")
+	return map[string]any{"object": "block", "id": id, "type": typ, typ: data, "has_children": len(f.children[id]) > 0}
+}
+
+// setText replaces the text of a stored block, as an edit in Notion would.
+func (f *fakeNotionPages) setText(id, text string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	block := f.blocks[id]
+	typ := block["type"].(string)
+	block[typ].(map[string]any)["rich_text"] = []any{map[string]any{"type": "text", "text": map[string]any{"content": text}}}
+}
+
+// pageText returns the text of each top-level block of a page.
+func (f *fakeNotionPages) pageText(pageID string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var texts []string
+	for _, id := range f.children[pageID] {
+		texts = append(texts, f.text(id))
+	}
+	return texts
+}
+
+// text returns the concatenated plain text of a stored block.
+func (f *fakeNotionPages) text(id string) string {
+	block := f.blocks[id]
+	typ := block["type"].(string)
+	var b strings.Builder
+	for _, item := range block[typ].(map[string]any)["rich_text"].([]any) {
+		b.WriteString(item.(map[string]any)["text"].(map[string]any)["content"].(string))
+	}
+	return b.String()
+}
+
+func postJSON(t *testing.T, ts *httptest.Server, path string, body any, cookies []*http.Cookie) *http.Response {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", ts.URL+path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	return resp
+}
+
+func TestNotionExport(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+	transcript := Transcript{
+		Title:   "Weekly sync",
+		Summary: "Discussed the roadmap.",
+		Notes:   "First point\n\nSecond point",
+	}
+	for i := 0; i < 150; i++ {
+		transcript.Turns = append(transcript.Turns, Turn{
+			Speaker:   fmt.Sprintf("Speaker %d", i%2),
+			Text:      fmt.Sprintf("Turn %d", i),
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Source:    "transcribed",
+		})
+	}
+	// A turn long enough to need several rich text items, with a multi-unit
+	// rune straddling the item boundary.
+	long := strings.Repeat("a", notionMaxTextLength-1) + "😀" + strings.Repeat("b", 3000)
+	transcript.Turns = append(transcript.Turns, Turn{Speaker: "Speaker 0", Text: long, Timestamp: start})
+
+	resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"page_id": "parent-page"},
+		"transcript": transcript,
+		"time_zone":  "Australia/Sydney",
+	}, cookies)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var result notionExportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.URL != "https://www.notion.so/"+result.PageID {
+		t.Errorf("Unexpected export result %+v", result)
+	}
+
+	page := fake.pages[result.PageID]
+	if parent := page["parent"].(map[string]any); parent["page_id"] != "parent-page" {
+		t.Errorf("Unexpected parent %v", parent)
+	}
+	title := page["properties"].(map[string]any)["title"].(map[string]any)["title"].([]any)
+	if title[0].(map[string]any)["text"].(map[string]any)["content"] != "Weekly sync" {
+		t.Errorf("Unexpected title %v", title)
+	}
+
+	blocks := fake.children[result.PageID]
+	// Summary heading + 1 paragraph, Notes heading + 2 paragraphs,
+	// Transcript heading + 151 turns.
+	if len(blocks) != 157 {
+		t.Fatalf("Expected 157 blocks, got %d", len(blocks))
+	}
+	if fake.appends != 2 {
+		t.Errorf("Expected 2 append requests, got %d", fake.appends)
+	}
+	if got := fake.text(blocks[0]); got != "Summary" || fake.blocks[blocks[0]]["type"] != "heading_2" {
+		t.Errorf("Expected Summary heading, got %q", got)
+	}
+	if got := fake.text(blocks[4]); got != "Second point" {
+		t.Errorf("Expected second notes paragraph, got %q", got)
+	}
+	if got := fake.text(blocks[6]); got != "Speaker 0 (20:30:00)\nTurn 0" {
+		t.Errorf("Unexpected first turn %q", got)
+	}
+	if got := fake.text(blocks[156]); got != "Speaker 0 (20:30:00)\n"+long {
+		t.Errorf("Long turn text was not preserved")
+	}
+}
+
+// TestNotionExport_FrontendTranscript exports a transcript as the frontend's
+// Transcript class serializes it, with its private fields.
+func TestNotionExport_FrontendTranscript(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	body := json.RawMessage(`{
+		"parent": {"page_id": "parent-page"},
+		"transcript": {
+			"title": "Standup",
+			"summary": "",
+			"notes": "",
+			"turns": [
+				{"speaker": "Speaker 0", "text": "Shall we start?", "timestamp": "2026-01-02T09:30:00.000Z", "interim": "", "source": "transcribed"},
+				{"speaker": "User", "text": "Budget first", "timestamp": "2026-01-02T09:30:05.000Z", "interim": "", "source": "typed"}
+			],
+			"activeTurns": {}
+		}
+	}`)
+	resp := postJSON(t, ts, "/api/export/notion", body, cookies)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var result notionExportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	blocks := fake.children[result.PageID]
+	if len(blocks) != 3 || fake.text(blocks[1]) != "Speaker 0 (09:30:00)\nShall we start?" {
+		t.Errorf("Unexpected blocks %v", blocks)
+	}
+}
+
+func TestNotionExport_DatabaseParent(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	fake.databases["db1"] = map[string]any{"object": "database", "id": "db1", "data_sources": []any{map[string]any{"id": "ds1"}}}
+	fake.dataSources["ds1"] = map[string]any{"object": "data_source", "id": "ds1", "properties": map[string]any{
+		"Meeting": map[string]any{"type": "title"},
+		"Date":    map[string]any{"type": "date"},
+	}}
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"database_id": "db1"},
+		"transcript": Transcript{Title: "Standup"},
+	}, cookies)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var result notionExportResponse
+	json.NewDecoder(resp.Body).Decode(&result)
+	page := fake.pages[result.PageID]
+	if parent := page["parent"].(map[string]any); parent["data_source_id"] != "ds1" {
+		t.Errorf("Expected data source parent, got %v", parent)
+	}
+	if _, ok := page["properties"].(map[string]any)["Meeting"]; !ok {
+		t.Errorf("Expected title in the Meeting property, got %v", page["properties"])
+	}
+}
+
+func TestNotionExport_BadRequests(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	tests := []struct {
+		name   string
+		body   any
+		status int
+	}{
+		{"No parent", map[string]any{"transcript": map[string]any{}}, http.StatusBadRequest},
+		{"Two parents", map[string]any{"parent": map[string]any{"page_id": "a", "database_id": "b"}}, http.StatusBadRequest},
+		{"Bad time zone", map[string]any{"parent": map[string]any{"page_id": "a"}, "time_zone": "Nowhere/Else"}, http.StatusBadRequest},
+		{"Missing database", map[string]any{"parent": map[string]any{"database_id": "missing"}}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := postJSON(t, ts, "/api/export/notion", tt.body, cookies)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestNotionExport_Reexport(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+	turn := func(i int, text string) Turn {
+		return Turn{Speaker: "Speaker 0", Text: text, Timestamp: start.Add(time.Duration(i) * time.Minute)}
+	}
+	transcript := Transcript{
+		ID:    "meeting-1",
+		Title: "Planning",
+		Notes: "Agenda",
+		Turns: []Turn{turn(0, "Hello"), turn(1, "Let's start")},
+	}
+
+	export := func(t *testing.T, transcript Transcript, force bool) (*http.Response, notionExportResponse) {
+		t.Helper()
+		resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+			"parent":     map[string]any{"page_id": "parent-page"},
+			"transcript": transcript,
+			"force":      force,
+		}, cookies)
+		defer resp.Body.Close()
+		var result notionExportResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, result
+	}
+
+	_, first := export(t, transcript, false)
+	if !first.Created || first.Added != 5 {
+		t.Fatalf("Expected a new page with 5 sections, got %+v", first)
+	}
+
+	t.Run("Appends new turns and replaces changed ones", func(t *testing.T) {
+		transcript.Turns[1].Text = "Let's start with the roadmap"
+		transcript.Turns = append(transcript.Turns, turn(2, "Sounds good"), turn(3, "Next item"))
+		appends, deletes := fake.appends, fake.deletes
+
+		resp, result := export(t, transcript, false)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if result.Created || result.PageID != first.PageID {
+			t.Errorf("Expected the existing page to be updated, got %+v", result)
+		}
+		if result.Added != 2 || result.Replaced != 1 || result.Unchanged != 4 || result.Removed != 0 {
+			t.Errorf("Unexpected section counts %+v", result)
+		}
+		if got := fake.appends - appends; got != 1 {
+			t.Errorf("Expected 1 append request (replaced and new turns are contiguous), got %d", got)
+		}
+		if got := fake.deletes - deletes; got != 1 {
+			t.Errorf("Expected 1 delete request, got %d", got)
+		}
+		want := []string{
+			"Notes", "Agenda", "Transcript",
+			"Speaker 0 (09:30:00)\nHello",
+			"Speaker 0 (09:31:00)\nLet's start with the roadmap",
+			"Speaker 0 (09:32:00)\nSounds good",
+			"Speaker 0 (09:33:00)\nNext item",
+		}
+		if got := fake.pageText(first.PageID); !slices.Equal(got, want) {
+			t.Errorf("Unexpected page content:\n got %q\nwant %q", got, want)
+		}
+		if len(fake.pages) != 1 {
+			t.Errorf("Expected no duplicate pages, got %d", len(fake.pages))
+		}
+	})
+
+	t.Run("Unchanged transcript writes nothing", func(t *testing.T) {
+		appends, deletes := fake.appends, fake.deletes
+		_, result := export(t, transcript, false)
+		if result.Unchanged != 7 || fake.appends != appends || fake.deletes != deletes {
+			t.Errorf("Expected no writes, got %+v", result)
+		}
+	})
+
+	t.Run("Conflicts with Notion edits", func(t *testing.T) {
+		edited := fake.children[first.PageID][3]
+		fake.setText(edited, "Edited in Notion")
+		transcript.Turns = append(transcript.Turns, turn(4, "More"))
+
+		resp, _ := export(t, transcript, false)
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("Expected status 409, got %d", resp.StatusCode)
+		}
+		if got := fake.pageText(first.PageID)[3]; got != "Edited in Notion" {
+			t.Errorf("Conflicting export should not modify the page, got %q", got)
+		}
+
+		resp, result := export(t, transcript, true)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected forced export to succeed, got %d", resp.StatusCode)
+		}
+		if result.Replaced != 1 || result.Added != 1 {
+			t.Errorf("Unexpected section counts %+v", result)
+		}
+		got := fake.pageText(first.PageID)
+		if len(got) != 8 || got[3] != "Speaker 0 (09:30:00)\nHello" || got[7] != "Speaker 0 (09:34:00)\nMore" {
+			t.Errorf("Unexpected page content %q", got)
+		}
+	})
+
+	t.Run("First section change keeps the rest of the page", func(t *testing.T) {
+		fake.mu.Lock()
+		added := fake.addBlock(first.PageID, map[string]any{"type": "paragraph", "paragraph": map[string]any{
+			"rich_text": []any{map[string]any{"type": "text", "text": map[string]any{"content": "Added in Notion"}}},
+		}}, 0)
+		kept := fake.children[first.PageID][3]
+		fake.mu.Unlock()
+
+		// The new summary is inserted after the first block, which is
+		// replaced; the other sections and the added block stay.
+		transcript.Summary = "Short meeting"
+		_, result := export(t, transcript, false)
+		if result.Created || result.Added != 2 || result.Replaced != 1 || result.Unchanged != 7 {
+			t.Errorf("Unexpected section counts %+v", result)
+		}
+		got := fake.pageText(first.PageID)
+		if len(got) != 11 || got[0] != "Summary" || got[1] != "Short meeting" || got[2] != "Notes" || got[10] != "Added in Notion" {
+			t.Errorf("Unexpected page content %q", got)
+		}
+		if ids := fake.children[first.PageID]; ids[5] != kept || ids[10] != added {
+			t.Errorf("Expected the unchanged blocks to be kept, got %v", ids)
+		}
+	})
+
+	t.Run("Trashed page is exported again", func(t *testing.T) {
+		fake.mu.Lock()
+		fake.trashed[first.PageID] = true
+		fake.mu.Unlock()
+
+		_, result := export(t, transcript, false)
+		if !result.Created || result.PageID == first.PageID {
+			t.Errorf("Expected a new page, got %+v", result)
+		}
+	})
+}
+
+func TestNotionExport_StableSections(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	var failAppend int
+	var appends int
+	s := setupTestServer(t)
+	useMockNotion(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" && strings.HasSuffix(r.URL.Path, "/children") {
+			if appends++; appends == failAppend {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"object":"error","status":400,"code":"validation_error","message":"Invalid block"}`))
+				return
+			}
+		}
+		fake.ServeHTTP(w, r)
+	}))
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+	transcript := Transcript{ID: "meeting-1", Title: "Planning", Notes: "Agenda"}
+	for i := range 150 {
+		transcript.Turns = append(transcript.Turns, Turn{Speaker: "Speaker 0", Text: "Turn " + strconv.Itoa(i), Timestamp: start.Add(time.Duration(i) * time.Minute)})
+	}
+	export := func(t *testing.T) (*http.Response, notionExportResponse) {
+		t.Helper()
+		resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+			"parent":     map[string]any{"page_id": "parent-page"},
+			"transcript": transcript,
+		}, cookies)
+		defer resp.Body.Close()
+		var result notionExportResponse
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp, result
+	}
+
+	// The second of the two appends fails, after the first wrote 100
+	// blocks. They are recorded, so exporting again completes the page.
+	failAppend = 2
+	if resp, _ := export(t); resp.StatusCode == http.StatusOK {
+		t.Fatal("Expected the export to fail")
+	}
+	rec, ok := s.notionExports.Get("user:testuser/meeting-1")
+	if !ok || len(rec.Sections) != 100 {
+		t.Fatalf("Expected the written sections to be recorded, got %+v", rec)
+	}
+	failAppend = 0
+	resp, result := export(t)
+	if resp.StatusCode != http.StatusOK || result.Created || result.PageID != rec.PageID {
+		t.Fatalf("Expected the partly written page to be updated, got %d %+v", resp.StatusCode, result)
+	}
+	if result.Unchanged != 100 || result.Added != 53 || result.Replaced != 0 {
+		t.Errorf("Unexpected section counts %+v", result)
+	}
+	if got := fake.pageText(rec.PageID); len(got) != 153 || got[152] != "Speaker 0 (11:59:00)\nTurn 149" {
+		t.Errorf("Unexpected page content %q", got)
+	}
+
+	// A turn inserted before others leaves their sections alone.
+	typed := Turn{Speaker: "User", Text: "Aside", Timestamp: start.Add(90 * time.Second), Source: "typed"}
+	transcript.Turns = slices.Insert(transcript.Turns, 2, typed)
+	_, result = export(t)
+	if result.Added != 1 || result.Replaced != 0 || result.Removed != 0 || result.Unchanged != 153 {
+		t.Errorf("Unexpected section counts %+v", result)
+	}
+	if got := fake.pageText(rec.PageID); len(got) != 154 || got[5] != "User (09:31:30)\nAside" || got[6] != "Speaker 0 (09:32:00)\nTurn 2" {
+		t.Errorf("Unexpected page content %q", got[:8])
+	}
+
+	// So does removing one.
+	transcript.Turns = slices.Delete(transcript.Turns, 0, 1)
+	_, result = export(t)
+	if result.Removed != 1 || result.Added != 0 || result.Replaced != 0 {
+		t.Errorf("Unexpected section counts %+v", result)
+	}
+}
+
+func TestNotionConvert(t *testing.T) {
+	s := setupTestServer(t)
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	resp := postJSON(t, ts, "/api/notion/convert", map[string]any{"markdown": "# Agenda"}, nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a session, got %d", resp.StatusCode)
+	}
+
+	cookies := loginWithNotionToken(t, s, ts, "")
+	resp = postJSON(t, ts, "/api/notion/convert", map[string]any{"markdown": "# Agenda\n\n- [ ] Budget\n  - Q3"}, cookies)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var result struct {
+		Blocks []struct {
+			Type string `json:"type"`
+			ToDo struct {
+				Checked  bool `json:"checked"`
+				Children []struct {
+					Type string `json:"type"`
+				} `json:"children"`
+			} `json:"to_do"`
+		} `json:"blocks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Blocks) != 2 || result.Blocks[0].Type != "heading_1" || result.Blocks[1].Type != "to_do" {
+		t.Fatalf("Unexpected blocks %+v", result.Blocks)
+	}
+	if children := result.Blocks[1].ToDo.Children; len(children) != 1 || children[0].Type != "bulleted_list_item" {
+		t.Errorf("Expected nested list item, got %+v", children)
+	}
+}
+
+func TestNotionExport_MarkdownNotes(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"page_id": "parent-page"},
+		"transcript": Transcript{Title: "Planning", Notes: "## Agenda\n\n1. **Budget**\n   - Q3\n2. Hiring"},
+	}, cookies)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var result notionExportResponse
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	var types []string
+	for _, id := range fake.children[result.PageID] {
+		types = append(types, fake.blocks[id]["type"].(string))
+	}
+	want := []string{"heading_2", "heading_2", "numbered_list_item", "numbered_list_item"}
+	if !slices.Equal(types, want) {
+		t.Fatalf("Expected blocks %v, got %v", want, types)
+	}
+	budget := fake.children[result.PageID][2]
+	if got := fake.text(budget); got != "Budget" {
+		t.Errorf("Unexpected list item text %q", got)
+	}
+	if nested := fake.children[budget]; len(nested) != 1 || fake.text(nested[0]) != "Q3" {
+		t.Errorf("Expected nested Q3 item under Budget")
+	}
+
+	// The preview of notes nested deeper than one request allows matches
+	// the exported page.
+	notes := "- a\n  - b\n    - c\n      - d\n\n        | h |\n        | - |\n        | r |"
+	resp = postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"page_id": "parent-page"},
+		"transcript": Transcript{Title: "Nested", Notes: notes},
+	}, cookies)
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	resp = postJSON(t, ts, "/api/notion/convert", map[string]any{"markdown": notes}, cookies)
+	var preview struct {
+		Blocks []map[string]any `json:"blocks"`
+	}
+	json.NewDecoder(resp.Body).Decode(&preview)
+	resp.Body.Close()
+	page := fake.outline(fake.children[result.PageID][1:], "")
+	if got := previewOutline(preview.Blocks, ""); got != page {
+		t.Errorf("Preview differs from the page:\npreview:\n%s\npage:\n%s", got, page)
+	}
+	if !strings.Contains(page, "      table_row") {
+		t.Errorf("Expected the table nested on the page:\n%s", page)
+	}
+}
+
+// outline describes the given blocks and their children by type, one per
+// line, indented by depth.
+func (f *fakeNotionPages) outline(ids []string, indent string) string {
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(indent + f.blocks[id]["type"].(string) + "\n")
+		b.WriteString(f.outline(f.children[id], indent+"  "))
+	}
+	return b.String()
+}
+
+// previewOutline describes converted blocks like fakeNotionPages.outline.
+func previewOutline(blocks []map[string]any, indent string) string {
+	var b strings.Builder
+	for _, block := range blocks {
+		typ := block["type"].(string)
+		b.WriteString(indent + typ + "\n")
+		children, _ := block[typ].(map[string]any)["children"].([]any)
+		var nested []map[string]any
+		for _, c := range children {
+			nested = append(nested, c.(map[string]any))
+		}
+		b.WriteString(previewOutline(nested, indent+"  "))
+	}
+	return b.String()
+}
+
+// recordedRequest is a request received by a recordingHandler.
+type recordedRequest struct {
+	Method string
+	Path   string
+	Body   map[string]any
+}
+
+// recordingHandler records requests before passing them on.
+type recordingHandler struct {
+	next     http.Handler
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+func (h *recordingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	raw, _ := io.ReadAll(r.Body)
+	json.Unmarshal(raw, &body)
+	h.mu.Lock()
+	h.requests = append(h.requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Body: body})
+	h.mu.Unlock()
+	r.Body = io.NopCloser(bytes.NewReader(raw))
+	h.next.ServeHTTP(w, r)
+}
+
+// writes returns the recorded requests that change Notion content.
+func (h *recordingHandler) writes() []recordedRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var writes []recordedRequest
+	for _, req := range h.requests {
+		if req.Method != "GET" {
+			writes = append(writes, req)
+		}
+	}
+	return writes
+}
+
+func TestNotionExport_DryRun(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	recorder := &recordingHandler{next: fake}
+	s := setupTestServer(t)
+	useMockNotion(t, s, recorder)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+	transcript := Transcript{ID: "t-1", Title: "Weekly sync", Notes: "- Budget\n  - Q3"}
+	for i := 0; i < 120; i++ {
+		transcript.Turns = append(transcript.Turns, Turn{Speaker: "Ann", Text: fmt.Sprintf("Turn %d", i), Timestamp: start})
+	}
+	export := func(path string) notionExportResponse {
+		t.Helper()
+		resp := postJSON(t, ts, path, map[string]any{
+			"parent":     map[string]any{"page_id": "parent-page"},
+			"transcript": transcript,
+		}, cookies)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		var result notionExportResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// checkPlan compares the planned requests with those actually made.
+	checkPlan := func(planned []*plannedRequest, made []recordedRequest) {
+		t.Helper()
+		if len(planned) != len(made) {
+			t.Fatalf("Planned %d requests, made %d", len(planned), len(made))
+		}
+		for i, p := range planned {
+			pattern := "^" + placeholderPattern.ReplaceAllString(p.Path, "[^/]+") + "$"
+			if p.Method != made[i].Method || !regexp.MustCompile(pattern).MatchString(made[i].Path) {
+				t.Errorf("Request %d: planned %s %s, made %s %s", i, p.Method, p.Path, made[i].Method, made[i].Path)
+			}
+			plannedChildren, _ := json.Marshal(p.Body["children"])
+			madeChildren, _ := json.Marshal(made[i].Body["children"])
+			if string(plannedChildren) != string(madeChildren) {
+				t.Errorf("Request %d: planned children differ from those sent", i)
+			}
+		}
+	}
+
+	preview := export("/api/export/notion?dry_run=true")
+	if !preview.DryRun || !preview.Created || preview.PageID != "" {
+		t.Errorf("Unexpected dry run response %+v", preview)
+	}
+	if writes := recorder.writes(); len(writes) != 0 {
+		t.Fatalf("Dry run made %d write requests", len(writes))
+	}
+	// Create the page, append the first batch of blocks and the nested list
+	// item under its parent, then append the second batch.
+	if len(preview.Requests) != 4 || preview.Requests[0].Method != "POST" || preview.Requests[1].Path != "/v1/blocks/{page}/children" {
+		t.Fatalf("Unexpected plan %+v", preview.Requests)
+	}
+	if nested := preview.Requests[2].Path; nested != "/v1/blocks/{block:2}/children" {
+		t.Errorf("Expected nested item to be appended under its parent, got %s", nested)
+	}
+
+	created := export("/api/export/notion")
+	checkPlan(preview.Requests, recorder.writes())
+	if created.DryRun || created.Requests != nil {
+		t.Errorf("Real export should not return a plan")
+	}
+
+	// A dry run of a re-export plans the update without writing it, and
+	// leaves the export record untouched.
+	transcript.Turns[119].Text = "Changed"
+	recorder.requests = nil
+	preview = export("/api/export/notion?dry_run=true")
+	if preview.PageID != created.PageID || preview.Replaced != 1 || preview.Unchanged != 122 {
+		t.Errorf("Unexpected re-export preview %+v", preview)
+	}
+	if writes := recorder.writes(); len(writes) != 0 {
+		t.Fatalf("Dry run made %d write requests", len(writes))
+	}
+	var methods []string
+	for _, req := range preview.Requests {
+		methods = append(methods, req.Method+" "+strings.Split(req.Path, "/")[2])
+	}
+	if want := []string{"PATCH blocks", "DELETE blocks", "PATCH pages"}; !slices.Equal(methods, want) {
+		t.Errorf("Expected plan %v, got %v", want, methods)
+	}
+
+	recorder.requests = nil
+	updated := export("/api/export/notion")
+	if updated.Replaced != 1 || updated.Created {
+		t.Errorf("Unexpected re-export response %+v", updated)
+	}
+	checkPlan(preview.Requests, recorder.writes())
+}
+
+func TestNotionExport_MockWorkspace(t *testing.T) {
+	mock := notionmock.New(notionmock.Options{Tokens: []string{"test-token"}})
+	parentID := mock.AddPage("", "Meetings")
+	s := setupTestServer(t)
+	useMockNotion(t, s, mock)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+	transcript := Transcript{ID: "meeting-1", Title: "Planning", Notes: "# Agenda\n\n- Roadmap\n  - Dates"}
+	for i := range 120 {
+		transcript.Turns = append(transcript.Turns, Turn{
+			Speaker:   "Speaker 0",
+			Text:      fmt.Sprintf("Turn %d", i),
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		})
+	}
+	export := func() notionExportResponse {
+		t.Helper()
+		resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+			"parent":     map[string]any{"page_id": parentID},
+			"transcript": transcript,
+		}, cookies)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, body)
+		}
+		var result notionExportResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// The mock enforces Notion's request limits, so the export must split
+	// its appends to fit them.
+	first := export()
+	page := mock.Page(first.PageID)
+	if page == nil || page["parent"].(map[string]any)["page_id"] != parentID {
+		t.Fatalf("Expected the page under the parent, got %v", page)
+	}
+	if got := len(mock.Children(first.PageID)); got < 120 {
+		t.Errorf("Expected the turns on the page, got %d blocks", got)
+	}
+
+	transcript.Turns[0].Text = "Welcome"
+	second := export()
+	if second.PageID != first.PageID || second.Replaced != 1 {
+		t.Errorf("Expected the changed turn to be replaced, got %+v", second)
+	}
+	var live []string
+	for _, block := range mock.Children(first.PageID) {
+		if block["in_trash"] != true && block["type"] == "paragraph" {
+			rt := block["paragraph"].(map[string]any)["rich_text"].([]any)
+			live = append(live, strings.TrimSpace(rt[len(rt)-1].(map[string]any)["plain_text"].(string)))
+		}
+	}
+	if !slices.Contains(live, "Welcome") || slices.Contains(live, "Turn 0") {
+		t.Errorf("Expected the page to hold the new text, got %v", live)
+	}
+}
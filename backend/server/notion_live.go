@@ -0,0 +1,522 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// Live sync timing. These are variables so tests can shorten them.
+var (
+	// liveSyncDebounce is how long a sync waits for further turns before
+	// appending pending ones.
+	liveSyncDebounce = 2 * time.Second
+	// liveSyncMaxDelay bounds how long a turn can wait while more keep arriving.
+	liveSyncMaxDelay = 10 * time.Second
+	// liveSyncRetryBase is the first delay after a failed append; it doubles
+	// on each consecutive failure up to liveSyncRetryMax.
+	liveSyncRetryBase = time.Second
+	liveSyncRetryMax  = 30 * time.Second
+	// liveSyncIdleTimeout stops syncs that receive no turns for this long.
+	liveSyncIdleTimeout = 2 * time.Hour
+	// liveSyncRequestTimeout bounds each Notion request made by a sync.
+	liveSyncRequestTimeout = 30 * time.Second
+)
+
+// maxLiveSyncsPerUser limits the number of concurrent syncs per user.
+const maxLiveSyncsPerUser = 4
+
+// Live sync states.
+const (
+	liveSyncRunning = "running"
+	liveSyncFailed  = "failed"
+	liveSyncStopped = "stopped"
+)
+
+// liveTurn is a finalized turn sent to a live sync. Seq is the turn's
+// position in the transcript, starting at zero, and makes resending safe.
+type liveTurn struct {
+	Seq int `json:"seq"`
+	Turn
+}
+
+// liveSyncStatus reports the progress of a live sync.
+type liveSyncStatus struct {
+	ID        string `json:"id"`
+	PageID    string `json:"page_id"`
+	State     string `json:"state"`
+	Synced    int    `json:"synced"`
+	Pending   int    `json:"pending"`
+	NextSeq   int    `json:"next_seq"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// liveSync appends finalized turns to a Notion page as they arrive, batching
+// them and retrying transient failures without duplicating blocks.
+type liveSync struct {
+	id     string
+	owner  string
+	pageID string
+	client *notionClient
+	loc    *time.Location
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending []Turn
+	// written is the number of blocks of the first pending turn already
+	// on the page, when an append of its blocks failed part way.
+	written     int
+	nextSeq     int
+	synced      int
+	lastBlockID string
+	state       string
+	lastErr     string
+}
+
+// liveSyncs tracks the running live syncs.
+type liveSyncs struct {
+	mu   sync.Mutex
+	byID map[string]*liveSync
+}
+
+func newLiveSyncs() *liveSyncs {
+	return &liveSyncs{byID: make(map[string]*liveSync)}
+}
+
+// start creates and starts a sync for owner, appending to pageID.
+func (m *liveSyncs) start(owner, pageID string, client *notionClient, loc *time.Location) (*liveSync, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, j := range m.byID {
+		if j.owner == owner {
+			count++
+		}
+	}
+	if count >= maxLiveSyncsPerUser {
+		return nil, endpoint.Error(http.StatusTooManyRequests, "too many live syncs", nil)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	j := &liveSync{
+		id:     hex.EncodeToString(b),
+		owner:  owner,
+		pageID: pageID,
+		client: client,
+		loc:    loc,
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		state:  liveSyncRunning,
+	}
+	m.byID[j.id] = j
+
+	go func() {
+		j.run()
+		m.mu.Lock()
+		delete(m.byID, j.id)
+		m.mu.Unlock()
+	}()
+	return j, nil
+}
+
+// get returns the sync with the given ID if it belongs to owner.
+func (m *liveSyncs) get(owner, id string) (*liveSync, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.byID[id]
+	if !ok || j.owner != owner {
+		return nil, false
+	}
+	return j, true
+}
+
+// status returns a snapshot of the sync's progress.
+func (j *liveSync) status() liveSyncStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return liveSyncStatus{
+		ID:        j.id,
+		PageID:    j.pageID,
+		State:     j.state,
+		Synced:    j.synced,
+		Pending:   len(j.pending),
+		NextSeq:   j.nextSeq,
+		LastError: j.lastErr,
+	}
+}
+
+// add queues turns for appending. Turns already received are ignored, so a
+// client can safely resend after a failed request; a gap in the sequence is
+// an error.
+func (j *liveSync) add(turns []liveTurn) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state == liveSyncStopped {
+		return endpoint.Error(http.StatusConflict, "live sync is stopped", nil)
+	}
+
+	added := false
+	for _, t := range turns {
+		if t.Seq < j.nextSeq {
+			continue
+		}
+		if t.Seq > j.nextSeq {
+			return endpoint.Error(http.StatusConflict, fmt.Sprintf("expected turn seq %d, got %d", j.nextSeq, t.Seq), nil)
+		}
+		j.pending = append(j.pending, t.Turn)
+		j.nextSeq++
+		added = true
+	}
+
+	if added {
+		select {
+		case j.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run is the sync's worker loop. It waits for turns, debounces them and
+// appends them, until stopped or idle.
+func (j *liveSync) run() {
+	defer close(j.done)
+	idle := time.NewTimer(liveSyncIdleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			j.flush(true)
+			j.setState(liveSyncStopped)
+			return
+		case <-idle.C:
+			j.flush(true)
+			j.setState(liveSyncStopped)
+			return
+		case <-j.notify:
+		}
+		idle.Reset(liveSyncIdleTimeout)
+
+		// Debounce: wait until no turn has arrived for liveSyncDebounce, or
+		// liveSyncMaxDelay has passed since the first one.
+		deadline := time.Now().Add(liveSyncMaxDelay)
+		debounce := time.NewTimer(liveSyncDebounce)
+		stopping := false
+	wait:
+		for {
+			select {
+			case <-j.notify:
+				debounce.Reset(min(liveSyncDebounce, time.Until(deadline)))
+			case <-debounce.C:
+				break wait
+			case <-j.stop:
+				stopping = true
+				break wait
+			}
+		}
+		debounce.Stop()
+
+		if stopping {
+			j.flush(true)
+			j.setState(liveSyncStopped)
+			return
+		}
+		j.flush(false)
+	}
+}
+
+// flush appends pending turns, retrying transient failures with backoff. A
+// final flush makes a single pass without waiting.
+func (j *liveSync) flush(final bool) {
+	delay := liveSyncRetryBase
+	for {
+		err := j.appendPending()
+		if err == nil {
+			return
+		}
+
+		j.mu.Lock()
+		j.lastErr = err.Error()
+		if !isTransientNotionError(err) {
+			// Wait for the next turns before trying again.
+			if j.state != liveSyncStopped {
+				j.state = liveSyncFailed
+			}
+			j.mu.Unlock()
+			return
+		}
+		j.mu.Unlock()
+
+		if final {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-j.stop:
+			final = true
+		}
+		delay = min(delay*2, liveSyncRetryMax)
+	}
+}
+
+// appendPending appends pending turns in batches. If an append fails in a way
+// that may still have been applied, the page is checked for the batch before
+// it is sent again.
+func (j *liveSync) appendPending() error {
+	for {
+		j.mu.Lock()
+		after := j.lastBlockID
+		var blocks []*notionBlock
+		// ends[i] is the number of blocks up to the end of the i-th turn.
+		var ends []int
+		for i, t := range j.pending {
+			tb := turnBlocks(t, j.loc)
+			if i == 0 {
+				tb = tb[j.written:]
+			}
+			if len(blocks)+len(tb) > notionMaxChildren && len(ends) > 0 {
+				break
+			}
+			blocks = append(blocks, tb...)
+			ends = append(ends, len(blocks))
+		}
+		j.mu.Unlock()
+		if len(ends) == 0 {
+			return nil
+		}
+
+		// A turn of more than notionMaxChildren blocks takes several
+		// requests, and those before a failure are kept.
+		ctx, cancel := context.WithTimeout(context.Background(), liveSyncRequestTimeout)
+		ids, err := j.client.appendBlocks(ctx, j.pageID, "", blocks)
+		if err != nil && isTransientNotionError(err) {
+			// The failed request may have been applied even so.
+			if len(ids) > 0 {
+				after = ids[len(ids)-1]
+			}
+			ids = append(ids, j.findAppended(ctx, after, blocks[len(ids):])...)
+			if len(ids) == len(blocks) {
+				err = nil
+			}
+		}
+		cancel()
+		j.advance(ends, ids)
+		if err != nil {
+			return err
+		}
+
+		j.mu.Lock()
+		j.lastErr = ""
+		// A sync stopped while the append was in flight stays stopped.
+		if j.state != liveSyncStopped {
+			j.state = liveSyncRunning
+		}
+		j.mu.Unlock()
+	}
+}
+
+// advance records that the blocks with the given IDs, the first of a batch
+// of pending turns whose blocks end at ends, are on the page.
+func (j *liveSync) advance(ends []int, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	done := 0
+	for done < len(ends) && ends[done] <= len(ids) {
+		done++
+	}
+	if done > 0 {
+		j.written = len(ids) - ends[done-1]
+	} else {
+		j.written += len(ids)
+	}
+	j.pending = j.pending[done:]
+	j.synced += done
+	j.lastBlockID = ids[len(ids)-1]
+}
+
+// findAppended looks on the page for blocks after the given block, and
+// returns the IDs of the longest leading part of blocks found there.
+func (j *liveSync) findAppended(ctx context.Context, after string, blocks []*notionBlock) []string {
+	children, err := j.client.listBlockChildren(ctx, j.pageID)
+	if err != nil {
+		return nil
+	}
+
+	type child struct{ id, fingerprint string }
+	var candidates []child
+	found := after == ""
+	for _, raw := range children {
+		var block struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &block) != nil {
+			continue
+		}
+		if found {
+			candidates = append(candidates, child{block.ID, blockFingerprint(raw)})
+		} else if block.ID == after {
+			found = true
+		}
+	}
+
+	var ids []string
+	for start := range candidates {
+		n := 0
+		for n < len(blocks) && start+n < len(candidates) && candidates[start+n].fingerprint == writtenFingerprint(blocks[n]) {
+			n++
+		}
+		if n > len(ids) {
+			ids = ids[:0]
+			for _, c := range candidates[start : start+n] {
+				ids = append(ids, c.id)
+			}
+		}
+	}
+	return ids
+}
+
+// setState sets the sync's state.
+func (j *liveSync) setState(state string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state = state
+}
+
+// isTransientNotionError reports whether a failed Notion request is worth
+// retrying: network failures, rate limiting and server errors.
+func isTransientNotionError(err error) bool {
+	var apiErr *notionAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status == http.StatusTooManyRequests || apiErr.Status >= 500
+	}
+	return true
+}
+
+// startLiveSyncEndpoint starts a live sync that appends turns to a page.
+func (s *Server) startLiveSyncEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req struct {
+		PageID   string `json:"page_id"`
+		TimeZone string `json:"time_zone,omitempty"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	if req.PageID == "" {
+		return nil, endpoint.Error(http.StatusBadRequest, "page_id is required", nil)
+	}
+	loc := time.UTC
+	if req.TimeZone != "" {
+		if loc, err = time.LoadLocation(req.TimeZone); err != nil {
+			return nil, endpoint.Error(http.StatusBadRequest, "invalid time_zone", err)
+		}
+	}
+
+	// Check the page is reachable before accepting turns for it.
+	client := s.newNotionClient(token)
+	exists, err := client.exportedPageExists(r.Context(), req.PageID)
+	if err != nil {
+		return nil, notionEndpointError(err)
+	}
+	if !exists {
+		return nil, endpoint.Error(http.StatusNotFound, "page not found", nil)
+	}
+
+	j, err := s.liveSyncs.start(owner, req.PageID, client, loc)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: j.status()}, nil
+}
+
+// liveSyncFromRequest returns the sync named in the path if it belongs to the
+// session's user.
+func (s *Server) liveSyncFromRequest(r *http.Request) (*liveSync, error) {
+	owner, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	j, ok := s.liveSyncs.get(owner, r.PathValue("id"))
+	if !ok {
+		return nil, endpoint.Error(http.StatusNotFound, "live sync not found", nil)
+	}
+	return j, nil
+}
+
+// liveSyncTurnsEndpoint queues finalized turns for a live sync.
+func (s *Server) liveSyncTurnsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	j, err := s.liveSyncFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req struct {
+		Turns []liveTurn `json:"turns"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	if err := j.add(req.Turns); err != nil {
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: j.status()}, nil
+}
+
+// liveSyncStatusEndpoint reports a live sync's progress.
+func (s *Server) liveSyncStatusEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	j, err := s.liveSyncFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: j.status()}, nil
+}
+
+// stopLiveSyncEndpoint appends any pending turns and stops a live sync.
+func (s *Server) stopLiveSyncEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	j, err := s.liveSyncFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	j.mu.Lock()
+	if j.state != liveSyncStopped {
+		j.state = liveSyncStopped
+		close(j.stop)
+	}
+	j.mu.Unlock()
+
+	select {
+	case <-j.done:
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	return &endpoint.JSONRenderer{Value: j.status()}, nil
+}
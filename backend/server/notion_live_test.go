@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmd"
+)
+
+// flakyAppends fails chosen block appends with a server error, either before
+// or after passing them to the wrapped handler.
+type flakyAppends struct {
+	next http.Handler
+
+	mu sync.Mutex
+	// skip is the number of append requests passed on before failures
+	// apply.
+	skip int
+	// failures is consumed in order by append requests; true means the
+	// append is applied before the error is returned.
+	failures []bool
+}
+
+func (f *flakyAppends) fail(applied bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, applied)
+}
+
+func (f *flakyAppends) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PATCH" && strings.HasSuffix(r.URL.Path, "/children") {
+		f.mu.Lock()
+		var failure, applied bool
+		if f.skip > 0 {
+			f.skip--
+		} else if len(f.failures) > 0 {
+			failure, applied = true, f.failures[0]
+			f.failures = f.failures[1:]
+		}
+		f.mu.Unlock()
+		if failure {
+			if applied {
+				f.next.ServeHTTP(httptest.NewRecorder(), r)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"object":"error","status":502,"code":"bad_gateway","message":"upstream failure"}`))
+			return
+		}
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+// useFastLiveSync shortens live sync timing for the duration of a test.
+func useFastLiveSync(t *testing.T) {
+	oldDebounce, oldMax, oldRetry := liveSyncDebounce, liveSyncMaxDelay, liveSyncRetryBase
+	liveSyncDebounce, liveSyncMaxDelay, liveSyncRetryBase = 10*time.Millisecond, 50*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		liveSyncDebounce, liveSyncMaxDelay, liveSyncRetryBase = oldDebounce, oldMax, oldRetry
+	})
+}
+
+func liveTurns(start time.Time, from, to int) []liveTurn {
+	var turns []liveTurn
+	for i := from; i < to; i++ {
+		turns = append(turns, liveTurn{Seq: i, Turn: Turn{
+			Speaker:   "Speaker 0",
+			Text:      fmt.Sprintf("Turn %d", i),
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+		}})
+	}
+	return turns
+}
+
+// waitForSynced polls a live sync until it has synced n turns.
+func waitForSynced(t *testing.T, ts *httptest.Server, id string, n int, cookies []*http.Cookie) liveSyncStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := getWithCookies(t, ts, "/api/notion/live/"+id, cookies)
+		var status liveSyncStatus
+		json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if status.Synced >= n {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d synced turns, status %+v", n, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNotionLiveSync(t *testing.T) {
+	useFastLiveSync(t)
+	fake := newFakeNotionPages(t)
+	fake.pages["meeting-page"] = map[string]any{}
+	flaky := &flakyAppends{next: fake}
+	s := setupTestServer(t)
+	useMockNotion(t, s, flaky)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+
+	resp := postJSON(t, ts, "/api/notion/live", map[string]any{"page_id": "meeting-page"}, cookies)
+	var status liveSyncStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || status.State != liveSyncRunning {
+		t.Fatalf("Expected running sync, got %d %+v", resp.StatusCode, status)
+	}
+	turnsPath := "/api/notion/live/" + status.ID + "/turns"
+
+	// Turns sent in quick succession are batched into one append, and
+	// resent turns are ignored.
+	for _, turns := range [][]liveTurn{liveTurns(start, 0, 2), liveTurns(start, 0, 3)} {
+		resp := postJSON(t, ts, turnsPath, map[string]any{"turns": turns}, cookies)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+	}
+	waitForSynced(t, ts, status.ID, 3, cookies)
+	if fake.appends != 1 {
+		t.Errorf("Expected 1 append request, got %d", fake.appends)
+	}
+
+	// A failed append that was applied is not repeated; one that was not
+	// applied is retried.
+	flaky.fail(true)
+	resp = postJSON(t, ts, turnsPath, map[string]any{"turns": liveTurns(start, 3, 4)}, cookies)
+	resp.Body.Close()
+	waitForSynced(t, ts, status.ID, 4, cookies)
+
+	flaky.fail(false)
+	flaky.fail(false)
+	resp = postJSON(t, ts, turnsPath, map[string]any{"turns": liveTurns(start, 4, 5)}, cookies)
+	resp.Body.Close()
+	waitForSynced(t, ts, status.ID, 5, cookies)
+
+	// A gap in the sequence is rejected.
+	resp = postJSON(t, ts, turnsPath, map[string]any{"turns": liveTurns(start, 7, 8)}, cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 for sequence gap, got %d", resp.StatusCode)
+	}
+
+	// Stopping appends the remaining turns without waiting for the debounce.
+	liveSyncDebounce = time.Hour
+	resp = postJSON(t, ts, turnsPath, map[string]any{"turns": liveTurns(start, 5, 6)}, cookies)
+	resp.Body.Close()
+	req, _ := http.NewRequest("DELETE", ts.URL+"/api/notion/live/"+status.ID, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.State != liveSyncStopped || status.Synced != 6 || status.Pending != 0 {
+		t.Errorf("Unexpected final status %+v", status)
+	}
+
+	texts := fake.pageText("meeting-page")
+	if len(texts) != 6 {
+		t.Fatalf("Expected 6 blocks, got %d: %q", len(texts), texts)
+	}
+	for i, text := range texts {
+		if want := fmt.Sprintf("Speaker 0 (09:30:%02d)\nTurn %d", i, i); text != want {
+			t.Errorf("Block %d: expected %q, got %q", i, want, text)
+		}
+	}
+
+	resp = getWithCookies(t, ts, "/api/notion/live/"+status.ID, cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected stopped sync to be gone, got %d", resp.StatusCode)
+	}
+}
+
+func TestNotionLiveSync_OtherUser(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	fake.pages["meeting-page"] = map[string]any{}
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	resp := postJSON(t, ts, "/api/notion/live", map[string]any{"page_id": "missing-page"}, cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for missing page, got %d", resp.StatusCode)
+	}
+
+	resp = postJSON(t, ts, "/api/notion/live", map[string]any{"page_id": "meeting-page"}, cookies)
+	var status liveSyncStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+
+	// Without the owner's session the sync is not visible.
+	resp = getWithCookies(t, ts, "/api/notion/live/"+status.ID, nil)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Errorf("Expected sync to be hidden from other sessions")
+	}
+}
+
+func TestNotionLiveSync_LongTurn(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	fake.pages["meeting-page"] = map[string]any{}
+	flaky := &flakyAppends{next: fake}
+	mock := mockNotionAPI(t, flaky)
+
+	// A turn this long takes 101 blocks, and so two append requests.
+	text := strings.Repeat("a", notionMaxChildren*notionmd.MaxRichText*notionmd.MaxTextLength+1)
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+	j := &liveSync{pageID: "meeting-page", client: newNotionClient(mock.URL, "test-token"), loc: time.UTC}
+	j.pending = []Turn{{Speaker: "Speaker 0", Text: text, Timestamp: start}}
+
+	// The turn's second request fails after being applied, and its block
+	// is found on the page.
+	flaky.skip, flaky.failures = 1, []bool{true}
+	if err := j.appendPending(); err != nil {
+		t.Fatal(err)
+	}
+	if j.synced != 1 || len(fake.children["meeting-page"]) != 101 {
+		t.Fatalf("Expected the turn synced once, got %d turns and %d blocks", j.synced, len(fake.children["meeting-page"]))
+	}
+
+	// Here it is not applied, and only its block is sent again.
+	j.pending = []Turn{{Speaker: "Speaker 0", Text: text, Timestamp: start.Add(time.Minute)}}
+	flaky.skip, flaky.failures = 1, []bool{false}
+	if err := j.appendPending(); err == nil || j.synced != 1 || j.written != 100 {
+		t.Fatalf("Expected the first request to be recorded, got %v after %d turns and %d blocks", err, j.synced, j.written)
+	}
+	if err := j.appendPending(); err != nil {
+		t.Fatal(err)
+	}
+	if j.synced != 2 || j.written != 0 || len(fake.children["meeting-page"]) != 202 {
+		t.Errorf("Expected the turn to be completed, got %d turns and %d blocks", j.synced, len(fake.children["meeting-page"]))
+	}
+}
+
+func TestNotionLiveSync_StoppedDuringAppend(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	fake.pages["meeting-page"] = map[string]any{}
+	mock := mockNotionAPI(t, fake)
+
+	// The sync was stopped while its append was in flight, and stays so.
+	start := time.Date(2026, 1, 2, 9, 30, 0, 0, time.UTC)
+	j := &liveSync{pageID: "meeting-page", client: newNotionClient(mock.URL, "test-token"), loc: time.UTC, state: liveSyncStopped}
+	j.pending = []Turn{{Speaker: "Speaker 0", Text: "Turn 0", Timestamp: start}}
+	if err := j.appendPending(); err != nil {
+		t.Fatal(err)
+	}
+	if status := j.status(); status.State != liveSyncStopped || status.Synced != 1 {
+		t.Errorf("Expected a stopped sync, got %+v", status)
+	}
+	if err := j.add(liveTurns(start, 1, 2)); err == nil {
+		t.Error("Expected a stopped sync to refuse turns")
+	}
+}
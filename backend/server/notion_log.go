@@ -0,0 +1,541 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mnehpets/oneserve/endpoint"
+	"github.com/mnehpets/oneserve/middleware"
+)
+
+const (
+	// notionLogBodyLimit bounds the bytes of each body kept in a log entry.
+	notionLogBodyLimit = 2048
+	// notionLogCaptureLimit bounds the bytes of each proxied body held for
+	// logging. Bodies are redacted before they are cut to
+	// notionLogBodyLimit, so a little more is kept.
+	notionLogCaptureLimit = 4 * notionLogBodyLimit
+	// notionDebugMaxEntries is the number of entries kept for each session
+	// with debugging enabled.
+	notionDebugMaxEntries = 100
+	// notionDebugSessionKey is the session key of the debug toggle.
+	notionDebugSessionKey = "notion_debug"
+	// notionRedacted replaces redacted values.
+	notionRedacted = "[REDACTED]"
+)
+
+// notionDebugTTL is how long the entries of a session are kept after its last
+// Notion call.
+var notionDebugTTL = time.Hour
+
+// notionRedactedFields are JSON fields that are always redacted from logged
+// bodies, in addition to the token used for the call.
+var notionRedactedFields = []string{
+	"access_token", "refresh_token", "token", "client_secret",
+	"authorization", "secret", "password",
+}
+
+// notionLogEntry describes a call to the Notion API. Route is the app
+// request that made the call.
+type notionLogEntry struct {
+	Time         time.Time `json:"time"`
+	Route        string    `json:"route"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Status       int       `json:"status"`
+	LatencyMS    int64     `json:"latency_ms"`
+	RequestID    string    `json:"request_id,omitempty"`
+	RequestBody  string    `json:"request_body,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// notionLogger records the Notion API calls made for sessions: to the server
+// log if NOTION_PROXY_LOG is set, and to a per-session buffer for sessions
+// that have turned debugging on.
+//
+// It is an endpoint.Processor for the Notion routes; it must run after the
+// session processor.
+type notionLogger struct {
+	// logger writes entries to the server log, or is nil.
+	logger *slog.Logger
+	redact map[string]bool
+
+	mu       sync.Mutex
+	sessions map[string]*notionDebugLog
+}
+
+// notionDebugLog holds the recent entries of a session, oldest first.
+type notionDebugLog struct {
+	entries  []notionLogEntry
+	lastUsed time.Time
+}
+
+func newNotionLogger(cfg *Config) *notionLogger {
+	l := &notionLogger{
+		redact:   make(map[string]bool),
+		sessions: make(map[string]*notionDebugLog),
+	}
+	if cfg.NotionProxyLog {
+		l.logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+	for _, field := range notionRedactedFields {
+		l.redact[field] = true
+	}
+	for _, field := range strings.Split(cfg.NotionLogRedact, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			l.redact[strings.ToLower(field)] = true
+		}
+	}
+	return l
+}
+
+// notionTrace records the Notion calls of one app request.
+type notionTrace struct {
+	logger *notionLogger
+	route  string
+	user   string
+	// debugID is the session ID if the session has debugging on.
+	debugID string
+}
+
+type notionTraceKey struct{}
+
+// Process attaches a trace to the request context if its Notion calls are to
+// be logged.
+func (l *notionLogger) Process(w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request) error) error {
+	session, ok := middleware.SessionFromContext(r.Context())
+	if !ok {
+		return next(w, r)
+	}
+	username, loggedIn := session.Username()
+	if !loggedIn {
+		return next(w, r)
+	}
+	var debug bool
+	session.Get(notionDebugSessionKey, &debug)
+	if l.logger == nil && !debug {
+		return next(w, r)
+	}
+
+	trace := &notionTrace{logger: l, route: r.Method + " " + r.URL.Path, user: username}
+	if debug {
+		trace.debugID = session.ID()
+	}
+	return next(w, r.WithContext(context.WithValue(r.Context(), notionTraceKey{}, trace)))
+}
+
+// notionTraceFrom returns the request's trace, or nil if its calls are not
+// logged.
+func notionTraceFrom(ctx context.Context) *notionTrace {
+	trace, _ := ctx.Value(notionTraceKey{}).(*notionTrace)
+	return trace
+}
+
+// record logs a Notion call. The bodies are redacted, with token removed, and
+// truncated. It does nothing if t is nil.
+func (t *notionTrace) record(e notionLogEntry, token string, reqBody, respBody notionBody) {
+	if t == nil {
+		return
+	}
+	e.Route = t.route
+	e.RequestBody = t.logger.redactBody(reqBody, token)
+	e.ResponseBody = t.logger.redactBody(respBody, token)
+
+	if t.logger.logger != nil {
+		level := slog.LevelInfo
+		if e.Error != "" || e.Status >= 400 {
+			level = slog.LevelWarn
+		}
+		t.logger.logger.LogAttrs(context.Background(), level, "notion request",
+			slog.String("user", t.user),
+			slog.String("route", e.Route),
+			slog.String("method", e.Method),
+			slog.String("path", e.Path),
+			slog.Int("status", e.Status),
+			slog.Int64("latency_ms", e.LatencyMS),
+			slog.String("request_id", e.RequestID),
+			slog.String("request_body", e.RequestBody),
+			slog.String("response_body", e.ResponseBody),
+			slog.String("error", e.Error),
+		)
+	}
+	if t.debugID != "" {
+		t.logger.append(t.debugID, e)
+	}
+}
+
+// notionBody is a body to log: all of it, or its first bytes if it was
+// captured in passing.
+type notionBody struct {
+	data []byte
+	// size is the size of the whole body, or -1 if it is not known.
+	size int64
+}
+
+// fullBody returns a body held in memory whole.
+func fullBody(data []byte) notionBody {
+	return notionBody{data: data, size: int64(len(data))}
+}
+
+// truncated reports whether data is only the start of the body.
+func (b notionBody) truncated() bool {
+	return b.size < 0 || b.size > int64(len(b.data))
+}
+
+// notionBodyCapture keeps the first notionLogCaptureLimit bytes written to
+// it and counts the rest, so that a proxied body can be logged without
+// holding all of it in memory.
+type notionBodyCapture struct {
+	mu   sync.Mutex
+	body notionBody
+}
+
+func (c *notionBodyCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if room := notionLogCaptureLimit - len(c.body.data); room > 0 {
+		c.body.data = append(c.body.data, p[:min(room, len(p))]...)
+	}
+	c.body.size += int64(len(p))
+	return len(p), nil
+}
+
+// captured returns the body written so far.
+func (c *notionBodyCapture) captured() notionBody {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.body
+}
+
+// notionTeeBody is a proxied response body that is captured as it is read,
+// and calls done once it has been read or closed.
+type notionTeeBody struct {
+	io.ReadCloser
+	capture *notionBodyCapture
+	once    sync.Once
+	done    func(error)
+}
+
+func (b *notionTeeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.capture.Write(p[:n])
+	if err != nil {
+		if err == io.EOF {
+			b.finish(nil)
+		} else {
+			b.finish(err)
+		}
+	}
+	return n, err
+}
+
+func (b *notionTeeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish(nil)
+	return err
+}
+
+func (b *notionTeeBody) finish(err error) {
+	b.once.Do(func() { b.done(err) })
+}
+
+// proxy records the call made by proxy for r. The bodies are captured as
+// they are forwarded, keeping only their first bytes for the log, and the
+// call is recorded once the response body has been passed on.
+func (t *notionTrace) proxy(proxy *httputil.ReverseProxy, r *http.Request, token string) {
+	reqBody := &notionBodyCapture{}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
+	}
+	entry := notionLogEntry{
+		Time:   time.Now().UTC(),
+		Method: r.Method,
+		Path:   strings.TrimPrefix(r.URL.RequestURI(), "/api/notion"),
+	}
+	recorded := false
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		recorded = true
+		entry.LatencyMS, entry.Status = time.Since(entry.Time).Milliseconds(), resp.StatusCode
+		respBody := &notionBodyCapture{}
+		resp.Body = &notionTeeBody{ReadCloser: resp.Body, capture: respBody, done: func(err error) {
+			body := decodedBody(resp.Header, respBody.captured())
+			entry.RequestID = notionRequestID(resp.Header, body.data)
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			t.record(entry, token, reqBody.captured(), body)
+		}}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if !recorded {
+			entry.LatencyMS, entry.Error = time.Since(entry.Time).Milliseconds(), err.Error()
+			entry.Status = http.StatusBadGateway
+			t.record(entry, token, reqBody.captured(), notionBody{})
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// append adds an entry to a session's buffer, dropping the oldest entries
+// and the buffers of sessions that have been idle too long.
+func (l *notionLogger) append(sessionID string, e notionLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for id, log := range l.sessions {
+		if now.Sub(log.lastUsed) > notionDebugTTL {
+			delete(l.sessions, id)
+		}
+	}
+	log, ok := l.sessions[sessionID]
+	if !ok {
+		log = &notionDebugLog{}
+		l.sessions[sessionID] = log
+	}
+	log.lastUsed = now
+	log.entries = append(log.entries, e)
+	if n := len(log.entries) - notionDebugMaxEntries; n > 0 {
+		log.entries = slices.Delete(log.entries, 0, n)
+	}
+}
+
+// entries returns a session's entries, newest first.
+func (l *notionLogger) entries(sessionID string) []notionLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []notionLogEntry{}
+	if log, ok := l.sessions[sessionID]; ok {
+		entries = append(entries, log.entries...)
+		slices.Reverse(entries)
+	}
+	return entries
+}
+
+// clear drops a session's entries.
+func (l *notionLogger) clear(sessionID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, sessionID)
+}
+
+// redactBody returns body as text for logging, with redacted JSON fields and
+// token replaced, truncated to notionLogBodyLimit bytes.
+func (l *notionLogger) redactBody(body notionBody, token string) string {
+	if len(body.data) == 0 {
+		return ""
+	}
+	data := body.data
+	var v any
+	if !body.truncated() && json.Unmarshal(data, &v) == nil {
+		data, _ = json.Marshal(l.redactValue(v))
+	} else if trimmed := bytes.TrimSpace(data); body.truncated() && len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		data = l.redactPartial(data)
+	}
+	s := string(data)
+	if token != "" {
+		s = strings.ReplaceAll(s, token, notionRedacted)
+	}
+	if !body.truncated() && len(s) <= notionLogBodyLimit {
+		return s
+	}
+	cut := min(notionLogBodyLimit, len(s))
+	for cut > 0 && cut < len(s) && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	if body.size < 0 {
+		return s[:cut] + "… (truncated)"
+	}
+	dropped := int64(len(s)-cut) + body.size - int64(len(body.data))
+	return fmt.Sprintf("%s… (%d bytes truncated)", s[:cut], dropped)
+}
+
+// redactPartial redacts the fields of the start of a JSON document whose end
+// was not captured. It returns the document compacted, up to its last
+// complete token.
+func (l *notionLogger) redactPartial(data []byte) []byte {
+	// level is an open object or array, with the number of keys and values
+	// written in it. Keys are at even counts in objects.
+	type level struct {
+		object bool
+		n      int
+	}
+	var levels []level
+	var out bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	redactNext, skip := false, 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return out.Bytes()
+		}
+		delim, isDelim := tok.(json.Delim)
+		if skip > 0 {
+			// Inside a redacted object or array.
+			if isDelim && (delim == '{' || delim == '[') {
+				skip++
+			} else if isDelim {
+				skip--
+			}
+			continue
+		}
+		if isDelim && (delim == '}' || delim == ']') {
+			out.WriteByte(byte(delim))
+			levels = levels[:len(levels)-1]
+			continue
+		}
+		key := false
+		if n := len(levels); n > 0 {
+			lv := &levels[n-1]
+			if lv.object && lv.n%2 == 1 {
+				out.WriteByte(':')
+			} else if lv.n > 0 {
+				out.WriteByte(',')
+			}
+			key = lv.object && lv.n%2 == 0
+			lv.n++
+		}
+		switch {
+		case redactNext:
+			redactNext = false
+			out.WriteString(`"` + notionRedacted + `"`)
+			if isDelim {
+				skip = 1
+			}
+		case isDelim:
+			out.WriteByte(byte(delim))
+			levels = append(levels, level{object: delim == '{'})
+		default:
+			b, _ := json.Marshal(tok)
+			out.Write(b)
+			if key {
+				redactNext = l.redact[strings.ToLower(tok.(string))]
+			}
+		}
+	}
+}
+
+// redactValue replaces the values of redacted fields in a decoded JSON value.
+func (l *notionLogger) redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if l.redact[strings.ToLower(key)] {
+				v[key] = notionRedacted
+			} else {
+				v[key] = l.redactValue(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = l.redactValue(value)
+		}
+	}
+	return v
+}
+
+// notionRequestID returns the request ID of a Notion response, from its
+// headers or, for errors, its body.
+func notionRequestID(header http.Header, body []byte) string {
+	if id := header.Get("X-Notion-Request-Id"); id != "" {
+		return id
+	}
+	if id := header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	var errBody struct {
+		RequestID string `json:"request_id"`
+	}
+	json.Unmarshal(body, &errBody)
+	return errBody.RequestID
+}
+
+// decodedBody returns a response body for logging, decompressing it if the
+// proxy passed it through gzip-encoded. The size of a decompressed body is
+// not known if it was cut short.
+func decodedBody(header http.Header, body notionBody) notionBody {
+	if header.Get("Content-Encoding") != "gzip" {
+		return body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body.data))
+	if err != nil {
+		return body
+	}
+	data, err := io.ReadAll(io.LimitReader(zr, notionLogCaptureLimit+1))
+	if err != nil && len(data) == 0 {
+		return body
+	}
+	if err == nil && !body.truncated() && len(data) <= notionLogCaptureLimit {
+		return fullBody(data)
+	}
+	return notionBody{data: data[:min(len(data), notionLogCaptureLimit)], size: -1}
+}
+
+// notionDebugResponse is the debug state of a session.
+type notionDebugResponse struct {
+	Enabled bool             `json:"enabled"`
+	Entries []notionLogEntry `json:"entries"`
+}
+
+// notionDebugEndpoint reports whether the session records its Notion calls,
+// with the most recent calls first.
+func (s *Server) notionDebugEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	if _, err := sessionUserKey(r); err != nil {
+		return nil, err
+	}
+	session, _ := middleware.SessionFromContext(r.Context())
+	var enabled bool
+	session.Get(notionDebugSessionKey, &enabled)
+	return &endpoint.JSONRenderer{Value: notionDebugResponse{
+		Enabled: enabled,
+		Entries: s.notionLog.entries(session.ID()),
+	}}, nil
+}
+
+// putNotionDebugEndpoint turns recording of the session's Notion calls on or
+// off. Turning it off discards the recorded calls.
+func (s *Server) putNotionDebugEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	if _, err := sessionUserKey(r); err != nil {
+		return nil, err
+	}
+	session, _ := middleware.SessionFromContext(r.Context())
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	if req.Enabled == nil {
+		return nil, endpoint.Error(http.StatusBadRequest, "enabled is required", nil)
+	}
+
+	if err := session.Set(notionDebugSessionKey, *req.Enabled); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to update session", err)
+	}
+	if !*req.Enabled {
+		s.notionLog.clear(session.ID())
+	}
+	return &endpoint.JSONRenderer{Value: notionDebugResponse{
+		Enabled: *req.Enabled,
+		Entries: s.notionLog.entries(session.ID()),
+	}}, nil
+}
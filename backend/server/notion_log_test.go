@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmock"
+)
+
+func TestNotionLogRedact(t *testing.T) {
+	l := newNotionLogger(&Config{NotionLogRedact: " Plain_Text ,email"})
+
+	body := `{"access_token":"a","results":[{"plain_text":"private","id":"p1","owner":{"email":"x@example.com"}}],"note":"Bearer ntn_secret"}`
+	got := l.redactBody(fullBody([]byte(body)), "ntn_secret")
+	for _, leaked := range []string{`"a"`, "private", "x@example.com", "ntn_secret"} {
+		if strings.Contains(got, leaked) {
+			t.Errorf("Expected %s to be redacted from %s", leaked, got)
+		}
+	}
+	if !strings.Contains(got, `"id":"p1"`) {
+		t.Errorf("Expected other fields to be kept, got %s", got)
+	}
+
+	if got := l.redactBody(fullBody([]byte("not json ntn_secret")), "ntn_secret"); got != "not json [REDACTED]" {
+		t.Errorf("Expected the token to be removed from text bodies, got %q", got)
+	}
+
+	long := strings.Repeat("é", notionLogBodyLimit)
+	got = l.redactBody(fullBody([]byte(long)), "")
+	if !strings.HasSuffix(got, "… (2048 bytes truncated)") || !strings.HasPrefix(got, strings.Repeat("é", notionLogBodyLimit/2)+"…") {
+		t.Errorf("Expected the body to be truncated on a rune boundary, got %q", got[len(got)-40:])
+	}
+
+	// Only the start of a proxied body is captured, and its fields are
+	// redacted up to where it was cut.
+	partial := `{"results":[{"id":"p1","secret":{"a":[1,{"b":2}]},"Token":"abc"},{"plain_text":"priv`
+	got = l.redactBody(notionBody{data: []byte(partial), size: 100000}, "")
+	want := fmt.Sprintf(`{"results":[{"id":"p1","secret":"[REDACTED]","Token":"[REDACTED]"},{"plain_text"… (%d bytes truncated)`, 100000-len(partial))
+	if got != want {
+		t.Errorf("Unexpected partial body %s", got)
+	}
+}
+
+func TestNotionDebug(t *testing.T) {
+	mock := notionmock.New(notionmock.Options{Tokens: []string{"test-token"}})
+	pageID := mock.AddPage("", "Meetings")
+	s := setupTestServer(t)
+	useMockNotion(t, s, mock)
+
+	s.cfg.NotionProxyLog = true
+	var serverLog bytes.Buffer
+	s.notionLog.logger = slog.New(slog.NewJSONHandler(&serverLog, nil))
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	resp := getWithCookies(t, ts, "/api/notion/debug", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+	proxyGet := func(path string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", ts.URL+"/api/notion"+path, nil)
+		req.Header.Set("Notion-Version", notionVersion)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	setDebug := func(enabled bool) {
+		t.Helper()
+		req, _ := http.NewRequest("PUT", ts.URL+"/api/notion/debug", strings.NewReader(fmt.Sprintf(`{"enabled":%t}`, enabled)))
+		req.Header.Set("Content-Type", "application/json")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+	}
+	debug := func() notionDebugResponse {
+		t.Helper()
+		resp := getWithCookies(t, ts, "/api/notion/debug", cookies)
+		defer resp.Body.Close()
+		var result notionDebugResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Calls are only kept for the session once it turns debugging on.
+	proxyGet("/v1/pages/" + pageID)
+	if got := debug(); got.Enabled || len(got.Entries) != 0 {
+		t.Errorf("Expected debugging to be off, got %+v", got)
+	}
+	setDebug(true)
+
+	proxyGet("/v1/pages/" + pageID)
+	proxyGet("/v1/pages/00000000-0000-4000-8000-0000000000ff")
+	resp = postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"page_id": pageID},
+		"transcript": Transcript{Title: "Standup", Turns: []Turn{{Speaker: "A", Text: "Hello"}}},
+	}, cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected export to succeed, got %d", resp.StatusCode)
+	}
+
+	got := debug()
+	if !got.Enabled || len(got.Entries) < 4 {
+		t.Fatalf("Expected the calls to be recorded, got %+v", got)
+	}
+	last := got.Entries[len(got.Entries)-1]
+	if last.Route != "GET /api/notion/v1/pages/"+pageID || last.Method != "GET" || last.Path != "/v1/pages/"+pageID || last.Status != http.StatusOK {
+		t.Errorf("Unexpected proxy entry %+v", last)
+	}
+	if last.RequestID == "" || !strings.Contains(last.ResponseBody, "Meetings") {
+		t.Errorf("Expected the request ID and response body, got %+v", last)
+	}
+	notFound := got.Entries[len(got.Entries)-2]
+	if notFound.Status != http.StatusNotFound || notFound.RequestID == "" {
+		t.Errorf("Expected the failed call with its request ID, got %+v", notFound)
+	}
+	export := got.Entries[0]
+	if export.Route != "POST /api/export/notion" || export.Method != "PATCH" || !strings.Contains(export.RequestBody, "Hello") {
+		t.Errorf("Expected the newest entry to be the export's append, got %+v", export)
+	}
+	for _, e := range got.Entries {
+		if strings.Contains(e.RequestBody+e.ResponseBody, "test-token") {
+			t.Errorf("Token leaked into %+v", e)
+		}
+	}
+
+	if lines := strings.Count(serverLog.String(), `"msg":"notion request"`); lines != len(got.Entries)+1 {
+		t.Errorf("Expected every call in the server log, got %d lines for %d entries", lines, len(got.Entries))
+	}
+	if !strings.Contains(serverLog.String(), `"user":"testuser"`) || strings.Contains(serverLog.String(), "test-token") {
+		t.Errorf("Unexpected server log %s", serverLog.String())
+	}
+
+	// Large bodies are logged from the start captured as they pass.
+	large := `{"query":"standup","filter_ids":[` + strings.Repeat(`"p1",`, 20000) + `"p1"]}`
+	req, _ := http.NewRequest("POST", ts.URL+"/api/notion/v1/search", strings.NewReader(large))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Notion-Version", notionVersion)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if resp, err := ts.Client().Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+	search := debug().Entries[0]
+	if search.Path != "/v1/search" || search.RequestBody != large[:notionLogBodyLimit]+fmt.Sprintf("… (%d bytes truncated)", len(large)-notionLogBodyLimit) {
+		t.Errorf("Unexpected large request entry %+v", search)
+	}
+
+	// Turning debugging off discards the entries.
+	setDebug(false)
+	proxyGet("/v1/pages/" + pageID)
+	if got := debug(); got.Enabled || len(got.Entries) != 0 {
+		t.Errorf("Expected no entries after turning debugging off, got %+v", got)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmd"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionMaxReadDepth bounds how deeply nested blocks are read from a page.
+// Deeper blocks are left out of the converted content.
+const notionMaxReadDepth = 8
+
+// blockTree reads the children of a block or page, and their children in
+// turn. Child pages and databases are not descended into.
+func (c *notionClient) blockTree(ctx context.Context, id string, depth int) ([]*notionmd.Block, error) {
+	raws, err := c.listBlockChildren(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*notionmd.Block, 0, len(raws))
+	for _, raw := range raws {
+		block, hasChildren, err := notionmd.DecodeBlock(raw)
+		if err != nil {
+			continue
+		}
+		if hasChildren && depth < notionMaxReadDepth && block.Type != "child_page" && block.Type != "child_database" {
+			if block.Children, err = c.blockTree(ctx, block.ID, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// notionPageMarkdownEndpoint returns the content of a page as Markdown, for
+// use as a transcript's notes.
+func (s *Server) notionPageMarkdownEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pageID := r.PathValue("id")
+	blocks, err := s.newNotionClient(token).blockTree(r.Context(), pageID, 1)
+	if err != nil {
+		return nil, notionEndpointError(err)
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{
+		"page_id":  pageID,
+		"markdown": notionmd.Markdown(blocks),
+	}}, nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotionPageMarkdown(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	fake.pages["agenda-page"] = map[string]any{}
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	paragraph := func(text string) map[string]any {
+		return map[string]any{"type": "paragraph", "paragraph": map[string]any{
+			"rich_text": []any{map[string]any{"type": "text", "text": map[string]any{"content": text}}},
+		}}
+	}
+	fake.addBlock("agenda-page", map[string]any{"type": "heading_2", "heading_2": map[string]any{
+		"rich_text": []any{map[string]any{"type": "text", "text": map[string]any{"content": "Agenda"}}},
+	}}, 1)
+	item := fake.addBlock("agenda-page", map[string]any{"type": "bulleted_list_item", "bulleted_list_item": map[string]any{
+		"rich_text": []any{map[string]any{"type": "text", "text": map[string]any{"content": "Budget"}, "annotations": map[string]any{"bold": true}}},
+	}}, 1)
+	fake.addBlock(item, map[string]any{"type": "bulleted_list_item", "bulleted_list_item": map[string]any{
+		"rich_text": []any{map[string]any{"type": "text", "text": map[string]any{"content": "Q3 review"}}},
+	}}, 1)
+	fake.addBlock("agenda-page", map[string]any{"type": "ai_block", "ai_block": map[string]any{}}, 1)
+	// Enough blocks to need a second page of results.
+	for i := 0; i < 120; i++ {
+		fake.addBlock("agenda-page", paragraph(fmt.Sprintf("Line %d", i)), 1)
+	}
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	resp := getWithCookies(t, ts, "/api/notion/pages/agenda-page/markdown", cookies)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var result struct {
+		PageID   string `json:"page_id"`
+		Markdown string `json:"markdown"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "## Agenda\n\n- **Budget**\n  - Q3 review\n\n<!-- unsupported block: ai_block -->\n\nLine 0\n"
+	if !strings.HasPrefix(result.Markdown, want) {
+		t.Errorf("Unexpected Markdown:\n%s", result.Markdown)
+	}
+	if !strings.HasSuffix(result.Markdown, "\n\nLine 119\n") {
+		t.Errorf("Expected all pages of blocks to be read")
+	}
+
+	resp = getWithCookies(t, ts, "/api/notion/pages/agenda-page/markdown", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a session, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmd"
+)
+
+// plannedRequest is a Notion API request planned by an export. A request can
+// refer to the page and blocks created by earlier requests in the same plan
+// through placeholders, such as "{page}" or "{block:3}", in its path and in
+// its body's "after" field. Creates lists the placeholders bound to the
+// objects the request creates, in the order Notion returns them.
+type plannedRequest struct {
+	Method  string         `json:"method"`
+	Path    string         `json:"path"`
+	Body    map[string]any `json:"body,omitempty"`
+	Creates []string       `json:"creates,omitempty"`
+}
+
+// exportPlan is the sequence of requests that performs an export. Planning
+// makes no Notion requests, so the same plan is both returned by a dry run
+// and executed by a real export.
+type exportPlan struct {
+	Requests []*plannedRequest
+	// Sections lists the page's sections once the plan has run. Block IDs
+	// of blocks the plan creates are placeholders.
+	Sections []exportedSection
+
+	blocks int
+}
+
+// placeholderPattern matches the placeholders used in planned requests.
+var placeholderPattern = regexp.MustCompile(`\{(page|block:\d+)\}`)
+
+// add appends a request to the plan.
+func (p *exportPlan) add(method, path string, body map[string]any, creates ...string) {
+	p.Requests = append(p.Requests, &plannedRequest{Method: method, Path: path, Body: body, Creates: creates})
+}
+
+// createPage plans creating an empty page under the target with the given
+// properties, and returns the placeholder for the page. The title is always
+// written to the target's title property.
+func (p *exportPlan) createPage(target *exportTarget, title string, properties map[string]any) string {
+	props := map[string]any{
+		target.TitleProperty: map[string]any{"title": notionmd.RichText(notionmd.Text{Content: title})},
+	}
+	for name, value := range properties {
+		props[name] = value
+	}
+	p.add(http.MethodPost, "/v1/pages", map[string]any{"parent": target.Parent, "properties": props}, "{page}")
+	return "{page}"
+}
+
+// updatePageProperties plans setting the title and the given property values
+// of an existing page.
+func (p *exportPlan) updatePageProperties(pageID string, target *exportTarget, title string, properties map[string]any) {
+	props := map[string]any{
+		target.TitleProperty: map[string]any{"title": notionmd.RichText(notionmd.Text{Content: title})},
+	}
+	for name, value := range properties {
+		props[name] = value
+	}
+	p.add(http.MethodPatch, "/v1/pages/"+pageID, map[string]any{"properties": props})
+}
+
+// appendBlocks plans appending blocks under parent in batches of at most
+// notionMaxChildren, each followed by appends of its blocks' deferred
+// children under the newly created blocks. If after is set, the blocks are
+// inserted after that child instead of at the end. It returns the
+// placeholders for the created blocks.
+func (p *exportPlan) appendBlocks(parent, after string, blocks []*notionBlock) []string {
+	var refs []string
+	for len(blocks) > 0 {
+		batch := blocks[:min(len(blocks), notionMaxChildren)]
+		blocks = blocks[len(batch):]
+
+		children := make([]map[string]any, len(batch))
+		created := make([]string, len(batch))
+		for i, b := range batch {
+			children[i] = notionmd.EncodeBlock(b)
+			p.blocks++
+			created[i] = fmt.Sprintf("{block:%d}", p.blocks)
+		}
+		body := map[string]any{"children": children}
+		if after != "" {
+			body["after"] = after
+		}
+		p.add(http.MethodPatch, "/v1/blocks/"+parent+"/children", body, created...)
+		refs = append(refs, created...)
+
+		for i, b := range batch {
+			if deferred := notionmd.Deferred(b); len(deferred) > 0 {
+				p.appendBlocks(created[i], "", deferred)
+			}
+		}
+		if after != "" {
+			after = created[len(created)-1]
+		}
+	}
+	return refs
+}
+
+// appendSections plans appending the blocks of each section after the given
+// block, and returns the sections with placeholders for their blocks.
+func (p *exportPlan) appendSections(parent, after string, sections []exportSection) []exportedSection {
+	var blocks []*notionBlock
+	for _, sec := range sections {
+		blocks = append(blocks, sec.Blocks...)
+	}
+	refs := p.appendBlocks(parent, after, blocks)
+
+	exported := make([]exportedSection, len(sections))
+	for i, sec := range sections {
+		exported[i] = exportedSection{Key: sec.Key, BlockIDs: refs[:len(sec.Blocks)], Fingerprints: sec.fingerprints()}
+		refs = refs[len(sec.Blocks):]
+	}
+	return exported
+}
+
+// deleteBlocks plans archiving the given blocks.
+func (p *exportPlan) deleteBlocks(ids []string) {
+	for _, id := range ids {
+		p.add(http.MethodDelete, "/v1/blocks/"+id, nil)
+	}
+}
+
+// planCreate plans exporting a transcript to a new page under the target.
+func planCreate(target *exportTarget, title string, sections []exportSection, properties map[string]any) *exportPlan {
+	p := &exportPlan{}
+	page := p.createPage(target, title, properties)
+	p.Sections = p.appendSections(page, "", sections)
+	return p
+}
+
+// planUpdate plans bringing a previously exported page up to date with the
+// transcript's sections. Unchanged sections are kept, changed sections are
+// replaced in place, new sections are inserted and removed sections are
+// deleted. Conflicting sections are only overwritten when forced. The
+// section counts are recorded in resp.
+func planUpdate(rec *notionExportRecord, sections []exportSection, conflicts []exportConflict, force bool, resp *notionExportResponse) (*exportPlan, error) {
+	if len(conflicts) > 0 && !force {
+		return nil, &exportConflictError{Conflicts: conflicts}
+	}
+	conflicted := make(map[string]bool)
+	for _, conflict := range conflicts {
+		conflicted[conflict.Section] = true
+	}
+
+	old := make(map[string]exportedSection, len(rec.Sections))
+	for _, sec := range rec.Sections {
+		old[sec.Key] = sec
+	}
+	// A section is kept if it is unchanged and still in the same order
+	// relative to the other kept sections, since kept blocks do not move.
+	position := make(map[string]int, len(rec.Sections))
+	for i, sec := range rec.Sections {
+		position[sec.Key] = i
+	}
+	keep := make(map[string]bool, len(sections))
+	last := -1
+	for _, sec := range sections {
+		prev, ok := old[sec.Key]
+		if ok && !conflicted[sec.Key] && position[sec.Key] > last && slices.Equal(prev.Fingerprints, sec.fingerprints()) {
+			keep[sec.Key] = true
+			last = position[sec.Key]
+		}
+	}
+	// Blocks can only be inserted after an existing block, so sections
+	// before the first kept one are inserted after the first block of the
+	// previous export, whose section is replaced even if unchanged.
+	after := ""
+	if len(sections) > 0 && !keep[sections[0].Key] && len(rec.Sections) > 0 {
+		first := rec.Sections[0]
+		keep[first.Key] = false
+		after = first.BlockIDs[0]
+	}
+	kept := func(sec exportSection) bool { return keep[sec.Key] }
+
+	p := &exportPlan{}
+	for i := 0; i < len(sections); {
+		if sec := sections[i]; kept(sec) {
+			prev := old[sec.Key]
+			resp.Unchanged++
+			p.Sections = append(p.Sections, prev)
+			after = prev.BlockIDs[len(prev.BlockIDs)-1]
+			i++
+			continue
+		}
+
+		// Replace the run of changed and new sections with a single append.
+		// The blocks it replaces are deleted afterwards, since the run may be
+		// inserted after one of them.
+		j := i
+		for j < len(sections) && !kept(sections[j]) {
+			j++
+		}
+		run := sections[i:j]
+		exported := p.appendSections(rec.PageID, after, run)
+		p.Sections = append(p.Sections, exported...)
+		for _, sec := range run {
+			if prev, ok := old[sec.Key]; ok {
+				p.deleteBlocks(prev.BlockIDs)
+				resp.Replaced++
+			} else {
+				resp.Added++
+			}
+		}
+		last := exported[len(exported)-1]
+		after = last.BlockIDs[len(last.BlockIDs)-1]
+		i = j
+	}
+
+	current := make(map[string]bool, len(sections))
+	for _, sec := range sections {
+		current[sec.Key] = true
+	}
+	for _, sec := range rec.Sections {
+		if !current[sec.Key] {
+			p.deleteBlocks(sec.BlockIDs)
+			resp.Removed++
+		}
+	}
+	return p, nil
+}
+
+// planResult holds the IDs, and for pages the URLs, of the objects created
+// by executing a plan, keyed by placeholder. Done counts the requests made.
+type planResult struct {
+	IDs  map[string]string
+	URLs map[string]string
+	Done int
+}
+
+// staleSectionPrefix marks the keys of sections left on a page by a failed
+// export, so that the next export removes them.
+const staleSectionPrefix = "stale:"
+
+// written returns the sections on the page after the plan failed part way:
+// the plan's sections as far as their blocks were created, followed by the
+// blocks of the previous sections that the plan did not get to delete.
+func (r *planResult) written(p *exportPlan, previous []exportedSection) []exportedSection {
+	var out []exportedSection
+	used := make(map[string]bool)
+	for _, sec := range p.Sections {
+		var ids []string
+		for _, ref := range sec.BlockIDs {
+			id, err := r.resolve(ref)
+			if err != nil {
+				break
+			}
+			ids = append(ids, id)
+			used[id] = true
+		}
+		if len(ids) > 0 {
+			out = append(out, exportedSection{Key: sec.Key, BlockIDs: ids, Fingerprints: sec.Fingerprints[:len(ids)]})
+		}
+	}
+
+	deleted := make(map[string]bool)
+	for _, req := range p.Requests[:r.Done] {
+		if req.Method == http.MethodDelete {
+			deleted[strings.TrimPrefix(req.Path, "/v1/blocks/")] = true
+		}
+	}
+	for _, sec := range previous {
+		stale := exportedSection{Key: sec.Key}
+		if !strings.HasPrefix(stale.Key, staleSectionPrefix) {
+			stale.Key = staleSectionPrefix + stale.Key
+		}
+		for i, id := range sec.BlockIDs {
+			if !used[id] && !deleted[id] {
+				stale.BlockIDs = append(stale.BlockIDs, id)
+				stale.Fingerprints = append(stale.Fingerprints, sec.Fingerprints[i])
+			}
+		}
+		if len(stale.BlockIDs) > 0 {
+			out = append(out, stale)
+		}
+	}
+	return out
+}
+
+// resolve replaces placeholders in s with the IDs bound to them.
+func (r *planResult) resolve(s string) (string, error) {
+	var missing string
+	resolved := placeholderPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		id, ok := r.IDs[ref]
+		if !ok {
+			missing = ref
+		}
+		return id
+	})
+	if missing != "" {
+		return "", fmt.Errorf("export plan refers to %s before it is created", missing)
+	}
+	return resolved, nil
+}
+
+// sections returns the plan's sections with placeholders resolved.
+func (r *planResult) sections(planned []exportedSection) ([]exportedSection, error) {
+	out := make([]exportedSection, len(planned))
+	for i, sec := range planned {
+		ids := make([]string, len(sec.BlockIDs))
+		for j, id := range sec.BlockIDs {
+			var err error
+			if ids[j], err = r.resolve(id); err != nil {
+				return nil, err
+			}
+		}
+		out[i] = exportedSection{Key: sec.Key, BlockIDs: ids, Fingerprints: sec.Fingerprints}
+	}
+	return out, nil
+}
+
+// execute performs a plan's requests in order, binding placeholders to the
+// objects they create. Deleting a block that no longer exists is not an
+// error. On failure, the objects created so far are returned with the error.
+func (c *notionClient) execute(ctx context.Context, p *exportPlan) (*planResult, error) {
+	result := &planResult{IDs: map[string]string{}, URLs: map[string]string{}}
+	for _, req := range p.Requests {
+		path, err := result.resolve(req.Path)
+		if err != nil {
+			return result, err
+		}
+		var body any
+		if req.Body != nil {
+			resolved := make(map[string]any, len(req.Body))
+			for k, v := range req.Body {
+				resolved[k] = v
+			}
+			if after, ok := req.Body["after"].(string); ok {
+				if resolved["after"], err = result.resolve(after); err != nil {
+					return result, err
+				}
+			}
+			body = resolved
+		}
+
+		var resp struct {
+			ID      string `json:"id"`
+			URL     string `json:"url"`
+			Results []struct {
+				ID string `json:"id"`
+			} `json:"results"`
+		}
+		if err := c.do(ctx, req.Method, path, body, &resp); err != nil {
+			if req.Method == http.MethodDelete && isNotFound(err) {
+				result.Done++
+				continue
+			}
+			return result, err
+		}
+		result.Done++
+
+		switch {
+		case len(req.Creates) == 0:
+		case strings.HasSuffix(req.Path, "/children"):
+			if len(resp.Results) < len(req.Creates) {
+				return result, fmt.Errorf("notion: append returned %d blocks, expected %d", len(resp.Results), len(req.Creates))
+			}
+			for i, ref := range req.Creates {
+				result.IDs[ref] = resp.Results[i].ID
+			}
+		default:
+			result.IDs[req.Creates[0]] = resp.ID
+			result.URLs[req.Creates[0]] = resp.URL
+		}
+	}
+	return result, nil
+}
+
+// appendBlocks appends blocks under parentID, after the given child if set,
+// and returns the IDs of the created top-level blocks. More than
+// notionMaxChildren blocks take several requests, so on failure it returns
+// the IDs of the blocks created by the requests that succeeded.
+func (c *notionClient) appendBlocks(ctx context.Context, parentID, after string, blocks []*notionBlock) ([]string, error) {
+	p := &exportPlan{}
+	refs := p.appendBlocks(parentID, after, blocks)
+	result, err := c.execute(ctx, p)
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		id, ok := result.IDs[ref]
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids, err
+}
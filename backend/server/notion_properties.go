@@ -0,0 +1,268 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/notionmd"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// transcriptFieldTypes lists, for each transcript field that can be mapped
+// onto a database property, the Notion property types it can be written to.
+var transcriptFieldTypes = map[string][]string{
+	"title":    {"title", "rich_text"},
+	"date":     {"date"},
+	"duration": {"number", "rich_text"},
+	"speakers": {"multi_select", "rich_text"},
+	"tags":     {"multi_select", "select", "rich_text"},
+	"summary":  {"rich_text"},
+}
+
+// notionPropertyMapping maps transcript fields onto the properties of a
+// Notion database. It is saved per user and database.
+type notionPropertyMapping struct {
+	DatabaseID string `json:"database_id"`
+	// Properties maps transcript field names (see transcriptFieldTypes) to
+	// database property names.
+	Properties map[string]string `json:"properties"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// propertyMappingError lists every problem found when validating a mapping
+// against a database schema.
+type propertyMappingError struct {
+	Problems []string
+}
+
+func (e *propertyMappingError) Error() string {
+	return "invalid property mapping: " + strings.Join(e.Problems, "; ")
+}
+
+// validate checks the mapping against a database schema (property name to
+// type). A nil schema only checks that the fields are known and map to
+// distinct properties.
+func (m notionPropertyMapping) validate(schema map[string]string) error {
+	var problems []string
+	// mapped holds the field each property is mapped from.
+	mapped := make(map[string]string, len(m.Properties))
+	fields := make([]string, 0, len(m.Properties))
+	for field := range m.Properties {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		property := m.Properties[field]
+		allowed, ok := transcriptFieldTypes[field]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("unknown transcript field %q", field))
+		case property == "":
+			problems = append(problems, fmt.Sprintf("field %q has no property name", field))
+		case mapped[property] != "":
+			problems = append(problems, fmt.Sprintf("fields %q and %q both map to property %q", mapped[property], field, property))
+		case schema == nil:
+		case schema[property] == "":
+			problems = append(problems, fmt.Sprintf("field %q: database has no property %q", field, property))
+		case !slices.Contains(allowed, schema[property]):
+			problems = append(problems, fmt.Sprintf("field %q: property %q has type %s, expected one of %s",
+				field, property, schema[property], strings.Join(allowed, ", ")))
+		}
+		if ok && property != "" && mapped[property] == "" {
+			mapped[property] = field
+		}
+	}
+
+	if len(problems) > 0 {
+		return &propertyMappingError{Problems: problems}
+	}
+	return nil
+}
+
+// transcriptMetadata holds the transcript values that can be mapped onto
+// database properties.
+type transcriptMetadata struct {
+	Title    string
+	Date     time.Time
+	Duration time.Duration
+	Speakers []string
+	Tags     []string
+	Summary  string
+}
+
+// metadata derives the mappable values of a transcript. The date and duration
+// span the timestamps of the first and last turns.
+func (t Transcript) metadata() transcriptMetadata {
+	md := transcriptMetadata{Title: t.Title, Tags: t.Tags, Summary: t.Summary}
+	var first, last time.Time
+	for _, turn := range t.Turns {
+		if turn.Timestamp.IsZero() {
+			continue
+		}
+		if first.IsZero() || turn.Timestamp.Before(first) {
+			first = turn.Timestamp
+		}
+		if turn.Timestamp.After(last) {
+			last = turn.Timestamp
+		}
+		if turn.Speaker != "" && !slices.Contains(md.Speakers, turn.Speaker) {
+			md.Speakers = append(md.Speakers, turn.Speaker)
+		}
+	}
+	md.Date = first
+	if !first.IsZero() {
+		md.Duration = last.Sub(first)
+	}
+	return md
+}
+
+// propertyValues builds the Notion property values for a transcript according
+// to the mapping. The mapping is validated against the schema first, so a
+// database changed since the mapping was saved is reported rather than
+// producing a failed request. Fields without a value are omitted.
+func (m notionPropertyMapping) propertyValues(t Transcript, schema map[string]string, loc *time.Location) (map[string]any, error) {
+	if err := m.validate(schema); err != nil {
+		return nil, err
+	}
+
+	md := t.metadata()
+	values := make(map[string]any, len(m.Properties))
+	for field, property := range m.Properties {
+		var value any
+		switch typ := schema[property]; field {
+		case "title":
+			value = textProperty(typ, md.Title)
+		case "summary":
+			value = textProperty(typ, md.Summary)
+		case "date":
+			if !md.Date.IsZero() {
+				value = map[string]any{"date": map[string]any{"start": md.Date.In(loc).Format(time.RFC3339)}}
+			}
+		case "duration":
+			if !md.Date.IsZero() {
+				if typ == "number" {
+					// Minutes, to one decimal place.
+					value = map[string]any{"number": math.Round(md.Duration.Minutes()*10) / 10}
+				} else {
+					value = textProperty(typ, md.Duration.Round(time.Second).String())
+				}
+			}
+		case "speakers":
+			value = listProperty(typ, md.Speakers)
+		case "tags":
+			value = listProperty(typ, md.Tags)
+		}
+		if value != nil {
+			values[property] = value
+		}
+	}
+	return values, nil
+}
+
+// textProperty builds a title or rich_text property value.
+func textProperty(typ, text string) any {
+	if text == "" {
+		return nil
+	}
+	rt := notionmd.RichText(notionmd.Text{Content: text})
+	return map[string]any{typ: rt[:min(len(rt), notionMaxRichText)]}
+}
+
+// listProperty builds a multi_select, select or rich_text property value from
+// a list of names. Option names may not contain commas in Notion.
+func listProperty(typ string, names []string) any {
+	if len(names) == 0 {
+		return nil
+	}
+	switch typ {
+	case "multi_select":
+		options := []map[string]any{}
+		for _, name := range names[:min(len(names), notionMaxMultiSelect)] {
+			options = append(options, map[string]any{"name": strings.ReplaceAll(name, ",", " ")})
+		}
+		return map[string]any{"multi_select": options}
+	case "select":
+		return map[string]any{"select": map[string]any{"name": strings.ReplaceAll(names[0], ",", " ")}}
+	}
+	return textProperty(typ, strings.Join(names, ", "))
+}
+
+// mappingKey returns the store key for a user's mapping of a database. IDs
+// are normalised so that dashed and undashed forms share a mapping.
+func mappingKey(userKey, databaseID string) string {
+	return userKey + "/" + compactNotionID(databaseID)
+}
+
+// getPropertyMappingEndpoint returns the saved mapping for a database.
+func (s *Server) getPropertyMappingEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, ok := s.notionMappings.Get(mappingKey(userKey, r.PathValue("database_id")))
+	if !ok {
+		return nil, endpoint.Error(http.StatusNotFound, "no mapping for database", nil)
+	}
+	return &endpoint.JSONRenderer{Value: mapping}, nil
+}
+
+// putPropertyMappingEndpoint validates a mapping against the database schema
+// retrieved from Notion and saves it.
+func (s *Server) putPropertyMappingEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
+	}
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Properties map[string]string `json:"properties"`
+	}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		return nil, err
+	}
+	mapping := notionPropertyMapping{
+		DatabaseID: r.PathValue("database_id"),
+		Properties: body.Properties,
+	}
+	if err := mapping.validate(nil); err != nil {
+		return nil, endpoint.Error(http.StatusUnprocessableEntity, err.Error(), err)
+	}
+
+	target, err := s.newNotionClient(token).resolveExportParent(r.Context(), notionExportParent{DatabaseID: mapping.DatabaseID})
+	if err != nil {
+		return nil, notionEndpointError(err)
+	}
+	if err := mapping.validate(target.Schema); err != nil {
+		return nil, endpoint.Error(http.StatusUnprocessableEntity, err.Error(), err)
+	}
+
+	mapping.UpdatedAt = time.Now().UTC()
+	if err := s.notionMappings.Put(mappingKey(userKey, mapping.DatabaseID), mapping); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to save mapping", err)
+	}
+	return &endpoint.JSONRenderer{Value: mapping}, nil
+}
+
+// deletePropertyMappingEndpoint removes the saved mapping for a database.
+func (s *Server) deletePropertyMappingEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.notionMappings.Delete(mappingKey(userKey, r.PathValue("database_id"))); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to delete mapping", err)
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{"deleted": true}}, nil
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPropertyMapping_Validate(t *testing.T) {
+	schema := map[string]string{
+		"Name":     "title",
+		"When":     "date",
+		"Minutes":  "number",
+		"People":   "multi_select",
+		"Label":    "select",
+		"Abstract": "rich_text",
+	}
+
+	tests := []struct {
+		name       string
+		properties map[string]string
+		problems   []string
+	}{
+		{
+			name: "Valid mapping",
+			properties: map[string]string{
+				"title": "Name", "date": "When", "duration": "Minutes",
+				"speakers": "People", "tags": "Label", "summary": "Abstract",
+			},
+		},
+		{
+			name:       "Unknown field",
+			properties: map[string]string{"attendees": "People"},
+			problems:   []string{`unknown transcript field "attendees"`},
+		},
+		{
+			name:       "Missing property",
+			properties: map[string]string{"date": "Date"},
+			problems:   []string{`field "date": database has no property "Date"`},
+		},
+		{
+			name:       "Type mismatches",
+			properties: map[string]string{"date": "Abstract", "summary": "People"},
+			problems: []string{
+				`field "date": property "Abstract" has type rich_text, expected one of date`,
+				`field "summary": property "People" has type multi_select, expected one of rich_text`,
+			},
+		},
+		{
+			name:       "Shared property",
+			properties: map[string]string{"speakers": "People", "tags": "People"},
+			problems:   []string{`fields "speakers" and "tags" both map to property "People"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := notionPropertyMapping{Properties: tt.properties}.validate(schema)
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			mappingErr, ok := err.(*propertyMappingError)
+			if !ok {
+				t.Fatalf("Expected propertyMappingError, got %v", err)
+			}
+			if strings.Join(mappingErr.Problems, "\n") != strings.Join(tt.problems, "\n") {
+				t.Errorf("Unexpected problems:\n got %q\nwant %q", mappingErr.Problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestPropertyMapping_Values(t *testing.T) {
+	start := time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)
+	transcript := Transcript{
+		Title:   "Retro",
+		Summary: "Went well",
+		Tags:    []string{"team, eng", "retro"},
+		Turns: []Turn{
+			{Speaker: "Speaker 0", Timestamp: start},
+			{Speaker: "Speaker 1", Timestamp: start.Add(30 * time.Second)},
+			{Speaker: "Speaker 0", Timestamp: start.Add(45 * time.Minute)},
+		},
+	}
+	schema := map[string]string{"When": "date", "Minutes": "number", "People": "multi_select", "Speakers": "rich_text", "Tags": "multi_select", "Notes": "rich_text"}
+	mapping := notionPropertyMapping{Properties: map[string]string{
+		"date": "When", "duration": "Minutes", "speakers": "People", "tags": "Tags", "summary": "Notes",
+	}}
+
+	values, err := mapping.propertyValues(transcript, schema, time.UTC)
+	if err != nil {
+		t.Fatalf("propertyValues failed: %v", err)
+	}
+	got, _ := json.Marshal(values)
+	want := `{"Minutes":{"number":45},` +
+		`"Notes":{"rich_text":[{"text":{"content":"Went well"},"type":"text"}]},` +
+		`"People":{"multi_select":[{"name":"Speaker 0"},{"name":"Speaker 1"}]},` +
+		`"Tags":{"multi_select":[{"name":"team  eng"},{"name":"retro"}]},` +
+		`"When":{"date":{"start":"2026-03-04T10:00:00Z"}}}`
+	if string(got) != want {
+		t.Errorf("Unexpected values:\n got %s\nwant %s", got, want)
+	}
+
+	// Speakers as text, and fields without values are omitted.
+	mapping = notionPropertyMapping{Properties: map[string]string{"speakers": "Speakers"}}
+	values, _ = mapping.propertyValues(transcript, schema, time.UTC)
+	got, _ = json.Marshal(values)
+	if want := `{"Speakers":{"rich_text":[{"text":{"content":"Speaker 0, Speaker 1"},"type":"text"}]}}`; string(got) != want {
+		t.Errorf("Unexpected values:\n got %s\nwant %s", got, want)
+	}
+	values, _ = notionPropertyMapping{Properties: map[string]string{"date": "When"}}.propertyValues(Transcript{}, schema, time.UTC)
+	if len(values) != 0 {
+		t.Errorf("Expected no values for an empty transcript, got %v", values)
+	}
+}
+
+func TestPropertyMapping_Export(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	fake.databases["db1"] = map[string]any{"object": "database", "id": "db1", "data_sources": []any{map[string]any{"id": "ds1"}}}
+	fake.dataSources["ds1"] = map[string]any{"object": "data_source", "id": "ds1",
+		"parent": map[string]any{"type": "database_id", "database_id": "db1"},
+		"properties": map[string]any{
+			"Meeting": map[string]any{"type": "title"},
+			"Date":    map[string]any{"type": "date"},
+			"Tags":    map[string]any{"type": "multi_select"},
+		},
+	}
+	s := setupTestServer(t)
+	useMockNotion(t, s, fake)
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	put := func(t *testing.T, body any) *http.Response {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		req, _ := http.NewRequest("PUT", ts.URL+"/api/notion/mappings/db1", strings.NewReader(string(payload)))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := put(t, map[string]any{"properties": map[string]string{"date": "Tags"}}); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 for a type mismatch, got %d", resp.StatusCode)
+	}
+	if resp := put(t, map[string]any{"properties": map[string]string{"date": "Date", "tags": "Tags"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	resp := getWithCookies(t, ts, "/api/notion/mappings/db1", cookies)
+	var mapping notionPropertyMapping
+	json.NewDecoder(resp.Body).Decode(&mapping)
+	resp.Body.Close()
+	if mapping.Properties["date"] != "Date" || mapping.Properties["tags"] != "Tags" {
+		t.Errorf("Unexpected saved mapping %+v", mapping)
+	}
+
+	transcript := Transcript{
+		Title: "Standup",
+		Tags:  []string{"daily"},
+		Turns: []Turn{{Speaker: "Speaker 0", Text: "Hi", Timestamp: time.Date(2026, 3, 4, 10, 0, 0, 0, time.UTC)}},
+	}
+	exportResp := postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"data_source_id": "ds1"},
+		"transcript": transcript,
+	}, cookies)
+	var result notionExportResponse
+	json.NewDecoder(exportResp.Body).Decode(&result)
+	exportResp.Body.Close()
+	if exportResp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", exportResp.StatusCode)
+	}
+	props := fake.pages[result.PageID]["properties"].(map[string]any)
+	if _, ok := props["Meeting"]; !ok {
+		t.Errorf("Expected title property, got %v", props)
+	}
+	if date := props["Date"].(map[string]any)["date"].(map[string]any)["start"]; date != "2026-03-04T10:00:00Z" {
+		t.Errorf("Unexpected date %v", date)
+	}
+	if tags := props["Tags"].(map[string]any)["multi_select"].([]any); len(tags) != 1 {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	// The database schema changed since the mapping was saved.
+	fake.mu.Lock()
+	fake.dataSources["ds1"]["properties"].(map[string]any)["Date"] = map[string]any{"type": "rich_text"}
+	fake.mu.Unlock()
+	exportResp = postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"database_id": "db1"},
+		"transcript": transcript,
+	}, cookies)
+	exportResp.Body.Close()
+	if exportResp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422 after a schema change, got %d", exportResp.StatusCode)
+	}
+}
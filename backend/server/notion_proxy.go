@@ -10,32 +10,25 @@ import (
 	"github.com/mnehpets/oneserve/middleware"
 )
 
-// notionAPIURL is the base URL used by the Notion reverse proxy.
-//
-// It is a variable (not a const) so tests can override it to point at a mock
-// Notion server.
-var notionAPIURL = "https://api.notion.com"
+// defaultNotionAPIURL is the base URL of the Notion API, unless
+// NOTION_API_URL points the server at another.
+const defaultNotionAPIURL = "https://api.notion.com"
 
 // notionProxyEndpoint handles proxying requests to the Notion API.
 func (s *Server) notionProxyEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
-	// 1. Check for session and authentication
-	session, ok := middleware.SessionFromContext(r.Context())
-	if !ok {
-		return nil, endpoint.Error(http.StatusUnauthorized, "Unauthorized", nil)
-	}
-
-	if _, loggedIn := session.Username(); !loggedIn {
-		return nil, endpoint.Error(http.StatusUnauthorized, "Unauthorized", nil)
+	// 1. Retrieve Notion token for the logged-in session
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
 	}
 
-	// 2. Retrieve Notion token
-	var notionToken NotionToken
-	if err := session.Get("notion_token", &notionToken); err != nil || notionToken.AccessToken == "" {
-		return nil, endpoint.Error(http.StatusUnauthorized, "Notion authentication required", nil)
+	// 2. Forward requests at the token's pace
+	if err := notionRateLimit.wait(r.Context(), token); err != nil {
+		return nil, endpoint.Error(http.StatusServiceUnavailable, "request cancelled", err)
 	}
 
 	// 3. Setup Reverse Proxy
-	target, _ := url.Parse(notionAPIURL)
+	target, _ := url.Parse(s.notionAPIURL)
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
 	// Custom Director to modify the request
@@ -52,8 +45,38 @@ func (s *Server) notionProxyEndpoint(w http.ResponseWriter, r *http.Request, _ s
 		req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, "/api/notion")
 
 		// Inject Authorization header
-		req.Header.Set("Authorization", "Bearer "+notionToken.AccessToken)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// 4. Log the call if the server or session asks for it
+	if trace := notionTraceFrom(r.Context()); trace != nil {
+		trace.proxy(proxy, r, token)
 	}
 
 	return &endpoint.ProxyRenderer{Proxy: proxy}, nil
 }
+
+// notionToken returns the Notion access token for the current request's
+// session, or the internal integration token if one is configured. It fails
+// with 401 if the session is not logged in or has not connected Notion.
+func (s *Server) notionToken(r *http.Request) (string, error) {
+	session, ok := middleware.SessionFromContext(r.Context())
+	if !ok {
+		return "", endpoint.Error(http.StatusUnauthorized, "Unauthorized", nil)
+	}
+
+	if _, loggedIn := session.Username(); !loggedIn {
+		return "", endpoint.Error(http.StatusUnauthorized, "Unauthorized", nil)
+	}
+
+	if s.cfg.NotionIntegrationToken != "" {
+		return s.cfg.NotionIntegrationToken, nil
+	}
+
+	var notionToken NotionToken
+	if err := session.Get("notion_token", &notionToken); err != nil || notionToken.AccessToken == "" {
+		return "", endpoint.Error(http.StatusUnauthorized, "Notion authentication required", nil)
+	}
+
+	return notionToken.AccessToken, nil
+}
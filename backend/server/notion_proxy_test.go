@@ -1,41 +1,33 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/mnehpets/mtranscribe/backend/notionmock"
 	"github.com/mnehpets/oneserve/endpoint"
 	"github.com/mnehpets/oneserve/middleware"
 )
 
 func TestNotionProxy(t *testing.T) {
-	// 1. Mock Notion API
-	mockNotion := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("Authorization") != "Bearer test-token" {
-			t.Errorf("Expected Authorization header 'Bearer test-token', got '%s'", r.Header.Get("Authorization"))
-		}
-		// ReverseProxy might modify the path, but we expect /v1/pages
-		if r.URL.Path != "/v1/pages" {
-			t.Errorf("Expected path '/v1/pages', got '%s'", r.URL.Path)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"object":"list"}`))
-	}))
+	// 1. Mock Notion API, which only accepts test-token
+	mock := notionmock.New(notionmock.Options{Tokens: []string{"test-token"}})
+	pageID := mock.AddPage("", "Meeting notes")
+	mockNotion := httptest.NewServer(mock)
 	defer mockNotion.Close()
 
-	// Ensure proxy targets the mock server rather than the real Notion API.
-	oldNotionAPIURL := notionAPIURL
-	notionAPIURL = mockNotion.URL
-	defer func() { notionAPIURL = oldNotionAPIURL }()
-
-	// 2. Setup Server
+	// 2. Setup Server, with NOTION_API_URL pointing the proxy and OAuth at
+	// the mock server
 	cfg := &Config{
-		Port:        "8080",
-		SessionKey:  "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=",
-		PublicURL:   "http://localhost:8080",
-		FrontendDir: ".",
+		Port:               "8080",
+		SessionKey:         "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=",
+		NotionClientID:     "test_client_id",
+		NotionClientSecret: "test_client_secret",
+		NotionAPIURL:       mockNotion.URL + "/",
+		PublicURL:          "http://localhost:8080",
+		FrontendDir:        ".",
 	}
 	s, err := New(cfg)
 	if err != nil {
@@ -87,7 +79,11 @@ func TestNotionProxy(t *testing.T) {
 	}
 
 	// 5. Call Proxy
-	req, _ = http.NewRequest("GET", ts.URL+"/api/notion/v1/pages", nil)
+	if s.notionAPIURL != mockNotion.URL {
+		t.Errorf("Expected the Notion API on the mock server, got %q", s.notionAPIURL)
+	}
+	req, _ = http.NewRequest("GET", ts.URL+"/api/notion/v1/pages/"+pageID, nil)
+	req.Header.Set("Notion-Version", notionVersion)
 	for _, c := range cookies {
 		req.AddCookie(c)
 	}
@@ -98,7 +94,137 @@ func TestNotionProxy(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var page notionObject
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.ID != pageID || page.title() != "Meeting notes" {
+		t.Errorf("Unexpected page %+v", page)
+	}
+}
+
+func TestNotionProxy_IntegrationToken(t *testing.T) {
+	mock := mockNotionAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer ntn_integration" {
+			t.Errorf("Expected integration token, got %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list"}`))
+	}))
+
+	s, err := New(&Config{
+		Port:                   "8080",
+		SessionKey:             "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=",
+		NotionIntegrationToken: "ntn_integration",
+		NotionAPIURL:           mock.URL,
+		PublicURL:              "http://localhost:8080",
+		FrontendDir:            ".",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	// Logged-out requests are still rejected.
+	resp := getWithCookies(t, ts, "/api/notion/v1/users/me", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+
+	// A session without a Notion token of its own uses the integration's.
+	cookies := loginWithNotionToken(t, s, ts, "")
+	resp = getWithCookies(t, ts, "/api/notion/v1/users/me", cookies)
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", resp.StatusCode)
 	}
+
+	resp = getWithCookies(t, ts, "/auth/me", cookies)
+	var me struct {
+		Services []string `json:"services"`
+	}
+	json.NewDecoder(resp.Body).Decode(&me)
+	resp.Body.Close()
+	if len(me.Services) != 1 || me.Services[0] != "notion" {
+		t.Errorf("Expected notion to be reported as connected, got %v", me.Services)
+	}
+
+	for _, path := range []string{"/auth/login/notion?next_url=/u/", "/auth/callback/notion?code=x&state=y"} {
+		resp = getWithCookies(t, ts, path, cookies)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected %s to be disabled, got %d", path, resp.StatusCode)
+		}
+	}
+
+	// Anonymous sessions, the only ones the app starts, use it too.
+	anon := loginAnonymous(t, ts)
+	resp = getWithCookies(t, ts, "/api/notion/v1/users/me", anon)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for an anonymous session, got %d", resp.StatusCode)
+	}
+	resp = getWithCookies(t, ts, "/auth/me", anon)
+	json.NewDecoder(resp.Body).Decode(&me)
+	resp.Body.Close()
+	if len(me.Services) != 1 || me.Services[0] != "notion" {
+		t.Errorf("Expected notion to be reported to an anonymous session, got %v", me.Services)
+	}
+}
+
+func TestNotionDisabled(t *testing.T) {
+	s, err := New(&Config{
+		Port:        "8080",
+		SessionKey:  "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=",
+		PublicURL:   "http://localhost:8080",
+		FrontendDir: ".",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create server without Notion: %v", err)
+	}
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	resp := getWithCookies(t, ts, "/auth/me", cookies)
+	var me struct {
+		LoggedIn     bool     `json:"logged_in"`
+		Integrations []string `json:"integrations"`
+	}
+	json.NewDecoder(resp.Body).Decode(&me)
+	resp.Body.Close()
+	if !me.LoggedIn || me.Integrations == nil || len(me.Integrations) != 0 {
+		t.Errorf("Expected no integrations, got %+v", me)
+	}
+
+	for _, path := range []string{"/api/notion/v1/users/me", "/api/notion-tree", "/api/notion/pages/p1/markdown", "/api/notion/mappings/db1"} {
+		resp := getWithCookies(t, ts, path, cookies)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotImplemented {
+			t.Errorf("Expected %s to return 501, got %d", path, resp.StatusCode)
+		}
+	}
+	resp = postJSON(t, ts, "/api/export/notion", map[string]any{}, cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected export to return 501, got %d", resp.StatusCode)
+	}
+
+	resp = getWithCookies(t, ts, "/auth/login/notion?next_url=/u/", cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected Notion login to return 404, got %d", resp.StatusCode)
+	}
+
+	// Conversion does not call Notion, so it stays available.
+	resp = postJSON(t, ts, "/api/notion/convert", map[string]any{"markdown": "# Hi"}, cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected conversion to work without Notion, got %d", resp.StatusCode)
+	}
 }
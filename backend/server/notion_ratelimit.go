@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Notion allows an average of three requests per second per integration
+// token, with short bursts above that.
+const (
+	notionRequestsPerSecond = 3
+	notionRequestBurst      = 6
+)
+
+// rateLimiterSweepInterval is how often a rateLimiter drops idle buckets.
+const rateLimiterSweepInterval = time.Minute
+
+// notionRateLimit paces the requests the backend sends to Notion for each
+// token, both through the proxy and from server-side calls.
+//
+// It is a variable so tests against a mock Notion server can lift the limit.
+var notionRateLimit = newRateLimiter(notionRequestsPerSecond, notionRequestBurst)
+
+// rateLimiter is a set of token buckets, one per key.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a limiter allowing rate requests per second for
+// each key, after an initial burst.
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*rateBucket), now: time.Now}
+}
+
+// reserve takes a request slot for key and returns how long to wait before
+// using it. Slots are handed out in the order they are reserved.
+func (l *rateLimiter) reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) >= rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled, which are the same as new
+// ones. It is called with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// cancel returns a slot reserved for key that was not used.
+func (l *rateLimiter) cancel(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = min(l.burst, b.tokens+1)
+	}
+}
+
+// wait blocks until a request for key may be sent, or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, key string) error {
+	delay := l.reserve(key)
+	if delay == 0 {
+		return nil
+	}
+	if err := sleepContext(ctx, delay); err != nil {
+		l.cancel(key)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionIndexTTL is how long a user's title index is used before it is
+// rebuilt from Notion.
+var notionIndexTTL = 10 * time.Minute
+
+const (
+	// notionSearchLimit is the default number of search results.
+	notionSearchLimit = 20
+	// notionSearchMaxLimit bounds the limit parameter.
+	notionSearchMaxLimit = 100
+	// notionMaxRecents is the number of export destinations remembered per
+	// user.
+	notionMaxRecents = 20
+	// notionMaxAncestry bounds the parent chain followed for an object, in
+	// case of cycles.
+	notionMaxAncestry = 32
+)
+
+// notionIndexEntry is an object in a title index.
+type notionIndexEntry struct {
+	ID       string
+	Title    string
+	Type     string
+	ParentID string
+}
+
+// notionTitleIndex is a cached list of the pages, databases and data sources
+// visible to a user, keyed by compact ID. A published map of entries is never
+// changed, since earlier searches may still be reading it; updates replace it.
+type notionTitleIndex struct {
+	mu      sync.Mutex
+	entries map[string]*notionIndexEntry
+	builtAt time.Time
+	// build is the crawl of the workspace in progress, if any.
+	build *notionIndexBuild
+
+	// lastUsed is guarded by notionTitleIndexes.mu.
+	lastUsed time.Time
+}
+
+// notionIndexBuild is a crawl of a workspace for a title index. done is
+// closed once entries or err is set.
+type notionIndexBuild struct {
+	done    chan struct{}
+	entries map[string]*notionIndexEntry
+	err     error
+}
+
+// notionTitleIndexes holds the title index of each user.
+type notionTitleIndexes struct {
+	mu     sync.Mutex
+	byUser map[string]*notionTitleIndex
+}
+
+func newNotionTitleIndexes() *notionTitleIndexes {
+	return &notionTitleIndexes{byUser: make(map[string]*notionTitleIndex)}
+}
+
+// get returns the index for userKey, creating an empty one if needed.
+// Indexes unused for longer than they stay fresh are dropped.
+func (x *notionTitleIndexes) get(userKey string) *notionTitleIndex {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	now := time.Now()
+	for key, idx := range x.byUser {
+		if now.Sub(idx.lastUsed) > notionIndexTTL {
+			delete(x.byUser, key)
+		}
+	}
+	idx, ok := x.byUser[userKey]
+	if !ok {
+		idx = &notionTitleIndex{}
+		x.byUser[userKey] = idx
+	}
+	idx.lastUsed = now
+	return idx
+}
+
+// addIndexEntries adds or replaces the entries for objects.
+func addIndexEntries(entries map[string]*notionIndexEntry, objects []*notionObject) {
+	for _, obj := range objects {
+		entries[compactNotionID(obj.ID)] = &notionIndexEntry{
+			ID:       obj.ID,
+			Title:    obj.title(),
+			Type:     obj.Object,
+			ParentID: obj.Parent.id(),
+		}
+	}
+}
+
+// search returns the indexed entries, refreshing the index if it has expired
+// and adding the results of a Notion search for query so that recent changes
+// are included. Requests to Notion are made without holding the lock, and
+// concurrent searches share a single crawl.
+func (idx *notionTitleIndex) search(ctx context.Context, client *notionClient, query string, refresh bool) (map[string]*notionIndexEntry, error) {
+	idx.mu.Lock()
+	if refresh || idx.entries == nil || time.Since(idx.builtAt) > notionIndexTTL {
+		build := idx.build
+		if build == nil {
+			build = &notionIndexBuild{done: make(chan struct{})}
+			idx.build = build
+			idx.mu.Unlock()
+			idx.crawl(ctx, client, build)
+		} else {
+			idx.mu.Unlock()
+		}
+		select {
+		case <-build.done:
+			return build.entries, build.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	idx.mu.Unlock()
+	if query == "" {
+		return idx.snapshot(), nil
+	}
+
+	objects, err := client.searchAll(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	entries := maps.Clone(idx.entries)
+	addIndexEntries(entries, objects)
+	idx.entries = entries
+	return entries, nil
+}
+
+// crawl builds the index from every object visible to client, and publishes
+// it unless the crawl failed.
+func (idx *notionTitleIndex) crawl(ctx context.Context, client *notionClient, build *notionIndexBuild) {
+	objects, err := client.notionObjects(ctx)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err != nil {
+		build.err = err
+	} else {
+		build.entries = make(map[string]*notionIndexEntry, len(objects))
+		addIndexEntries(build.entries, objects)
+		idx.entries, idx.builtAt = build.entries, time.Now()
+	}
+	idx.build = nil
+	close(build.done)
+}
+
+// snapshot returns the current entries.
+func (idx *notionTitleIndex) snapshot() map[string]*notionIndexEntry {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.entries
+}
+
+// ancestors returns the entry's ancestors in the index, nearest first.
+func ancestors(entries map[string]*notionIndexEntry, entry *notionIndexEntry) []*notionIndexEntry {
+	var chain []*notionIndexEntry
+	for id := entry.ParentID; id != "" && len(chain) < notionMaxAncestry; {
+		parent, ok := entries[compactNotionID(id)]
+		if !ok {
+			break
+		}
+		chain = append(chain, parent)
+		id = parent.ParentID
+	}
+	return chain
+}
+
+// normalizeTitle lower-cases s and reduces it to words separated by single
+// spaces.
+func normalizeTitle(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// fuzzyScore rates how well title matches query, from 100 for an exact match
+// down to 1 for a loose subsequence match. ok is false if title does not
+// match. Both arguments must be normalized.
+func fuzzyScore(query, title string) (score int, ok bool) {
+	switch {
+	case query == "":
+		return 0, true
+	case title == query:
+		return 100, true
+	case strings.HasPrefix(title, query):
+		return 90, true
+	case strings.Contains(" "+title, " "+query):
+		return 80, true
+	case strings.Contains(title, query):
+		return 70, true
+	}
+
+	// Every query word starts a title word, in any order.
+	words := strings.Fields(title)
+	matched := true
+	for _, q := range strings.Fields(query) {
+		if !slices.ContainsFunc(words, func(w string) bool { return strings.HasPrefix(w, q) }) {
+			matched = false
+			break
+		}
+	}
+	if matched {
+		return 60, true
+	}
+
+	// The query's characters appear in order. Tighter matches score higher.
+	q := []rune(strings.ReplaceAll(query, " ", ""))
+	start, i := -1, 0
+	t := []rune(title)
+	end := 0
+	for j, r := range t {
+		if i < len(q) && r == q[i] {
+			if start < 0 {
+				start = j
+			}
+			i++
+			end = j
+		}
+	}
+	if i < len(q) {
+		return 0, false
+	}
+	span := end - start + 1
+	return max(1, 50*len(q)/span), true
+}
+
+// recentDestination is an export destination used by a user.
+type recentDestination struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	UsedAt time.Time `json:"used_at"`
+}
+
+// recordRecentDestination moves the export parent to the front of the user's
+// recent destinations.
+func (s *Server) recordRecentDestination(userKey string, parent notionExportParent) error {
+	dest := recentDestination{ID: parent.PageID, Type: "page", UsedAt: time.Now().UTC()}
+	switch {
+	case parent.DatabaseID != "":
+		dest.ID, dest.Type = parent.DatabaseID, "database"
+	case parent.DataSourceID != "":
+		dest.ID, dest.Type = parent.DataSourceID, "data_source"
+	}
+	_, err := s.notionRecents.Update(userKey, func(recents []recentDestination, _ bool) ([]recentDestination, error) {
+		recents = slices.DeleteFunc(recents, func(r recentDestination) bool { return sameNotionID(r.ID, dest.ID) })
+		recents = append([]recentDestination{dest}, recents...)
+		return recents[:min(len(recents), notionMaxRecents)], nil
+	})
+	return err
+}
+
+// notionSearchResult is an object found by a search. Path lists the titles
+// of its ancestors, outermost first.
+type notionSearchResult struct {
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Type       string     `json:"type"`
+	ParentID   string     `json:"parent_id,omitempty"`
+	Path       []string   `json:"path"`
+	Score      int        `json:"score"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+
+	recent int
+}
+
+// notionSearchEndpoint finds pages, databases and data sources by title, to
+// choose where to export a transcript.
+//
+// Results combine Notion's search with a cached index of titles, matched
+// fuzzily against q. type keeps objects of one type and parent keeps
+// descendants of one object. Destinations the user recently exported to are
+// ranked first, most recent first, followed by the best matches. With
+// refresh=true the index is rebuilt.
+func (s *Server) notionSearchEndpoint(w http.ResponseWriter, r *http.Request, params struct {
+	Query   string `query:"q"`
+	Type    string `query:"type"`
+	Parent  string `query:"parent"`
+	Limit   string `query:"limit"`
+	Refresh string `query:"refresh"`
+}) (endpoint.Renderer, error) {
+	if params.Type != "" && !isHierarchyType(params.Type) {
+		return nil, endpoint.Error(http.StatusBadRequest, "type must be one of page, database or data_source", nil)
+	}
+	limit := notionSearchLimit
+	if params.Limit != "" {
+		n, err := strconv.Atoi(params.Limit)
+		if err != nil || n < 1 {
+			return nil, endpoint.Error(http.StatusBadRequest, "invalid limit", err)
+		}
+		limit = min(n, notionSearchMaxLimit)
+	}
+	refresh := false
+	if params.Refresh != "" {
+		var err error
+		if refresh, err = strconv.ParseBool(params.Refresh); err != nil {
+			return nil, endpoint.Error(http.StatusBadRequest, "invalid refresh", err)
+		}
+	}
+
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
+	}
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+
+	query := normalizeTitle(params.Query)
+	idx := s.notionIndexes.get(userKey)
+	entries, err := idx.search(r.Context(), s.newNotionClient(token), params.Query, refresh)
+	if err != nil {
+		return nil, notionEndpointError(err)
+	}
+
+	recents, _ := s.notionRecents.Get(userKey)
+	recentRank := make(map[string]int, len(recents))
+	for i, dest := range recents {
+		recentRank[compactNotionID(dest.ID)] = i + 1
+	}
+
+	idx.mu.Lock()
+	results := []*notionSearchResult{}
+	for key, entry := range entries {
+		if params.Type != "" && entry.Type != params.Type {
+			continue
+		}
+		score, ok := fuzzyScore(query, normalizeTitle(entry.Title))
+		if !ok {
+			continue
+		}
+		chain := ancestors(entries, entry)
+		if params.Parent != "" && !slices.ContainsFunc(chain, func(a *notionIndexEntry) bool { return sameNotionID(a.ID, params.Parent) }) {
+			continue
+		}
+
+		result := &notionSearchResult{
+			ID:       entry.ID,
+			Title:    entry.Title,
+			Type:     entry.Type,
+			ParentID: entry.ParentID,
+			Path:     make([]string, 0, len(chain)),
+			Score:    score,
+			recent:   recentRank[key],
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			result.Path = append(result.Path, chain[i].Title)
+		}
+		if result.recent > 0 {
+			result.LastUsedAt = &recents[result.recent-1].UsedAt
+		}
+		results = append(results, result)
+	}
+	idx.mu.Unlock()
+
+	slices.SortFunc(results, func(a, b *notionSearchResult) int {
+		switch {
+		case (a.recent > 0) != (b.recent > 0):
+			if a.recent > 0 {
+				return -1
+			}
+			return 1
+		case a.recent != b.recent:
+			return a.recent - b.recent
+		case a.Score != b.Score:
+			return b.Score - a.Score
+		case a.Title != b.Title:
+			return strings.Compare(a.Title, b.Title)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{"results": results}}, nil
+}
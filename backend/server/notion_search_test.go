@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	tests := []struct {
+		query, title string
+		want         int
+		ok           bool
+	}{
+		{"", "anything", 0, true},
+		{"standup", "standup", 100, true},
+		{"stand", "standup notes", 90, true},
+		{"notes", "standup notes", 80, true},
+		{"tand", "standup", 70, true},
+		{"notes stand", "standup notes", 60, true},
+		{"wkly", "weekly sync", 33, true},
+		{"wr", "weekly sync ready", 7, true},
+		{"xyz", "weekly sync", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := fuzzyScore(tt.query, tt.title)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("fuzzyScore(%q, %q) = %d, %v; want %d, %v", tt.query, tt.title, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if got := normalizeTitle("  Weekly   Sync: 2026-01-02! "); got != "weekly sync 2026 01 02" {
+		t.Errorf("Unexpected normalized title %q", got)
+	}
+}
+
+func TestNotionSearch(t *testing.T) {
+	// Workspace:
+	//   Engineering (p1)
+	//     Weekly Standup (p2)
+	//     Meetings database (db1)
+	//       Meetings data source (ds1)
+	//         Standup 2026-01-02 (p3)
+	//   Personal (p4)
+	//     Standups archive (p5)
+	objects := []any{
+		titledPage("p1", "workspace", "", "Engineering"),
+		titledPage("p2", "page_id", "p1", "Weekly Standup"),
+		map[string]any{"object": "data_source", "id": "ds1", "parent": map[string]any{"type": "database_id", "database_id": "db1"}, "title": []any{map[string]any{"plain_text": "Meetings"}}},
+		titledPage("p3", "data_source_id", "ds1", "Standup 2026-01-02"),
+		titledPage("p4", "workspace", "", "Personal"),
+		titledPage("p5", "page_id", "p4", "Standups archive"),
+	}
+	fresh := titledPage("p6", "page_id", "p4", "Fresh ideas")
+
+	fake := newFakeNotionPages(t)
+	var searches []string
+	s := setupTestServer(t)
+	useMockNotion(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/search":
+			var body struct {
+				Query string `json:"query"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			searches = append(searches, body.Query)
+			results := objects
+			if body.Query != "" {
+				// Notion's own search finds a page created since the
+				// index was built.
+				results = []any{fresh}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"object": "list", "results": results})
+		case r.Method == "GET" && r.URL.Path == "/v1/databases/db1":
+			json.NewEncoder(w).Encode(map[string]any{
+				"object": "database",
+				"id":     "db1",
+				"parent": map[string]any{"type": "page_id", "page_id": "p1"},
+				"title":  []any{map[string]any{"plain_text": "Meetings"}},
+			})
+		default:
+			fake.ServeHTTP(w, r)
+		}
+	}))
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	search := func(query url.Values) []notionSearchResult {
+		t.Helper()
+		resp := getWithCookies(t, ts, "/api/notion/search?"+query.Encode(), cookies)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		var result struct {
+			Results []notionSearchResult `json:"results"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result.Results
+	}
+	ids := func(results []notionSearchResult) string {
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, r.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	results := search(url.Values{"q": {"standup"}})
+	if got := ids(results); got != "p3,p5,p2" {
+		t.Errorf("Expected prefix matches before word matches, got %s", got)
+	}
+	if got := strings.Join(results[0].Path, " / "); got != "Engineering / Meetings / Meetings" {
+		t.Errorf("Unexpected path %q", got)
+	}
+
+	if got := ids(search(url.Values{"q": {"stndp"}, "type": {"page"}})); got != "p3,p5,p2" {
+		t.Errorf("Expected fuzzy matches, got %s", got)
+	}
+	if got := ids(search(url.Values{"type": {"page"}, "parent": {"p1"}})); got != "p3,p2" {
+		t.Errorf("Expected pages under Engineering, got %s", got)
+	}
+	if got := ids(search(url.Values{"type": {"database"}})); got != "db1" {
+		t.Errorf("Expected the database, got %s", got)
+	}
+	if got := ids(search(url.Values{"q": {"fresh"}})); got != "p6" {
+		t.Errorf("Expected Notion search results to be merged, got %s", got)
+	}
+
+	// The index is built once; later searches only query Notion for q.
+	if got := strings.Join(searches, "|"); got != "|stndp|fresh" {
+		t.Errorf("Unexpected Notion searches %q", got)
+	}
+
+	// Exporting makes the destination rank first.
+	resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+		"parent":     map[string]any{"page_id": "p5"},
+		"transcript": Transcript{Title: "Standup"},
+	}, cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected export to succeed, got %d", resp.StatusCode)
+	}
+	results = search(url.Values{"q": {"standup"}})
+	if got := ids(results); got != "p5,p3,p2" {
+		t.Errorf("Expected recent destination first, got %s", got)
+	}
+	if results[0].LastUsedAt == nil || results[1].LastUsedAt != nil {
+		t.Errorf("Expected only the recent destination to have last_used_at")
+	}
+
+	// Recent destinations are kept per user.
+	if recents, _ := s.notionRecents.Get("user:testuser"); len(recents) != 1 || recents[0].ID != "p5" || recents[0].Type != "page" {
+		t.Errorf("Unexpected recent destinations %+v", recents)
+	}
+
+	before := len(searches)
+	search(url.Values{"refresh": {"true"}})
+	if len(searches) != before+1 || searches[before] != "" {
+		t.Errorf("Expected refresh to rebuild the index, got %v", searches[before:])
+	}
+
+	resp = getWithCookies(t, ts, "/api/notion/search?type=block", cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid type, got %d", resp.StatusCode)
+	}
+}
+
+func TestNotionTitleIndex_Crawl(t *testing.T) {
+	crawling, release := make(chan struct{}, 2), make(chan struct{})
+	var mu sync.Mutex
+	crawls := 0
+	mock := mockNotionAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Query string `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		results := []any{titledPage("p2", "workspace", "", "Fresh ideas")}
+		if body.Query == "" {
+			mu.Lock()
+			crawls++
+			mu.Unlock()
+			crawling <- struct{}{}
+			<-release
+			results = []any{titledPage("p1", "workspace", "", "Engineering")}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "results": results})
+	}))
+	client := newNotionClient(mock.URL, "test-token")
+	idx := &notionTitleIndex{entries: map[string]*notionIndexEntry{}, builtAt: time.Now()}
+
+	// Refreshes share one crawl of the workspace.
+	type result struct {
+		entries map[string]*notionIndexEntry
+		err     error
+	}
+	refreshed := make(chan result, 2)
+	refresh := func() {
+		entries, err := idx.search(context.Background(), client, "", true)
+		refreshed <- result{entries, err}
+	}
+	go refresh()
+	<-crawling
+	go refresh()
+
+	// Meanwhile, searches are answered from the current index.
+	entries, err := idx.search(context.Background(), client, "fresh", false)
+	if err != nil || len(entries) != 1 || entries["p2"] == nil {
+		t.Errorf("Expected the search during the crawl to be answered, got %v %v", entries, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for range 2 {
+		r := <-refreshed
+		if r.err != nil || len(r.entries) != 1 || r.entries["p1"] == nil {
+			t.Errorf("Expected the crawled entries, got %v %v", r.entries, r.err)
+		}
+	}
+	if crawls != 1 {
+		t.Errorf("Expected 1 crawl, got %d", crawls)
+	}
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionTreeConcurrency bounds the number of concurrent database retrievals
+// made while building the hierarchy. Notion allows roughly three requests per
+// second per integration.
+const notionTreeConcurrency = 3
+
+// HierarchyNode is a page, database or data source in the Notion hierarchy.
+// It mirrors the HierarchyNode type in the frontend's notion.ts.
+type HierarchyNode struct {
+	ID       string           `json:"id"`
+	Title    string           `json:"title"`
+	Type     string           `json:"type"`
+	Children []*HierarchyNode `json:"children"`
+	Data     json.RawMessage  `json:"data"`
+}
+
+// notionParent is the parent reference of a Notion object.
+type notionParent struct {
+	Type         string `json:"type"`
+	PageID       string `json:"page_id,omitempty"`
+	DatabaseID   string `json:"database_id,omitempty"`
+	DataSourceID string `json:"data_source_id,omitempty"`
+}
+
+// id returns the ID of the parent object, or "" for workspace and block parents.
+func (p notionParent) id() string {
+	switch p.Type {
+	case "page_id":
+		return p.PageID
+	case "database_id":
+		return p.DatabaseID
+	case "data_source_id":
+		return p.DataSourceID
+	}
+	return ""
+}
+
+// notionRichText is a Notion rich text item, reduced to its plain text.
+type notionRichText struct {
+	PlainText string `json:"plain_text"`
+}
+
+// notionObject holds the fields of a page, database or data source needed to
+// place it in the hierarchy. Raw retains the full object.
+type notionObject struct {
+	Object     string           `json:"object"`
+	ID         string           `json:"id"`
+	Parent     *notionParent    `json:"parent"`
+	Title      []notionRichText `json:"title"`
+	Properties map[string]struct {
+		Type  string           `json:"type"`
+		Title []notionRichText `json:"title"`
+	} `json:"properties"`
+	Raw json.RawMessage `json:"-"`
+}
+
+// title returns the display title of the object, matching the frontend's
+// fallbacks for untitled objects.
+func (o *notionObject) title() string {
+	switch o.Object {
+	case "page":
+		for _, prop := range o.Properties {
+			if prop.Type == "title" {
+				if len(prop.Title) > 0 && prop.Title[0].PlainText != "" {
+					return prop.Title[0].PlainText
+				}
+				return "Untitled"
+			}
+		}
+		return "Untitled"
+	case "database":
+		if len(o.Title) > 0 && o.Title[0].PlainText != "" {
+			return o.Title[0].PlainText
+		}
+		return "Untitled Database"
+	case "data_source":
+		if len(o.Title) > 0 && o.Title[0].PlainText != "" {
+			return o.Title[0].PlainText
+		}
+		return "Untitled Data Source"
+	}
+	return "Untitled"
+}
+
+// isHierarchyType reports whether t is an object type that appears in the hierarchy.
+func isHierarchyType(t string) bool {
+	return t == "page" || t == "database" || t == "data_source"
+}
+
+// decodeNotionObject decodes a page, database or data source. It returns nil
+// for partial objects and other object types.
+func decodeNotionObject(raw json.RawMessage) *notionObject {
+	var obj notionObject
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil
+	}
+	if !isHierarchyType(obj.Object) || obj.Parent == nil {
+		return nil
+	}
+	obj.Raw = raw
+	return &obj
+}
+
+// notionSearchResponse is a page of results from /v1/search.
+type notionSearchResponse struct {
+	Results    []json.RawMessage `json:"results"`
+	HasMore    bool              `json:"has_more"`
+	NextCursor string            `json:"next_cursor"`
+}
+
+// searchAll pages through /v1/search and returns every hierarchy object.
+func (c *notionClient) searchAll(ctx context.Context, query string) ([]*notionObject, error) {
+	var items []*notionObject
+	cursor := ""
+	for {
+		body := map[string]any{"page_size": 100}
+		if query != "" {
+			body["query"] = query
+		}
+		if cursor != "" {
+			body["start_cursor"] = cursor
+		}
+
+		var resp notionSearchResponse
+		if err := c.do(ctx, http.MethodPost, "/v1/search", body, &resp); err != nil {
+			return nil, err
+		}
+		for _, raw := range resp.Results {
+			if obj := decodeNotionObject(raw); obj != nil {
+				items = append(items, obj)
+			}
+		}
+
+		if !resp.HasMore || resp.NextCursor == "" {
+			return items, nil
+		}
+		cursor = resp.NextCursor
+	}
+}
+
+// retrieveDatabases retrieves the given databases with bounded concurrency.
+// Databases that cannot be retrieved (permissions, deleted, etc.) are skipped
+// so the hierarchy stays best-effort. Results keep the order of ids.
+func (c *notionClient) retrieveDatabases(ctx context.Context, ids []string) ([]*notionObject, error) {
+	results := make([]*notionObject, len(ids))
+	sem := make(chan struct{}, notionTreeConcurrency)
+	var wg sync.WaitGroup
+
+	for i, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var raw json.RawMessage
+			if err := c.do(ctx, http.MethodGet, "/v1/databases/"+url.PathEscape(id), nil, &raw); err != nil {
+				return
+			}
+			if obj := decodeNotionObject(raw); obj != nil && obj.Object == "database" {
+				results[i] = obj
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var dbs []*notionObject
+	for _, db := range results {
+		if db != nil {
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs, nil
+}
+
+// notionHierarchy retrieves every accessible page, database and data source
+// and arranges them into a tree. It follows the same steps as getHierarchy in
+// the frontend's notion.ts.
+func (c *notionClient) notionHierarchy(ctx context.Context) ([]*HierarchyNode, error) {
+	items, err := c.notionObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return buildHierarchy(items), nil
+}
+
+// notionObjects retrieves every accessible page, database and data source.
+func (c *notionClient) notionObjects(ctx context.Context) ([]*notionObject, error) {
+	items, err := c.searchAll(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Search returns pages and data sources but not databases. Retrieve the
+	// databases referenced as parents explicitly.
+	seen := make(map[string]bool)
+	var databaseIDs []string
+	for _, item := range items {
+		if item.Parent.Type == "database_id" && item.Parent.DatabaseID != "" && !seen[item.Parent.DatabaseID] {
+			seen[item.Parent.DatabaseID] = true
+			databaseIDs = append(databaseIDs, item.Parent.DatabaseID)
+		}
+	}
+	dbs, err := c.retrieveDatabases(ctx, databaseIDs)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, dbs...), nil
+}
+
+// buildHierarchy links objects to their parents. Objects whose parent is not
+// among items become roots.
+func buildHierarchy(items []*notionObject) []*HierarchyNode {
+	nodes := make(map[string]*HierarchyNode, len(items))
+	for _, item := range items {
+		nodes[item.ID] = &HierarchyNode{
+			ID:       item.ID,
+			Title:    item.title(),
+			Type:     item.Object,
+			Children: []*HierarchyNode{},
+			Data:     item.Raw,
+		}
+	}
+
+	roots := []*HierarchyNode{}
+	for _, item := range items {
+		node := nodes[item.ID]
+		if parent, ok := nodes[item.Parent.id()]; ok && parent != node {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+// findHierarchyNode returns the node with the given ID, searching depth-first.
+func findHierarchyNode(nodes []*HierarchyNode, id string) *HierarchyNode {
+	for _, node := range nodes {
+		if sameNotionID(node.ID, id) {
+			return node
+		}
+		if found := findHierarchyNode(node.Children, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// filterHierarchy keeps nodes of the given type, together with any ancestors
+// needed to reach them.
+func filterHierarchy(nodes []*HierarchyNode, typ string) []*HierarchyNode {
+	filtered := []*HierarchyNode{}
+	for _, node := range nodes {
+		children := filterHierarchy(node.Children, typ)
+		if node.Type == typ || len(children) > 0 {
+			copied := *node
+			copied.Children = children
+			filtered = append(filtered, &copied)
+		}
+	}
+	return filtered
+}
+
+// notionTreeEndpoint returns the Notion hierarchy for the current session.
+//
+// The optional root parameter restricts the result to the subtree rooted at
+// that object, and type keeps only objects of that type (and their ancestors).
+func (s *Server) notionTreeEndpoint(w http.ResponseWriter, r *http.Request, params struct {
+	Root string `query:"root"`
+	Type string `query:"type"`
+}) (endpoint.Renderer, error) {
+	if params.Type != "" && !isHierarchyType(params.Type) {
+		return nil, endpoint.Error(http.StatusBadRequest, "type must be one of page, database or data_source", nil)
+	}
+
+	token, err := s.notionToken(r)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := s.newNotionClient(token).notionHierarchy(r.Context())
+	if err != nil {
+		return nil, notionEndpointError(err)
+	}
+
+	if params.Root != "" {
+		root := findHierarchyNode(nodes, params.Root)
+		if root == nil {
+			return nil, endpoint.Error(http.StatusNotFound, "root not found", nil)
+		}
+		nodes = []*HierarchyNode{root}
+	}
+	if params.Type != "" {
+		nodes = filterHierarchy(nodes, params.Type)
+	}
+
+	return &endpoint.JSONRenderer{Value: nodes}, nil
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mnehpets/oneserve/endpoint"
+	"github.com/mnehpets/oneserve/middleware"
+)
+
+// loginWithNotionToken registers a backdoor route that logs in and stores the
+// given Notion token in the session, calls it, and returns the session cookies.
+func loginWithNotionToken(t *testing.T, s *Server, ts *httptest.Server, token string) []*http.Cookie {
+	t.Helper()
+
+	s.mux.Handle("POST /test/setup-session", endpoint.HandleFunc(func(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+		session, ok := middleware.SessionFromContext(r.Context())
+		if !ok {
+			return nil, endpoint.Error(http.StatusInternalServerError, "no session", nil)
+		}
+		if err := session.Login("testuser"); err != nil {
+			return nil, endpoint.Error(http.StatusInternalServerError, "login failed", err)
+		}
+		if token != "" {
+			if err := session.Set("notion_token", NotionToken{AccessToken: token}); err != nil {
+				return nil, endpoint.Error(http.StatusInternalServerError, "set token failed", err)
+			}
+		}
+		return &endpoint.JSONRenderer{Value: "ok"}, nil
+	}, s.sessionProcessor))
+
+	resp, err := ts.Client().Post(ts.URL+"/test/setup-session", "", nil)
+	if err != nil {
+		t.Fatalf("Setup session failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Setup session returned status %d", resp.StatusCode)
+	}
+	if len(resp.Cookies()) == 0 {
+		t.Fatal("No cookies received from setup-session")
+	}
+	return resp.Cookies()
+}
+
+// loginAnonymous starts an anonymous session and returns its cookies.
+func loginAnonymous(t *testing.T, ts *httptest.Server) []*http.Cookie {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(ts.URL + "/auth/login/anon?next_url=/u/")
+	if err != nil {
+		t.Fatalf("Anonymous login failed: %v", err)
+	}
+	resp.Body.Close()
+	if len(resp.Cookies()) == 0 {
+		t.Fatal("No cookies received from anonymous login")
+	}
+	return resp.Cookies()
+}
+
+// getWithCookies performs a GET request carrying the given cookies.
+func getWithCookies(t *testing.T, ts *httptest.Server, path string, cookies []*http.Cookie) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	return resp
+}
+
+// mockNotionAPI serves handler as the Notion API for the duration of the
+// test.
+func mockNotionAPI(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	mock := httptest.NewServer(handler)
+	oldLimit := notionRateLimit
+	// The mock is not rate limited, so neither are tests.
+	notionRateLimit = newRateLimiter(1e6, 1e6)
+	t.Cleanup(func() {
+		notionRateLimit = oldLimit
+		mock.Close()
+	})
+	return mock
+}
+
+// useMockNotion points s at handler as its Notion API for the duration of
+// the test.
+func useMockNotion(t *testing.T, s *Server, handler http.Handler) *httptest.Server {
+	t.Helper()
+	mock := mockNotionAPI(t, handler)
+	s.notionAPIURL = mock.URL
+	return mock
+}
+
+func titledPage(id, parentType, parentID, title string) map[string]any {
+	parent := map[string]any{"type": parentType}
+	if parentType != "workspace" {
+		parent[parentType] = parentID
+	} else {
+		parent["workspace"] = true
+	}
+	return map[string]any{
+		"object": "page",
+		"id":     id,
+		"parent": parent,
+		"properties": map[string]any{
+			"Name": map[string]any{"type": "title", "title": []any{map[string]any{"plain_text": title}}},
+		},
+	}
+}
+
+func TestNotionTree(t *testing.T) {
+	var inFlight, maxInFlight int32
+	var mu sync.Mutex
+	retrieved := map[string]int{}
+
+	// Workspace:
+	//   Root page (p1)
+	//     Child page (p2)
+	//     Database db1 (discovered through its data source ds1)
+	//       Data source ds1
+	//         Row page (p3)
+	//   Databases db2..db5 referenced directly by pages p4..p7
+	//   A database with a path in its ID, referenced by p8
+	//   A partial object without a parent, which is ignored
+	searchPages := [][]any{
+		{
+			titledPage("p1", "workspace", "", "Root"),
+			titledPage("p2", "page_id", "p1", "Child"),
+			map[string]any{"object": "data_source", "id": "ds1", "parent": map[string]any{"type": "database_id", "database_id": "db1"}, "title": []any{map[string]any{"plain_text": "Meetings DS"}}},
+		},
+		{
+			titledPage("p3", "data_source_id", "ds1", "Row"),
+			titledPage("p4", "database_id", "db2", ""),
+			titledPage("p5", "database_id", "db3", "Five"),
+			titledPage("p6", "database_id", "db4", "Six"),
+			titledPage("p7", "database_id", "db5", "Seven"),
+			titledPage("p8", "database_id", "db6/../../v1/users", "Eight"),
+			map[string]any{"object": "page", "id": "partial"},
+		},
+	}
+
+	s := setupTestServer(t)
+	useMockNotion(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			t.Errorf("Expected Authorization header 'Bearer test-token', got '%s'", r.Header.Get("Authorization"))
+		}
+		if r.Header.Get("Notion-Version") != notionVersion {
+			t.Errorf("Expected Notion-Version %s, got %s", notionVersion, r.Header.Get("Notion-Version"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/search":
+			var body struct {
+				StartCursor string `json:"start_cursor"`
+				PageSize    int    `json:"page_size"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.PageSize != 100 {
+				t.Errorf("Expected page_size 100, got %d", body.PageSize)
+			}
+			page, next := 0, "cursor-1"
+			if body.StartCursor == "cursor-1" {
+				page, next = 1, ""
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"object":      "list",
+				"results":     searchPages[page],
+				"has_more":    next != "",
+				"next_cursor": next,
+			})
+		case r.Method == "GET" && len(r.URL.Path) > len("/v1/databases/"):
+			id := r.URL.Path[len("/v1/databases/"):]
+			if r.URL.EscapedPath() != "/v1/databases/"+url.PathEscape(id) {
+				t.Errorf("Expected the database ID to be escaped, got %s", r.URL.EscapedPath())
+			}
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			mu.Lock()
+			retrieved[id]++
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+
+			if id == "db5" || strings.Contains(id, "/") {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"object":"error","status":404,"code":"object_not_found","message":"not found"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"object": "database",
+				"id":     id,
+				"parent": map[string]any{"type": "page_id", "page_id": "p1"},
+				"title":  []any{map[string]any{"plain_text": "DB " + id}},
+			})
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	fetchTree := func(t *testing.T, query string) []*HierarchyNode {
+		t.Helper()
+		resp := getWithCookies(t, ts, "/api/notion-tree"+query, cookies)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		var nodes []*HierarchyNode
+		if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+			t.Fatal(err)
+		}
+		return nodes
+	}
+
+	t.Run("Full tree", func(t *testing.T) {
+		roots := fetchTree(t, "")
+		if len(roots) != 3 {
+			t.Fatalf("Expected 3 roots (p1, p7, p8), got %d: %v", len(roots), nodeIDs(roots))
+		}
+		root := roots[0]
+		if root.ID != "p1" || root.Title != "Root" || root.Type != "page" {
+			t.Errorf("Unexpected root %+v", root)
+		}
+		if got := nodeIDs(root.Children); fmt.Sprint(got) != "[p2 db1 db2 db3 db4]" {
+			t.Errorf("Unexpected root children %v", got)
+		}
+		db1 := findHierarchyNode(roots, "db1")
+		if db1.Type != "database" || db1.Title != "DB db1" || fmt.Sprint(nodeIDs(db1.Children)) != "[ds1]" {
+			t.Errorf("Unexpected db1 %+v", db1)
+		}
+		if ds1 := db1.Children[0]; ds1.Title != "Meetings DS" || fmt.Sprint(nodeIDs(ds1.Children)) != "[p3]" {
+			t.Errorf("Unexpected ds1 %+v", ds1)
+		}
+		if p4 := findHierarchyNode(roots, "p4"); p4 == nil || p4.Title != "Untitled" {
+			t.Errorf("Expected untitled p4, got %+v", p4)
+		}
+		if p7 := roots[1]; p7.ID != "p7" {
+			t.Errorf("Expected p7 as a root when its database is not retrievable, got %s", p7.ID)
+		}
+		if findHierarchyNode(roots, "partial") != nil {
+			t.Error("Partial objects should be ignored")
+		}
+		var data map[string]any
+		if err := json.Unmarshal(root.Data, &data); err != nil || data["object"] != "page" {
+			t.Errorf("Expected raw page data, got %s", root.Data)
+		}
+	})
+
+	t.Run("Bounded concurrency", func(t *testing.T) {
+		if max := atomic.LoadInt32(&maxInFlight); max > notionTreeConcurrency {
+			t.Errorf("Expected at most %d concurrent database retrievals, got %d", notionTreeConcurrency, max)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for id, n := range retrieved {
+			if n != 1 {
+				t.Errorf("Database %s retrieved %d times in one tree build", id, n)
+			}
+		}
+	})
+
+	t.Run("Root subtree", func(t *testing.T) {
+		nodes := fetchTree(t, "?root=db1")
+		if len(nodes) != 1 || nodes[0].ID != "db1" || len(nodes[0].Children) != 1 {
+			t.Errorf("Unexpected subtree %+v", nodes)
+		}
+	})
+
+	t.Run("Type filter", func(t *testing.T) {
+		nodes := fetchTree(t, "?type=data_source")
+		if len(nodes) != 1 || nodes[0].ID != "p1" {
+			t.Fatalf("Expected only the path to ds1, got %v", nodeIDs(nodes))
+		}
+		db1 := nodes[0].Children
+		if len(db1) != 1 || db1[0].ID != "db1" || len(db1[0].Children) != 1 || len(db1[0].Children[0].Children) != 0 {
+			t.Errorf("Unexpected filtered tree %+v", db1)
+		}
+	})
+
+	t.Run("Unknown root", func(t *testing.T) {
+		resp := getWithCookies(t, ts, "/api/notion-tree?root=missing", cookies)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Invalid type", func(t *testing.T) {
+		resp := getWithCookies(t, ts, "/api/notion-tree?type=block", cookies)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestNotionTree_Unauthorized(t *testing.T) {
+	s := setupTestServer(t)
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	resp := getWithCookies(t, ts, "/api/notion-tree", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestNotionClient_RetriesRateLimit(t *testing.T) {
+	var calls int32
+	mock := mockNotionAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"object":"error","status":429,"code":"rate_limited","message":"slow down"}`))
+			return
+		}
+		w.Write([]byte(`{"object":"list","results":[],"has_more":false}`))
+	}))
+
+	items, err := newNotionClient(mock.URL, "test-token").searchAll(t.Context(), "")
+	if err != nil {
+		t.Fatalf("searchAll failed: %v", err)
+	}
+	if len(items) != 0 || calls != 2 {
+		t.Errorf("Expected one retry and no items, got %d calls and %d items", calls, len(items))
+	}
+}
+
+func nodeIDs(nodes []*HierarchyNode) []string {
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		ids[i] = n.ID
+	}
+	return ids
+}
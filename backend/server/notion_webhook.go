@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// notionWebhookMaxBody caps the size of a webhook request body.
+const notionWebhookMaxBody = 1 << 20
+
+// notionWebhookTokenKey is the key of the latest verification token received
+// in the notionWebhook store.
+const notionWebhookTokenKey = "verification_token"
+
+// errNotionWebhookTokenStored reports a verification request received after
+// a token was stored.
+var errNotionWebhookTokenStored = errors.New("verification token already stored")
+
+// notionWebhookEvent is the part of a Notion webhook event used to keep
+// export records current. Events only identify the entity that changed; they
+// do not carry its content.
+type notionWebhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Entity    struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	} `json:"entity"`
+}
+
+// validNotionSignature reports whether signature, the X-Notion-Signature
+// header, is the HMAC-SHA256 of body keyed by the verification token.
+func validNotionSignature(token string, body []byte, signature string) bool {
+	sum, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok || token == "" {
+		return false
+	}
+	got, err := hex.DecodeString(sum)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// notionWebhookEndpoint receives Notion webhook events. Requests are not tied
+// to a session; they are authenticated by their signature instead.
+//
+// When a subscription is created, Notion first sends an unsigned request
+// holding a verification token, which must be entered in Notion to activate
+// the subscription and set as NOTION_WEBHOOK_SECRET to verify its events.
+// Since anyone can send such a request, the token is only stored in DATA_DIR
+// for the operator to copy, and events are rejected until the secret is set.
+// Once it is, verification requests are refused.
+func (s *Server) notionWebhookEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, notionWebhookMaxBody))
+	if err != nil {
+		return nil, endpoint.Error(http.StatusRequestEntityTooLarge, "request body too large", err)
+	}
+
+	var verification struct {
+		VerificationToken string `json:"verification_token"`
+	}
+	if err := json.Unmarshal(body, &verification); err != nil {
+		return nil, endpoint.Error(http.StatusBadRequest, "invalid JSON", err)
+	}
+	secret := s.cfg.NotionWebhookSecret
+	if token := verification.VerificationToken; token != "" {
+		if secret != "" {
+			return nil, endpoint.Error(http.StatusForbidden, "the webhook is already verified; unset NOTION_WEBHOOK_SECRET to verify a new subscription", nil)
+		}
+		return s.verifyNotionWebhook(token)
+	}
+
+	if secret == "" {
+		return nil, endpoint.Error(http.StatusServiceUnavailable, "NOTION_WEBHOOK_SECRET is not set", nil)
+	}
+	if !validNotionSignature(secret, body, r.Header.Get("X-Notion-Signature")) {
+		return nil, endpoint.Error(http.StatusUnauthorized, "invalid signature", nil)
+	}
+
+	var event notionWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, endpoint.Error(http.StatusBadRequest, "invalid event", err)
+	}
+	if err := s.applyNotionEvent(&event); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to update export records", err)
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{}}, nil
+}
+
+// verifyNotionWebhook handles a subscription verification request by storing
+// its token. Since the request is not authenticated, a token already stored
+// is kept: the operator removes it to receive another. The token is never
+// used to verify events, nor logged.
+func (s *Server) verifyNotionWebhook(token string) (endpoint.Renderer, error) {
+	_, err := s.notionWebhook.Update(notionWebhookTokenKey, func(stored string, ok bool) (string, error) {
+		if ok {
+			return stored, errNotionWebhookTokenStored
+		}
+		return token, nil
+	})
+	switch {
+	case errors.Is(err, errNotionWebhookTokenStored):
+		log.Printf("Notion webhook verification token received and ignored, since one is already stored; remove it from DATA_DIR and restart to receive another")
+		return nil, endpoint.Error(http.StatusConflict, "a verification token is already stored", nil)
+	case err != nil:
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to save verification token", err)
+	}
+	if path := dataPath(s.cfg, "notion_webhook.json"); path == "" {
+		log.Printf("Notion webhook verification token received; set DATA_DIR to keep it, since it is not logged")
+	} else {
+		log.Printf("Notion webhook verification token received and stored in %s; set NOTION_WEBHOOK_SECRET to it to accept events", path)
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{}}, nil
+}
+
+// applyNotionEvent updates the export records of the page an event is about.
+// Events may arrive out of order or more than once, so each record keeps the
+// time of the latest event applied to it and older events do not override
+// newer ones.
+func (s *Server) applyNotionEvent(event *notionWebhookEvent) error {
+	if event.Entity.Type != "page" {
+		return nil
+	}
+	var apply func(rec *notionExportRecord)
+	switch event.Type {
+	case "page.deleted":
+		apply = func(rec *notionExportRecord) { rec.Deleted = true }
+	case "page.undeleted":
+		apply = func(rec *notionExportRecord) { rec.Deleted = false }
+	case "page.content_updated", "page.properties_updated":
+		apply = func(rec *notionExportRecord) { rec.LastEditedAt = event.Timestamp }
+	case "page.moved":
+		apply = func(rec *notionExportRecord) { rec.MovedAt = event.Timestamp }
+	default:
+		return nil
+	}
+
+	for _, key := range s.notionExports.Keys() {
+		_, err := s.notionExports.Update(key, func(rec notionExportRecord, ok bool) (notionExportRecord, error) {
+			if !ok || !sameNotionID(rec.PageID, event.Entity.ID) {
+				return rec, errSkipRecord
+			}
+			if event.Timestamp.Before(rec.LastEventAt) {
+				return rec, errSkipRecord
+			}
+			apply(&rec)
+			rec.LastEventAt = event.Timestamp
+			return rec, nil
+		})
+		if err != nil && !errors.Is(err, errSkipRecord) {
+			return err
+		}
+	}
+	return nil
+}
+
+// errSkipRecord leaves a record unchanged in a store update.
+var errSkipRecord = errors.New("record unchanged")
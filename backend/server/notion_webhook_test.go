@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// notionEventFixture is a webhook event as sent by Notion, with the event
+// type, timestamp and page ID to fill in.
+const notionEventFixture = `{
+	"id": "367cba44-b6f3-4c92-81e7-6a2e9659efd4",
+	"timestamp": %q,
+	"workspace_id": "13950b26-c203-4f3b-b97d-93ec06319565",
+	"workspace_name": "Meetings",
+	"subscription_id": "29d75c0d-5546-4414-8459-7b7a92f1fc4b",
+	"integration_id": "0ef2e755-4912-8096-91c1-00376a88a5ca",
+	"type": %q,
+	"authors": [{"id": "c7c11cca-1d73-471d-9b6e-bdef51470190", "type": "person"}],
+	"attempt_number": 1,
+	"entity": {"id": %q, "type": "page"},
+	"data": {"parent": {"id": "13950b26-c203-4f3b-b97d-93ec06319565", "type": "space"}}
+}`
+
+// postWebhook sends a webhook request, signed with secret if it is not empty.
+func postWebhook(t *testing.T, ts *httptest.Server, body, secret string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", ts.URL+"/api/notion/webhook", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		req.Header.Set("X-Notion-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST webhook failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestValidNotionSignature(t *testing.T) {
+	body := []byte(`{"id":"evt-1","type":"page.deleted"}`)
+	signature := "sha256=e5fea7508b6b957d8c5952789d65ef56c1ecddf7a9b13d431e335af70e817231"
+
+	if !validNotionSignature("secret_fixture", body, signature) {
+		t.Error("Expected fixture signature to be valid")
+	}
+	for name, tc := range map[string]struct {
+		token, body, signature string
+	}{
+		"Wrong token":    {"secret_other", string(body), signature},
+		"Modified body":  {"secret_fixture", string(body) + " ", signature},
+		"Missing scheme": {"secret_fixture", string(body), signature[len("sha256="):]},
+		"Not hex":        {"secret_fixture", string(body), "sha256=zz"},
+		"No token":       {"", string(body), signature},
+	} {
+		if validNotionSignature(tc.token, []byte(tc.body), tc.signature) {
+			t.Errorf("%s: expected signature to be invalid", name)
+		}
+	}
+}
+
+func TestNotionWebhook_Verification(t *testing.T) {
+	s := setupTestServer(t)
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	event := fmt.Sprintf(notionEventFixture, "2026-01-02T10:00:00Z", "page.deleted", "page-1")
+
+	// The first token is stored for the operator, and not replaced by
+	// later ones, but events are rejected until the secret is configured,
+	// even if signed with a token received.
+	if resp := postWebhook(t, ts, `{"verification_token": "secret_notion"}`, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected verification to succeed, got %d", resp.StatusCode)
+	}
+	if resp := postWebhook(t, ts, `{"verification_token": "secret_attacker"}`, ""); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for a second token, got %d", resp.StatusCode)
+	}
+	if got, _ := s.notionWebhook.Get(notionWebhookTokenKey); got != "secret_notion" {
+		t.Errorf("Expected the first token to be kept, got %q", got)
+	}
+	for _, secret := range []string{"secret_attacker", "secret_notion"} {
+		if resp := postWebhook(t, ts, event, secret); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 without a configured secret, got %d", resp.StatusCode)
+		}
+	}
+
+	s.cfg.NotionWebhookSecret = "secret_notion"
+	if resp := postWebhook(t, ts, event, "secret_notion"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected signed event to be accepted, got %d", resp.StatusCode)
+	}
+	if resp := postWebhook(t, ts, event, "secret_attacker"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a bad signature, got %d", resp.StatusCode)
+	}
+	if resp := postWebhook(t, ts, event, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a missing signature, got %d", resp.StatusCode)
+	}
+
+	// Once the secret is set, verification requests are refused.
+	s.notionWebhook.Delete(notionWebhookTokenKey)
+	if resp := postWebhook(t, ts, `{"verification_token": "secret_attacker"}`, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for verification with a secret set, got %d", resp.StatusCode)
+	}
+	if _, ok := s.notionWebhook.Get(notionWebhookTokenKey); ok {
+		t.Error("Expected no token to be stored")
+	}
+}
+
+func TestNotionWebhook_Events(t *testing.T) {
+	fake := newFakeNotionPages(t)
+	rec := &recordingHandler{next: fake}
+	s := setupTestServer(t)
+	useMockNotion(t, s, rec)
+
+	s.cfg.NotionWebhookSecret = "secret_fixture"
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "test-token")
+
+	export := func() notionExportResponse {
+		t.Helper()
+		resp := postJSON(t, ts, "/api/export/notion", map[string]any{
+			"parent":     map[string]any{"page_id": "parent-page"},
+			"transcript": Transcript{ID: "t1", Title: "Standup", Summary: "Short."},
+		}, cookies)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected export to succeed, got %d", resp.StatusCode)
+		}
+		var result notionExportResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	status := func() map[string]any {
+		t.Helper()
+		resp := getWithCookies(t, ts, "/api/export/notion/t1", cookies)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected export status, got %d", resp.StatusCode)
+		}
+		var result map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	send := func(typ, pageID string, at time.Time) {
+		t.Helper()
+		body := fmt.Sprintf(notionEventFixture, at.Format(time.RFC3339Nano), typ, pageID)
+		if resp := postWebhook(t, ts, body, "secret_fixture"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected %s event to be accepted, got %d", typ, resp.StatusCode)
+		}
+	}
+
+	first := export()
+	if got := status(); got["edited"] != false || got["deleted"] != false || got["last_edited_at"] != nil {
+		t.Errorf("Unexpected status after export: %v", got)
+	}
+
+	edited := time.Now().UTC().Add(time.Minute)
+	send("page.content_updated", first.PageID, edited)
+	got := status()
+	if got["edited"] != true || got["last_edited_at"] != edited.Format(time.RFC3339Nano) {
+		t.Errorf("Expected edit to be recorded, got %v", got)
+	}
+
+	// Events for other pages are ignored.
+	send("page.deleted", "other-page", edited.Add(time.Minute))
+	if got := status(); got["deleted"] != false {
+		t.Errorf("Event for another page changed the record: %v", got)
+	}
+
+	send("page.moved", first.PageID, edited.Add(time.Minute))
+	send("page.deleted", first.PageID, edited.Add(2*time.Minute))
+	// A late undelete from before the deletion does not revive the page.
+	send("page.undeleted", first.PageID, edited.Add(90*time.Second))
+	got = status()
+	if got["deleted"] != true || got["moved_at"] != edited.Add(time.Minute).Format(time.RFC3339Nano) {
+		t.Errorf("Expected page to be recorded as moved and deleted, got %v", got)
+	}
+
+	// Re-exporting a deleted page creates a new page without looking up the
+	// old one.
+	before := len(rec.requests)
+	second := export()
+	if second.PageID == first.PageID || !second.Created {
+		t.Errorf("Expected a new page, got %+v", second)
+	}
+	for _, req := range rec.requests[before:] {
+		if req.Method == "GET" && req.Path == "/v1/pages/"+first.PageID {
+			t.Errorf("Deleted page was looked up: %s", req)
+		}
+	}
+
+	send("page.undeleted", second.PageID, time.Now().UTC().Add(time.Hour))
+	if got := status(); got["deleted"] != false || got["page_id"] != second.PageID {
+		t.Errorf("Unexpected status after undelete: %v", got)
+	}
+
+	resp := getWithCookies(t, ts, "/api/export/notion/unknown", cookies)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unexported transcript, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// Waveform peak limits.
+const (
+	// defaultPeakBuckets is the number of peaks computed when the request
+	// does not say.
+	defaultPeakBuckets = 1000
+	// maxPeakBuckets bounds the number of peaks a request may ask for.
+	maxPeakBuckets = 10000
+	// maxCachedPeaks bounds the number of waveforms kept in memory.
+	maxCachedPeaks = 64
+)
+
+// recordingPeaks is the waveform of a recording: the recording is divided
+// into equal buckets of time, and each peak is the largest amplitude in its
+// bucket, from 0 for silence to 1 for full scale.
+type recordingPeaks struct {
+	Buckets    int       `json:"buckets"`
+	Duration   float64   `json:"duration"`
+	SampleRate int       `json:"sample_rate"`
+	Channels   int       `json:"channels"`
+	Peaks      []float64 `json:"peaks"`
+}
+
+// cachedPeaks is a waveform in a recordingPeaksCache.
+type cachedPeaks struct {
+	peaks    *recordingPeaks
+	lastUsed time.Time
+}
+
+// recordingPeaksCache holds recently computed waveforms, keyed by the
+// recording's entity tag and the number of buckets. Since the entity tag
+// changes with the recording's content, entries never go stale.
+type recordingPeaksCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedPeaks
+}
+
+func newRecordingPeaksCache() *recordingPeaksCache {
+	return &recordingPeaksCache{entries: make(map[string]*cachedPeaks)}
+}
+
+// get returns the cached waveform for key, if any.
+func (c *recordingPeaksCache) get(key string) (*recordingPeaks, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e.lastUsed = time.Now()
+	return e.peaks, true
+}
+
+// put caches a waveform, dropping the least recently used one if the cache
+// is full.
+func (c *recordingPeaksCache) put(key string, peaks *recordingPeaks) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCachedPeaks {
+		var oldest string
+		for k, e := range c.entries {
+			if oldest == "" || e.lastUsed.Before(c.entries[oldest].lastUsed) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = &cachedPeaks{peaks: peaks, lastUsed: time.Now()}
+}
+
+// pcmFormat describes uncompressed PCM audio.
+type pcmFormat struct {
+	sampleRate int
+	channels   int
+	// bits is the size of a sample: 8 (unsigned), 16, 24 or 32 bits for
+	// integers, or 32 or 64 bits for floats.
+	bits      int
+	float     bool
+	bigEndian bool
+}
+
+// frameSize returns the size of a frame, one sample of each channel.
+func (f pcmFormat) frameSize() int {
+	return f.channels * f.bits / 8
+}
+
+// valid reports whether the format is one peaks can be computed for.
+func (f pcmFormat) valid() bool {
+	if f.sampleRate <= 0 || f.channels <= 0 || f.channels > 32 {
+		return false
+	}
+	if f.float {
+		return f.bits == 32 || f.bits == 64
+	}
+	return f.bits == 8 || f.bits == 16 || f.bits == 24 || f.bits == 32
+}
+
+// amplitude returns the absolute value of the sample in b, from 0 to 1.
+func (f pcmFormat) amplitude(b []byte) float64 {
+	var order binary.ByteOrder = binary.LittleEndian
+	if f.bigEndian {
+		order = binary.BigEndian
+	}
+	var v float64
+	switch {
+	case f.float && f.bits == 32:
+		v = float64(math.Float32frombits(order.Uint32(b)))
+	case f.float:
+		v = math.Float64frombits(order.Uint64(b))
+	case f.bits == 8:
+		v = (float64(b[0]) - 128) / 128
+	case f.bits == 16:
+		v = float64(int16(order.Uint16(b))) / (1 << 15)
+	case f.bits == 24:
+		if f.bigEndian {
+			b = []byte{b[2], b[1], b[0]}
+		}
+		v = float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+	default:
+		v = float64(int32(order.Uint32(b))) / (1 << 31)
+	}
+	if math.IsNaN(v) {
+		return 0
+	}
+	return min(math.Abs(v), 1)
+}
+
+// errNotPCM is returned for audio whose samples cannot be read directly.
+var errNotPCM = errors.New("peaks need WAV or audio/L16 audio")
+
+// WAV format tags.
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// readWAVHeader reads a WAV file up to the start of its samples, returning
+// their format and size. The size is -1 for files written while recording,
+// whose samples run to the end of the file.
+func readWAVHeader(r io.Reader) (pcmFormat, int64, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return pcmFormat{}, 0, errors.New("not a WAV file")
+	}
+	var format pcmFormat
+	haveFormat := false
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return pcmFormat{}, 0, errors.New("WAV file has no samples")
+		}
+		id, size := string(header[:4]), int64(binary.LittleEndian.Uint32(header[4:]))
+		switch id {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return pcmFormat{}, 0, errors.New("invalid WAV format")
+			}
+			fmtChunk := make([]byte, size)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return pcmFormat{}, 0, errors.New("invalid WAV format")
+			}
+			tag := binary.LittleEndian.Uint16(fmtChunk)
+			if tag == wavFormatExtensible && size >= 26 {
+				// The format is the start of the sub-format GUID.
+				tag = binary.LittleEndian.Uint16(fmtChunk[24:])
+			}
+			if tag != wavFormatPCM && tag != wavFormatFloat {
+				return pcmFormat{}, 0, errNotPCM
+			}
+			format = pcmFormat{
+				channels:   int(binary.LittleEndian.Uint16(fmtChunk[2:])),
+				sampleRate: int(binary.LittleEndian.Uint32(fmtChunk[4:])),
+				bits:       int(binary.LittleEndian.Uint16(fmtChunk[14:])),
+				float:      tag == wavFormatFloat,
+			}
+			haveFormat = true
+			if size%2 == 1 {
+				io.CopyN(io.Discard, r, 1)
+			}
+		case "data":
+			if !haveFormat {
+				return pcmFormat{}, 0, errors.New("invalid WAV format")
+			}
+			if size == 0 || size == math.MaxUint32 {
+				size = -1
+			}
+			return format, size, nil
+		default:
+			// Chunks are padded to an even size.
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return pcmFormat{}, 0, errors.New("WAV file has no samples")
+			}
+		}
+	}
+}
+
+// l16Format returns the format of audio/L16 audio (RFC 2586): big-endian
+// 16-bit samples, with the rate and channels given as parameters.
+func l16Format(params map[string]string) pcmFormat {
+	rate, _ := strconv.Atoi(params["rate"])
+	channels := 1
+	if c, ok := params["channels"]; ok {
+		channels, _ = strconv.Atoi(c)
+	}
+	return pcmFormat{sampleRate: rate, channels: channels, bits: 16, bigEndian: true}
+}
+
+// computePeaks reads size bytes of samples in format f from r and returns
+// their peaks in the given number of buckets.
+func computePeaks(r io.Reader, f pcmFormat, size int64, buckets int) (*recordingPeaks, error) {
+	frameSize := int64(f.frameSize())
+	frames := size / frameSize
+	peaks := &recordingPeaks{
+		Buckets:    buckets,
+		Duration:   float64(frames) / float64(f.sampleRate),
+		SampleRate: f.sampleRate,
+		Channels:   f.channels,
+		Peaks:      make([]float64, buckets),
+	}
+	br := bufio.NewReaderSize(io.LimitReader(r, frames*frameSize), 64<<10)
+	frame := make([]byte, frameSize)
+	sampleSize := f.bits / 8
+	for i := int64(0); i < frames; i++ {
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return nil, fmt.Errorf("read samples: %w", err)
+		}
+		bucket := int(i * int64(buckets) / frames)
+		for c := 0; c < f.channels; c++ {
+			if a := f.amplitude(frame[c*sampleSize:]); a > peaks.Peaks[bucket] {
+				peaks.Peaks[bucket] = a
+			}
+		}
+	}
+	for i, p := range peaks.Peaks {
+		// Four decimals are plenty to draw, and keep the response small.
+		peaks.Peaks[i] = math.Round(p*1e4) / 1e4
+	}
+	return peaks, nil
+}
+
+// peaksFromRecording decodes a recording's samples and computes their
+// peaks.
+func (s *Server) peaksFromRecording(rec recordingRecord, buckets int) (*recordingPeaks, error) {
+	mediaType, params, err := mime.ParseMediaType(recordingContentType(rec.ContentType))
+	if err != nil {
+		return nil, endpoint.Error(http.StatusUnsupportedMediaType, errNotPCM.Error(), err)
+	}
+	audio := newRecordingReader(s.blobs, rec)
+	defer audio.Close()
+
+	var format pcmFormat
+	size := rec.Size
+	switch mediaType {
+	case "audio/wav":
+		counter := &countingReader{r: audio}
+		f, dataSize, err := readWAVHeader(counter)
+		if err != nil {
+			return nil, endpoint.Error(http.StatusUnsupportedMediaType, err.Error(), err)
+		}
+		format, size = f, rec.Size-counter.n
+		if dataSize >= 0 {
+			size = min(size, dataSize)
+		}
+	case "audio/l16":
+		// Media types are parsed in lower case.
+		format = l16Format(params)
+	default:
+		return nil, endpoint.Error(http.StatusUnsupportedMediaType, errNotPCM.Error(), nil)
+	}
+	if !format.valid() {
+		return nil, endpoint.Error(http.StatusUnsupportedMediaType, "unsupported PCM format", nil)
+	}
+	peaks, err := computePeaks(audio, format, size, buckets)
+	if err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to read recording", err)
+	}
+	return peaks, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// recordingPeaksEndpoint returns the waveform of a WAV or audio/L16
+// recording, with the number of peaks given by the buckets query parameter.
+func (s *Server) recordingPeaksEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	_, rec, err := s.recordingFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	buckets := defaultPeakBuckets
+	if q := r.URL.Query().Get("buckets"); q != "" {
+		buckets, err = strconv.Atoi(q)
+		if err != nil || buckets < 1 || buckets > maxPeakBuckets {
+			return nil, endpoint.Error(http.StatusBadRequest, fmt.Sprintf("buckets must be from 1 to %d", maxPeakBuckets), nil)
+		}
+	}
+
+	key := recordingETag(rec) + "/" + strconv.Itoa(buckets)
+	peaks, ok := s.recordingPeaks.get(key)
+	if !ok {
+		if peaks, err = s.peaksFromRecording(rec, buckets); err != nil {
+			return nil, err
+		}
+		s.recordingPeaks.put(key, peaks)
+	}
+	return &endpoint.JSONRenderer{Value: peaks}, nil
+}
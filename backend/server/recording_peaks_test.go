@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// wavFile returns a WAV file of 16-bit samples.
+func wavFile(sampleRate, channels int, samples []int16) []byte {
+	var b bytes.Buffer
+	data := len(samples) * 2
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+8+4+data))
+	b.WriteString("WAVE")
+	b.WriteString("fmt ")
+	for _, v := range []any{uint32(16), uint16(wavFormatPCM), uint16(channels), uint32(sampleRate), uint32(sampleRate * channels * 2), uint16(channels * 2), uint16(16)} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	// Chunks other than the format and samples are skipped.
+	b.WriteString("LIST")
+	binary.Write(&b, binary.LittleEndian, uint32(3))
+	b.WriteString("abc\x00")
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(data))
+	binary.Write(&b, binary.LittleEndian, samples)
+	return b.Bytes()
+}
+
+func TestRecordingPeaks(t *testing.T) {
+	s := setupTestServer(t)
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "")
+	getPeaks := func(id, query string) (*http.Response, recordingPeaks) {
+		t.Helper()
+		resp := getWithCookies(t, ts, "/api/recordings/"+id+"/peaks"+query, cookies)
+		defer resp.Body.Close()
+		var peaks recordingPeaks
+		json.NewDecoder(resp.Body).Decode(&peaks)
+		return resp, peaks
+	}
+
+	// A second of audio at half scale, then a second at a quarter, stored
+	// in chunks that split a sample. Like a WAV file written while
+	// recording, its samples have no size.
+	samples := make([]int16, 16000)
+	for i := range samples {
+		amplitude := int16(1 << 14)
+		if i >= 8000 {
+			amplitude = 1 << 13
+		}
+		if i%2 == 1 {
+			amplitude = -amplitude
+		}
+		samples[i] = amplitude
+	}
+	wav := wavFile(8000, 1, samples)
+	binary.LittleEndian.PutUint32(wav[bytes.Index(wav, []byte("data"))+4:], math.MaxUint32)
+	appendChunk(t, ts, cookies, "wav", 0, "audio/x-wav", wav[:1001])
+	appendChunk(t, ts, cookies, "wav", 1, "audio/x-wav", wav[1001:])
+
+	resp, peaks := getPeaks("wav", "?buckets=4")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected peaks, got %d", resp.StatusCode)
+	}
+	if peaks.Buckets != 4 || peaks.Duration != 2 || peaks.SampleRate != 8000 || peaks.Channels != 1 {
+		t.Errorf("Unexpected waveform %+v", peaks)
+	}
+	if want := []float64{0.5, 0.5, 0.25, 0.25}; len(peaks.Peaks) != 4 || peaks.Peaks[0] != want[0] || peaks.Peaks[1] != want[1] || peaks.Peaks[2] != want[2] || peaks.Peaks[3] != want[3] {
+		t.Errorf("Expected peaks %v, got %v", want, peaks.Peaks)
+	}
+	if _, peaks := getPeaks("wav", ""); len(peaks.Peaks) != defaultPeakBuckets {
+		t.Errorf("Expected %d peaks by default, got %d", defaultPeakBuckets, len(peaks.Peaks))
+	}
+
+	// Waveforms are cached until the recording changes.
+	rec, _ := s.recording("user:testuser", "wav")
+	cached, ok := s.recordingPeaks.get(recordingETag(rec) + "/4")
+	if !ok {
+		t.Fatal("Expected the waveform to be cached")
+	}
+	cached.Peaks[0] = 0.75
+	if _, peaks := getPeaks("wav", "?buckets=4"); peaks.Peaks[0] != 0.75 {
+		t.Errorf("Expected the cached waveform, got %v", peaks.Peaks)
+	}
+	appendChunk(t, ts, cookies, "wav", 2, "audio/x-wav", []byte{0, 0x80})
+	if _, peaks := getPeaks("wav", "?buckets=4"); peaks.Peaks[0] != 0.5 || peaks.Peaks[3] != 1 {
+		t.Errorf("Expected a new waveform, got %v", peaks.Peaks)
+	}
+
+	// Raw PCM is big-endian, with its rate and channels in the type.
+	pcm := []byte{0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0xE0, 0x00}
+	appendChunk(t, ts, cookies, "l16", 0, "audio/L16;rate=2;channels=2", pcm)
+	if _, peaks := getPeaks("l16", "?buckets=2"); peaks.Duration != 1 || peaks.Channels != 2 || peaks.Peaks[0] != 0.5 || peaks.Peaks[1] != 0.25 {
+		t.Errorf("Unexpected L16 waveform %+v", peaks)
+	}
+
+	appendChunk(t, ts, cookies, "webm", 0, "audio/webm", []byte("webm audio"))
+	appendChunk(t, ts, cookies, "bad", 0, "audio/wav", []byte("RIFF0000WAVEdata"))
+	for _, tc := range []struct {
+		id, query string
+		status    int
+	}{
+		{"wav", "?buckets=0", http.StatusBadRequest},
+		{"wav", "?buckets=10001", http.StatusBadRequest},
+		{"wav", "?buckets=many", http.StatusBadRequest},
+		{"webm", "", http.StatusUnsupportedMediaType},
+		{"bad", "", http.StatusUnsupportedMediaType},
+		{"missing", "", http.StatusNotFound},
+	} {
+		if resp, _ := getPeaks(tc.id, tc.query); resp.StatusCode != tc.status {
+			t.Errorf("%s%s: expected %d, got %d", tc.id, tc.query, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestPCMFormat_Amplitude(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format pcmFormat
+		sample []byte
+		want   float64
+	}{
+		{"8-bit", pcmFormat{bits: 8}, []byte{0}, 1},
+		{"8-bit silence", pcmFormat{bits: 8}, []byte{128}, 0},
+		{"16-bit", pcmFormat{bits: 16}, []byte{0x00, 0xC0}, 0.5},
+		{"24-bit", pcmFormat{bits: 24}, []byte{0x00, 0x00, 0xE0}, 0.25},
+		{"24-bit big-endian", pcmFormat{bits: 24, bigEndian: true}, []byte{0x20, 0x00, 0x00}, 0.25},
+		{"32-bit", pcmFormat{bits: 32}, []byte{0, 0, 0, 0x40}, 0.5},
+		{"float", pcmFormat{bits: 32, float: true}, binary.LittleEndian.AppendUint32(nil, math.Float32bits(-0.125)), 0.125},
+		{"clipped float", pcmFormat{bits: 64, float: true}, binary.LittleEndian.AppendUint64(nil, math.Float64bits(1.5)), 1},
+	} {
+		if got := tc.format.amplitude(tc.sample); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/blobstore"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// Recording limits. These are variables so tests can lower them.
+var (
+	// recordingMaxChunk bounds the size of an uploaded chunk.
+	recordingMaxChunk int64 = 8 << 20
+	// recordingMaxSize bounds the size of a recording.
+	recordingMaxSize int64 = 2 << 30
+	// recordingPruneInterval is how often expired recordings are removed.
+	recordingPruneInterval = time.Hour
+	// recordingBlobGrace is how old a blob must be before it is removed for
+	// not belonging to any recording.
+	recordingBlobGrace = time.Hour
+)
+
+// recordingFlushSize is how much relayed audio is buffered before it is
+// stored as a chunk.
+const recordingFlushSize = 256 << 10
+
+// recordingIDPattern matches transcript IDs that recordings may be stored
+// under.
+var recordingIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// recordingChunk is a chunk of a recording, stored as a blob.
+type recordingChunk struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// recordingRecord is the audio recorded for a transcript: its chunks in the
+// order they were recorded, which together make up the recording. StartedAt
+// is when recording started, which may be well before the first chunk was
+// stored. Quota is the quota key of the session that started it, which its
+// size is counted under.
+type recordingRecord struct {
+	ID          string           `json:"id"`
+	ContentType string           `json:"content_type"`
+	Quota       string           `json:"quota,omitempty"`
+	Chunks      []recordingChunk `json:"chunks"`
+	Size        int64            `json:"size"`
+	StartedAt   time.Time        `json:"started_at"`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+// startTime returns when the recording started. Recordings stored before
+// StartedAt was recorded use when their first chunk was stored.
+func (rec recordingRecord) startTime() time.Time {
+	if rec.StartedAt.IsZero() {
+		return rec.CreatedAt
+	}
+	return rec.StartedAt
+}
+
+// quota returns the quota key the recording stored under key is counted
+// under. Recordings stored before Quota was recorded are counted under their
+// user's key.
+func (rec recordingRecord) quota(key string) string {
+	if rec.Quota != "" {
+		return rec.Quota
+	}
+	return key[:strings.LastIndex(key, "/")]
+}
+
+// recordingInfo describes a recording.
+type recordingInfo struct {
+	ID          string     `json:"id"`
+	ContentType string     `json:"content_type"`
+	Chunks      int        `json:"chunks"`
+	Size        int64      `json:"size"`
+	StartedAt   time.Time  `json:"started_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// recordingKey returns the key of a user's recording in the store.
+func recordingKey(userKey, id string) string {
+	return userKey + "/" + id
+}
+
+// recordingExpiry returns when a recording expires, or nil if recordings are
+// kept until deleted.
+func (s *Server) recordingExpiry(rec recordingRecord) *time.Time {
+	if s.cfg.RecordingRetentionDays <= 0 {
+		return nil
+	}
+	at := rec.UpdatedAt.AddDate(0, 0, s.cfg.RecordingRetentionDays)
+	return &at
+}
+
+func (s *Server) recordingInfo(rec recordingRecord) recordingInfo {
+	return recordingInfo{
+		ID:          rec.ID,
+		ContentType: rec.ContentType,
+		Chunks:      len(rec.Chunks),
+		Size:        rec.Size,
+		StartedAt:   rec.startTime(),
+		CreatedAt:   rec.CreatedAt,
+		UpdatedAt:   rec.UpdatedAt,
+		ExpiresAt:   s.recordingExpiry(rec),
+	}
+}
+
+// expired reports whether a recording is past its retention.
+func (s *Server) expired(rec recordingRecord) bool {
+	at := s.recordingExpiry(rec)
+	return at != nil && time.Now().After(*at)
+}
+
+// recording returns the user's recording of a transcript, unless it has
+// expired.
+func (s *Server) recording(userKey, id string) (recordingRecord, bool) {
+	rec, ok := s.recordings.Get(recordingKey(userKey, id))
+	if !ok || s.expired(rec) {
+		return recordingRecord{}, false
+	}
+	return rec, true
+}
+
+// errChunkStored reports a chunk that was already stored, such as when an
+// upload is retried.
+var errChunkStored = errors.New("chunk already stored")
+
+// recordingUsage returns the size of the recordings counted under quota, and
+// of all recordings. Expired recordings are not counted.
+func (s *Server) recordingUsage(quota string) (used, total int64) {
+	for _, key := range s.recordings.Keys() {
+		rec, ok := s.recordings.Get(key)
+		if !ok || s.expired(rec) {
+			continue
+		}
+		total += rec.Size
+		if rec.quota(key) == quota {
+			used += rec.Size
+		}
+	}
+	return used, total
+}
+
+// appendRecording stores a chunk of a user's recording of a transcript,
+// counting it under quota, the request's quotaKey. seq is the chunk's
+// position in the recording, or -1 to add it at the end. A chunk already
+// stored at seq is accepted again, for retries; others must be of the
+// recording's contentType, and fit in the storage limits. startedAt is when
+// recording started, kept if the chunk begins a new recording; zero means
+// now.
+func (s *Server) appendRecording(userKey, quota, id, contentType string, seq int, data []byte, startedAt time.Time) (recordingRecord, error) {
+	s.recordingsMu.Lock()
+	defer s.recordingsMu.Unlock()
+	used, total := s.recordingUsage(quota)
+	digest, err := s.blobs.Put(data)
+	if err != nil {
+		return recordingRecord{}, endpoint.Error(http.StatusInternalServerError, "failed to store audio", err)
+	}
+	// refused is the error for a chunk that cannot be added.
+	var refused error
+	rec, err := s.recordings.Update(recordingKey(userKey, id), func(rec recordingRecord, ok bool) (recordingRecord, error) {
+		now := time.Now().UTC()
+		if !ok || s.expired(rec) {
+			rec = recordingRecord{ID: id, ContentType: contentType, Quota: quota, Chunks: []recordingChunk{}, StartedAt: now, CreatedAt: now}
+			if !startedAt.IsZero() {
+				rec.StartedAt = startedAt.UTC()
+			}
+		}
+		switch {
+		case seq >= 0 && seq < len(rec.Chunks) && rec.Chunks[seq].Digest == digest:
+			refused = errChunkStored
+		case seq >= 0 && seq < len(rec.Chunks):
+			refused = endpoint.Error(http.StatusConflict, fmt.Sprintf("chunk %d differs from the one stored", seq), nil)
+		case seq > len(rec.Chunks):
+			refused = endpoint.Error(http.StatusConflict, fmt.Sprintf("expected chunk %d", len(rec.Chunks)), nil)
+		case contentType != rec.ContentType:
+			refused = endpoint.Error(http.StatusConflict, fmt.Sprintf("recording is %s", rec.ContentType), nil)
+		case rec.Size+int64(len(data)) > recordingMaxSize:
+			refused = endpoint.Error(http.StatusRequestEntityTooLarge, "recording is too large", nil)
+		case s.cfg.RecordingQuotaMB > 0 && used+int64(len(data)) > int64(s.cfg.RecordingQuotaMB)<<20:
+			refused = endpoint.Error(http.StatusRequestEntityTooLarge, "recordings are over your storage quota", nil)
+		case s.cfg.RecordingStorageMB > 0 && total+int64(len(data)) > int64(s.cfg.RecordingStorageMB)<<20:
+			refused = endpoint.Error(http.StatusInsufficientStorage, "the server is out of storage for recordings", nil)
+		}
+		if refused != nil {
+			return rec, refused
+		}
+		rec.Chunks = append(rec.Chunks, recordingChunk{Digest: digest, Size: int64(len(data))})
+		rec.Size += int64(len(data))
+		rec.UpdatedAt = now
+		return rec, nil
+	})
+	switch {
+	case err == nil, err == errChunkStored:
+		return rec, nil
+	case err == refused:
+		return rec, err
+	}
+	return rec, endpoint.Error(http.StatusInternalServerError, "failed to store recording", err)
+}
+
+// deleteRecording removes a recording. Its chunks are left to
+// pruneRecordings, since a chunk being appended to another recording may
+// share one while not yet being recorded.
+func (s *Server) deleteRecording(key string) error {
+	return s.recordings.Delete(key)
+}
+
+// recordedDigests returns the digests of the chunks of all recordings.
+func (s *Server) recordedDigests() map[string]bool {
+	digests := map[string]bool{}
+	for _, key := range s.recordings.Keys() {
+		rec, _ := s.recordings.Get(key)
+		for _, c := range rec.Chunks {
+			digests[c.Digest] = true
+		}
+	}
+	return digests
+}
+
+// pruneRecordings removes expired recordings, and blobs that belong to no
+// recording, such as chunks of deleted recordings or whose upload was
+// refused.
+func (s *Server) pruneRecordings() error {
+	s.recordingsMu.Lock()
+	defer s.recordingsMu.Unlock()
+	for _, key := range s.recordings.Keys() {
+		if rec, ok := s.recordings.Get(key); ok && s.expired(rec) {
+			if err := s.deleteRecording(key); err != nil {
+				return err
+			}
+		}
+	}
+	recorded := s.recordedDigests()
+	return s.blobs.Walk(func(d string, modTime time.Time) error {
+		if recorded[d] || time.Since(modTime) < recordingBlobGrace {
+			return nil
+		}
+		return s.blobs.Delete(d)
+	})
+}
+
+// pruneRecordingsEvery prunes recordings every interval, forever.
+func (s *Server) pruneRecordingsEvery(interval time.Duration) {
+	for {
+		if err := s.pruneRecordings(); err != nil {
+			log.Printf("Failed to prune recordings: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// recordingAudioType returns the media type of uploaded audio, which must be
+// audio or video, such as a MediaRecorder's.
+func recordingAudioType(contentType string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "audio/") && !strings.HasPrefix(mediaType, "video/") {
+		return "", endpoint.Error(http.StatusUnsupportedMediaType, "audio must be an audio or video type", err)
+	}
+	return contentType, nil
+}
+
+// recordingIDFromRequest returns the transcript ID in the path.
+func recordingIDFromRequest(r *http.Request) (string, error) {
+	id := r.PathValue("id")
+	if !recordingIDPattern.MatchString(id) {
+		return "", endpoint.Error(http.StatusBadRequest, "invalid recording ID", nil)
+	}
+	return id, nil
+}
+
+// appendRecordingEndpoint stores the next chunk of the audio recorded for a
+// transcript, such as a MediaRecorder's dataavailable event. The seq query
+// parameter numbers the chunks from 0, so that retries are stored once. The
+// optional started_at parameter, an RFC 3339 time, is when recording started;
+// it is kept from the first chunk and defaults to when that was stored.
+func (s *Server) appendRecordingEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := recordingIDFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := strconv.Atoi(r.URL.Query().Get("seq"))
+	if err != nil || seq < 0 {
+		return nil, endpoint.Error(http.StatusBadRequest, "seq must be a chunk number", nil)
+	}
+	var startedAt time.Time
+	if v := r.URL.Query().Get("started_at"); v != "" {
+		if startedAt, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, endpoint.Error(http.StatusBadRequest, "started_at must be an RFC 3339 time", nil)
+		}
+	}
+	contentType, err := recordingAudioType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, recordingMaxChunk))
+	if err != nil {
+		return nil, endpoint.Error(http.StatusRequestEntityTooLarge, fmt.Sprintf("chunks must be at most %d MB", recordingMaxChunk>>20), err)
+	}
+	if len(data) == 0 {
+		return nil, endpoint.Error(http.StatusBadRequest, "chunk is empty", nil)
+	}
+	rec, err := s.appendRecording(userKey, quotaKey(r, userKey), id, contentType, seq, data, startedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: s.recordingInfo(rec)}, nil
+}
+
+// listRecordingsEndpoint lists the user's recordings.
+func (s *Server) listRecordingsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	recordings := []recordingInfo{}
+	for _, key := range s.recordings.Keys() {
+		id, ok := strings.CutPrefix(key, userKey+"/")
+		if !ok {
+			continue
+		}
+		if rec, ok := s.recording(userKey, id); ok {
+			recordings = append(recordings, s.recordingInfo(rec))
+		}
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{"recordings": recordings}}, nil
+}
+
+// recordingFromRequest returns the user's recording named in the path.
+func (s *Server) recordingFromRequest(r *http.Request) (string, recordingRecord, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return "", recordingRecord{}, err
+	}
+	id, err := recordingIDFromRequest(r)
+	if err != nil {
+		return "", recordingRecord{}, err
+	}
+	rec, ok := s.recording(userKey, id)
+	if !ok {
+		return "", recordingRecord{}, endpoint.Error(http.StatusNotFound, "recording not found", nil)
+	}
+	return userKey, rec, nil
+}
+
+// getRecordingEndpoint downloads a recording, its chunks joined in order.
+func (s *Server) getRecordingEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	_, rec, err := s.recordingFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingRenderer{blobs: s.blobs, rec: rec}, nil
+}
+
+// deleteRecordingEndpoint removes a recording.
+func (s *Server) deleteRecordingEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, rec, err := s.recordingFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.deleteRecording(recordingKey(userKey, rec.ID)); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to remove recording", err)
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{}}, nil
+}
+
+// recordingRenderer writes a recording's audio, or the byte ranges of it
+// the request asks for, so that players can seek.
+type recordingRenderer struct {
+	blobs *blobstore.Store
+	rec   recordingRecord
+}
+
+func (rr *recordingRenderer) Render(w http.ResponseWriter, r *http.Request) error {
+	contentType := recordingContentType(rr.rec.ContentType)
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": rr.rec.ID + recordingExtension(contentType)}))
+	h.Set("Cache-Control", "private, no-cache")
+	h.Set("ETag", recordingETag(rr.rec))
+	audio := newRecordingReader(rr.blobs, rr.rec)
+	defer audio.Close()
+	http.ServeContent(w, r, "", rr.rec.UpdatedAt, audio)
+	return nil
+}
+
+// recordingETag returns an entity tag for a recording's content, which
+// changes whenever a chunk is appended.
+func recordingETag(rec recordingRecord) string {
+	var digests strings.Builder
+	for _, c := range rec.Chunks {
+		digests.WriteString(c.Digest)
+	}
+	return `"` + blobstore.Digest([]byte(digests.String()))[:32] + `"`
+}
+
+// recordingReader reads a recording's chunks as one seekable stream,
+// opening each chunk's blob as it is reached.
+type recordingReader struct {
+	blobs *blobstore.Store
+	rec   recordingRecord
+	// starts holds the offset of each chunk in the recording.
+	starts []int64
+	pos    int64
+
+	// blob is the open blob of chunk index, if any.
+	blob  blobstore.Blob
+	index int
+}
+
+func newRecordingReader(blobs *blobstore.Store, rec recordingRecord) *recordingReader {
+	rr := &recordingReader{blobs: blobs, rec: rec, starts: make([]int64, len(rec.Chunks)), index: -1}
+	var offset int64
+	for i, c := range rec.Chunks {
+		rr.starts[i] = offset
+		offset += c.Size
+	}
+	return rr
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	if rr.pos >= rr.rec.Size {
+		return 0, io.EOF
+	}
+	// The chunk holding pos is the last one starting at or before it.
+	i, found := slices.BinarySearch(rr.starts, rr.pos)
+	if !found {
+		i--
+	}
+	if i != rr.index {
+		rr.closeBlob()
+		b, err := rr.blobs.Open(rr.rec.Chunks[i].Digest)
+		if err != nil {
+			log.Printf("Recording %s: chunk %s: %v", rr.rec.ID, rr.rec.Chunks[i].Digest, err)
+			return 0, err
+		}
+		rr.blob, rr.index = b, i
+	}
+	if _, err := rr.blob.Seek(rr.pos-rr.starts[i], io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := rr.blob.Read(p[:min(int64(len(p)), rr.rec.Chunks[i].Size-(rr.pos-rr.starts[i]))])
+	rr.pos += int64(n)
+	if err == io.EOF {
+		if n == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (rr *recordingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += rr.pos
+	case io.SeekEnd:
+		offset += rr.rec.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("recording: negative position")
+	}
+	rr.pos = offset
+	return offset, nil
+}
+
+func (rr *recordingReader) closeBlob() {
+	if rr.blob != nil {
+		rr.blob.Close()
+		rr.blob, rr.index = nil, -1
+	}
+}
+
+func (rr *recordingReader) Close() error {
+	rr.closeBlob()
+	return nil
+}
+
+// recordingContentType returns the type a recording is served as, naming
+// its media type the way browsers expect and keeping parameters such as
+// codecs.
+func recordingContentType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	switch mediaType {
+	case "audio/wave", "audio/x-wav", "audio/vnd.wave":
+		mediaType = "audio/wav"
+	case "audio/mp3", "audio/x-mp3", "audio/mpeg3":
+		mediaType = "audio/mpeg"
+	case "audio/x-m4a", "audio/m4a":
+		mediaType = "audio/mp4"
+	case "audio/x-flac":
+		mediaType = "audio/flac"
+	default:
+		return contentType
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// recordingExtension returns the file extension for a recording's type.
+func recordingExtension(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(recordingContentType(contentType))
+	switch mediaType {
+	case "audio/webm", "video/webm":
+		return ".webm"
+	case "audio/ogg":
+		return ".ogg"
+	case "audio/mp4", "video/mp4":
+		return ".m4a"
+	case "audio/wav":
+		return ".wav"
+	case "audio/mpeg":
+		return ".mp3"
+	case "audio/flac":
+		return ".flac"
+	}
+	return ""
+}
+
+// liveRecordingSink returns the sink for the audio of a live relay that
+// records it, as asked by the "recording" (a transcript ID) and
+// "recording_type" (the audio's type, default audio/webm) query parameters,
+// which it removes from q, counting it under quota. It returns nil if the
+// relay does not record. A
+// relay starts a new recording, so the transcript must not have one yet:
+// another stream appended to it would not play.
+func (s *Server) liveRecordingSink(userKey, quota string, q url.Values) (*recordingSink, error) {
+	if !q.Has("recording") {
+		if q.Has("recording_type") {
+			return nil, endpoint.Error(http.StatusBadRequest, "recording_type needs recording", nil)
+		}
+		return nil, nil
+	}
+	id, contentType := q.Get("recording"), cmp.Or(q.Get("recording_type"), "audio/webm")
+	q.Del("recording")
+	q.Del("recording_type")
+	if !recordingIDPattern.MatchString(id) {
+		return nil, endpoint.Error(http.StatusBadRequest, "invalid recording ID", nil)
+	}
+	contentType, err := recordingAudioType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.recording(userKey, id); ok {
+		return nil, endpoint.Error(http.StatusConflict, "transcript already has a recording", nil)
+	}
+	return &recordingSink{s: s, userKey: userKey, quota: quota, id: id, contentType: contentType}, nil
+}
+
+// recordingSink stores the audio relayed for a transcript, in chunks of
+// about recordingFlushSize. Failures are logged, so that transcription goes
+// on without the recording. Chunks are numbered from 0, so that audio
+// uploaded to the recording meanwhile is not joined with the relay's.
+type recordingSink struct {
+	s           *Server
+	userKey     string
+	quota       string
+	id          string
+	contentType string
+	buf         []byte
+	seq         int
+	failed      bool
+	// started is when the first audio was received, which is when the
+	// recording started rather than when its first chunk is stored.
+	started time.Time
+}
+
+func (k *recordingSink) Write(data []byte) {
+	if k.started.IsZero() {
+		k.started = time.Now().UTC()
+	}
+	k.buf = append(k.buf, data...)
+	if len(k.buf) >= recordingFlushSize {
+		k.Flush()
+	}
+}
+
+// Flush stores the buffered audio.
+func (k *recordingSink) Flush() {
+	if len(k.buf) == 0 || k.failed {
+		return
+	}
+	if _, err := k.s.appendRecording(k.userKey, k.quota, k.id, k.contentType, k.seq, k.buf, k.started); err != nil {
+		log.Printf("Recording %s: failed to store relayed audio, no longer recording: %v", k.id, err)
+		k.failed = true
+	}
+	k.seq++
+	k.buf = k.buf[:0]
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/mnehpets/mtranscribe/backend/blobstore"
+)
+
+// appendChunk uploads a chunk of a recording.
+func appendChunk(t *testing.T, ts *httptest.Server, cookies []*http.Cookie, id string, seq int, contentType string, data []byte) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", ts.URL+"/api/recordings/"+id+"/chunks?seq="+strconv.Itoa(seq), bytes.NewReader(data))
+	req.Header.Set("Content-Type", contentType)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestRecordings(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.DataDir = t.TempDir()
+	s.blobs = blobstore.Open(dataPath(s.cfg, "blobs"))
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	const webm = "audio/webm;codecs=opus"
+	if resp := appendChunk(t, ts, nil, "tr1", 0, webm, []byte("header")); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	// Chunks are stored in order, and retries are stored once.
+	for i, chunk := range []string{"header", "one", "two"} {
+		if resp := appendChunk(t, ts, cookies, "tr1", i, webm, []byte(chunk)); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected chunk %d to be stored, got %d", i, resp.StatusCode)
+		}
+	}
+	if resp := appendChunk(t, ts, cookies, "tr1", 1, webm, []byte("one")); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a retried chunk to be accepted, got %d", resp.StatusCode)
+	}
+	for _, tc := range []struct {
+		name        string
+		id          string
+		seq         int
+		contentType string
+		data        string
+		status      int
+	}{
+		{"different retry", "tr1", 1, webm, "uno", http.StatusConflict},
+		{"gap", "tr1", 5, webm, "five", http.StatusConflict},
+		{"other type", "tr1", 3, "audio/ogg", "three", http.StatusConflict},
+		{"not audio", "tr1", 3, "text/plain", "three", http.StatusUnsupportedMediaType},
+		{"empty", "tr1", 3, webm, "", http.StatusBadRequest},
+		{"bad ID", "tr.1", 0, webm, "x", http.StatusBadRequest},
+	} {
+		if resp := appendChunk(t, ts, cookies, tc.id, tc.seq, tc.contentType, []byte(tc.data)); resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+
+	// The recording is downloaded with its chunks joined.
+	resp := getWithCookies(t, ts, "/api/recordings/tr1", cookies)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "headeronetwo" || resp.Header.Get("Content-Type") != webm || resp.Header.Get("Content-Length") != "12" {
+		t.Errorf("Unexpected recording %q %v", body, resp.Header)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename=tr1.webm` {
+		t.Errorf("Unexpected disposition %s", got)
+	}
+
+	// Ranges may span chunks, so that players can seek.
+	req, _ := http.NewRequest("GET", ts.URL+"/api/recordings/tr1", nil)
+	req.Header.Set("Range", "bytes=4-8")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "erone" || resp.Header.Get("Content-Range") != "bytes 4-8/12" {
+		t.Errorf("Unexpected range %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	req.Header.Set("Range", "bytes=20-")
+	if resp, err := ts.Client().Do(req); err != nil || resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected 416 for a range past the end, got %v", err)
+	}
+	req.Header.Del("Range")
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	if resp, err := ts.Client().Do(req); err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged recording, got %v", err)
+	}
+
+	resp = getWithCookies(t, ts, "/api/recordings", cookies)
+	var list struct {
+		Recordings []recordingInfo `json:"recordings"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Recordings) != 1 || list.Recordings[0].Chunks != 3 || list.Recordings[0].Size != 12 || list.Recordings[0].ExpiresAt != nil {
+		t.Errorf("Unexpected recordings %+v", list.Recordings)
+	}
+	if _, ok := s.recording("user:someone-else", "tr1"); ok {
+		t.Error("Expected other users not to see the recording")
+	}
+
+	// Identical chunks are stored once. Deleting a recording leaves its
+	// chunks to be pruned, keeping those other recordings share.
+	appendChunk(t, ts, cookies, "tr2", 0, webm, []byte("header"))
+	req, _ = http.NewRequest("DELETE", ts.URL+"/api/recordings/tr1", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if resp, err := ts.Client().Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the recording to be deleted, got %v", err)
+	}
+	if resp := getWithCookies(t, ts, "/api/recordings/tr1", cookies); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 after deletion, got %d", resp.StatusCode)
+	}
+	if _, err := s.blobs.Open(blobstore.Digest([]byte("one"))); err != nil {
+		t.Errorf("Expected the recording's chunks to be kept until pruned, got %v", err)
+	}
+	oldGrace := recordingBlobGrace
+	recordingBlobGrace = 0
+	if err := s.pruneRecordings(); err != nil {
+		t.Fatal(err)
+	}
+	recordingBlobGrace = oldGrace
+	if _, err := s.blobs.Open(blobstore.Digest([]byte("one"))); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("Expected the recording's chunks to be pruned, got %v", err)
+	}
+	if _, err := s.blobs.Open(blobstore.Digest([]byte("header"))); err != nil {
+		t.Errorf("Expected the shared chunk to be kept, got %v", err)
+	}
+
+	// Chunks and recordings are limited in size.
+	oldChunk, oldSize := recordingMaxChunk, recordingMaxSize
+	recordingMaxChunk, recordingMaxSize = 8, 10
+	defer func() { recordingMaxChunk, recordingMaxSize = oldChunk, oldSize }()
+	if resp := appendChunk(t, ts, cookies, "tr2", 1, webm, []byte("too large")); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large chunk, got %d", resp.StatusCode)
+	}
+	if resp := appendChunk(t, ts, cookies, "tr2", 1, webm, []byte("large")); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large recording, got %d", resp.StatusCode)
+	}
+}
+
+func TestRecordings_Retention(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.RecordingRetentionDays = 7
+	oldGrace := recordingBlobGrace
+	recordingBlobGrace = 0
+	defer func() { recordingBlobGrace = oldGrace }()
+
+	old, err := s.appendRecording("user:testuser", "user:testuser", "old", "audio/webm", 0, []byte("old audio"), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.UpdatedAt = time.Now().AddDate(0, 0, -8)
+	s.recordings.Put(recordingKey("user:testuser", "old"), old)
+	recent, _ := s.appendRecording("user:testuser", "user:testuser", "recent", "audio/webm", 0, []byte("recent audio"), time.Time{})
+	if info := s.recordingInfo(recent); info.ExpiresAt == nil || info.ExpiresAt.Sub(recent.UpdatedAt) != 7*24*time.Hour {
+		t.Errorf("Unexpected expiry %v", info.ExpiresAt)
+	}
+	orphan, _ := s.blobs.Put([]byte("refused chunk"))
+
+	// Expired recordings are gone at once, and removed with their chunks
+	// and chunks of no recording when pruned.
+	if _, ok := s.recording("user:testuser", "old"); ok {
+		t.Error("Expected the expired recording to be gone")
+	}
+	if err := s.pruneRecordings(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.recordings.Get(recordingKey("user:testuser", "old")); ok {
+		t.Error("Expected the expired recording to be removed")
+	}
+	for _, d := range []string{old.Chunks[0].Digest, orphan} {
+		if _, err := s.blobs.Open(d); !errors.Is(err, blobstore.ErrNotFound) {
+			t.Errorf("Expected chunk %s to be removed, got %v", d, err)
+		}
+	}
+	if _, ok := s.recording("user:testuser", "recent"); !ok {
+		t.Error("Expected the recent recording to be kept")
+	}
+	if _, err := s.blobs.Open(recent.Chunks[0].Digest); err != nil {
+		t.Errorf("Expected the recent recording's chunk to be kept, got %v", err)
+	}
+}
+
+func TestRecordings_Quota(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.RecordingQuotaMB, s.cfg.RecordingStorageMB = 2, 3
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	kb := func(n int) []byte { return bytes.Repeat([]byte("a"), n<<10) }
+
+	// Anonymous sessions share the quota of their address.
+	anon := loginAnonymous(t, ts)
+	if resp := appendChunk(t, ts, anon, "tr1", 0, "audio/webm", kb(1200)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the chunk to be stored, got %d", resp.StatusCode)
+	}
+	if resp := appendChunk(t, ts, loginAnonymous(t, ts), "tr1", 0, "audio/webm", kb(1000)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 over the address's quota, got %d", resp.StatusCode)
+	}
+
+	// Everyone's recordings share the server's storage.
+	cookies := loginWithNotionToken(t, s, ts, "")
+	if resp := appendChunk(t, ts, cookies, "tr1", 0, "audio/webm", kb(1200)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the chunk to be stored, got %d", resp.StatusCode)
+	}
+	if resp := appendChunk(t, ts, cookies, "tr1", 1, "audio/webm", kb(800)); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 over the server's storage, got %d", resp.StatusCode)
+	}
+
+	// Deleted recordings no longer count.
+	if err := s.deleteRecording(recordingKey("user:testuser", "tr1")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := appendChunk(t, ts, cookies, "tr2", 0, "audio/webm", kb(1500)); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the chunk to be stored, got %d", resp.StatusCode)
+	}
+}
+
+func TestRecordings_PruneWhileAppending(t *testing.T) {
+	s := setupTestServer(t)
+	oldGrace := recordingBlobGrace
+	recordingBlobGrace = 0
+	defer func() { recordingBlobGrace = oldGrace }()
+
+	// Chunks being stored are not pruned before they are recorded.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 50 {
+			if _, err := s.appendRecording("user:testuser", "user:testuser", "tr1", "audio/webm", i, []byte("chunk "+strconv.Itoa(i)), time.Time{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for pruning := true; pruning; {
+		select {
+		case <-done:
+			pruning = false
+		default:
+		}
+		if err := s.pruneRecordings(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, _ := s.recording("user:testuser", "tr1")
+	for _, c := range rec.Chunks {
+		if _, err := s.blobs.Open(c.Digest); err != nil {
+			t.Errorf("Expected chunk %s to be kept, got %v", c.Digest, err)
+		}
+	}
+}
+
+func TestLiveTranscribe_Recording(t *testing.T) {
+	fake := newFakeDeepgramStream(t)
+	s := setupTestServer(t)
+	useMockDeepgram(t, s, fake)
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "")
+	header := http.Header{}
+	for _, c := range cookies {
+		header.Add("Cookie", c.String())
+	}
+	ctx := context.Background()
+	dial := func(query string) (*websocket.Conn, *http.Response, error) {
+		return websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/api/transcribe/live?"+query, &websocket.DialOptions{HTTPHeader: header})
+	}
+
+	if _, resp, _ := dial("recording=tr%2F1"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid recording, got %d", resp.StatusCode)
+	}
+
+	// The relayed audio is recorded, and the recording options are not
+	// passed to Deepgram.
+	conn, _, err := dial("recording=tr1&recording_type=audio%2Fogg&model=nova-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := <-fake.queries; q.Has("recording") || q.Has("recording_type") || q.Get("model") != "nova-3" {
+		t.Errorf("Unexpected upstream query %v", q)
+	}
+	// The recording starts with the first audio received, before its
+	// first chunk is stored.
+	started := time.Now()
+	audio := bytes.Repeat([]byte("a"), recordingFlushSize+200)
+	for _, part := range [][]byte{audio[:100], audio[100 : recordingFlushSize+100], audio[recordingFlushSize+100:]} {
+		conn.Write(ctx, websocket.MessageBinary, part)
+		conn.Read(ctx)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+	// Deepgram's connection is closed once the recording is stored.
+	<-fake.closed
+
+	rec, ok := s.recording("user:testuser", "tr1")
+	if !ok || rec.Size != int64(len(audio)) || len(rec.Chunks) != 2 || rec.ContentType != "audio/ogg" {
+		t.Errorf("Unexpected recording %+v", rec)
+	}
+	if rec.StartedAt.Before(started) || !rec.StartedAt.Before(rec.CreatedAt) {
+		t.Errorf("Expected the recording to start before its first chunk was stored, got %+v", rec)
+	}
+
+	// Another relay does not append its stream to the recording, nor to
+	// one uploaded while it relays.
+	if _, resp, _ := dial("recording=tr1"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected 409 for a transcript already recorded, got %d", resp.StatusCode)
+	}
+	sink, err := s.liveRecordingSink("user:testuser", "user:testuser", url.Values{"recording": {"tr2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendChunk(t, ts, cookies, "tr2", 0, "audio/webm", []byte("uploaded"))
+	sink.Write([]byte("relayed"))
+	sink.Flush()
+	if rec, _ := s.recording("user:testuser", "tr2"); len(rec.Chunks) != 1 {
+		t.Errorf("Expected the relayed audio not to be recorded, got %+v", rec)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// defaultSpeakerPattern matches the names speakers are given before anyone
+// renames them, including the frontend's name for an unlabeled speaker.
+var defaultSpeakerPattern = regexp.MustCompile(`^(Speaker ([0-9]+|[A-Z])|Transcription)$`)
+
+// maxTurnSpeech bounds how long a turn is taken to last per word, so that a
+// silence before the next turn is not counted as the turn's speech.
+const maxTurnSpeech = time.Second
+
+// retranscribeRequest is the body of a request to re-transcribe a stored
+// recording.
+type retranscribeRequest struct {
+	// Provider names the provider to use, empty for the user's default.
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Language string `json:"language"`
+	// Diarize defaults to true.
+	Diarize *bool `json:"diarize"`
+	// RecordedAt is when the recording started, for the turns' timestamps.
+	// It defaults to the start stored with the recording.
+	RecordedAt *time.Time `json:"recorded_at"`
+	// Transcript is the version of the transcript being replaced.
+	Transcript *Transcript `json:"transcript"`
+}
+
+// retranscribeRecordingEndpoint transcribes a stored recording again in the
+// background, with another provider, model or options. Once done, the job's
+// transcript is a new version of the transcript in the request, keeping its
+// notes and speaker names.
+func (s *Server) retranscribeRecordingEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	owner, rec, err := s.recordingFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	var body retranscribeRequest
+	if err := decodeTranscriptBody(w, r, &body); err != nil {
+		return nil, err
+	}
+	prev := body.Transcript
+	if prev == nil {
+		return nil, endpoint.Error(http.StatusBadRequest, "transcript is required", nil)
+	}
+	if prev.ID != rec.ID && prev.OriginalID != rec.ID {
+		return nil, endpoint.Error(http.StatusBadRequest, "transcript is not a version of the recording's transcript", nil)
+	}
+	if body.Model != "" && !liveModelPattern.MatchString(body.Model) {
+		return nil, endpoint.Error(http.StatusBadRequest, "invalid model", nil)
+	}
+	if body.Language != "" && !liveLanguagePattern.MatchString(body.Language) {
+		return nil, endpoint.Error(http.StatusBadRequest, "invalid language", nil)
+	}
+	if rec.Size > transcriptionMaxUpload {
+		return nil, endpoint.Error(http.StatusRequestEntityTooLarge, fmt.Sprintf("recordings larger than %d MB cannot be transcribed", transcriptionMaxUpload>>20), nil)
+	}
+
+	contentType := recordingContentType(rec.ContentType)
+	req := transcriptionRequest{
+		Provider:    body.Provider,
+		Title:       cmp.Or(prev.Title, rec.ID),
+		Filename:    rec.ID + recordingExtension(contentType),
+		ContentType: contentType,
+		RecordedAt:  rec.startTime(),
+		Options: transcribe.Options{
+			Language: body.Language,
+			Model:    body.Model,
+			Diarize:  body.Diarize == nil || *body.Diarize,
+		},
+		Previous:    prev,
+		RecordingID: rec.ID,
+	}
+	if body.RecordedAt != nil {
+		req.RecordedAt = body.RecordedAt.UTC()
+	}
+	provider, err := s.batchTranscriber(r, body.Provider)
+	if err != nil {
+		return nil, err
+	}
+	quota := quotaKey(r, owner)
+	release, err := s.transcriptionJobs.reserve(quota)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	audio, err := s.recordingFile(rec)
+	if err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to read recording", err)
+	}
+	j, err := s.transcriptionJobs.start(owner, quota, provider, audio, rec.Size, req)
+	if err != nil {
+		audio.Close()
+		os.Remove(audio.Name())
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: j.snapshot()}, nil
+}
+
+// recordingFile copies a recording to a temporary file, so that it can be
+// transcribed even if the recording is deleted meanwhile.
+func (s *Server) recordingFile(rec recordingRecord) (*os.File, error) {
+	f, err := os.CreateTemp("", "mtranscribe-recording-*")
+	if err != nil {
+		return nil, err
+	}
+	audio := newRecordingReader(s.blobs, rec)
+	defer audio.Close()
+	if _, err := io.Copy(f, audio); err == nil {
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			return f, nil
+		}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil, err
+}
+
+// retranscribedVersion returns the version of prev made from next, a new
+// transcription of its recording. It keeps prev's title, summary, notes and
+// tags, and the turns that were not transcribed, such as typed notes,
+// placed by time among next's turns. Speakers of next who mostly spoke when
+// a renamed speaker of prev did take that speaker's name.
+func retranscribedVersion(prev, next Transcript, recordingID string) Transcript {
+	t := next
+	t.Title = cmp.Or(prev.Title, next.Title)
+	t.Summary, t.Notes, t.Tags = prev.Summary, prev.Notes, prev.Tags
+	t.OriginalID = recordingID
+	t.Version = max(prev.Version, 1) + 1
+
+	names := alignSpeakers(prev.Turns, next.Turns)
+	var kept []Turn
+	for _, turn := range prev.Turns {
+		if !turn.transcribed() {
+			kept = append(kept, turn)
+		}
+	}
+	t.Turns = make([]Turn, 0, len(next.Turns)+len(kept))
+	for _, turn := range next.Turns {
+		for len(kept) > 0 && kept[0].Timestamp.Before(turn.Timestamp) {
+			t.Turns, kept = append(t.Turns, kept[0]), kept[1:]
+		}
+		if name, ok := names[turn.Speaker]; ok {
+			turn.Speaker = name
+		}
+		t.Turns = append(t.Turns, turn)
+	}
+	t.Turns = append(t.Turns, kept...)
+	return t
+}
+
+// turnSpan is the time a transcribed turn's speaker was speaking.
+type turnSpan struct {
+	speaker    string
+	start, end time.Time
+}
+
+// turnSpans returns the spans of the transcribed turns, in order. A turn
+// lasts until the next one starts, but no longer than maxTurnSpeech per
+// word.
+func turnSpans(turns []Turn) []turnSpan {
+	var spans []turnSpan
+	for _, turn := range turns {
+		if !turn.transcribed() || turn.Timestamp.IsZero() {
+			continue
+		}
+		words := len(strings.Fields(turn.content()))
+		spans = append(spans, turnSpan{
+			speaker: turn.Speaker,
+			start:   turn.Timestamp,
+			end:     turn.Timestamp.Add(time.Duration(max(words, 1)) * maxTurnSpeech),
+		})
+	}
+	slices.SortStableFunc(spans, func(a, b turnSpan) int { return a.start.Compare(b.start) })
+	for i := range len(spans) - 1 {
+		if spans[i+1].start.Before(spans[i].end) {
+			spans[i].end = spans[i+1].start
+		}
+	}
+	return spans
+}
+
+// alignSpeakers maps speakers of next to the names given to speakers of
+// prev, by how long they spoke at the same times. A speaker takes a name
+// only if they spoke more than half of their aligned time as that speaker,
+// and each name is given once, to the speaker who spoke as them longest.
+// Speakers whose names were never changed are not mapped.
+func alignSpeakers(prev, next []Turn) map[string]string {
+	type pair struct{ speaker, name string }
+	overlaps := map[pair]time.Duration{}
+	aligned := map[string]time.Duration{}
+	old, cur := turnSpans(prev), turnSpans(next)
+	for i, j := 0, 0; i < len(old) && j < len(cur); {
+		start := maxTime(old[i].start, cur[j].start)
+		end := minTime(old[i].end, cur[j].end)
+		if overlap := end.Sub(start); overlap > 0 && cur[j].speaker != "" {
+			overlaps[pair{cur[j].speaker, old[i].speaker}] += overlap
+			aligned[cur[j].speaker] += overlap
+		}
+		if old[i].end.Before(cur[j].end) {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	var pairs []pair
+	for p := range overlaps {
+		if p.name != "" && !defaultSpeakerPattern.MatchString(p.name) && overlaps[p]*2 > aligned[p.speaker] {
+			pairs = append(pairs, p)
+		}
+	}
+	slices.SortFunc(pairs, func(a, b pair) int {
+		return cmp.Or(cmp.Compare(overlaps[b], overlaps[a]), cmp.Compare(a.speaker, b.speaker), cmp.Compare(a.name, b.name))
+	})
+	names := map[string]string{}
+	taken := map[string]bool{}
+	for _, p := range pairs {
+		if _, ok := names[p.speaker]; !ok && !taken[p.name] {
+			names[p.speaker], taken[p.name] = p.name, true
+		}
+	}
+	return names
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
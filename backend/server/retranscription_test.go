@@ -0,0 +1,204 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
+)
+
+func TestRetranscribe(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.TranscribeProvider = transcribe.ProviderFake
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	if resp := postJSON(t, ts, "/api/recordings/tr1/retranscribe", map[string]any{}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+	cookies := loginWithNotionToken(t, s, ts, "")
+	script := "0: Shall we start?\n1: Yes, the budget first.\n1: And the roadmap.\n"
+	appendChunk(t, ts, cookies, "tr1", 0, "audio/webm", []byte(script[:20]))
+	appendChunk(t, ts, cookies, "tr1", 1, "audio/webm", []byte(script[20:]))
+
+	// The live transcript split the turns differently, and its speaker
+	// 0 was renamed.
+	recordedAt := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	prev := Transcript{
+		ID:    "tr1",
+		Title: "Standup",
+		Notes: "Weekly",
+		Tags:  []string{"team"},
+		Turns: []Turn{
+			{Speaker: "Alice", Text: "Shall we start", Timestamp: recordedAt, Source: "transcribed"},
+			{Speaker: "Speaker 1", Text: "Yes the budget first and the roadmap", Timestamp: recordedAt.Add(1600 * time.Millisecond), Source: "transcribed"},
+			{Speaker: "User", Text: "Check the budget", Timestamp: recordedAt.Add(2 * time.Second), Source: "typed"},
+		},
+	}
+	body := map[string]any{"transcript": prev, "recorded_at": recordedAt, "model": "better"}
+	start := decodeTranscription(t, postJSON(t, ts, "/api/recordings/tr1/retranscribe", body, cookies))
+	if start.Provider != "fake" || start.Filename != "tr1.webm" || start.Size != int64(len(script)) {
+		t.Errorf("Unexpected job %+v", start)
+	}
+	st := waitForTranscription(t, ts, cookies, start.ID)
+	if st.State != transcriptionDone || st.Transcript == nil {
+		t.Fatalf("Expected a transcript, got %+v", st)
+	}
+
+	// The new version keeps the notes and the renamed speaker.
+	tr := st.Transcript
+	if tr.ID != start.ID || tr.OriginalID != "tr1" || tr.Version != 2 || tr.Title != "Standup" || tr.Notes != "Weekly" || len(tr.Tags) != 1 {
+		t.Errorf("Unexpected transcript %+v", tr)
+	}
+	want := []struct{ speaker, text string }{
+		{"Alice", "Shall we start?"},
+		{"Speaker 1", "Yes, the budget first."},
+		{"User", "Check the budget"},
+		{"Speaker 1", "And the roadmap."},
+	}
+	if len(tr.Turns) != len(want) {
+		t.Fatalf("Unexpected turns %+v", tr.Turns)
+	}
+	for i, w := range want {
+		if turn := tr.Turns[i]; turn.Speaker != w.speaker || turn.Text != w.text {
+			t.Errorf("Turn %d: expected %s: %s, got %+v", i, w.speaker, w.text, turn)
+		}
+	}
+	if turn := tr.Turns[3]; turn.Source != "transcribed" || !turn.Timestamp.Equal(recordedAt.Add(3500*time.Millisecond)) {
+		t.Errorf("Unexpected turn %+v", turn)
+	}
+
+	// A later version may be re-transcribed too. Without diarization
+	// there are no speakers to name, but the notes are kept.
+	body = map[string]any{"transcript": tr, "recorded_at": recordedAt, "diarize": false}
+	tr = waitForTranscription(t, ts, cookies, decodeTranscription(t, postJSON(t, ts, "/api/recordings/tr1/retranscribe", body, cookies)).ID).Transcript
+	if tr == nil || tr.Version != 3 || tr.OriginalID != "tr1" || len(tr.Turns) != 4 || tr.Turns[0].Speaker != "" || tr.Turns[2].Source != "typed" {
+		t.Errorf("Unexpected third version %+v", tr)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		body   map[string]any
+		status int
+	}{
+		{"no transcript", "/api/recordings/tr1/retranscribe", map[string]any{}, http.StatusBadRequest},
+		{"other transcript", "/api/recordings/tr1/retranscribe", map[string]any{"transcript": Transcript{ID: "tr2"}}, http.StatusBadRequest},
+		{"bad model", "/api/recordings/tr1/retranscribe", map[string]any{"transcript": prev, "model": "Bad Model"}, http.StatusBadRequest},
+		{"bad language", "/api/recordings/tr1/retranscribe", map[string]any{"transcript": prev, "language": "english!"}, http.StatusBadRequest},
+		{"unknown provider", "/api/recordings/tr1/retranscribe", map[string]any{"transcript": prev, "provider": "whisper"}, http.StatusBadRequest},
+		{"no recording", "/api/recordings/tr2/retranscribe", map[string]any{"transcript": Transcript{ID: "tr2"}}, http.StatusNotFound},
+	} {
+		resp := postJSON(t, ts, tc.path, tc.body, cookies)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestRetranscribe_RecordingStart(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.TranscribeProvider = transcribe.ProviderFake
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	// The recording started long before its first chunk was stored, as
+	// when the client uploads after the meeting.
+	startedAt := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	script := "0: Shall we start?\n1: Yes, the budget first.\n"
+	req, _ := http.NewRequest("POST", ts.URL+"/api/recordings/tr1/chunks?seq=0&started_at="+startedAt.Format(time.RFC3339), strings.NewReader(script))
+	req.Header.Set("Content-Type", "audio/webm")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if rec, _ := s.recording("user:testuser", "tr1"); !rec.StartedAt.Equal(startedAt) || !rec.CreatedAt.After(startedAt) {
+		t.Fatalf("Unexpected recording %+v", rec)
+	}
+
+	// Without recorded_at the new turns are timed from the recording's
+	// start, so the typed note stays between the live turns.
+	prev := Transcript{
+		ID: "tr1",
+		Turns: []Turn{
+			{Speaker: "Speaker 0", Text: "Shall we start", Timestamp: startedAt, Source: "transcribed"},
+			{Speaker: "User", Text: "Check the budget", Timestamp: startedAt.Add(time.Second), Source: "typed"},
+			{Speaker: "Speaker 1", Text: "Yes the budget first", Timestamp: startedAt.Add(1600 * time.Millisecond), Source: "transcribed"},
+		},
+	}
+	start := decodeTranscription(t, postJSON(t, ts, "/api/recordings/tr1/retranscribe", map[string]any{"transcript": prev}, cookies))
+	tr := waitForTranscription(t, ts, cookies, start.ID).Transcript
+	if tr == nil || len(tr.Turns) != 3 {
+		t.Fatalf("Unexpected transcript %+v", tr)
+	}
+	if !tr.Turns[0].Timestamp.Equal(startedAt) || tr.Turns[1].Source != "typed" || !tr.Turns[2].Timestamp.Equal(startedAt.Add(1500*time.Millisecond)) {
+		t.Errorf("Expected turns timed from the recording's start, got %+v", tr.Turns)
+	}
+
+	req, _ = http.NewRequest("POST", ts.URL+"/api/recordings/tr2/chunks?seq=0&started_at=yesterday", strings.NewReader("audio"))
+	req.Header.Set("Content-Type", "audio/webm")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if resp, err = ts.Client().Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid started_at, got %d", resp.StatusCode)
+	}
+}
+
+func TestAlignSpeakers(t *testing.T) {
+	at := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	turn := func(speaker, text string, seconds int) Turn {
+		return Turn{Speaker: speaker, Text: text, Timestamp: at.Add(time.Duration(seconds) * time.Second), Source: "transcribed"}
+	}
+
+	// Renamed speakers follow the voices, whatever the new labels.
+	prev := []Turn{
+		turn("Alice", "one two three", 0),
+		turn("Bob", "four five", 3),
+		turn("Speaker 2", "six", 5),
+		turn("Alice", "seven eight", 6),
+	}
+	next := []Turn{
+		turn("Speaker 1", "one two three", 0),
+		turn("Speaker 0", "four five", 3),
+		turn("Speaker 2", "six", 5),
+		turn("Speaker 1", "seven eight", 6),
+	}
+	names := alignSpeakers(prev, next)
+	if len(names) != 2 || names["Speaker 1"] != "Alice" || names["Speaker 0"] != "Bob" {
+		t.Errorf("Unexpected names %v", names)
+	}
+
+	// A name is given once, to the speaker who spoke as them longest, and
+	// only to a speaker who mostly did.
+	prev = []Turn{turn("Alice", "one two three four five six", 0)}
+	next = []Turn{
+		turn("Speaker 0", "one two", 0),
+		turn("Speaker 1", "three four five six", 2),
+		turn("Speaker 1", "seven eight nine ten eleven", 6),
+	}
+	if names := alignSpeakers(prev, next); len(names) != 1 || names["Speaker 1"] != "Alice" {
+		t.Errorf("Unexpected names %v", names)
+	}
+	prev = []Turn{turn("Alice", "one two three", 0), turn("Speaker 1", "four five six", 3)}
+	next = []Turn{turn("Speaker 0", "three four five six", 2)}
+	if names := alignSpeakers(prev, next); len(names) != 0 {
+		t.Errorf("Expected a speaker mostly not aligned to keep their label, got %v", names)
+	}
+}
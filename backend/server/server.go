@@ -1,15 +1,21 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"crypto/cipher"
 	"encoding/base64"
 	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 
+	"github.com/mnehpets/mtranscribe/backend/blobstore"
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
 	"github.com/mnehpets/oneserve/endpoint"
 	"github.com/mnehpets/oneserve/middleware"
 )
@@ -21,13 +27,73 @@ type Server struct {
 	securityProcessor endpoint.Processor
 	authHandler       http.Handler
 	mux               *http.ServeMux
+
+	// notionExports maps "<user key>/<transcript ID>" to the Notion page the
+	// transcript was exported to.
+	notionExports *jsonStore[notionExportRecord]
+	// notionMappings maps "<user key>/<database ID>" to the property mapping
+	// used when exporting into that database.
+	notionMappings *jsonStore[notionPropertyMapping]
+	// notionWebhook holds the first verification token received for the
+	// Notion webhook subscription, for the operator to configure.
+	notionWebhook *jsonStore[string]
+	// notionRecents maps a user key to the destinations the user recently
+	// exported to.
+	notionRecents *jsonStore[[]recentDestination]
+	// liveSyncs tracks the running live appends to Notion pages.
+	liveSyncs *liveSyncs
+	// liveRelays counts the running live transcription relays.
+	liveRelays *liveRelays
+	// transcriptionJobs tracks the transcriptions of uploaded recordings.
+	transcriptionJobs *transcriptionJobs
+	// transcribeWebhooks wakes transcriptions when their provider's
+	// completion webhook arrives.
+	transcribeWebhooks *transcribe.Webhooks
+	// notionIndexes caches the titles of the Notion objects each user can
+	// see, for search.
+	notionIndexes *notionTitleIndexes
+	// secrets encrypts secrets stored server-side, such as users' Deepgram
+	// API keys.
+	secrets cipher.AEAD
+	// deepgramKeys maps a user key to the user's encrypted Deepgram API key.
+	deepgramKeys *jsonStore[deepgramKeyRecord]
+	// transcriptionSettings maps a user key to the user's choice of
+	// transcription provider.
+	transcriptionSettings *jsonStore[transcriptionSettingsRecord]
+	// recordings maps "<user key>/<transcript ID>" to the chunks of the
+	// audio recorded for the transcript.
+	recordings *jsonStore[recordingRecord]
+	// recordingsMu is held while a chunk is stored and recorded, and while
+	// recordings are pruned, so that a chunk is not pruned before it is
+	// recorded.
+	recordingsMu sync.Mutex
+	// blobs stores the chunks of recordings by content.
+	blobs *blobstore.Store
+	// recordingPeaks caches the waveforms of recordings.
+	recordingPeaks *recordingPeaksCache
+	// notionLog records Notion API calls for the server log and for sessions
+	// debugging their calls.
+	notionLog *notionLogger
+	// notionAPIURL and deepgramAPIURL are the base URLs of the Notion and
+	// Deepgram APIs, without a trailing slash.
+	notionAPIURL   string
+	deepgramAPIURL string
 }
 
 // New creates a new Server instance with the given configuration.
 func New(cfg *Config) (*Server, error) {
 	s := &Server{
-		cfg: cfg,
-		mux: http.NewServeMux(),
+		cfg:                cfg,
+		mux:                http.NewServeMux(),
+		liveSyncs:          newLiveSyncs(),
+		liveRelays:         newLiveRelays(),
+		transcriptionJobs:  newTranscriptionJobs(),
+		transcribeWebhooks: transcribe.NewWebhooks(),
+		notionIndexes:      newNotionTitleIndexes(),
+		recordingPeaks:     newRecordingPeaksCache(),
+		notionLog:          newNotionLogger(cfg),
+		notionAPIURL:       strings.TrimSuffix(cmp.Or(cfg.NotionAPIURL, defaultNotionAPIURL), "/"),
+		deepgramAPIURL:     strings.TrimSuffix(cmp.Or(cfg.DeepgramAPIURL, defaultDeepgramAPIURL), "/"),
 	}
 
 	// Decode session key from base64url
@@ -38,6 +104,9 @@ func New(cfg *Config) (*Server, error) {
 	if len(sessionKey) != 32 {
 		return nil, fmt.Errorf("session key must be 32 bytes, got %d bytes", len(sessionKey))
 	}
+	if s.secrets, err = newSecretsAEAD(sessionKey); err != nil {
+		return nil, fmt.Errorf("failed to create secrets cipher: %w", err)
+	}
 
 	// Determine if we should use secure cookies based on PUBLIC_URL scheme
 	secureCookies := strings.HasPrefix(cfg.PublicURL, "https://")
@@ -73,12 +142,51 @@ func New(cfg *Config) (*Server, error) {
 	// Create common processors
 	processors := []endpoint.Processor{s.securityProcessor, s.sessionProcessor}
 
-	// Setup Notion OAuth
-	authHandler, err := setupNotionAuth(cfg, sessionKey, secureCookies, processors)
+	// Setup Notion OAuth, unless an internal integration token is used for
+	// every session instead or Notion is not configured at all
+	switch {
+	case cfg.NotionIntegrationToken != "":
+		s.authHandler = endpoint.HandleFunc(notionLoginDisabledEndpoint, processors...)
+	case cfg.NotionEnabled():
+		authHandler, err := setupNotionAuth(cfg, s.notionAPIURL, sessionKey, secureCookies, processors)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup Notion auth: %w", err)
+		}
+		s.authHandler = authHandler
+	default:
+		s.authHandler = endpoint.HandleFunc(notionLoginUnavailableEndpoint, processors...)
+	}
+
+	// Open server-side stores
+	s.notionExports, err = openJSONStore[notionExportRecord](dataPath(cfg, "notion_exports.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Notion export store: %w", err)
+	}
+	s.notionMappings, err = openJSONStore[notionPropertyMapping](dataPath(cfg, "notion_mappings.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Notion mapping store: %w", err)
+	}
+	s.notionRecents, err = openJSONStore[[]recentDestination](dataPath(cfg, "notion_recents.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Notion recents store: %w", err)
+	}
+	s.notionWebhook, err = openJSONStore[string](dataPath(cfg, "notion_webhook.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Notion webhook store: %w", err)
+	}
+	s.deepgramKeys, err = openJSONStore[deepgramKeyRecord](dataPath(cfg, "deepgram_keys.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Deepgram key store: %w", err)
+	}
+	s.transcriptionSettings, err = openJSONStore[transcriptionSettingsRecord](dataPath(cfg, "transcription_settings.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open transcription settings store: %w", err)
+	}
+	s.recordings, err = openJSONStore[recordingRecord](dataPath(cfg, "recordings.json"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to setup Notion auth: %w", err)
+		return nil, fmt.Errorf("failed to open recording store: %w", err)
 	}
-	s.authHandler = authHandler
+	s.blobs = blobstore.Open(dataPath(cfg, "blobs"))
 
 	// Setup routes
 	s.setupRoutes(processors)
@@ -100,15 +208,89 @@ func (s *Server) setupRoutes(processors []endpoint.Processor) {
 	// Session management routes (override auth handler for these specific paths)
 	s.mux.Handle("GET /auth/login/anon", endpoint.HandleFunc(loginAnonEndpoint, processors...))
 	s.mux.Handle("GET /auth/logout", endpoint.HandleFunc(logoutEndpoint, processors...))
-	s.mux.Handle("GET /auth/me", endpoint.HandleFunc(meEndpoint, processors...))
+	s.mux.Handle("GET /auth/me", endpoint.HandleFunc(s.meEndpoint, processors...))
+
+	// Transcription settings
+	s.mux.Handle("GET /api/settings/deepgram", endpoint.HandleFunc(s.getDeepgramSettingsEndpoint, processors...))
+	s.mux.Handle("PUT /api/settings/deepgram", endpoint.HandleFunc(s.putDeepgramSettingsEndpoint, processors...))
+	s.mux.Handle("DELETE /api/settings/deepgram", endpoint.HandleFunc(s.deleteDeepgramSettingsEndpoint, processors...))
+	s.mux.Handle("GET /api/settings/transcription", endpoint.HandleFunc(s.getTranscriptionSettingsEndpoint, processors...))
+	s.mux.Handle("PUT /api/settings/transcription", endpoint.HandleFunc(s.putTranscriptionSettingsEndpoint, processors...))
+	s.mux.Handle("DELETE /api/settings/transcription", endpoint.HandleFunc(s.deleteTranscriptionSettingsEndpoint, processors...))
+	s.mux.Handle("POST /api/deepgram/token", endpoint.HandleFunc(s.deepgramTokenEndpoint, processors...))
+	s.mux.Handle("GET /api/transcribe/live", endpoint.HandleFunc(s.liveTranscribeEndpoint, processors...))
+	s.mux.Handle("POST /api/transcriptions", endpoint.HandleFunc(s.createTranscriptionEndpoint, processors...))
+	s.mux.Handle("GET /api/transcriptions/{id}", endpoint.HandleFunc(s.transcriptionStatusEndpoint, processors...))
+	s.mux.Handle("DELETE /api/transcriptions/{id}", endpoint.HandleFunc(s.deleteTranscriptionEndpoint, processors...))
+
+	// Recorded audio
+	s.mux.Handle("GET /api/recordings", endpoint.HandleFunc(s.listRecordingsEndpoint, processors...))
+	s.mux.Handle("GET /api/recordings/{id}", endpoint.HandleFunc(s.getRecordingEndpoint, processors...))
+	s.mux.Handle("DELETE /api/recordings/{id}", endpoint.HandleFunc(s.deleteRecordingEndpoint, processors...))
+	s.mux.Handle("POST /api/recordings/{id}/chunks", endpoint.HandleFunc(s.appendRecordingEndpoint, processors...))
+	s.mux.Handle("GET /api/recordings/{id}/peaks", endpoint.HandleFunc(s.recordingPeaksEndpoint, processors...))
+	s.mux.Handle("POST /api/recordings/{id}/retranscribe", endpoint.HandleFunc(s.retranscribeRecordingEndpoint, processors...))
+
+	// AssemblyAI's completion webhook comes from AssemblyAI, without a
+	// session.
+	s.mux.Handle("POST /api/transcribe/assemblyai/webhook", endpoint.HandleFunc(s.assemblyAIWebhookEndpoint, s.securityProcessor))
+
+	// Notion routes below report that Notion is not configured when it is
+	// disabled, except conversion, which does not call Notion. Their Notion
+	// calls are logged when logging is on for the server or session.
+	notionProcessors := append(slices.Clip(processors), s.notionLog)
 
 	// Notion Proxy
-	s.mux.Handle("/api/notion/{path...}", endpoint.HandleFunc(s.notionProxyEndpoint, processors...))
+	s.mux.Handle("/api/notion/{path...}", s.notionRoute(endpoint.HandleFunc(s.notionProxyEndpoint, notionProcessors...)))
+	s.mux.Handle("POST /api/notion/batch", s.notionRoute(endpoint.HandleFunc(s.notionBatchEndpoint, notionProcessors...)))
+
+	// Notion hierarchy built server-side
+	s.mux.Handle("GET /api/notion-tree", s.notionRoute(endpoint.HandleFunc(s.notionTreeEndpoint, notionProcessors...)))
+	s.mux.Handle("GET /api/notion/search", s.notionRoute(endpoint.HandleFunc(s.notionSearchEndpoint, notionProcessors...)))
+
+	// Recent Notion calls of the session, for debugging
+	s.mux.Handle("GET /api/notion/debug", s.notionRoute(endpoint.HandleFunc(s.notionDebugEndpoint, processors...)))
+	s.mux.Handle("PUT /api/notion/debug", s.notionRoute(endpoint.HandleFunc(s.putNotionDebugEndpoint, processors...)))
+
+	// Transcript export
+	s.mux.Handle("POST /api/export/notion", s.notionRoute(endpoint.HandleFunc(s.notionExportEndpoint, notionProcessors...)))
+	s.mux.Handle("GET /api/export/notion/{transcript_id}", s.notionRoute(endpoint.HandleFunc(s.notionExportStatusEndpoint, notionProcessors...)))
+	s.mux.Handle("POST /api/notion/convert", endpoint.HandleFunc(s.notionConvertEndpoint, processors...))
+
+	// Page content import
+	s.mux.Handle("GET /api/notion/pages/{id}/markdown", s.notionRoute(endpoint.HandleFunc(s.notionPageMarkdownEndpoint, notionProcessors...)))
+	s.mux.Handle("GET /api/notion/mappings/{database_id}", s.notionRoute(endpoint.HandleFunc(s.getPropertyMappingEndpoint, notionProcessors...)))
+	s.mux.Handle("PUT /api/notion/mappings/{database_id}", s.notionRoute(endpoint.HandleFunc(s.putPropertyMappingEndpoint, notionProcessors...)))
+	s.mux.Handle("DELETE /api/notion/mappings/{database_id}", s.notionRoute(endpoint.HandleFunc(s.deletePropertyMappingEndpoint, notionProcessors...)))
+
+	// Live append of finalized turns while recording
+	s.mux.Handle("POST /api/notion/live", s.notionRoute(endpoint.HandleFunc(s.startLiveSyncEndpoint, notionProcessors...)))
+	s.mux.Handle("GET /api/notion/live/{id}", s.notionRoute(endpoint.HandleFunc(s.liveSyncStatusEndpoint, notionProcessors...)))
+	s.mux.Handle("POST /api/notion/live/{id}/turns", s.notionRoute(endpoint.HandleFunc(s.liveSyncTurnsEndpoint, notionProcessors...)))
+	s.mux.Handle("DELETE /api/notion/live/{id}", s.notionRoute(endpoint.HandleFunc(s.stopLiveSyncEndpoint, notionProcessors...)))
+
+	// Notion webhook events, authenticated by signature rather than session
+	s.mux.Handle("POST /api/notion/webhook", s.notionRoute(endpoint.HandleFunc(s.notionWebhookEndpoint, s.securityProcessor)))
 
 	// 3. File system endpoint - serves static assets (catch-all for everything else)
 	s.mux.HandleFunc("/", endpoint.HandleFunc(s.fileSystemEndpoint, processors...))
 }
 
+// notionRoute returns h if the Notion integration is configured, and
+// otherwise a handler that responds 501 Not Implemented.
+func (s *Server) notionRoute(h http.Handler) http.Handler {
+	if s.cfg.NotionEnabled() {
+		return h
+	}
+	return endpoint.HandleFunc(notionUnavailableEndpoint, s.securityProcessor)
+}
+
+// notionUnavailableEndpoint responds to Notion routes when Notion is not
+// configured.
+func notionUnavailableEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	return nil, endpoint.Error(http.StatusNotImplemented, "Notion integration is not configured on this server", nil)
+}
+
 // rootRedirectEndpoint redirects root to /u/ to avoid double redirect.
 func (s *Server) rootRedirectEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
 	return &endpoint.RedirectRenderer{URL: "/u/", Status: http.StatusFound}, nil
@@ -152,6 +334,7 @@ func (s *Server) ListenAndServe() error {
 	log.Printf("Server starting on %s", addr)
 	log.Printf("Public URL: %s", s.cfg.PublicURL)
 	log.Printf("Frontend directory: %s", s.cfg.FrontendDir)
+	go s.pruneRecordingsEvery(recordingPruneInterval)
 	return http.ListenAndServe(addr, s.mux)
 }
 
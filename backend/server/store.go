@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// jsonStore is a concurrency-safe map of records, persisted as a single JSON
+// file. A store with an empty path keeps its records in memory only.
+type jsonStore[T any] struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]T
+}
+
+// openJSONStore opens the store persisted at path, creating it if it does
+// not exist. An empty path opens an in-memory store.
+func openJSONStore[T any](path string) (*jsonStore[T], error) {
+	s := &jsonStore[T]{path: path, records: make(map[string]T)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, fmt.Errorf("failed to parse store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// dataPath returns the path of a store file in the configured data
+// directory, or "" for an in-memory store when no directory is configured.
+func dataPath(cfg *Config, name string) string {
+	if cfg.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(cfg.DataDir, name)
+}
+
+// Get returns the record stored under key.
+func (s *jsonStore[T]) Get(key string) (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.records[key]
+	return v, ok
+}
+
+// Put stores v under key and persists the store.
+func (s *jsonStore[T]) Put(key string, v T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = v
+	return s.save()
+}
+
+// Delete removes the record stored under key and persists the store.
+func (s *jsonStore[T]) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+	delete(s.records, key)
+	return s.save()
+}
+
+// Update atomically replaces the record stored under key with the result of
+// fn. If fn returns an error the store is left unchanged.
+func (s *jsonStore[T]) Update(key string, fn func(v T, ok bool) (T, error)) (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.records[key]
+	v, err := fn(old, ok)
+	if err != nil {
+		return old, err
+	}
+	s.records[key] = v
+	if err := s.save(); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// Keys returns the keys of all records in sorted order.
+func (s *jsonStore[T]) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.records))
+	for k := range s.records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save writes the records to disk. The file is replaced atomically so a crash
+// never leaves a partially written store. s.mu must be held.
+func (s *jsonStore[T]) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.records)
+	if err != nil {
+		return fmt.Errorf("failed to encode store: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "records.json")
+
+	store, err := openJSONStore[notionExportRecord](path)
+	if err != nil {
+		t.Fatalf("openJSONStore failed: %v", err)
+	}
+	if err := store.Put("a", notionExportRecord{PageID: "page-a"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put("b", notionExportRecord{PageID: "page-b"}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	reopened, err := openJSONStore[notionExportRecord](path)
+	if err != nil {
+		t.Fatalf("Reopening store failed: %v", err)
+	}
+	if rec, ok := reopened.Get("a"); !ok || rec.PageID != "page-a" {
+		t.Errorf("Expected record a to persist, got %+v (found=%v)", rec, ok)
+	}
+	if _, ok := reopened.Get("b"); ok {
+		t.Error("Expected record b to be deleted")
+	}
+	if keys := reopened.Keys(); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+}
+
+func TestJSONStore_Update(t *testing.T) {
+	store, err := openJSONStore[int]("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inc := func(v int, _ bool) (int, error) { return v + 1, nil }
+	store.Update("n", inc)
+	if v, _ := store.Update("n", inc); v != 2 {
+		t.Errorf("Expected 2, got %d", v)
+	}
+
+	failed := errors.New("failed")
+	if _, err := store.Update("n", func(int, bool) (int, error) { return 0, failed }); err != failed {
+		t.Errorf("Expected update error, got %v", err)
+	}
+	if v, _ := store.Get("n"); v != 2 {
+		t.Errorf("Failed update should leave the record unchanged, got %d", v)
+	}
+}
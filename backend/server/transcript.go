@@ -0,0 +1,47 @@
+package server
+
+import "time"
+
+// Transcript mirrors the frontend's Transcript model as sent in JSON.
+type Transcript struct {
+	// ID identifies the transcript across exports. It is optional; exports of
+	// transcripts without an ID always create a new Notion page.
+	ID      string `json:"id,omitempty"`
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+	Notes   string `json:"notes"`
+	Turns   []Turn `json:"turns"`
+	// Tags are free-form labels, written to Notion database properties when
+	// a property mapping is configured.
+	Tags []string `json:"tags,omitempty"`
+	// OriginalID and Version link a transcript re-transcribed from a stored
+	// recording to the transcript the recording was made for, whose version
+	// is 1.
+	OriginalID string `json:"original_id,omitempty"`
+	Version    int    `json:"version,omitempty"`
+}
+
+// Turn is a single speaker turn within a Transcript.
+type Turn struct {
+	Speaker   string    `json:"speaker"`
+	Text      string    `json:"text"`
+	Interim   string    `json:"interim,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Source is one of "transcribed", "typed" or "generated".
+	Source string `json:"source,omitempty"`
+}
+
+// transcribed reports whether the turn was transcribed from audio. Turns
+// without a source are taken to be.
+func (t Turn) transcribed() bool {
+	return t.Source == "" || t.Source == "transcribed"
+}
+
+// content returns the turn's stable text, falling back to its interim text
+// as the Markdown renderer does.
+func (t Turn) content() string {
+	if t.Text != "" {
+		return t.Text
+	}
+	return t.Interim
+}
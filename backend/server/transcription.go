@@ -0,0 +1,233 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// newBatchTranscriber creates batch providers. Tests replace it to slow
+// providers down.
+var newBatchTranscriber = transcribe.NewBatch
+
+// transcriptionSettingsRecord is a user's choice of transcription provider.
+type transcriptionSettingsRecord struct {
+	Provider  string    `json:"provider"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// transcriptionSettings reports the user's choice of transcription provider.
+type transcriptionSettings struct {
+	// Provider is the user's choice, empty for the server's default.
+	Provider string `json:"provider"`
+	// Default is the server's provider.
+	Default string `json:"default"`
+	// Providers lists the providers the user can choose.
+	Providers []string `json:"providers"`
+}
+
+// transcriptionProvider returns the provider the user transcribes with by
+// default: the one they chose, or else the server's.
+func (s *Server) transcriptionProvider(userKey string) string {
+	if rec, ok := s.transcriptionSettings.Get(userKey); ok && transcribe.Known(rec.Provider) && rec.Provider != "" {
+		return rec.Provider
+	}
+	return cmp.Or(s.cfg.TranscribeProvider, transcribe.ProviderDeepgram)
+}
+
+// serverProvidersAllowed reports whether the user may transcribe with the
+// server's providers and keys. Anyone can start an anonymous session, so
+// anonymous sessions may only if configured to.
+func (s *Server) serverProvidersAllowed(userKey string) bool {
+	return !strings.HasPrefix(userKey, "session:") || s.cfg.TranscribeAllowAnonymous
+}
+
+// providerAvailable reports whether the user can transcribe with the named
+// provider: Deepgram if the user has a key or may use the server's, and
+// otherwise, for users allowed the server's providers, OpenAI and AssemblyAI
+// if they are configured, and any provider the server uses by default if it
+// needs no key.
+func (s *Server) providerAvailable(userKey, name string) bool {
+	if name == transcribe.ProviderDeepgram {
+		return s.deepgramSettings(userKey).Available
+	}
+	if !s.serverProvidersAllowed(userKey) {
+		return false
+	}
+	switch name {
+	case transcribe.ProviderOpenAI:
+		return name == s.cfg.TranscribeProvider || s.cfg.OpenAIAPIKey != "" || s.cfg.OpenAIAPIURL != ""
+	case transcribe.ProviderAssemblyAI:
+		return s.cfg.AssemblyAIAPIKey != ""
+	}
+	return name == s.cfg.TranscribeProvider
+}
+
+// transcribeConfig returns the configuration of the named transcription
+// provider for the request's session, or of the session's default provider
+// if provider is empty. Deepgram uses the session's Deepgram key, and other
+// providers the server's configuration. It fails with 401 if the session is
+// not logged in or may not use the provider, 400 for an unknown provider,
+// and 501 if the provider is not configured.
+func (s *Server) transcribeConfig(r *http.Request, provider string) (transcribe.Config, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return transcribe.Config{}, err
+	}
+	if provider == "" {
+		provider = s.transcriptionProvider(userKey)
+	} else if !transcribe.Known(provider) {
+		return transcribe.Config{}, endpoint.Error(http.StatusBadRequest, fmt.Sprintf("unknown transcription provider %q", provider), nil)
+	}
+	cfg := transcribe.Config{Provider: provider}
+	if provider != transcribe.ProviderDeepgram && !s.serverProvidersAllowed(userKey) {
+		return cfg, endpoint.Error(http.StatusUnauthorized, fmt.Sprintf("transcription with %q requires a named login", provider), nil)
+	}
+	if provider != transcribe.ProviderDeepgram && !s.providerAvailable(userKey, provider) {
+		return cfg, endpoint.Error(http.StatusNotImplemented, fmt.Sprintf("transcription provider %q is not configured", provider), nil)
+	}
+	switch provider {
+	case transcribe.ProviderDeepgram:
+		key, _, err := s.deepgramKey(r)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.APIKey, cfg.BaseURL = key, s.deepgramAPIURL
+	case transcribe.ProviderOpenAI:
+		cfg.APIKey, cfg.BaseURL, cfg.Model = s.cfg.OpenAIAPIKey, s.cfg.OpenAIAPIURL, s.cfg.OpenAITranscribeModel
+	case transcribe.ProviderAssemblyAI:
+		cfg.APIKey, cfg.BaseURL = s.cfg.AssemblyAIAPIKey, s.cfg.AssemblyAIAPIURL
+		if s.cfg.AssemblyAIWebhook {
+			cfg.WebhookURL = strings.TrimSuffix(s.cfg.PublicURL, "/") + "/api/transcribe/assemblyai/webhook"
+			cfg.Webhooks = s.transcribeWebhooks
+		}
+	}
+	return cfg, nil
+}
+
+// batchTranscriber returns the named batch transcription provider for the
+// request's session, or its default provider if provider is empty.
+func (s *Server) batchTranscriber(r *http.Request, provider string) (transcribe.BatchProvider, error) {
+	cfg, err := s.transcribeConfig(r, provider)
+	if err != nil {
+		return nil, err
+	}
+	return newBatchTranscriber(cfg)
+}
+
+// transcriptionAvailable reports whether the user can use their default
+// transcription provider.
+func (s *Server) transcriptionAvailable(userKey string) bool {
+	return s.providerAvailable(userKey, s.transcriptionProvider(userKey))
+}
+
+func (s *Server) transcriptionSettingsFor(userKey string) transcriptionSettings {
+	settings := transcriptionSettings{Default: cmp.Or(s.cfg.TranscribeProvider, transcribe.ProviderDeepgram), Providers: []string{}}
+	if rec, ok := s.transcriptionSettings.Get(userKey); ok {
+		settings.Provider = rec.Provider
+	}
+	for _, name := range transcribe.Providers() {
+		if s.providerAvailable(userKey, name) {
+			settings.Providers = append(settings.Providers, name)
+		}
+	}
+	return settings
+}
+
+// getTranscriptionSettingsEndpoint reports the user's choice of provider and
+// the providers they can choose.
+func (s *Server) getTranscriptionSettingsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: s.transcriptionSettingsFor(userKey)}, nil
+}
+
+// putTranscriptionSettingsEndpoint sets the provider the user transcribes
+// with by default.
+func (s *Server) putTranscriptionSettingsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		Provider string `json:"provider"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	if req.Provider == "" || !transcribe.Known(req.Provider) || !s.providerAvailable(userKey, req.Provider) {
+		return nil, endpoint.Error(http.StatusBadRequest, "provider is not available", nil)
+	}
+	rec := transcriptionSettingsRecord{Provider: req.Provider, UpdatedAt: time.Now().UTC()}
+	if err := s.transcriptionSettings.Put(userKey, rec); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to store transcription settings", err)
+	}
+	return &endpoint.JSONRenderer{Value: s.transcriptionSettingsFor(userKey)}, nil
+}
+
+// deleteTranscriptionSettingsEndpoint removes the user's choice of provider,
+// so that the server's is used.
+func (s *Server) deleteTranscriptionSettingsEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	userKey, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.transcriptionSettings.Delete(userKey); err != nil {
+		return nil, endpoint.Error(http.StatusInternalServerError, "failed to remove transcription settings", err)
+	}
+	return &endpoint.JSONRenderer{Value: s.transcriptionSettingsFor(userKey)}, nil
+}
+
+// assemblyAIWebhookEndpoint receives AssemblyAI's completion webhooks and
+// wakes the transcription waiting for the transcript. The webhook is not
+// authenticated: a forged one only makes the transcription poll early.
+func (s *Server) assemblyAIWebhookEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	var event struct {
+		TranscriptID string `json:"transcript_id"`
+		Status       string `json:"status"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes)).Decode(&event); err != nil || event.TranscriptID == "" {
+		return nil, endpoint.Error(http.StatusBadRequest, "invalid webhook", err)
+	}
+	if !s.transcribeWebhooks.Notify(transcribe.ProviderAssemblyAI, event.TranscriptID) {
+		log.Printf("AssemblyAI webhook for unknown transcript %s (%s)", event.TranscriptID, event.Status)
+	}
+	return &endpoint.JSONRenderer{Value: map[string]any{}}, nil
+}
+
+// transcriptFromResult converts a provider's transcript into a Transcript
+// with a turn per segment, timed from start.
+func transcriptFromResult(id, title string, result *transcribe.Transcript, start time.Time) Transcript {
+	t := Transcript{ID: id, Title: title, Turns: []Turn{}}
+	for _, seg := range result.Segments {
+		if seg.Text == "" {
+			continue
+		}
+		t.Turns = append(t.Turns, Turn{
+			Speaker:   speakerLabel(seg.Speaker),
+			Text:      seg.Text,
+			Timestamp: start.Add(seg.Start),
+			Source:    "transcribed",
+		})
+	}
+	return t
+}
+
+// speakerLabel returns the name shown for a provider's speaker label.
+// Numbered and lettered speakers are named as the frontend names Deepgram's.
+func speakerLabel(speaker string) string {
+	if _, err := strconv.Atoi(speaker); err == nil || (len(speaker) == 1 && 'A' <= speaker[0] && speaker[0] <= 'Z') {
+		return "Speaker " + speaker
+	}
+	return speaker
+}
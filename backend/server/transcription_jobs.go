@@ -0,0 +1,422 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
+	"github.com/mnehpets/oneserve/endpoint"
+)
+
+// Transcription job limits. These are variables so tests can lower them.
+var (
+	// transcriptionMaxUpload bounds the size of an uploaded recording.
+	transcriptionMaxUpload int64 = 500 << 20
+	// transcriptionJobTimeout bounds how long a provider may take.
+	transcriptionJobTimeout = time.Hour
+	// transcriptionJobRetention is how long finished jobs are kept.
+	transcriptionJobRetention = 24 * time.Hour
+)
+
+// maxTranscriptionJobsPerUser limits the number of running jobs per user,
+// counted by quotaKey.
+const maxTranscriptionJobsPerUser = 2
+
+// maxTranscriptionField bounds the size of the upload's form fields.
+const maxTranscriptionField = 1024
+
+// Transcription job states.
+const (
+	transcriptionRunning  = "running"
+	transcriptionDone     = "done"
+	transcriptionFailed   = "failed"
+	transcriptionCanceled = "canceled"
+)
+
+// transcriptionStatus reports the progress of a transcription job, and its
+// transcript once done.
+type transcriptionStatus struct {
+	ID         string      `json:"id"`
+	State      string      `json:"state"`
+	Provider   string      `json:"provider"`
+	Filename   string      `json:"filename"`
+	Size       int64       `json:"size"`
+	CreatedAt  time.Time   `json:"created_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Transcript *Transcript `json:"transcript,omitempty"`
+}
+
+// transcriptionRequest describes an uploaded recording to transcribe.
+type transcriptionRequest struct {
+	// Provider names the provider to use, empty for the user's default.
+	Provider    string
+	Title       string
+	Filename    string
+	ContentType string
+	// RecordedAt is when the recording started, for the turns' timestamps.
+	RecordedAt time.Time
+	Options    transcribe.Options
+	// Previous is the transcript a stored recording is re-transcribed for,
+	// whose notes and speaker names the new version keeps.
+	Previous *Transcript
+	// RecordingID names the stored recording being re-transcribed.
+	RecordingID string
+}
+
+// transcriptionJob transcribes an uploaded recording in the background.
+type transcriptionJob struct {
+	id     string
+	owner  string
+	quota  string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	status transcriptionStatus
+}
+
+// transcriptionJobs tracks transcription jobs, running and recently
+// finished.
+type transcriptionJobs struct {
+	mu   sync.Mutex
+	byID map[string]*transcriptionJob
+	// reserved counts the slots taken by reserve for jobs whose audio is
+	// still being read, by quota.
+	reserved map[string]int
+}
+
+func newTranscriptionJobs() *transcriptionJobs {
+	return &transcriptionJobs{byID: make(map[string]*transcriptionJob), reserved: make(map[string]int)}
+}
+
+// reserve takes a job slot for quota, so that the limit is checked before a
+// job's audio is read. The returned function gives the slot back, once the
+// job has started or failed to.
+func (m *transcriptionJobs) reserve(quota string) (release func(), err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	running := m.reserved[quota]
+	for id, j := range m.byID {
+		st := j.snapshot()
+		if st.FinishedAt != nil && time.Since(*st.FinishedAt) > transcriptionJobRetention {
+			delete(m.byID, id)
+			continue
+		}
+		if j.quota == quota && st.State == transcriptionRunning {
+			running++
+		}
+	}
+	if running >= maxTranscriptionJobsPerUser {
+		return nil, endpoint.Error(http.StatusTooManyRequests, "too many transcriptions in progress", nil)
+	}
+	m.reserved[quota]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.reserved[quota]--; m.reserved[quota] <= 0 {
+				delete(m.reserved, quota)
+			}
+		})
+	}, nil
+}
+
+// start creates a job for owner, counted against quota, that transcribes
+// audio with provider, and removes audio once done. The caller holds a slot
+// taken by reserve, and releases it once start returns.
+func (m *transcriptionJobs) start(owner, quota string, provider transcribe.BatchProvider, audio *os.File, size int64, req transcriptionRequest) (*transcriptionJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transcriptionJobTimeout)
+	j := &transcriptionJob{
+		id:     hex.EncodeToString(b),
+		owner:  owner,
+		quota:  quota,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	j.status = transcriptionStatus{
+		ID:        j.id,
+		State:     transcriptionRunning,
+		Provider:  provider.Name(),
+		Filename:  req.Filename,
+		Size:      size,
+		CreatedAt: time.Now().UTC(),
+	}
+	m.byID[j.id] = j
+
+	go j.run(ctx, provider, audio, req)
+	return j, nil
+}
+
+// get returns the job with the given ID if it belongs to owner.
+func (m *transcriptionJobs) get(owner, id string) (*transcriptionJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.byID[id]
+	if !ok || j.owner != owner {
+		return nil, false
+	}
+	return j, true
+}
+
+// remove forgets a job.
+func (m *transcriptionJobs) remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.byID, id)
+}
+
+// snapshot returns a copy of the job's status.
+func (j *transcriptionJob) snapshot() transcriptionStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// run transcribes the recording and records the outcome.
+func (j *transcriptionJob) run(ctx context.Context, provider transcribe.BatchProvider, audio *os.File, req transcriptionRequest) {
+	defer close(j.done)
+	defer j.cancel()
+	defer os.Remove(audio.Name())
+	defer audio.Close()
+
+	result, err := provider.Transcribe(ctx, audio, req.ContentType, req.Options)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now().UTC()
+	j.status.FinishedAt = &now
+	switch {
+	case err == nil:
+		t := transcriptFromResult(j.id, req.Title, result, req.RecordedAt)
+		if req.Previous != nil {
+			t = retranscribedVersion(*req.Previous, t, req.RecordingID)
+		}
+		j.status.State, j.status.Transcript = transcriptionDone, &t
+	case errors.Is(err, context.Canceled):
+		j.status.State = transcriptionCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		j.status.State, j.status.Error = transcriptionFailed, "transcription timed out"
+	default:
+		j.status.State, j.status.Error = transcriptionFailed, err.Error()
+	}
+}
+
+// createTranscriptionEndpoint accepts an uploaded recording and starts
+// transcribing it in the background. The multipart form has optionally
+// "provider" (default the user's), "title", "language", "model", "diarize"
+// (default true) and "recorded_at" (RFC 3339), followed by the recording as
+// "file".
+func (s *Server) createTranscriptionEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	owner, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	quota := quotaKey(r, owner)
+	var provider transcribe.BatchProvider
+	var release func()
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+	audio, size, req, err := readTranscriptionUpload(w, r, func(req transcriptionRequest) (err error) {
+		// Refuse the upload before storing it if it cannot be transcribed.
+		if provider, err = s.batchTranscriber(r, req.Provider); err != nil {
+			return err
+		}
+		release, err = s.transcriptionJobs.reserve(quota)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	j, err := s.transcriptionJobs.start(owner, quota, provider, audio, size, req)
+	if err != nil {
+		audio.Close()
+		os.Remove(audio.Name())
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: j.snapshot()}, nil
+}
+
+// readTranscriptionUpload reads an uploaded recording into a temporary file,
+// along with the options sent before it. prepare is called with the options
+// before the recording is read, and may refuse it.
+func readTranscriptionUpload(w http.ResponseWriter, r *http.Request, prepare func(transcriptionRequest) error) (audio *os.File, size int64, req transcriptionRequest, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, transcriptionMaxUpload)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, 0, req, endpoint.Error(http.StatusBadRequest, "expected a multipart/form-data upload", err)
+	}
+	defer func() {
+		if err != nil && audio != nil {
+			audio.Close()
+			os.Remove(audio.Name())
+			audio = nil
+		}
+	}()
+
+	req.Options.Diarize = true
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, req, uploadError(err)
+		}
+		if audio != nil {
+			return nil, 0, req, endpoint.Error(http.StatusBadRequest, "file must be the last part of the upload", nil)
+		}
+		name := part.FormName()
+		if name != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, maxTranscriptionField+1))
+			if err != nil {
+				return nil, 0, req, uploadError(err)
+			}
+			if len(value) > maxTranscriptionField {
+				return nil, 0, req, endpoint.Error(http.StatusBadRequest, fmt.Sprintf("%s is too long", name), nil)
+			}
+			if err := req.setUploadField(name, string(value)); err != nil {
+				return nil, 0, req, err
+			}
+			continue
+		}
+
+		req.Filename = path.Base(strings.ReplaceAll(part.FileName(), `\`, "/"))
+		req.ContentType = part.Header.Get("Content-Type")
+		if mediaType, _, _ := mime.ParseMediaType(req.ContentType); req.ContentType != "" &&
+			!strings.HasPrefix(mediaType, "audio/") && !strings.HasPrefix(mediaType, "video/") && mediaType != "application/octet-stream" {
+			return nil, 0, req, endpoint.Error(http.StatusUnsupportedMediaType, "file must be audio or video", nil)
+		}
+		if err := prepare(req); err != nil {
+			return nil, 0, req, err
+		}
+		if audio, err = os.CreateTemp("", "mtranscribe-upload-*"); err != nil {
+			return nil, 0, req, endpoint.Error(http.StatusInternalServerError, "failed to store upload", err)
+		}
+		if size, err = io.Copy(audio, part); err != nil {
+			return nil, 0, req, uploadError(err)
+		}
+	}
+	if audio == nil || size == 0 {
+		return nil, 0, req, endpoint.Error(http.StatusBadRequest, "file is required", nil)
+	}
+	if _, err := audio.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, req, endpoint.Error(http.StatusInternalServerError, "failed to store upload", err)
+	}
+
+	if req.Title == "" {
+		req.Title = strings.TrimSuffix(req.Filename, path.Ext(req.Filename))
+	}
+	if req.RecordedAt.IsZero() {
+		req.RecordedAt = time.Now().UTC()
+	}
+	return audio, size, req, nil
+}
+
+// setUploadField sets the option named by a field of an upload.
+func (req *transcriptionRequest) setUploadField(name, value string) error {
+	var err error
+	switch name {
+	case "title":
+		req.Title = strings.TrimSpace(value)
+	case "provider":
+		if !transcribe.Known(value) || value == "" {
+			return endpoint.Error(http.StatusBadRequest, fmt.Sprintf("unknown transcription provider %q", value), nil)
+		}
+		req.Provider = value
+	case "language":
+		if !liveLanguagePattern.MatchString(value) {
+			return endpoint.Error(http.StatusBadRequest, "invalid language", nil)
+		}
+		req.Options.Language = value
+	case "model":
+		if !liveModelPattern.MatchString(value) {
+			return endpoint.Error(http.StatusBadRequest, "invalid model", nil)
+		}
+		req.Options.Model = value
+	case "diarize":
+		if req.Options.Diarize, err = strconv.ParseBool(value); err != nil {
+			return endpoint.Error(http.StatusBadRequest, "diarize must be true or false", nil)
+		}
+	case "recorded_at":
+		if req.RecordedAt, err = time.Parse(time.RFC3339, value); err != nil {
+			return endpoint.Error(http.StatusBadRequest, "recorded_at must be an RFC 3339 time", nil)
+		}
+	default:
+		return endpoint.Error(http.StatusBadRequest, fmt.Sprintf("unsupported field %q", name), nil)
+	}
+	return nil
+}
+
+// uploadError returns the error for a failed read of an upload.
+func uploadError(err error) error {
+	if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+		return endpoint.Error(http.StatusRequestEntityTooLarge, fmt.Sprintf("file is larger than %d MB", transcriptionMaxUpload>>20), err)
+	}
+	return endpoint.Error(http.StatusBadRequest, "failed to read upload", err)
+}
+
+// transcriptionFromRequest returns the job named in the path if it belongs
+// to the session's user.
+func (s *Server) transcriptionFromRequest(r *http.Request) (*transcriptionJob, error) {
+	owner, err := sessionUserKey(r)
+	if err != nil {
+		return nil, err
+	}
+	j, ok := s.transcriptionJobs.get(owner, r.PathValue("id"))
+	if !ok {
+		return nil, endpoint.Error(http.StatusNotFound, "transcription not found", nil)
+	}
+	return j, nil
+}
+
+// transcriptionStatusEndpoint reports a job's progress, and its transcript
+// once done.
+func (s *Server) transcriptionStatusEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	j, err := s.transcriptionFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint.JSONRenderer{Value: j.snapshot()}, nil
+}
+
+// deleteTranscriptionEndpoint cancels a running job, or forgets a finished
+// one.
+func (s *Server) deleteTranscriptionEndpoint(w http.ResponseWriter, r *http.Request, _ struct{}) (endpoint.Renderer, error) {
+	j, err := s.transcriptionFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if j.snapshot().State == transcriptionRunning {
+		j.cancel()
+		<-j.done
+	} else {
+		s.transcriptionJobs.remove(j.id)
+	}
+	return &endpoint.JSONRenderer{Value: j.snapshot()}, nil
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
+)
+
+// uploadRecording posts a recording to /api/transcriptions with the given
+// form fields.
+func uploadRecording(t *testing.T, ts *httptest.Server, cookies []*http.Cookie, filename, contentType string, audio []byte, fields map[string]string) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	if audio != nil {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+		h.Set("Content-Type", contentType)
+		part, _ := mw.CreatePart(h)
+		part.Write(audio)
+	}
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/api/transcriptions", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST /api/transcriptions failed: %v", err)
+	}
+	return resp
+}
+
+// decodeTranscription decodes a transcription status response.
+func decodeTranscription(t *testing.T, resp *http.Response) transcriptionStatus {
+	t.Helper()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	var st transcriptionStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// waitForTranscription polls a job until it is no longer running.
+func waitForTranscription(t *testing.T, ts *httptest.Server, cookies []*http.Cookie, id string) transcriptionStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := decodeTranscription(t, getWithCookies(t, ts, "/api/transcriptions/"+id, cookies))
+		if st.State != transcriptionRunning {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Transcription %s still running", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTranscriptions(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.TranscribeProvider = transcribe.ProviderFake
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	script := []byte("0: Shall we start?\n1: Yes, the budget first.\n")
+	if resp := uploadRecording(t, ts, nil, "standup.wav", "audio/wav", script, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	// The upload is transcribed in the background into a transcript with a
+	// turn per segment.
+	start := decodeTranscription(t, uploadRecording(t, ts, cookies, "standup.wav", "audio/wav", script, map[string]string{
+		"recorded_at": "2026-03-02T09:00:00Z",
+	}))
+	if start.Provider != "fake" || start.Filename != "standup.wav" || start.Size != int64(len(script)) {
+		t.Errorf("Unexpected job %+v", start)
+	}
+	st := waitForTranscription(t, ts, cookies, start.ID)
+	if st.State != transcriptionDone || st.Transcript == nil || st.FinishedAt == nil {
+		t.Fatalf("Expected a transcript, got %+v", st)
+	}
+	tr := st.Transcript
+	if tr.ID != start.ID || tr.Title != "standup" || len(tr.Turns) != 2 {
+		t.Fatalf("Unexpected transcript %+v", tr)
+	}
+	recordedAt := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	if turn := tr.Turns[1]; turn.Speaker != "Speaker 1" || turn.Text != "Yes, the budget first." || turn.Source != "transcribed" || !turn.Timestamp.Equal(recordedAt.Add(1500*time.Millisecond)) {
+		t.Errorf("Unexpected turn %+v", turn)
+	}
+
+	// Options are passed to the provider.
+	st = waitForTranscription(t, ts, cookies, decodeTranscription(t, uploadRecording(t, ts, cookies, "x.wav", "audio/wav", script, map[string]string{
+		"title": "Standup", "diarize": "false",
+	})).ID)
+	if st.Transcript.Title != "Standup" || st.Transcript.Turns[0].Speaker != "" {
+		t.Errorf("Expected the options to apply, got %+v", st.Transcript)
+	}
+
+	// A finished job is forgotten once deleted, and other users cannot see
+	// it.
+	if resp := getWithCookies(t, ts, "/api/transcriptions/"+st.ID, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", resp.StatusCode)
+	}
+	if _, ok := s.transcriptionJobs.get("user:someone-else", st.ID); ok {
+		t.Error("Expected other users not to see the job")
+	}
+	del := func(id string) *http.Response {
+		req, _ := http.NewRequest("DELETE", ts.URL+"/api/transcriptions/"+id, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	decodeTranscription(t, del(st.ID))
+	if resp := getWithCookies(t, ts, "/api/transcriptions/"+st.ID, cookies); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 after deletion, got %d", resp.StatusCode)
+	}
+
+	// Bad uploads are refused.
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		audio       []byte
+		fields      map[string]string
+		status      int
+	}{
+		{"missing file", "", nil, nil, http.StatusBadRequest},
+		{"empty file", "audio/wav", []byte{}, nil, http.StatusBadRequest},
+		{"not audio", "text/html", script, nil, http.StatusUnsupportedMediaType},
+		{"bad language", "audio/wav", script, map[string]string{"language": "english"}, http.StatusBadRequest},
+		{"bad diarize", "audio/wav", script, map[string]string{"diarize": "maybe"}, http.StatusBadRequest},
+		{"bad time", "audio/wav", script, map[string]string{"recorded_at": "yesterday"}, http.StatusBadRequest},
+		{"unknown field", "audio/wav", script, map[string]string{"keywords": "secret"}, http.StatusBadRequest},
+	} {
+		if resp := uploadRecording(t, ts, cookies, "x.wav", tc.contentType, tc.audio, tc.fields); resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+	oldMax := transcriptionMaxUpload
+	transcriptionMaxUpload = 1024
+	defer func() { transcriptionMaxUpload = oldMax }()
+	if resp := uploadRecording(t, ts, cookies, "x.wav", "audio/wav", make([]byte, 2048), nil); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large upload, got %d", resp.StatusCode)
+	}
+
+	// An upload that cannot be transcribed is refused before it is read.
+	if resp := uploadRecording(t, ts, cookies, "x.wav", "audio/wav", make([]byte, 2048), map[string]string{"provider": "openai"}); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for an unconfigured provider, got %d", resp.StatusCode)
+	}
+
+	// Fields come before the file.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "x.wav")
+	part.Write(script)
+	mw.WriteField("provider", "fake")
+	mw.Close()
+	req, _ := http.NewRequest("POST", ts.URL+"/api/transcriptions", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a field after the file, got %d", resp.StatusCode)
+	}
+}
+
+func TestTranscriptions_Cancel(t *testing.T) {
+	slow := &transcribe.Fake{Delay: time.Minute}
+	oldNew := newBatchTranscriber
+	newBatchTranscriber = func(transcribe.Config) (transcribe.BatchProvider, error) { return slow, nil }
+	defer func() { newBatchTranscriber = oldNew }()
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	s := setupTestServer(t)
+	s.cfg.TranscribeProvider = transcribe.ProviderFake
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	// Each user may run a limited number of jobs.
+	var ids []string
+	for range maxTranscriptionJobsPerUser {
+		ids = append(ids, decodeTranscription(t, uploadRecording(t, ts, cookies, "x.wav", "audio/wav", []byte("hello"), nil)).ID)
+	}
+	if resp := uploadRecording(t, ts, cookies, "x.wav", "audio/wav", []byte("hello"), nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 beyond the limit, got %d", resp.StatusCode)
+	}
+	oldMax := transcriptionMaxUpload
+	transcriptionMaxUpload = 1024
+	if resp := uploadRecording(t, ts, cookies, "x.wav", "audio/wav", make([]byte, 2048), nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected the limit to apply before the upload is read, got %d", resp.StatusCode)
+	}
+	transcriptionMaxUpload = oldMax
+
+	// Deleting a running job cancels it and removes its upload.
+	cancel := func(id string, cookies []*http.Cookie) {
+		t.Helper()
+		req, _ := http.NewRequest("DELETE", ts.URL+"/api/transcriptions/"+id, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := decodeTranscription(t, resp); st.State != transcriptionCanceled {
+			t.Errorf("Expected the job to be canceled, got %+v", st)
+		}
+	}
+	for _, id := range ids {
+		cancel(id, cookies)
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmp, "mtranscribe-upload-*")); len(files) != 0 {
+		t.Errorf("Expected the uploads to be removed, got %v", files)
+	}
+	cancel(decodeTranscription(t, uploadRecording(t, ts, cookies, "x.wav", "audio/wav", []byte("hello"), nil)).ID, cookies)
+
+	// Anonymous sessions may only use the server's providers if configured
+	// to, and share the limit of their address however many sessions they
+	// start.
+	if resp := uploadRecording(t, ts, loginAnonymous(t, ts), "x.wav", "audio/wav", []byte("hello"), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an anonymous session, got %d", resp.StatusCode)
+	}
+	s.cfg.TranscribeAllowAnonymous = true
+	anon := map[string][]*http.Cookie{}
+	for range maxTranscriptionJobsPerUser {
+		cookies := loginAnonymous(t, ts)
+		anon[decodeTranscription(t, uploadRecording(t, ts, cookies, "x.wav", "audio/wav", []byte("hello"), nil)).ID] = cookies
+	}
+	if resp := uploadRecording(t, ts, loginAnonymous(t, ts), "x.wav", "audio/wav", []byte("hello"), nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a new anonymous session, got %d", resp.StatusCode)
+	}
+	for id, cookies := range anon {
+		cancel(id, cookies)
+	}
+
+	// Provider errors are reported.
+	failing := &transcribe.Fake{Err: &transcribe.Error{Provider: "fake", StatusCode: 400, Message: "corrupt audio"}}
+	newBatchTranscriber = func(transcribe.Config) (transcribe.BatchProvider, error) { return failing, nil }
+	st := waitForTranscription(t, ts, cookies, decodeTranscription(t, uploadRecording(t, ts, cookies, "x.wav", "audio/wav", []byte("hello"), nil)).ID)
+	if st.State != transcriptionFailed || st.Error != "fake: 400: corrupt audio" {
+		t.Errorf("Expected the provider's error, got %+v", st)
+	}
+}
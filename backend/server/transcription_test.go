@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mnehpets/mtranscribe/backend/transcribe"
+)
+
+func TestTranscribeConfig(t *testing.T) {
+	s := setupTestServer(t)
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	// config returns the provider configuration for the test session.
+	config := func() (transcribe.Config, error) {
+		t.Helper()
+		var cfg transcribe.Config
+		var err error
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		s.sessionProcessor.Process(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) error {
+			cfg, err = s.transcribeConfig(r, "")
+			return nil
+		})
+		return cfg, err
+	}
+	available := func() bool {
+		t.Helper()
+		resp := getWithCookies(t, ts, "/auth/me", cookies)
+		defer resp.Body.Close()
+		var me struct {
+			TranscriptionAvailable bool `json:"transcription_available"`
+		}
+		json.NewDecoder(resp.Body).Decode(&me)
+		return me.TranscriptionAvailable
+	}
+
+	if _, err := config(); err == nil || available() {
+		t.Error("Expected Deepgram to be unavailable without a key")
+	}
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	if cfg, err := config(); err != nil || cfg.APIKey != "dg_server_key" || cfg.BaseURL != s.deepgramAPIURL || !available() {
+		t.Errorf("Expected the server's Deepgram key, got %+v, %v", cfg, err)
+	}
+
+	// OpenAI uses the server's configuration.
+	s.cfg.DeepgramAPIKey = ""
+	s.cfg.TranscribeProvider = transcribe.ProviderOpenAI
+	s.cfg.OpenAIAPIKey, s.cfg.OpenAIAPIURL, s.cfg.OpenAITranscribeModel = "sk_key", "http://whisper.internal:8000/v1", "large-v3"
+	if cfg, err := config(); err != nil || cfg.APIKey != "sk_key" || cfg.BaseURL != "http://whisper.internal:8000/v1" || cfg.Model != "large-v3" || !available() {
+		t.Errorf("Expected the OpenAI configuration, got %+v, %v", cfg, err)
+	}
+
+	// The fake provider needs no key.
+	s.cfg.DeepgramAPIKey = ""
+	s.cfg.TranscribeProvider = transcribe.ProviderFake
+	if cfg, err := config(); err != nil || cfg.Provider != "fake" || !available() {
+		t.Errorf("Expected the fake provider, got %+v, %v", cfg, err)
+	}
+}
+
+// transcriptionSettingsRequest calls /api/settings/transcription.
+func transcriptionSettingsRequest(t *testing.T, ts *httptest.Server, method, body string, cookies []*http.Cookie) (int, transcriptionSettings) {
+	t.Helper()
+	req, _ := http.NewRequest(method, ts.URL+"/api/settings/transcription", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var settings transcriptionSettings
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, settings
+}
+
+func TestTranscriptionSettings(t *testing.T) {
+	s := setupTestServer(t)
+	s.cfg.DeepgramAPIKey = "dg_server_key"
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+
+	if status, _ := transcriptionSettingsRequest(t, ts, "GET", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", status)
+	}
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	// Only configured providers can be chosen.
+	status, settings := transcriptionSettingsRequest(t, ts, "GET", "", cookies)
+	if status != http.StatusOK || settings.Provider != "" || settings.Default != "deepgram" || !slices.Equal(settings.Providers, []string{"deepgram"}) {
+		t.Errorf("Unexpected settings %d %+v", status, settings)
+	}
+	if status, _ := transcriptionSettingsRequest(t, ts, "PUT", `{"provider":"assemblyai"}`, cookies); status != http.StatusBadRequest {
+		t.Errorf("Expected an unconfigured provider to be refused, got %d", status)
+	}
+	s.cfg.AssemblyAIAPIKey = "aai_key"
+	status, settings = transcriptionSettingsRequest(t, ts, "PUT", `{"provider":"assemblyai"}`, cookies)
+	if status != http.StatusOK || settings.Provider != "assemblyai" || !slices.Equal(settings.Providers, []string{"deepgram", "assemblyai"}) {
+		t.Errorf("Unexpected settings %d %+v", status, settings)
+	}
+
+	// The choice applies unless a request names another provider.
+	config := func(provider string) (transcribe.Config, error) {
+		t.Helper()
+		var cfg transcribe.Config
+		var err error
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		s.sessionProcessor.Process(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) error {
+			cfg, err = s.transcribeConfig(r, provider)
+			return nil
+		})
+		return cfg, err
+	}
+	if cfg, err := config(""); err != nil || cfg.Provider != "assemblyai" || cfg.APIKey != "aai_key" || cfg.Webhooks != nil {
+		t.Errorf("Expected the user's provider, got %+v, %v", cfg, err)
+	}
+	if cfg, err := config("deepgram"); err != nil || cfg.Provider != "deepgram" || cfg.APIKey != "dg_server_key" {
+		t.Errorf("Expected the requested provider, got %+v, %v", cfg, err)
+	}
+	if _, err := config("openai"); err == nil {
+		t.Error("Expected an unconfigured provider to fail")
+	}
+	s.cfg.AssemblyAIWebhook = true
+	if cfg, _ := config(""); cfg.WebhookURL != s.cfg.PublicURL+"/api/transcribe/assemblyai/webhook" || cfg.Webhooks != s.transcribeWebhooks {
+		t.Errorf("Expected the webhook to be configured, got %+v", cfg)
+	}
+
+	status, settings = transcriptionSettingsRequest(t, ts, "DELETE", "", cookies)
+	if status != http.StatusOK || settings.Provider != "" {
+		t.Errorf("Unexpected settings %d %+v", status, settings)
+	}
+	if cfg, _ := config(""); cfg.Provider != "deepgram" {
+		t.Errorf("Expected the server's provider, got %+v", cfg)
+	}
+}
+
+// fakeAssemblyAI is a stand-in for the AssemblyAI API whose transcript is
+// processing until its webhook is sent.
+type fakeAssemblyAI struct {
+	mu       sync.Mutex
+	webhook  string
+	complete bool
+}
+
+func (f *fakeAssemblyAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method + " " + r.URL.Path {
+	case "POST /v2/upload":
+		w.Write([]byte(`{"upload_url":"https://cdn.assemblyai.com/upload/1"}`))
+	case "POST /v2/transcript":
+		var req struct {
+			WebhookURL string `json:"webhook_url"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.webhook = req.WebhookURL
+		w.Write([]byte(`{"id":"tr_1","status":"queued"}`))
+	case "GET /v2/transcript/tr_1":
+		if !f.complete {
+			w.Write([]byte(`{"id":"tr_1","status":"processing"}`))
+			if f.webhook != "" {
+				// Complete the transcript, then notify the server.
+				f.complete = true
+				go http.Post(f.webhook, "application/json", strings.NewReader(`{"transcript_id":"tr_1","status":"completed"}`))
+			}
+			return
+		}
+		w.Write([]byte(`{"id":"tr_1","status":"completed","language_code":"en","audio_duration":3,"utterances":[
+			{"speaker":"A","text":"Morning.","start":0,"end":800,"words":[]},
+			{"speaker":"B","text":"Hi there.","start":1200,"end":2000,"words":[]}]}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestTranscriptions_AssemblyAI(t *testing.T) {
+	fake := &fakeAssemblyAI{}
+	mock := httptest.NewServer(fake)
+	defer mock.Close()
+
+	s := setupTestServer(t)
+	s.cfg.AssemblyAIAPIURL = mock.URL
+	ts := httptest.NewServer(s.mux)
+	defer ts.Close()
+	s.cfg.PublicURL = ts.URL
+	s.cfg.AssemblyAIAPIKey = "aai_key"
+	s.cfg.AssemblyAIWebhook = true
+	cookies := loginWithNotionToken(t, s, ts, "")
+
+	// The upload names AssemblyAI, whose webhook ends the wait for the
+	// transcript; its speakers are named like Deepgram's.
+	if resp := uploadRecording(t, ts, cookies, "x.wav", "audio/wav", []byte("RIFF"), map[string]string{"provider": "whisper"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown provider to be refused, got %d", resp.StatusCode)
+	}
+	start := decodeTranscription(t, uploadRecording(t, ts, cookies, "x.wav", "audio/wav", []byte("RIFF"), map[string]string{"provider": "assemblyai"}))
+	st := waitForTranscription(t, ts, cookies, start.ID)
+	if st.State != transcriptionDone || st.Provider != "assemblyai" {
+		t.Fatalf("Expected the transcript, got %+v", st)
+	}
+	if turns := st.Transcript.Turns; len(turns) != 2 || turns[0].Speaker != "Speaker A" || turns[1].Text != "Hi there." {
+		t.Errorf("Unexpected turns %+v", turns)
+	}
+
+	resp := postJSON(t, ts, "/api/transcribe/assemblyai/webhook", map[string]string{"status": "completed"}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a webhook without a transcript to be refused, got %d", resp.StatusCode)
+	}
+}
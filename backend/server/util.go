@@ -1,7 +1,11 @@
 package server
 
 import (
+	"encoding/json"
+	"net/http"
 	"strings"
+
+	"github.com/mnehpets/oneserve/endpoint"
 )
 
 // ValidateNextURL validates the next_url parameter to prevent open redirect vulnerabilities.
@@ -18,3 +22,31 @@ func ValidateNextURL(nextURL string) string {
 	}
 	return "/u/"
 }
+
+// maxJSONBodyBytes limits the size of JSON request bodies.
+const maxJSONBodyBytes = 10 << 20
+
+// decodeJSONBody decodes the JSON request body into v, rejecting unknown
+// fields and bodies larger than maxJSONBodyBytes.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) error {
+	return decodeJSON(w, r, v, true)
+}
+
+// decodeTranscriptBody decodes a JSON request body carrying a transcript
+// into v like decodeJSONBody, but ignores unknown fields, since transcripts
+// hold whatever the frontend's Transcript class serializes, such as its
+// activeTurns.
+func decodeTranscriptBody(w http.ResponseWriter, r *http.Request, v any) error {
+	return decodeJSON(w, r, v, false)
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any, strict bool) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return endpoint.Error(http.StatusBadRequest, "invalid request body: "+err.Error(), err)
+	}
+	return nil
+}
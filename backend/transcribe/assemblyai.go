@@ -0,0 +1,221 @@
+package transcribe
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AssemblyAIURL is the default base URL of the AssemblyAI API.
+const AssemblyAIURL = "https://api.assemblyai.com"
+
+// AssemblyAI poll intervals. These are variables so tests can shorten them.
+var (
+	// assemblyAIPollInterval is how often a transcript is polled.
+	assemblyAIPollInterval = 3 * time.Second
+	// assemblyAIWebhookPollInterval is how often a transcript is polled
+	// while waiting for its webhook, in case the webhook is lost.
+	assemblyAIWebhookPollInterval = time.Minute
+)
+
+// AssemblyAI transcribes with AssemblyAI's asynchronous API: the audio is
+// uploaded, a transcript is requested, and the transcript is polled until
+// it completes. With a webhook URL and registry, AssemblyAI's completion
+// webhook ends the wait early. Streaming is not supported.
+type AssemblyAI struct {
+	apiKey     string
+	baseURL    string
+	model      string
+	webhookURL string
+	webhooks   *Webhooks
+	httpClient *http.Client
+}
+
+// NewAssemblyAI returns an AssemblyAI provider for cfg. The webhook is used
+// only if cfg has both a WebhookURL and Webhooks.
+func NewAssemblyAI(cfg Config) *AssemblyAI {
+	a := &AssemblyAI{apiKey: cfg.APIKey, baseURL: AssemblyAIURL, model: cfg.Model, httpClient: http.DefaultClient}
+	if cfg.BaseURL != "" {
+		a.baseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+	if cfg.WebhookURL != "" && cfg.Webhooks != nil {
+		a.webhookURL, a.webhooks = cfg.WebhookURL, cfg.Webhooks
+	}
+	return a
+}
+
+func (a *AssemblyAI) Name() string { return ProviderAssemblyAI }
+
+// assemblyAIWord is a word in AssemblyAI's responses, timed in milliseconds.
+type assemblyAIWord struct {
+	Text       string  `json:"text"`
+	Start      int64   `json:"start"`
+	End        int64   `json:"end"`
+	Confidence float64 `json:"confidence"`
+	Speaker    *string `json:"speaker"`
+}
+
+// assemblyAISegment is an utterance or sentence in AssemblyAI's responses.
+type assemblyAISegment struct {
+	Text    string           `json:"text"`
+	Start   int64            `json:"start"`
+	End     int64            `json:"end"`
+	Speaker *string          `json:"speaker"`
+	Words   []assemblyAIWord `json:"words"`
+}
+
+// segment converts s, keeping its speakers if diarize is set.
+func (s assemblyAISegment) segment(diarize bool) Segment {
+	seg := Segment{Text: s.Text, Start: time.Duration(s.Start) * time.Millisecond, End: time.Duration(s.End) * time.Millisecond}
+	if diarize && s.Speaker != nil {
+		seg.Speaker = *s.Speaker
+	}
+	for _, w := range s.Words {
+		word := Word{Text: w.Text, Start: time.Duration(w.Start) * time.Millisecond, End: time.Duration(w.End) * time.Millisecond, Confidence: w.Confidence}
+		if diarize && w.Speaker != nil {
+			word.Speaker = *w.Speaker
+		}
+		seg.Words = append(seg.Words, word)
+	}
+	return seg
+}
+
+// assemblyAITranscript is a transcript in AssemblyAI's responses.
+type assemblyAITranscript struct {
+	ID            string              `json:"id"`
+	Status        string              `json:"status"`
+	Error         string              `json:"error"`
+	LanguageCode  string              `json:"language_code"`
+	AudioDuration float64             `json:"audio_duration"`
+	Utterances    []assemblyAISegment `json:"utterances"`
+}
+
+// Transcribe uploads a recording and waits for its transcript.
+func (a *AssemblyAI) Transcribe(ctx context.Context, audio io.Reader, contentType string, opts Options) (*Transcript, error) {
+	var upload struct {
+		UploadURL string `json:"upload_url"`
+	}
+	if err := a.call(ctx, "POST", "/v2/upload", "application/octet-stream", audio, &upload); err != nil {
+		return nil, err
+	}
+
+	req := map[string]any{
+		"audio_url":      upload.UploadURL,
+		"speaker_labels": opts.Diarize,
+	}
+	if opts.Language != "" {
+		// AssemblyAI writes regions with an underscore, as in en_us.
+		req["language_code"] = strings.ToLower(strings.ReplaceAll(opts.Language, "-", "_"))
+	} else {
+		req["language_detection"] = true
+	}
+	if model := cmp.Or(opts.Model, a.model); model != "" {
+		req["speech_model"] = model
+	}
+	if a.webhookURL != "" {
+		req["webhook_url"] = a.webhookURL
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var t assemblyAITranscript
+	if err := a.call(ctx, "POST", "/v2/transcript", "application/json", bytes.NewReader(body), &t); err != nil {
+		return nil, err
+	}
+
+	if t, err = a.wait(ctx, t.ID); err != nil {
+		return nil, err
+	}
+	result := &Transcript{Duration: seconds(t.AudioDuration), Language: cmp.Or(opts.Language, t.LanguageCode), Segments: []Segment{}}
+	segments := t.Utterances
+	// Without speaker labels there are no utterances, so use sentences.
+	if len(segments) == 0 {
+		var sentences struct {
+			Sentences []assemblyAISegment `json:"sentences"`
+		}
+		if err := a.call(ctx, "GET", "/v2/transcript/"+t.ID+"/sentences", "", nil, &sentences); err != nil {
+			return nil, err
+		}
+		segments = sentences.Sentences
+	}
+	for _, s := range segments {
+		result.Segments = append(result.Segments, s.segment(opts.Diarize))
+	}
+	return result, nil
+}
+
+// wait polls the transcript until it completes or fails.
+func (a *AssemblyAI) wait(ctx context.Context, id string) (assemblyAITranscript, error) {
+	interval := assemblyAIPollInterval
+	var notified <-chan struct{}
+	if a.webhooks != nil {
+		var done func()
+		notified, done = a.webhooks.wait(ProviderAssemblyAI, id)
+		defer done()
+		interval = assemblyAIWebhookPollInterval
+	}
+	for {
+		var t assemblyAITranscript
+		if err := a.call(ctx, "GET", "/v2/transcript/"+id, "", nil, &t); err != nil {
+			return t, err
+		}
+		switch t.Status {
+		case "completed":
+			return t, nil
+		case "error":
+			return t, &Error{Provider: ProviderAssemblyAI, Message: t.Error}
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return t, ctx.Err()
+		case <-notified:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// call makes an API call and decodes its JSON response into out.
+func (a *AssemblyAI) call(ctx context.Context, method, path, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", a.apiKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("assemblyai: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &Error{Provider: ProviderAssemblyAI, StatusCode: resp.StatusCode}
+		var body struct {
+			Error string `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &body) == nil {
+			apiErr.Message = body.Error
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("assemblyai: decode response: %w", err)
+	}
+	return nil
+}
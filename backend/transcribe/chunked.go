@@ -0,0 +1,126 @@
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// chunkTimeout bounds the transcription of each chunk of a chunked stream.
+var chunkTimeout = time.Minute
+
+// chunkedStream streams with a batch provider, for providers without a
+// streaming API. Each chunk of audio is a complete recording, transcribed
+// in the order sent; its segments are final results timed from the start
+// of the stream, followed by the end of the utterance.
+type chunkedStream struct {
+	provider BatchProvider
+	opts     StreamOptions
+	results  chan Result
+	notify   chan struct{}
+	done     chan struct{}
+	err      error
+
+	mu      sync.Mutex
+	pending [][]byte
+	closed  bool
+	failed  error
+}
+
+func newChunkedStream(provider BatchProvider, opts StreamOptions) *chunkedStream {
+	s := &chunkedStream{
+		provider: provider,
+		opts:     opts,
+		results:  make(chan Result),
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *chunkedStream) Results() <-chan Result { return s.results }
+
+func (s *chunkedStream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *chunkedStream) SendAudio(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed != nil {
+		return s.failed
+	}
+	if s.closed {
+		return fmt.Errorf("%s: stream closed", s.provider.Name())
+	}
+	s.pending = append(s.pending, append([]byte(nil), data...))
+	s.signal()
+	return nil
+}
+
+func (s *chunkedStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.signal()
+	s.mu.Unlock()
+	<-s.done
+	return s.err
+}
+
+func (s *chunkedStream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run transcribes chunks until the stream is closed or a chunk fails.
+func (s *chunkedStream) run() {
+	defer close(s.done)
+	defer close(s.results)
+	var at time.Duration
+	for range s.notify {
+		s.mu.Lock()
+		chunks, closed := s.pending, s.closed
+		s.pending = nil
+		s.mu.Unlock()
+
+		for _, chunk := range chunks {
+			t, err := s.transcribe(chunk)
+			if err != nil {
+				s.mu.Lock()
+				s.err, s.failed = err, err
+				s.mu.Unlock()
+				return
+			}
+			for _, seg := range t.Segments {
+				seg.Start, seg.End = seg.Start+at, seg.End+at
+				for i := range seg.Words {
+					seg.Words[i].Start += at
+					seg.Words[i].End += at
+				}
+				s.results <- Result{Segment: seg, Final: true}
+			}
+			at += t.Duration
+			s.results <- Result{Segment: Segment{Start: at, End: at}, Final: true, UtteranceEnd: true}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// transcribe transcribes a chunk.
+func (s *chunkedStream) transcribe(chunk []byte) (*Transcript, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), chunkTimeout)
+	defer cancel()
+	return s.provider.Transcribe(ctx, bytes.NewReader(chunk), s.opts.ContentType, s.opts.Options)
+}
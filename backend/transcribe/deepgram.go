@@ -0,0 +1,322 @@
+package transcribe
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// DeepgramURL is the default base URL of the Deepgram API.
+const DeepgramURL = "https://api.deepgram.com"
+
+// deepgramDefaultModel is used when neither the options nor the Config name
+// a model.
+const deepgramDefaultModel = "nova-3"
+
+// deepgramMessageLimit bounds the size of Deepgram's streaming results.
+const deepgramMessageLimit = 1 << 20
+
+// deepgramKeepAlive is how long a stream may go without audio before a
+// KeepAlive is sent. Deepgram closes streams after ten seconds without one.
+var deepgramKeepAlive = 5 * time.Second
+
+// Deepgram transcribes with Deepgram's prerecorded and streaming APIs.
+type Deepgram struct {
+	apiKey     string
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+// NewDeepgram returns a Deepgram provider for cfg.
+func NewDeepgram(cfg Config) *Deepgram {
+	d := &Deepgram{apiKey: cfg.APIKey, baseURL: DeepgramURL, model: cfg.Model, httpClient: http.DefaultClient}
+	if cfg.BaseURL != "" {
+		d.baseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	}
+	if d.model == "" {
+		d.model = deepgramDefaultModel
+	}
+	return d
+}
+
+func (d *Deepgram) Name() string { return ProviderDeepgram }
+
+// query returns the query parameters for opts.
+func (d *Deepgram) query(opts Options) url.Values {
+	q := url.Values{}
+	q.Set("model", cmp.Or(opts.Model, d.model))
+	if opts.Language != "" {
+		q.Set("language", opts.Language)
+	}
+	q.Set("diarize", strconv.FormatBool(opts.Diarize))
+	q.Set("smart_format", "true")
+	// Opt out of Deepgram's model improvement program for privacy.
+	q.Set("mip_opt_out", "true")
+	return q
+}
+
+// deepgramWord is a word in Deepgram's responses.
+type deepgramWord struct {
+	Word           string   `json:"word"`
+	PunctuatedWord string   `json:"punctuated_word"`
+	Start          float64  `json:"start"`
+	End            float64  `json:"end"`
+	Confidence     float64  `json:"confidence"`
+	Speaker        *float64 `json:"speaker"`
+}
+
+func (w deepgramWord) word() Word {
+	word := Word{Text: cmp.Or(w.PunctuatedWord, w.Word), Start: seconds(w.Start), End: seconds(w.End), Confidence: w.Confidence}
+	if w.Speaker != nil {
+		word.Speaker = strconv.Itoa(int(*w.Speaker))
+	}
+	return word
+}
+
+func deepgramWords(words []deepgramWord) []Word {
+	out := make([]Word, len(words))
+	for i, w := range words {
+		out[i] = w.word()
+	}
+	return out
+}
+
+// deepgramAlternative is a transcription hypothesis in Deepgram's responses.
+type deepgramAlternative struct {
+	Transcript string         `json:"transcript"`
+	Words      []deepgramWord `json:"words"`
+}
+
+// Transcribe transcribes a recording with Deepgram's prerecorded API.
+func (d *Deepgram) Transcribe(ctx context.Context, audio io.Reader, contentType string, opts Options) (*Transcript, error) {
+	q := d.query(opts)
+	q.Set("utterances", "true")
+	if opts.Language == "" {
+		q.Set("detect_language", "true")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.baseURL+"/v1/listen?"+q.Encode(), audio)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+d.apiKey)
+	req.Header.Set("Content-Type", cmp.Or(contentType, "application/octet-stream"))
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("deepgram: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, deepgramError(resp)
+	}
+
+	var body struct {
+		Metadata struct {
+			Duration float64 `json:"duration"`
+		} `json:"metadata"`
+		Results struct {
+			Channels []struct {
+				DetectedLanguage string                `json:"detected_language"`
+				Alternatives     []deepgramAlternative `json:"alternatives"`
+			} `json:"channels"`
+			Utterances []struct {
+				Start      float64        `json:"start"`
+				End        float64        `json:"end"`
+				Transcript string         `json:"transcript"`
+				Speaker    *float64       `json:"speaker"`
+				Words      []deepgramWord `json:"words"`
+			} `json:"utterances"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("deepgram: decode response: %w", err)
+	}
+
+	t := &Transcript{Duration: seconds(body.Metadata.Duration), Language: opts.Language, Segments: []Segment{}}
+	for _, u := range body.Results.Utterances {
+		seg := Segment{Text: u.Transcript, Start: seconds(u.Start), End: seconds(u.End), Words: deepgramWords(u.Words)}
+		if u.Speaker != nil && opts.Diarize {
+			seg.Speaker = strconv.Itoa(int(*u.Speaker))
+		}
+		t.Segments = append(t.Segments, seg)
+	}
+	if len(body.Results.Channels) > 0 {
+		ch := body.Results.Channels[0]
+		if t.Language == "" {
+			t.Language = ch.DetectedLanguage
+		}
+		// Without utterances, split the words by speaker instead.
+		if len(t.Segments) == 0 && len(ch.Alternatives) > 0 {
+			t.Segments = SplitBySpeaker(deepgramWords(ch.Alternatives[0].Words))
+		}
+	}
+	return t, nil
+}
+
+// deepgramError returns the error for a failed Deepgram response.
+func deepgramError(resp *http.Response) error {
+	apiErr := &Error{Provider: ProviderDeepgram, StatusCode: resp.StatusCode, Message: resp.Header.Get("Dg-Error")}
+	if resp.Body != nil {
+		var body struct {
+			ErrMsg string `json:"err_msg"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &body) == nil && body.ErrMsg != "" {
+			apiErr.Message = body.ErrMsg
+		}
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+// Stream starts a transcription with Deepgram's streaming API.
+func (d *Deepgram) Stream(ctx context.Context, opts StreamOptions) (Stream, error) {
+	q := d.query(opts.Options)
+	q.Set("interim_results", strconv.FormatBool(opts.InterimResults))
+	if opts.UtteranceEnd > 0 {
+		q.Set("utterance_end_ms", strconv.FormatInt(opts.UtteranceEnd.Milliseconds(), 10))
+	}
+	streamURL := d.baseURL
+	if rest, ok := strings.CutPrefix(streamURL, "https://"); ok {
+		streamURL = "wss://" + rest
+	} else if rest, ok := strings.CutPrefix(streamURL, "http://"); ok {
+		streamURL = "ws://" + rest
+	}
+
+	conn, resp, err := websocket.Dial(ctx, streamURL+"/v1/listen?"+q.Encode(), &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Token " + d.apiKey}},
+	})
+	if err != nil && resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, deepgramError(resp)
+	} else if err != nil {
+		return nil, fmt.Errorf("deepgram: %w", err)
+	}
+	conn.SetReadLimit(deepgramMessageLimit)
+
+	s := &deepgramStream{conn: conn, results: make(chan Result), done: make(chan struct{}), lastSend: time.Now()}
+	go s.read()
+	go s.keepAlive()
+	return s, nil
+}
+
+// deepgramStream is a running Deepgram streaming transcription.
+type deepgramStream struct {
+	conn    *websocket.Conn
+	results chan Result
+	done    chan struct{}
+	err     error
+
+	mu       sync.Mutex
+	lastSend time.Time
+}
+
+func (s *deepgramStream) Results() <-chan Result { return s.results }
+
+func (s *deepgramStream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *deepgramStream) SendAudio(data []byte) error {
+	s.mu.Lock()
+	s.lastSend = time.Now()
+	s.mu.Unlock()
+	return s.conn.Write(context.Background(), websocket.MessageBinary, data)
+}
+
+func (s *deepgramStream) Close() error {
+	// Deepgram sends the remaining results and closes the stream.
+	if err := s.conn.Write(context.Background(), websocket.MessageText, []byte(`{"type":"CloseStream"}`)); err != nil {
+		s.conn.CloseNow()
+	}
+	<-s.done
+	return s.err
+}
+
+// read turns Deepgram's messages into results until the stream ends.
+func (s *deepgramStream) read() {
+	defer close(s.done)
+	defer close(s.results)
+	defer s.conn.CloseNow()
+	for {
+		_, data, err := s.conn.Read(context.Background())
+		if err != nil {
+			var ce websocket.CloseError
+			if !errors.As(err, &ce) {
+				s.err = err
+			} else if ce.Code != websocket.StatusNormalClosure {
+				s.err = &Error{Provider: ProviderDeepgram, StatusCode: int(ce.Code), Message: ce.Reason}
+			}
+			return
+		}
+
+		var msg struct {
+			Type        string  `json:"type"`
+			IsFinal     bool    `json:"is_final"`
+			SpeechFinal bool    `json:"speech_final"`
+			Start       float64 `json:"start"`
+			Duration    float64 `json:"duration"`
+			LastWordEnd float64 `json:"last_word_end"`
+			Channel     struct {
+				Alternatives []deepgramAlternative `json:"alternatives"`
+			} `json:"channel"`
+		}
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case "Results":
+			r := Result{Final: msg.IsFinal, UtteranceEnd: msg.SpeechFinal}
+			r.Start, r.End = seconds(msg.Start), seconds(msg.Start+msg.Duration)
+			if len(msg.Channel.Alternatives) > 0 {
+				alt := msg.Channel.Alternatives[0]
+				r.Text, r.Words = alt.Transcript, deepgramWords(alt.Words)
+				if len(r.Words) > 0 {
+					r.Speaker = r.Words[0].Speaker
+				}
+			}
+			s.results <- r
+		case "UtteranceEnd":
+			end := seconds(msg.LastWordEnd)
+			s.results <- Result{Segment: Segment{Start: end, End: end}, Final: true, UtteranceEnd: true}
+		}
+	}
+}
+
+// keepAlive keeps the stream open while no audio is sent, such as while
+// recording is paused.
+func (s *deepgramStream) keepAlive() {
+	ticker := time.NewTicker(deepgramKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			idle := time.Since(s.lastSend) >= deepgramKeepAlive
+			s.mu.Unlock()
+			if idle {
+				s.conn.Write(context.Background(), websocket.MessageText, []byte(`{"type":"KeepAlive"}`))
+			}
+		}
+	}
+}
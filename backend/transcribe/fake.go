@@ -0,0 +1,189 @@
+package transcribe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// fakeWordDuration is how long each word of a fake transcript lasts.
+const fakeWordDuration = 500 * time.Millisecond
+
+// Fake is a deterministic provider for tests and offline development. It
+// reads the audio as a script: each line is a segment, and a line of the
+// form "Name: text" is spoken by Name. Each word lasts half a second. Audio
+// that is not text becomes a single segment describing its size.
+type Fake struct {
+	// Delay is how long Transcribe takes, to test slow providers.
+	Delay time.Duration
+	// Err, if set, is returned by Transcribe and Stream.
+	Err error
+}
+
+func (f *Fake) Name() string { return ProviderFake }
+
+// Transcribe transcribes a script.
+func (f *Fake) Transcribe(ctx context.Context, audio io.Reader, contentType string, opts Options) (*Transcript, error) {
+	data, err := io.ReadAll(audio)
+	if err != nil {
+		return nil, err
+	}
+	if f.Delay > 0 {
+		timer := time.NewTimer(f.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	t := &Transcript{Language: opts.Language, Segments: []Segment{}}
+	if t.Language == "" {
+		t.Language = "en"
+	}
+	var at time.Duration
+	for _, line := range fakeScript(data) {
+		seg := fakeSegment(line, at, opts.Diarize)
+		t.Segments = append(t.Segments, seg)
+		at = seg.End
+	}
+	t.Duration = at
+	return t, nil
+}
+
+// fakeScript returns the lines of a script, or a description of audio that
+// is not one.
+func fakeScript(data []byte) []string {
+	if !utf8.Valid(data) || strings.ContainsRune(string(data), 0) {
+		return []string{fmt.Sprintf("%d bytes of audio", len(data))}
+	}
+	var lines []string
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// fakeSegment returns the segment for a script line starting at start.
+func fakeSegment(line string, start time.Duration, diarize bool) Segment {
+	var speaker string
+	if name, text, ok := strings.Cut(line, ":"); ok && name != "" && !strings.ContainsAny(name, " \t") {
+		speaker, line = name, strings.TrimSpace(text)
+	}
+	if !diarize {
+		speaker = ""
+	}
+	seg := Segment{Speaker: speaker, Text: line, Start: start, End: start}
+	for _, text := range strings.Fields(line) {
+		w := Word{Text: text, Start: seg.End, End: seg.End + fakeWordDuration, Confidence: 1, Speaker: speaker}
+		seg.Words = append(seg.Words, w)
+		seg.End = w.End
+	}
+	return seg
+}
+
+// Stream starts a fake streaming transcription. Each chunk of audio is
+// transcribed as a script line: an interim result with its first word, if
+// interim results were asked for, then a final one, then the end of the
+// utterance.
+func (f *Fake) Stream(ctx context.Context, opts StreamOptions) (Stream, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	s := &fakeStream{opts: opts, results: make(chan Result), notify: make(chan struct{}, 1), done: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+// fakeStream is a running fake transcription.
+type fakeStream struct {
+	opts    StreamOptions
+	results chan Result
+	notify  chan struct{}
+	done    chan struct{}
+	err     error
+
+	mu      sync.Mutex
+	pending [][]byte
+	closed  bool
+}
+
+func (s *fakeStream) Results() <-chan Result { return s.results }
+
+func (s *fakeStream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *fakeStream) SendAudio(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("fake: stream closed")
+	}
+	s.pending = append(s.pending, append([]byte(nil), data...))
+	s.signal()
+	return nil
+}
+
+func (s *fakeStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.signal()
+	s.mu.Unlock()
+	<-s.done
+	return s.err
+}
+
+func (s *fakeStream) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run transcribes chunks in the order they were sent until the stream is
+// closed.
+func (s *fakeStream) run() {
+	defer close(s.done)
+	defer close(s.results)
+	var at time.Duration
+	for range s.notify {
+		s.mu.Lock()
+		chunks, closed := s.pending, s.closed
+		s.pending = nil
+		s.mu.Unlock()
+
+		for _, chunk := range chunks {
+			for _, line := range fakeScript(chunk) {
+				seg := fakeSegment(line, at, s.opts.Diarize)
+				if s.opts.InterimResults && len(seg.Words) > 1 {
+					interim := seg
+					interim.Words = seg.Words[:1]
+					interim.Text, interim.End = interim.Words[0].Text, interim.Words[0].End
+					s.results <- Result{Segment: interim}
+				}
+				s.results <- Result{Segment: seg, Final: true}
+				s.results <- Result{Segment: Segment{Start: seg.End, End: seg.End}, Final: true, UtteranceEnd: true}
+				at = seg.End
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package transcribe
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// OpenAIURL is the default base URL of the OpenAI API.
+const OpenAIURL = "https://api.openai.com"
+
+// openAIDefaultModel is used when neither the options nor the Config name a
+// model.
+const openAIDefaultModel = "whisper-1"
+
+// openAIExtensions maps audio MIME types to the file extensions OpenAI-style
+// servers use to tell the format of an upload.
+var openAIExtensions = map[string]string{
+	"audio/wav":    ".wav",
+	"audio/x-wav":  ".wav",
+	"audio/wave":   ".wav",
+	"audio/webm":   ".webm",
+	"video/webm":   ".webm",
+	"audio/ogg":    ".ogg",
+	"audio/mpeg":   ".mp3",
+	"audio/mp3":    ".mp3",
+	"audio/mp4":    ".m4a",
+	"audio/x-m4a":  ".m4a",
+	"video/mp4":    ".mp4",
+	"audio/flac":   ".flac",
+	"audio/x-flac": ".flac",
+}
+
+// OpenAI transcribes with the OpenAI audio transcription API, as served by
+// OpenAI and by self-hosted Whisper servers. The API has no streaming, so
+// streams transcribe each chunk of audio as a recording of its own. It does
+// not tell speakers apart.
+type OpenAI struct {
+	apiKey     string
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+// NewOpenAI returns an OpenAI provider for cfg. The base URL may include the
+// API's /v1 prefix, as OpenAI clients usually configure it.
+func NewOpenAI(cfg Config) *OpenAI {
+	o := &OpenAI{apiKey: cfg.APIKey, baseURL: OpenAIURL, model: cfg.Model, httpClient: http.DefaultClient}
+	if cfg.BaseURL != "" {
+		o.baseURL = strings.TrimSuffix(strings.TrimSuffix(cfg.BaseURL, "/"), "/v1")
+	}
+	if o.model == "" {
+		o.model = openAIDefaultModel
+	}
+	return o
+}
+
+func (o *OpenAI) Name() string { return ProviderOpenAI }
+
+// Transcribe transcribes a recording with the transcription API's verbose
+// JSON format, which has segment and word timings.
+func (o *OpenAI) Transcribe(ctx context.Context, audio io.Reader, contentType string, opts Options) (*Transcript, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("model", cmp.Or(opts.Model, o.model))
+	mw.WriteField("response_format", "verbose_json")
+	mw.WriteField("timestamp_granularities[]", "segment")
+	mw.WriteField("timestamp_granularities[]", "word")
+	if opts.Language != "" {
+		// The API takes ISO 639-1 codes, without a region.
+		lang, _, _ := strings.Cut(opts.Language, "-")
+		mw.WriteField("language", lang)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	file, err := mw.CreatePart(map[string][]string{
+		"Content-Disposition": {fmt.Sprintf(`form-data; name="file"; filename="audio%s"`, openAIExtensions[mediaType])},
+		"Content-Type":        {cmp.Or(contentType, "application/octet-stream")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, audio); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", o.baseURL+"/v1/audio/transcriptions", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("openai: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, openAIError(resp)
+	}
+
+	var result struct {
+		Text     string  `json:"text"`
+		Language string  `json:"language"`
+		Duration float64 `json:"duration"`
+		Segments []struct {
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+			Text  string  `json:"text"`
+		} `json:"segments"`
+		Words []struct {
+			Word  string  `json:"word"`
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+		} `json:"words"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("openai: decode response: %w", err)
+	}
+
+	t := &Transcript{Duration: seconds(result.Duration), Language: cmp.Or(opts.Language, result.Language), Segments: []Segment{}}
+	for _, s := range result.Segments {
+		seg := Segment{Text: strings.TrimSpace(s.Text), Start: seconds(s.Start), End: seconds(s.End)}
+		if seg.Text == "" {
+			continue
+		}
+		for _, w := range result.Words {
+			if start := seconds(w.Start); start >= seg.Start && start < seg.End {
+				seg.Words = append(seg.Words, Word{Text: strings.TrimSpace(w.Word), Start: start, End: seconds(w.End), Confidence: 1})
+			}
+		}
+		t.Segments = append(t.Segments, seg)
+	}
+	// Servers that only give the text have a single untimed segment.
+	if len(result.Segments) == 0 && strings.TrimSpace(result.Text) != "" {
+		t.Segments = append(t.Segments, Segment{Text: strings.TrimSpace(result.Text), End: t.Duration})
+	}
+	if t.Duration == 0 && len(t.Segments) > 0 {
+		t.Duration = t.Segments[len(t.Segments)-1].End
+	}
+	return t, nil
+}
+
+// openAIError returns the error for a failed response. OpenAI reports errors
+// as {"error": {"message"}}, and many self-hosted servers as {"detail"}.
+func openAIError(resp *http.Response) error {
+	apiErr := &Error{Provider: ProviderOpenAI, StatusCode: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Detail any `json:"detail"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(data, &body) == nil {
+		if detail, ok := body.Detail.(string); ok {
+			apiErr.Message = detail
+		}
+		apiErr.Message = cmp.Or(body.Error.Message, apiErr.Message)
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+// Stream starts a chunked transcription: each chunk of audio must be a
+// complete recording in the stream's content type, such as a few seconds
+// of WAV, and is transcribed on its own.
+func (o *OpenAI) Stream(ctx context.Context, opts StreamOptions) (Stream, error) {
+	return newChunkedStream(o, opts), nil
+}
@@ -0,0 +1,225 @@
+// Package transcribe defines the speech-to-text providers the backend uses,
+// and a result model shared by all of them.
+//
+// Batch providers transcribe a complete recording. Streaming providers
+// transcribe audio as it is captured, sending interim results that later
+// results replace until one is final; providers without a streaming API
+// transcribe each chunk of a stream as a recording of its own. Providers are
+// created from a Config,
+// which names the provider to use.
+package transcribe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Word is a recognized word. Speaker is the provider's label for the person
+// speaking, empty if the speakers were not told apart.
+type Word struct {
+	Text       string        `json:"text"`
+	Start      time.Duration `json:"start"`
+	End        time.Duration `json:"end"`
+	Confidence float64       `json:"confidence"`
+	Speaker    string        `json:"speaker,omitempty"`
+}
+
+// Segment is a stretch of speech by one speaker.
+type Segment struct {
+	Speaker string        `json:"speaker,omitempty"`
+	Text    string        `json:"text"`
+	Start   time.Duration `json:"start"`
+	End     time.Duration `json:"end"`
+	Words   []Word        `json:"words,omitempty"`
+}
+
+// Transcript is the result of transcribing a recording.
+type Transcript struct {
+	Segments []Segment     `json:"segments"`
+	Duration time.Duration `json:"duration"`
+	Language string        `json:"language,omitempty"`
+}
+
+// Result is a streaming result. Interim results are replaced by the next
+// result for the same audio, until one is Final. UtteranceEnd marks a pause
+// after which the current turn is complete; such results may have no text.
+type Result struct {
+	Segment
+	Final        bool `json:"final"`
+	UtteranceEnd bool `json:"utterance_end"`
+}
+
+// Options are the transcription options shared by all providers. Empty
+// values leave the choice to the provider.
+type Options struct {
+	Model    string
+	Language string
+	// Diarize tells speakers apart.
+	Diarize bool
+}
+
+// StreamOptions are the options of a streaming transcription.
+type StreamOptions struct {
+	Options
+	// InterimResults asks for results before they are final.
+	InterimResults bool
+	// UtteranceEnd is the pause after which an utterance ends, if set.
+	UtteranceEnd time.Duration
+	// ContentType is the MIME type of the audio, for providers that
+	// transcribe each chunk as a recording of its own.
+	ContentType string
+}
+
+// BatchProvider transcribes complete recordings.
+type BatchProvider interface {
+	// Name returns the provider's name, as used in Config.
+	Name() string
+	// Transcribe transcribes the audio read from audio, whose MIME type is
+	// contentType if known.
+	Transcribe(ctx context.Context, audio io.Reader, contentType string, opts Options) (*Transcript, error)
+}
+
+// StreamProvider transcribes audio as it is captured.
+type StreamProvider interface {
+	// Name returns the provider's name, as used in Config.
+	Name() string
+	// Stream starts a streaming transcription. ctx bounds starting it
+	// only; the stream runs until closed.
+	Stream(ctx context.Context, opts StreamOptions) (Stream, error)
+}
+
+// Stream is a running streaming transcription.
+type Stream interface {
+	// SendAudio sends the next chunk of audio.
+	SendAudio(data []byte) error
+	// Results returns the stream's results. It is closed when the stream
+	// ends, and must be drained for the stream to make progress.
+	Results() <-chan Result
+	// Close ends the audio and waits for the remaining results, then
+	// returns the error that ended the stream, if any.
+	Close() error
+	// Err returns the error that ended the stream, once Results is closed.
+	Err() error
+}
+
+// Error is an error reported by a provider's API. StatusCode is zero for
+// errors reported in a successful response, such as a failed transcription.
+type Error struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s: %s", e.Provider, e.Message)
+	}
+	return fmt.Sprintf("%s: %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+var (
+	// ErrUnknownProvider is returned for a Config naming no provider.
+	ErrUnknownProvider = errors.New("transcribe: unknown provider")
+	// ErrNotSupported is returned when a provider does not support the
+	// requested kind of transcription.
+	ErrNotSupported = errors.New("transcribe: not supported by the provider")
+)
+
+// Provider names.
+const (
+	ProviderDeepgram   = "deepgram"
+	ProviderOpenAI     = "openai"
+	ProviderAssemblyAI = "assemblyai"
+	ProviderFake       = "fake"
+)
+
+// Config selects and configures a provider.
+type Config struct {
+	// Provider is the provider's name. It defaults to ProviderDeepgram.
+	Provider string
+	// APIKey authenticates with the provider's API.
+	APIKey string
+	// BaseURL overrides the provider's API URL, such as for a stand-in.
+	BaseURL string
+	// Model is the model used when the options name none.
+	Model string
+	// WebhookURL is where a provider that supports completion webhooks
+	// sends them, to be passed to Webhooks.Notify.
+	WebhookURL string
+	// Webhooks wakes transcriptions when their webhook arrives. Without it,
+	// providers poll.
+	Webhooks *Webhooks
+}
+
+// Providers returns the names of the available providers.
+func Providers() []string {
+	return []string{ProviderDeepgram, ProviderOpenAI, ProviderAssemblyAI, ProviderFake}
+}
+
+// Known reports whether name is the name of a provider, or empty for the
+// default provider.
+func Known(name string) bool {
+	return name == "" || slices.Contains(Providers(), name)
+}
+
+// NewBatch returns the batch provider named by cfg.
+func NewBatch(cfg Config) (BatchProvider, error) {
+	switch cfg.Provider {
+	case "", ProviderDeepgram:
+		return NewDeepgram(cfg), nil
+	case ProviderOpenAI:
+		return NewOpenAI(cfg), nil
+	case ProviderAssemblyAI:
+		return NewAssemblyAI(cfg), nil
+	case ProviderFake:
+		return &Fake{}, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownProvider, cfg.Provider)
+}
+
+// NewStream returns the streaming provider named by cfg.
+func NewStream(cfg Config) (StreamProvider, error) {
+	switch cfg.Provider {
+	case "", ProviderDeepgram:
+		return NewDeepgram(cfg), nil
+	case ProviderOpenAI:
+		return NewOpenAI(cfg), nil
+	case ProviderAssemblyAI:
+		return nil, fmt.Errorf("%w: %s", ErrNotSupported, cfg.Provider)
+	case ProviderFake:
+		return &Fake{}, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownProvider, cfg.Provider)
+}
+
+// SplitBySpeaker groups consecutive words by the same speaker into segments.
+func SplitBySpeaker(words []Word) []Segment {
+	var segments []Segment
+	for _, w := range words {
+		if n := len(segments); n > 0 && segments[n-1].Speaker == w.Speaker {
+			seg := &segments[n-1]
+			seg.Words = append(seg.Words, w)
+			seg.End = w.End
+			continue
+		}
+		segments = append(segments, Segment{Speaker: w.Speaker, Start: w.Start, End: w.End, Words: []Word{w}})
+	}
+	for i := range segments {
+		texts := make([]string, len(segments[i].Words))
+		for j, w := range segments[i].Words {
+			texts[j] = w.Text
+		}
+		segments[i].Text = strings.Join(texts, " ")
+	}
+	return segments
+}
+
+// seconds converts a time in seconds, as most APIs give them, to a Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,549 @@
+package transcribe
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestSplitBySpeaker(t *testing.T) {
+	words := []Word{
+		{Text: "Hello", Start: 0, End: time.Second, Speaker: "0"},
+		{Text: "there.", Start: time.Second, End: 2 * time.Second, Speaker: "0"},
+		{Text: "Hi!", Start: 3 * time.Second, End: 4 * time.Second, Speaker: "1"},
+	}
+	got := SplitBySpeaker(words)
+	if len(got) != 2 || got[0].Text != "Hello there." || got[0].End != 2*time.Second || got[1].Speaker != "1" || got[1].Start != 3*time.Second {
+		t.Errorf("Unexpected segments %+v", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range Providers() {
+		if b, err := NewBatch(Config{Provider: name}); err != nil || b.Name() != name {
+			t.Errorf("Expected batch provider %s, got %v", name, err)
+		}
+		if s, err := NewStream(Config{Provider: name}); errors.Is(err, ErrNotSupported) {
+			continue
+		} else if err != nil || s.Name() != name {
+			t.Errorf("Expected streaming provider %s, got %v", name, err)
+		}
+	}
+	if b, _ := NewBatch(Config{}); b.Name() != ProviderDeepgram {
+		t.Errorf("Expected Deepgram by default, got %s", b.Name())
+	}
+	if _, err := NewStream(Config{Provider: ProviderAssemblyAI}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Expected AssemblyAI not to stream, got %v", err)
+	}
+	if _, err := NewBatch(Config{Provider: "whisper"}); !errors.Is(err, ErrUnknownProvider) || Known("whisper") {
+		t.Errorf("Expected an unknown provider error, got %v", err)
+	}
+}
+
+func TestFake(t *testing.T) {
+	script := "Alice: Hello there.\n\nBob: Hi Alice, how are you?\nFine.\n"
+	f := &Fake{}
+	got, err := f.Transcribe(context.Background(), strings.NewReader(script), "text/plain", Options{Diarize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := f.Transcribe(context.Background(), strings.NewReader(script), "text/plain", Options{Diarize: true})
+	if !reflect.DeepEqual(got, again) {
+		t.Error("Expected the fake to be deterministic")
+	}
+	if len(got.Segments) != 3 || got.Segments[1].Speaker != "Bob" || got.Segments[1].Text != "Hi Alice, how are you?" || got.Segments[2].Speaker != "" {
+		t.Errorf("Unexpected segments %+v", got.Segments)
+	}
+	if got.Segments[1].Start != time.Second || got.Duration != 4*time.Second || got.Language != "en" {
+		t.Errorf("Unexpected timings %v %v", got.Segments[1].Start, got.Duration)
+	}
+	if got, _ := f.Transcribe(context.Background(), strings.NewReader("A: x"), "", Options{}); got.Segments[0].Speaker != "" {
+		t.Errorf("Expected no speakers without diarization, got %+v", got.Segments)
+	}
+	if got, _ := f.Transcribe(context.Background(), strings.NewReader("\x00\x01\x02"), "audio/wav", Options{}); got.Segments[0].Text != "3 bytes of audio" {
+		t.Errorf("Expected binary audio to be described, got %+v", got.Segments)
+	}
+
+	slow := &Fake{Delay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := slow.Transcribe(ctx, strings.NewReader(script), "", Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the delay to end with the context, got %v", err)
+	}
+
+	stream, err := f.Stream(context.Background(), StreamOptions{Options: Options{Diarize: true}, InterimResults: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SendAudio([]byte("Alice: Good morning"))
+	var results []Result
+	go func() { stream.Close() }()
+	for r := range stream.Results() {
+		results = append(results, r)
+	}
+	if len(results) != 3 || results[0].Final || results[0].Text != "Good" || !results[1].Final || results[1].Text != "Good morning" || !results[2].UtteranceEnd {
+		t.Errorf("Unexpected stream results %+v", results)
+	}
+	if stream.Err() != nil || stream.SendAudio([]byte("late")) == nil {
+		t.Errorf("Expected a cleanly closed stream, got %v", stream.Err())
+	}
+}
+
+const deepgramBatchResponse = `{
+  "metadata": {"request_id": "r1", "duration": 4.5},
+  "results": {
+    "channels": [{"detected_language": "en", "alternatives": [{"transcript": "Hello there. Hi!", "words": [
+      {"word": "hello", "punctuated_word": "Hello", "start": 0.1, "end": 0.5, "confidence": 0.99, "speaker": 0},
+      {"word": "there", "punctuated_word": "there.", "start": 0.5, "end": 1.0, "confidence": 0.98, "speaker": 0},
+      {"word": "hi", "punctuated_word": "Hi!", "start": 2.0, "end": 2.5, "confidence": 0.97, "speaker": 1}
+    ]}]}],
+    "utterances": [
+      {"start": 0.1, "end": 1.0, "transcript": "Hello there.", "speaker": 0, "words": [
+        {"word": "hello", "punctuated_word": "Hello", "start": 0.1, "end": 0.5, "confidence": 0.99, "speaker": 0},
+        {"word": "there", "punctuated_word": "there.", "start": 0.5, "end": 1.0, "confidence": 0.98, "speaker": 0}]},
+      {"start": 2.0, "end": 2.5, "transcript": "Hi!", "speaker": 1, "words": [
+        {"word": "hi", "punctuated_word": "Hi!", "start": 2.0, "end": 2.5, "confidence": 0.97, "speaker": 1}]}
+    ]
+  }
+}`
+
+func TestDeepgram_Transcribe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token dg_key" {
+			w.Header().Set("Dg-Error", "Invalid credentials.")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		if r.URL.Path != "/v1/listen" || q.Get("model") != "nova-2" || q.Get("diarize") != "true" || q.Get("utterances") != "true" || q.Get("detect_language") != "true" || q.Get("mip_opt_out") != "true" {
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != "RIFF" || r.Header.Get("Content-Type") != "audio/wav" {
+			t.Errorf("Unexpected audio %q of type %s", body, r.Header.Get("Content-Type"))
+		}
+		w.Write([]byte(deepgramBatchResponse))
+	}))
+	defer ts.Close()
+
+	d := NewDeepgram(Config{APIKey: "dg_key", BaseURL: ts.URL + "/", Model: "nova-2"})
+	got, err := d.Transcribe(context.Background(), strings.NewReader("RIFF"), "audio/wav", Options{Diarize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Transcript{
+		Duration: 4500 * time.Millisecond,
+		Language: "en",
+		Segments: []Segment{
+			{Speaker: "0", Text: "Hello there.", Start: 100 * time.Millisecond, End: time.Second, Words: []Word{
+				{Text: "Hello", Start: 100 * time.Millisecond, End: 500 * time.Millisecond, Confidence: 0.99, Speaker: "0"},
+				{Text: "there.", Start: 500 * time.Millisecond, End: time.Second, Confidence: 0.98, Speaker: "0"},
+			}},
+			{Speaker: "1", Text: "Hi!", Start: 2 * time.Second, End: 2500 * time.Millisecond, Words: []Word{
+				{Text: "Hi!", Start: 2 * time.Second, End: 2500 * time.Millisecond, Confidence: 0.97, Speaker: "1"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected transcript\n got %+v\nwant %+v", got, want)
+	}
+
+	d = NewDeepgram(Config{APIKey: "wrong", BaseURL: ts.URL})
+	_, err = d.Transcribe(context.Background(), strings.NewReader("RIFF"), "audio/wav", Options{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "Invalid credentials." {
+		t.Errorf("Expected Deepgram's error, got %v", err)
+	}
+}
+
+func TestDeepgram_Stream(t *testing.T) {
+	oldKeepAlive := deepgramKeepAlive
+	deepgramKeepAlive = 20 * time.Millisecond
+	defer func() { deepgramKeepAlive = oldKeepAlive }()
+
+	keepAlives := make(chan struct{}, 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("interim_results") != "true" || q.Get("utterance_end_ms") != "1000" || q.Get("language") != "fr" {
+			t.Errorf("Unexpected options %s", r.URL.RawQuery)
+		}
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+		ctx := r.Context()
+		for {
+			typ, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			switch {
+			case typ == websocket.MessageBinary:
+				conn.Write(ctx, websocket.MessageText, []byte(`{"type":"Results","is_final":false,"start":0,"duration":1,"channel":{"alternatives":[{"transcript":"bon","words":[{"word":"bon","start":0,"end":0.4,"confidence":0.9,"speaker":1}]}]}}`))
+				conn.Write(ctx, websocket.MessageText, []byte(`{"type":"Results","is_final":true,"speech_final":false,"start":0,"duration":1,"channel":{"alternatives":[{"transcript":"Bonjour.","words":[{"word":"bonjour","punctuated_word":"Bonjour.","start":0,"end":0.8,"confidence":0.95,"speaker":1}]}]}}`))
+				conn.Write(ctx, websocket.MessageText, []byte(`{"type":"SpeechStarted","timestamp":0}`))
+				conn.Write(ctx, websocket.MessageText, []byte(`{"type":"UtteranceEnd","last_word_end":0.8}`))
+			case strings.Contains(string(data), "KeepAlive"):
+				keepAlives <- struct{}{}
+			case strings.Contains(string(data), "CloseStream"):
+				conn.Write(ctx, websocket.MessageText, []byte(`{"type":"Metadata"}`))
+				conn.Close(websocket.StatusNormalClosure, "")
+			}
+		}
+	}))
+	defer ts.Close()
+
+	d := NewDeepgram(Config{APIKey: "dg_key", BaseURL: ts.URL})
+	stream, err := d.Stream(context.Background(), StreamOptions{Options: Options{Language: "fr", Diarize: true}, InterimResults: true, UtteranceEnd: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-keepAlives:
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a keepalive while no audio is sent")
+	}
+	stream.SendAudio([]byte{1, 2, 3})
+	var results []Result
+	for r := range stream.Results() {
+		results = append(results, r)
+		if r.UtteranceEnd {
+			go stream.Close()
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Expected a clean close, got %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %+v", results)
+	}
+	if results[0].Final || results[0].Text != "bon" || results[0].Speaker != "1" {
+		t.Errorf("Unexpected interim result %+v", results[0])
+	}
+	if !results[1].Final || results[1].Text != "Bonjour." || results[1].Words[0].Text != "Bonjour." || results[1].End != time.Second {
+		t.Errorf("Unexpected final result %+v", results[1])
+	}
+	if !results[2].UtteranceEnd || results[2].Start != 800*time.Millisecond {
+		t.Errorf("Unexpected utterance end %+v", results[2])
+	}
+}
+
+// fakeOpenAI is a stand-in for the OpenAI transcription API. It transcribes
+// every upload as the same two segments, reading the audio as its duration
+// in seconds.
+func fakeOpenAI(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk_key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"message":"Incorrect API key provided.","type":"invalid_request_error"}}`))
+			return
+		}
+		if r.URL.Path != "/v1/audio/transcriptions" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+			return
+		}
+		if r.FormValue("model") != "large-v3" || r.FormValue("response_format") != "verbose_json" || len(r.Form["timestamp_granularities[]"]) != 2 {
+			t.Errorf("Unexpected form %v", r.Form)
+		}
+		if lang := r.FormValue("language"); lang != "" && lang != "de" {
+			t.Errorf("Expected a language without a region, got %s", lang)
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if header.Filename != "audio.wav" {
+			t.Errorf("Expected the upload's extension to give its format, got %s", header.Filename)
+		}
+		data, _ := io.ReadAll(file)
+		if string(data) == "silence" {
+			w.Write([]byte(`{"text":"","language":"english","duration":1.0,"segments":[]}`))
+			return
+		}
+		if string(data) == "corrupt" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"detail":"Invalid audio file"}`))
+			return
+		}
+		w.Write([]byte(`{"text":" Guten Tag. Wie geht's?","language":"german","duration":` + string(data) + `,
+			"segments":[{"id":0,"start":0.0,"end":1.0,"text":" Guten Tag."},{"id":1,"start":1.0,"end":2.0,"text":" Wie geht's?"}],
+			"words":[{"word":"Guten","start":0.0,"end":0.5},{"word":"Tag.","start":0.5,"end":1.0},{"word":"Wie","start":1.0,"end":1.4},{"word":"geht's?","start":1.4,"end":2.0}]}`))
+	}))
+}
+
+func TestOpenAI_Transcribe(t *testing.T) {
+	ts := fakeOpenAI(t)
+	defer ts.Close()
+
+	o := NewOpenAI(Config{APIKey: "sk_key", BaseURL: ts.URL + "/v1/", Model: "large-v3"})
+	got, err := o.Transcribe(context.Background(), strings.NewReader("2.5"), "audio/wav", Options{Language: "de-DE", Diarize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Transcript{
+		Duration: 2500 * time.Millisecond,
+		Language: "de-DE",
+		Segments: []Segment{
+			{Text: "Guten Tag.", Start: 0, End: time.Second, Words: []Word{
+				{Text: "Guten", Start: 0, End: 500 * time.Millisecond, Confidence: 1},
+				{Text: "Tag.", Start: 500 * time.Millisecond, End: time.Second, Confidence: 1},
+			}},
+			{Text: "Wie geht's?", Start: time.Second, End: 2 * time.Second, Words: []Word{
+				{Text: "Wie", Start: time.Second, End: 1400 * time.Millisecond, Confidence: 1},
+				{Text: "geht's?", Start: 1400 * time.Millisecond, End: 2 * time.Second, Confidence: 1},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected transcript\n got %+v\nwant %+v", got, want)
+	}
+	if got, _ := o.Transcribe(context.Background(), strings.NewReader("silence"), "audio/wav", Options{}); len(got.Segments) != 0 || got.Language != "english" {
+		t.Errorf("Expected no segments for silence, got %+v", got)
+	}
+
+	var apiErr *Error
+	if _, err := o.Transcribe(context.Background(), strings.NewReader("corrupt"), "audio/wav", Options{}); !errors.As(err, &apiErr) || apiErr.Message != "Invalid audio file" {
+		t.Errorf("Expected the server's detail, got %v", err)
+	}
+	o = NewOpenAI(Config{APIKey: "wrong", BaseURL: ts.URL, Model: "large-v3"})
+	if _, err := o.Transcribe(context.Background(), strings.NewReader("1"), "audio/wav", Options{}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "Incorrect API key provided." {
+		t.Errorf("Expected OpenAI's error, got %v", err)
+	}
+}
+
+func TestOpenAI_Stream(t *testing.T) {
+	ts := fakeOpenAI(t)
+	defer ts.Close()
+
+	// Each chunk is transcribed on its own, timed from the start of the
+	// stream.
+	o := NewOpenAI(Config{APIKey: "sk_key", BaseURL: ts.URL, Model: "large-v3"})
+	stream, err := o.Stream(context.Background(), StreamOptions{ContentType: "audio/wav; codecs=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []Result
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for r := range stream.Results() {
+			results = append(results, r)
+		}
+	}()
+	stream.SendAudio([]byte("3"))
+	stream.SendAudio([]byte("2"))
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-collected
+	if len(results) != 6 {
+		t.Fatalf("Expected two segments and an utterance end per chunk, got %+v", results)
+	}
+	if r := results[3]; r.Text != "Guten Tag." || r.Start != 3*time.Second || r.Words[1].End != 4*time.Second || !r.Final {
+		t.Errorf("Expected the second chunk to follow the first, got %+v", r)
+	}
+	if r := results[5]; !r.UtteranceEnd || r.End != 5*time.Second {
+		t.Errorf("Expected the utterance to end with the chunk, got %+v", r)
+	}
+
+	// A failed chunk ends the stream.
+	stream, _ = o.Stream(context.Background(), StreamOptions{ContentType: "audio/wav"})
+	stream.SendAudio([]byte("corrupt"))
+	for range stream.Results() {
+	}
+	var apiErr *Error
+	if !errors.As(stream.Err(), &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the chunk's error, got %v", stream.Err())
+	}
+	if err := stream.SendAudio([]byte("1")); err == nil {
+		t.Error("Expected audio to be refused after a failure")
+	}
+}
+
+// fakeAssemblyAI is a stand-in for the AssemblyAI API that replays recorded
+// responses from testdata/assemblyai. Transcripts are processing until
+// complete is called, or until polled twice if autoComplete is set. Audio
+// reading "corrupt" fails to transcribe.
+type fakeAssemblyAI struct {
+	t            *testing.T
+	autoComplete bool
+	requests     chan map[string]any
+	polls        chan struct{}
+
+	mu       sync.Mutex
+	audio    string
+	diarize  bool
+	complete bool
+	polled   int
+}
+
+func newFakeAssemblyAI(t *testing.T, autoComplete bool) (*fakeAssemblyAI, *httptest.Server) {
+	f := &fakeAssemblyAI{t: t, autoComplete: autoComplete, requests: make(chan map[string]any, 10), polls: make(chan struct{}, 100)}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+func (f *fakeAssemblyAI) replay(w http.ResponseWriter, status int, name string) {
+	data, err := os.ReadFile(filepath.Join("testdata", "assemblyai", name))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (f *fakeAssemblyAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "aai_key" {
+		f.replay(w, http.StatusUnauthorized, "unauthorized.json")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const id = "5551722-f677-48a2-b9f8-3d2e4b1e8e3c"
+	switch r.Method + " " + r.URL.Path {
+	case "POST /v2/upload":
+		data, _ := io.ReadAll(r.Body)
+		f.audio = string(data)
+		f.replay(w, http.StatusOK, "upload.json")
+	case "POST /v2/transcript":
+		var req map[string]any
+		json.NewDecoder(r.Body).Decode(&req)
+		f.diarize = req["speaker_labels"] == true
+		f.requests <- req
+		f.replay(w, http.StatusOK, "transcript_queued.json")
+	case "GET /v2/transcript/" + id:
+		f.polled++
+		f.polls <- struct{}{}
+		switch {
+		case f.audio == "corrupt":
+			f.replay(w, http.StatusOK, "transcript_error.json")
+		case !f.complete && !(f.autoComplete && f.polled > 1):
+			f.replay(w, http.StatusOK, "transcript_processing.json")
+		case f.diarize:
+			f.replay(w, http.StatusOK, "transcript_completed.json")
+		default:
+			f.replay(w, http.StatusOK, "transcript_completed_no_speakers.json")
+		}
+	case "GET /v2/transcript/" + id + "/sentences":
+		f.replay(w, http.StatusOK, "sentences.json")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestAssemblyAI_Transcribe(t *testing.T) {
+	oldPoll := assemblyAIPollInterval
+	assemblyAIPollInterval = time.Millisecond
+	defer func() { assemblyAIPollInterval = oldPoll }()
+	fake, ts := newFakeAssemblyAI(t, true)
+
+	// Utterances become segments with their speaker labels.
+	a := NewAssemblyAI(Config{APIKey: "aai_key", BaseURL: ts.URL + "/"})
+	got, err := a.Transcribe(context.Background(), strings.NewReader("RIFF"), "audio/wav", Options{Diarize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := <-fake.requests; req["audio_url"] != "https://cdn.assemblyai.com/upload/6d4b7f0e-1c4a-4a52-9b4e-2f0d0a3c7e11" || req["language_detection"] != true || req["speech_model"] != nil {
+		t.Errorf("Unexpected transcript request %v", req)
+	}
+	if got.Duration != 6*time.Second || got.Language != "en_us" || len(got.Segments) != 2 {
+		t.Fatalf("Unexpected transcript %+v", got)
+	}
+	want := Segment{Speaker: "B", Text: "Sure, starting with search.", Start: 2480 * time.Millisecond, End: 4160 * time.Millisecond}
+	if seg := got.Segments[1]; seg.Speaker != want.Speaker || seg.Text != want.Text || seg.Start != want.Start || seg.End != want.End ||
+		len(seg.Words) != 4 || seg.Words[0] != (Word{Text: "Sure,", Start: 2480 * time.Millisecond, End: 2880 * time.Millisecond, Confidence: 0.9612, Speaker: "B"}) {
+		t.Errorf("Unexpected segment %+v", seg)
+	}
+
+	// Without speakers, sentences become segments.
+	fake.mu.Lock()
+	fake.polled = 0
+	fake.mu.Unlock()
+	got, err = a.Transcribe(context.Background(), strings.NewReader("RIFF"), "audio/wav", Options{Language: "en-US", Model: "universal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := <-fake.requests; req["language_code"] != "en_us" || req["speech_model"] != "universal" || req["speaker_labels"] != false {
+		t.Errorf("Unexpected transcript request %v", req)
+	}
+	if len(got.Segments) != 2 || got.Segments[0].Text != "Let's look at the roadmap." || got.Segments[0].Speaker != "" || got.Language != "en-US" {
+		t.Errorf("Unexpected transcript %+v", got)
+	}
+
+	// Failed transcripts and requests report AssemblyAI's error.
+	var apiErr *Error
+	if _, err := a.Transcribe(context.Background(), strings.NewReader("corrupt"), "text/plain", Options{}); !errors.As(err, &apiErr) || !strings.Contains(apiErr.Message, "does not appear to contain audio") {
+		t.Errorf("Expected the transcript's error, got %v", err)
+	}
+	<-fake.requests
+	a = NewAssemblyAI(Config{APIKey: "wrong", BaseURL: ts.URL})
+	if _, err := a.Transcribe(context.Background(), strings.NewReader("RIFF"), "audio/wav", Options{}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || !strings.Contains(apiErr.Message, "API token") {
+		t.Errorf("Expected AssemblyAI's error, got %v", err)
+	}
+}
+
+func TestAssemblyAI_Webhook(t *testing.T) {
+	oldPoll := assemblyAIWebhookPollInterval
+	assemblyAIWebhookPollInterval = time.Hour
+	defer func() { assemblyAIWebhookPollInterval = oldPoll }()
+	fake, ts := newFakeAssemblyAI(t, false)
+
+	// The transcript is fetched again once its webhook arrives.
+	webhooks := NewWebhooks()
+	a := NewAssemblyAI(Config{APIKey: "aai_key", BaseURL: ts.URL, WebhookURL: "https://mtranscribe.example/api/transcribe/assemblyai/webhook", Webhooks: webhooks})
+	go func() {
+		if req := <-fake.requests; req["webhook_url"] != "https://mtranscribe.example/api/transcribe/assemblyai/webhook" {
+			t.Errorf("Expected the webhook URL, got %v", req)
+		}
+		<-fake.polls
+		fake.mu.Lock()
+		fake.complete = true
+		fake.mu.Unlock()
+		for !webhooks.Notify(ProviderAssemblyAI, "5551722-f677-48a2-b9f8-3d2e4b1e8e3c") {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	got, err := a.Transcribe(context.Background(), strings.NewReader("RIFF"), "audio/wav", Options{Diarize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Segments) != 2 || got.Segments[0].Speaker != "A" {
+		t.Errorf("Unexpected transcript %+v", got)
+	}
+	if webhooks.Notify(ProviderAssemblyAI, "5551722-f677-48a2-b9f8-3d2e4b1e8e3c") {
+		t.Error("Expected the transcription to stop waiting")
+	}
+
+	// Canceling stops the wait.
+	fake.mu.Lock()
+	fake.complete = false
+	fake.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-fake.requests
+		<-fake.polls
+		cancel()
+	}()
+	if _, err := a.Transcribe(ctx, strings.NewReader("RIFF"), "audio/wav", Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the wait to be canceled, got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package transcribe
+
+import "sync"
+
+// Webhooks routes providers' completion webhooks to the transcriptions
+// waiting for them, so that they need not wait for their next poll.
+type Webhooks struct {
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+}
+
+// NewWebhooks returns an empty webhook registry.
+func NewWebhooks() *Webhooks {
+	return &Webhooks{waiting: make(map[string]chan struct{})}
+}
+
+// Notify wakes the transcription waiting for the provider's job id. It
+// reports whether one was waiting.
+func (w *Webhooks) Notify(provider, id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch, ok := w.waiting[provider+"/"+id]
+	if ok {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// wait registers a transcription waiting for the provider's job id. The
+// returned channel receives a value on each notification; done unregisters
+// it.
+func (w *Webhooks) wait(provider, id string) (notified <-chan struct{}, done func()) {
+	key := provider + "/" + id
+	ch := make(chan struct{}, 1)
+	w.mu.Lock()
+	w.waiting[key] = ch
+	w.mu.Unlock()
+	return ch, func() {
+		w.mu.Lock()
+		delete(w.waiting, key)
+		w.mu.Unlock()
+	}
+}
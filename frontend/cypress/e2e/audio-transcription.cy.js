@@ -4,7 +4,7 @@ describe('Audio Transcription E2E', () => {
     // - Mock MediaRecorder
     // - Mock navigator.mediaDevices.getUserMedia
     // - Mock Deepgram SDK
-    // - Set up API key in localStorage
+    // - Stub /auth/me and the Deepgram token endpoint
     
     // Visit the capture page (route is /u/ not /u/capture)
     cy.visit('/u/')
@@ -3,13 +3,23 @@ import { LiveTranscriptionEvents } from '@deepgram/sdk'
 // Cypress support file for E2E tests
 // This file runs before every test
 
+// The backend says transcription is available, and mints a token for the
+// mock SDK
+beforeEach(() => {
+  cy.intercept('GET', '/auth/me', {
+    logged_in: true,
+    services: [],
+    transcription_available: true
+  })
+  cy.intercept('POST', '/api/deepgram/token', {
+    access_token: 'test-access-token',
+    expires_in: 30,
+    url: 'wss://api.deepgram.com/v1/listen'
+  })
+})
+
 // Mock Deepgram SDK by intercepting the module
 Cypress.on('window:before:load', (win) => {
-  // Set up API key in localStorage before app loads
-  win.localStorage.setItem('mtranscribe-settings', JSON.stringify({
-    deepgramApiKey: 'test-api-key-12345'
-  }))
-
   // Create global mock store for Deepgram events
   win.__deepgramMock = {
     connection: null,
@@ -121,7 +131,7 @@ Cypress.on('window:before:load', (win) => {
 
   // Mock the Deepgram SDK module
   // We'll intercept the import by modifying the module cache
-  const createMockClient = (apiKey) => ({
+  const createMockClient = (options) => ({
     listen: {
       live: (options) => {
         const connection = {
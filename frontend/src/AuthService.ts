@@ -79,6 +79,7 @@ export class AuthService {
   private activeLoginFlow: boolean = false;
   private popupCheckInterval: number | null = null;
   private services: string[] = [];
+  private transcriptionAvailable: boolean = false;
 
   private constructor() {}
 
@@ -121,9 +122,11 @@ export class AuthService {
       if (response.ok) {
         const data = await response.json();
         this.services = data.services || [];
+        this.transcriptionAvailable = data.transcription_available === true;
         return data.logged_in === true;
       } else if (response.status === 401) {
         this.services = [];
+        this.transcriptionAvailable = false;
         return false;
       } else {
         throw new Error(`Auth check failed with status: ${response.status}`);
@@ -146,6 +149,16 @@ export class AuthService {
     return this.services.includes(service);
   }
 
+  /**
+   * Checks if the session can use live transcription, as of the last `checkAuth()`:
+   * the server has a Deepgram key the session may use, or the user stored their own.
+   *
+   * @returns `true` if transcription is available, `false` otherwise
+   */
+  isTranscriptionAvailable(): boolean {
+    return this.transcriptionAvailable;
+  }
+
   /**
    * Initiates a popup-based login flow.
    * 
@@ -1,12 +1,15 @@
 /**
  * Global application configuration singleton.
- * Holds application-wide settings like the Deepgram API key.
+ * Holds application-wide settings kept in the browser. Credentials such as
+ * the Deepgram API key are kept by the server, never here.
  */
 const STORAGE_KEY = 'mtranscribe-settings';
 
+/** Settings that earlier versions stored and that must not be kept. */
+const LEGACY_KEYS = ['deepgramApiKey'];
+
 export class AppConfig {
   private static instance: AppConfig;
-  public deepgramApiKey: string = '';
 
   private constructor() {
     this.load();
@@ -20,7 +23,8 @@ export class AppConfig {
   }
 
   /**
-   * Loads settings from localStorage.
+   * Loads settings from localStorage, dropping any Deepgram API key an
+   * earlier version stored there.
    */
   load(): void {
     if (typeof localStorage === 'undefined') return;
@@ -29,8 +33,8 @@ export class AppConfig {
     if (stored) {
       try {
         const data = JSON.parse(stored);
-        if (data.deepgramApiKey) {
-          this.deepgramApiKey = data.deepgramApiKey;
+        if (LEGACY_KEYS.some((key) => key in data)) {
+          this.save();
         }
       } catch (e) {
         console.error('Failed to parse settings', e);
@@ -44,9 +48,7 @@ export class AppConfig {
   save(): void {
     if (typeof localStorage === 'undefined') return;
 
-    const data = {
-      deepgramApiKey: this.deepgramApiKey
-    };
+    const data = {};
     localStorage.setItem(STORAGE_KEY, JSON.stringify(data));
   }
 }
@@ -0,0 +1,64 @@
+/**
+ * Client for the backend's Deepgram settings. The user's own Deepgram API
+ * key is sent to the server once, stored there encrypted, and never read
+ * back; the settings only describe which key transcription uses.
+ */
+
+/** Which Deepgram key the user's transcription uses. */
+export interface DeepgramSettings {
+  /** True if the user has stored their own key. */
+  user_key: boolean;
+  /** The last characters of the user's key, if it is long enough to hint. */
+  hint?: string;
+  updated_at?: string;
+  /** True if the server has a key of its own. */
+  server_key: boolean;
+  /** True if transcription can be used. */
+  available: boolean;
+}
+
+const SETTINGS_URL = '/api/settings/deepgram';
+
+/**
+ * Returns the error message of a failed backend response.
+ */
+export async function responseError(response: Response, action: string): Promise<Error> {
+  let message = '';
+  try {
+    message = (await response.text()).trim();
+  } catch {
+    // Fall back to the status below.
+  }
+  return new Error(message || `${action} failed with status: ${response.status}`);
+}
+
+async function request(method: string, body?: unknown): Promise<DeepgramSettings> {
+  const response = await fetch(SETTINGS_URL, {
+    method,
+    credentials: 'include',
+    headers: {
+      'Accept': 'application/json',
+      ...(body !== undefined ? { 'Content-Type': 'application/json' } : {})
+    },
+    body: body !== undefined ? JSON.stringify(body) : undefined
+  });
+  if (!response.ok) {
+    throw await responseError(response, 'Deepgram settings request');
+  }
+  return response.json();
+}
+
+/** Fetches the user's Deepgram settings. */
+export function getDeepgramSettings(): Promise<DeepgramSettings> {
+  return request('GET');
+}
+
+/** Stores the user's own Deepgram API key on the server. */
+export function saveDeepgramKey(apiKey: string): Promise<DeepgramSettings> {
+  return request('PUT', { api_key: apiKey });
+}
+
+/** Removes the user's own Deepgram API key, falling back to the server's. */
+export function removeDeepgramKey(): Promise<DeepgramSettings> {
+  return request('DELETE');
+}
@@ -1,13 +1,23 @@
 import { AppConfig } from "./Config";
+import { responseError } from "./DeepgramSettings";
 import { Transcript } from "./Transcript";
 import type { Transcriber, TranscriberFactory } from "./Transcriber";
 import { createClient, LiveTranscriptionEvents } from "./deepgram-wrapper";
 import type { LiveClient } from "./deepgram-wrapper";
 
+/** A short-lived Deepgram token minted by the backend. */
+interface DeepgramToken {
+  access_token: string;
+  expires_in: number;
+  /** The streaming endpoint the token is meant for. */
+  url: string;
+}
+
 /**
  * DeepgramTranscriber handles real-time speech-to-text transcription using Deepgram's API.
  * It connects to Deepgram's live transcription service and populates a Transcript object
- * with interim and final results.
+ * with interim and final results. The backend holds the Deepgram API key; the browser
+ * only receives a short-lived token to open the connection with.
  */
 export class DeepgramTranscriber implements Transcriber {
   private config: AppConfig;
@@ -38,20 +48,39 @@ export class DeepgramTranscriber implements Transcriber {
   }
 
   /**
-   * Starts the transcription connection to Deepgram.
-   * Throws an error if the API key is not configured.
+   * Requests a short-lived Deepgram token from the backend.
+   * Throws an error if transcription is not available to the session.
    */
-  async start(): Promise<void> {
-    if (!this.config.deepgramApiKey) {
-      throw new Error('Deepgram API key is not configured');
+  private async fetchToken(): Promise<DeepgramToken> {
+    const response = await fetch('/api/deepgram/token', {
+      method: 'POST',
+      credentials: 'include',
+      headers: {
+        'Accept': 'application/json'
+      }
+    });
+    if (!response.ok) {
+      throw await responseError(response, 'Deepgram token request');
     }
+    return response.json();
+  }
 
+  /**
+   * Starts the transcription connection to Deepgram.
+   * Throws an error if transcription is not available to the session.
+   */
+  async start(): Promise<void> {
     if (!this.transcript) {
       throw new Error('No transcript attached. Call attach() first.');
     }
 
-    // Create Deepgram client
-    const deepgram = createClient(this.config.deepgramApiKey);
+    // Create a Deepgram client with a token for the server's streaming endpoint
+    const token = await this.fetchToken();
+    const endpoint = new URL(token.url);
+    const deepgram = createClient({
+      accessToken: token.access_token,
+      global: { websocket: { options: { url: `${endpoint.protocol}//${endpoint.host}` } } }
+    });
 
     // Establish live transcription connection
     this.connection = deepgram.listen.live({
@@ -76,6 +76,19 @@ describe('AuthService', () => {
       });
     });
 
+    it('reports whether transcription is available', async () => {
+      global.fetch = vi.fn().mockResolvedValue({
+        ok: true,
+        status: 200,
+        json: async () => ({ logged_in: true, services: [], transcription_available: true }),
+      });
+
+      const authService = AuthService.getInstance();
+      expect(authService.isTranscriptionAvailable()).toBe(false);
+      await authService.checkAuth();
+      expect(authService.isTranscriptionAvailable()).toBe(true);
+    });
+
     it('returns false when user is not authenticated (401 response)', async () => {
       global.fetch = vi.fn().mockResolvedValue({
         ok: false,
@@ -6,6 +6,7 @@ describe('AppConfig', () => {
   beforeEach(() => {
     // @ts-ignore - accessing private property for testing
     AppConfig.instance = undefined;
+    localStorage.clear();
   });
 
   it('returns a singleton instance', () => {
@@ -14,22 +15,15 @@ describe('AppConfig', () => {
     expect(instance1).toBe(instance2);
   });
 
-  it('initializes with empty API key', () => {
+  it('does not hold a Deepgram API key', () => {
     const config = AppConfig.getInstance();
-    expect(config.deepgramApiKey).toBe('');
+    expect('deepgramApiKey' in config).toBe(false);
   });
 
-  it('allows setting the API key', () => {
-    const config = AppConfig.getInstance();
-    config.deepgramApiKey = 'test-api-key';
-    expect(config.deepgramApiKey).toBe('test-api-key');
-  });
-
-  it('persists API key across getInstance calls', () => {
-    const config1 = AppConfig.getInstance();
-    config1.deepgramApiKey = 'test-api-key';
+  it('drops a Deepgram API key stored by earlier versions', () => {
+    localStorage.setItem('mtranscribe-settings', JSON.stringify({ deepgramApiKey: 'test-api-key' }));
 
-    const config2 = AppConfig.getInstance();
-    expect(config2.deepgramApiKey).toBe('test-api-key');
+    AppConfig.getInstance();
+    expect(localStorage.getItem('mtranscribe-settings')).not.toContain('test-api-key');
   });
 });
@@ -41,7 +41,17 @@ describe('DeepgramTranscriber', () => {
     // @ts-ignore - accessing private property for testing
     AppConfig.instance = undefined;
     config = AppConfig.getInstance();
-    config.deepgramApiKey = 'test-api-key';
+
+    // The backend mints a short-lived token for the session
+    global.fetch = vi.fn().mockResolvedValue({
+      ok: true,
+      status: 200,
+      json: async () => ({
+        access_token: 'test-access-token',
+        expires_in: 30,
+        url: 'wss://api.deepgram.com/v1/listen'
+      }),
+    });
     
     transcriber = new DeepgramTranscriber(config);
     transcript = new Transcript();
@@ -56,17 +66,22 @@ describe('DeepgramTranscriber', () => {
   });
 
   describe('start', () => {
-    it('throws error if API key is not configured', async () => {
-      config.deepgramApiKey = '';
-      
-      await expect(transcriber.start()).rejects.toThrow('Deepgram API key is not configured');
+    it('throws the backend error if transcription is not available', async () => {
+      global.fetch = vi.fn().mockResolvedValue({
+        ok: false,
+        status: 501,
+        text: async () => 'Transcription is not available: no Deepgram API key is configured',
+      });
+      transcriber.attach(transcript);
+
+      await expect(transcriber.start()).rejects.toThrow('Transcription is not available');
     });
 
     it('throws error if no transcript is attached', async () => {
       await expect(transcriber.start()).rejects.toThrow('No transcript attached');
     });
 
-    it('creates a Deepgram client with the API key', async () => {
+    it('creates a Deepgram client with a token from the backend', async () => {
       transcriber.attach(transcript);
       
       // Mock the Deepgram SDK
@@ -78,7 +93,11 @@ describe('DeepgramTranscriber', () => {
       // Give it a moment to call createClient
       await new Promise(resolve => setTimeout(resolve, 10));
       
-      expect(createClient).toHaveBeenCalledWith('test-api-key');
+      expect(fetch).toHaveBeenCalledWith('/api/deepgram/token', expect.objectContaining({ method: 'POST', credentials: 'include' }));
+      expect(createClient).toHaveBeenCalledWith({
+        accessToken: 'test-access-token',
+        global: { websocket: { options: { url: 'wss://api.deepgram.com' } } }
+      });
       
       // Clean up the hanging promise
       transcriber.stop();
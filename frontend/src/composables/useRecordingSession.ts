@@ -3,6 +3,7 @@ import { useAudioCapture } from './useAudioCapture'
 import { Transcript } from '../Transcript'
 import { DeepgramTranscriber } from '../DeepgramTranscriber'
 import { AppConfig } from '../Config'
+import { AuthService } from '../AuthService'
 
 const now = new Date()
 const currentTranscript = ref<Transcript>(new Transcript(
@@ -54,9 +55,25 @@ const transcriberFactory = DeepgramTranscriber.createFactory(AppConfig.getInstan
 // Initialize singleton with autoCleanup disabled so it persists across navigation
 const session = useAudioCapture(transcriberFactory, currentTranscript, { autoCleanup: false })
 
+// Whether the session can transcribe: the server has a Deepgram key it may
+// use, or the user stored their own.
+const transcriptionAvailable = ref(false)
+
+async function refreshTranscriptionAvailable(): Promise<void> {
+  const authService = AuthService.getInstance()
+  try {
+    await authService.checkAuth()
+  } catch (error) {
+    console.error('Failed to check auth status:', error)
+  }
+  transcriptionAvailable.value = authService.isTranscriptionAvailable()
+}
+
 export function useRecordingSession() {
   return {
     ...session,
-    transcript: currentTranscript
+    transcript: currentTranscript,
+    transcriptionAvailable,
+    refreshTranscriptionAvailable
   }
 }
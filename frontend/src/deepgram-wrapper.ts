@@ -1,22 +1,22 @@
 import { createClient as createRealClient, LiveTranscriptionEvents as RealLiveTranscriptionEvents } from "@deepgram/sdk";
-import type { LiveClient } from "@deepgram/sdk";
+import type { DeepgramClientOptions, LiveClient } from "@deepgram/sdk";
 
 // Re-export types
-export type { LiveClient };
+export type { DeepgramClientOptions, LiveClient };
 
 /**
  * Wrapper for createClient that checks for a mock implementation on the window object.
  * This allows end-to-end tests to inject a mock SDK.
  */
-export const createClient = (apiKey: string) => {
+export const createClient = (options: DeepgramClientOptions) => {
   const win = typeof window !== 'undefined' ? window as any : null;
   const mockSdk = win?.__deepgramSdkMock;
 
   if (mockSdk) {
-    return mockSdk.createClient(apiKey);
+    return mockSdk.createClient(options);
   }
 
-  return createRealClient(apiKey);
+  return createRealClient(options);
 };
 
 /**